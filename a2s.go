@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// a2sInfo is the part of an A2S_INFO response the daemon uses.
+type a2sInfo struct {
+	Name       string
+	Map        string
+	Players    int
+	MaxPlayers int
+	Bots       int
+	Version    string
+}
+
+// a2sPlayer is one entry of an A2S_PLAYER response.
+type a2sPlayer struct {
+	Name     string
+	Score    int32
+	Duration float32
+}
+
+// a2sChecker asks a Steam game server how many players are online with the A2S_INFO query,
+// the same one the Steam server browser uses. Bots don't count.
+type a2sChecker struct {
+	address string
+}
+
+func (c *a2sChecker) check() (bool, int, error) {
+	info, err := queryA2SInfo(c.address, 5*time.Second)
+	if err != nil {
+		return false, -1, err
+	}
+
+	players := info.Players - info.Bots
+	if players < 0 {
+		players = 0
+	}
+
+	return players == 0, players, nil
+}
+
+func (c *a2sChecker) playerNames() ([]string, error) {
+	players, err := queryA2SPlayers(c.address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some games list players who are still connecting with no name.
+	names := []string{}
+	for _, player := range players {
+		if player.Name != "" {
+			names = append(names, player.Name)
+		}
+	}
+	return names, nil
+}
+
+// queryA2SInfo sends an A2S_INFO query to the server's query port.
+func queryA2SInfo(address string, timeout time.Duration) (*a2sInfo, error) {
+	request := append([]byte{0xff, 0xff, 0xff, 0xff, 'T'}, []byte("Source Engine Query\x00")...)
+	response, err := a2sQuery(address, request, 'I', timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(response)
+	info := &a2sInfo{}
+
+	// Protocol version, then the name, map, folder, and game strings.
+	reader.ReadByte()
+	info.Name = readCString(reader)
+	info.Map = readCString(reader)
+	readCString(reader)
+	readCString(reader)
+
+	var appID uint16
+	binary.Read(reader, binary.LittleEndian, &appID)
+
+	counts := make([]byte, 3)
+	_, err = reader.Read(counts)
+	if err != nil {
+		return nil, fmt.Errorf("A2S_INFO response is malformed")
+	}
+	info.Players = int(counts[0])
+	info.MaxPlayers = int(counts[1])
+	info.Bots = int(counts[2])
+
+	// Server type, environment, visibility, and VAC, then the version.
+	flags := make([]byte, 4)
+	_, err = reader.Read(flags)
+	if err == nil {
+		info.Version = readCString(reader)
+	}
+
+	return info, nil
+}
+
+// queryA2SPlayers sends an A2S_PLAYER query to the server's query port.
+func queryA2SPlayers(address string, timeout time.Duration) ([]a2sPlayer, error) {
+	request := []byte{0xff, 0xff, 0xff, 0xff, 'U', 0xff, 0xff, 0xff, 0xff}
+	response, err := a2sQuery(address, request, 'D', timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(response)
+	count, err := reader.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("A2S_PLAYER response is malformed")
+	}
+
+	players := []a2sPlayer{}
+	for i := 0; i < int(count); i++ {
+		_, err = reader.ReadByte()
+		if err != nil {
+			// Some servers send fewer players than they claim.
+			break
+		}
+
+		player := a2sPlayer{Name: readCString(reader)}
+		binary.Read(reader, binary.LittleEndian, &player.Score)
+		err = binary.Read(reader, binary.LittleEndian, &player.Duration)
+		if err != nil {
+			break
+		}
+		players = append(players, player)
+	}
+
+	return players, nil
+}
+
+// a2sQuery sends a query and returns the payload of the response, after its type byte.
+// Servers may answer with a challenge number instead, in which case the query is sent again
+// with the challenge in place of the last four bytes (or appended, for A2S_INFO).
+func a2sQuery(address string, request []byte, responseType byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %s", address, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, fmt.Errorf("error sending query: %s", err.Error())
+		}
+
+		response, err := readA2SResponse(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		switch response[0] {
+		case responseType:
+			return response[1:], nil
+		case 'A':
+			if len(response) < 5 {
+				return nil, fmt.Errorf("challenge response is malformed")
+			}
+			if request[4] == 'T' {
+				request = append(request[:len("\xff\xff\xff\xffTSource Engine Query\x00")], response[1:5]...)
+			} else {
+				request = append(request[:5], response[1:5]...)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected response type 0x%02x", response[0])
+		}
+	}
+
+	return nil, fmt.Errorf("server kept sending challenges")
+}
+
+// readA2SResponse reads a response, putting it back together if it was split over several
+// packets. Compressed split responses, only sent by some old GoldSource games, aren't
+// supported.
+func readA2SResponse(conn net.Conn) ([]byte, error) {
+	buffer := make([]byte, 1400)
+	parts := map[byte][]byte{}
+	total := byte(0)
+
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %s", err.Error())
+		}
+		if n < 5 {
+			return nil, fmt.Errorf("response is too short")
+		}
+		packet := buffer[:n]
+
+		header := int32(binary.LittleEndian.Uint32(packet))
+		if header == -1 {
+			return append([]byte{}, packet[4:]...), nil
+		}
+		if header != -2 || n < 12 {
+			return nil, fmt.Errorf("response has a bad header")
+		}
+
+		// ID, total packets, this packet's number, and the maximum packet size.
+		id := binary.LittleEndian.Uint32(packet[4:])
+		if id&0x80000000 != 0 {
+			return nil, fmt.Errorf("compressed responses aren't supported")
+		}
+		total = packet[8]
+		parts[packet[9]] = append([]byte{}, packet[12:]...)
+
+		if len(parts) == int(total) {
+			break
+		}
+	}
+
+	var whole []byte
+	for i := byte(0); i < total; i++ {
+		part, ok := parts[i]
+		if !ok {
+			return nil, fmt.Errorf("split response is missing a packet")
+		}
+		whole = append(whole, part...)
+	}
+
+	if len(whole) < 5 || int32(binary.LittleEndian.Uint32(whole)) != -1 {
+		return nil, fmt.Errorf("split response has a bad header")
+	}
+
+	return whole[4:], nil
+}
+
+// readCString reads a null terminated string.
+func readCString(reader *bytes.Reader) string {
+	var value []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil || b == 0 {
+			return string(value)
+		}
+		value = append(value, b)
+	}
+}
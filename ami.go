@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// amiAliases are the AMI names a profile can give instead of an ID, and the public SSM
+// parameters holding each one's current AMI in the region.
+var amiAliases = map[string]string{
+	"ubuntu-20.04":            "/aws/service/canonical/ubuntu/server/20.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+	"ubuntu-20.04-arm64":      "/aws/service/canonical/ubuntu/server/20.04/stable/current/arm64/hvm/ebs-gp2/ami-id",
+	"ubuntu-22.04":            "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id",
+	"ubuntu-22.04-arm64":      "/aws/service/canonical/ubuntu/server/22.04/stable/current/arm64/hvm/ebs-gp2/ami-id",
+	"ubuntu-24.04":            "/aws/service/canonical/ubuntu/server/24.04/stable/current/amd64/hvm/ebs-gp3/ami-id",
+	"ubuntu-24.04-arm64":      "/aws/service/canonical/ubuntu/server/24.04/stable/current/arm64/hvm/ebs-gp3/ami-id",
+	"debian-12":               "/aws/service/debian/release/12/latest/amd64",
+	"debian-12-arm64":         "/aws/service/debian/release/12/latest/arm64",
+	"amazon-linux-2":          "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2",
+	"amazon-linux-2-arm64":    "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-arm64-gp2",
+	"amazon-linux-2023":       "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64",
+	"amazon-linux-2023-arm64": "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-arm64",
+}
+
+// amiParameter returns the SSM parameter holding the AMI, when it is an alias or a parameter
+// path rather than an ID, or "".
+func amiParameter(ami string) string {
+	if strings.HasPrefix(ami, "/") {
+		return ami
+	}
+	return amiAliases[ami]
+}
+
+// validAMI checks the profile's AMI is an ID, a parameter path, or a known alias.
+func validAMI(ami string) error {
+	if strings.HasPrefix(ami, "ami-") || amiParameter(ami) != "" {
+		return nil
+	}
+	return fmt.Errorf("AMI %q must be an AMI ID, an SSM parameter path, or one of %s", ami, strings.Join(sortedKeys(amiAliases), ", "))
+}
+
+// resolveAMI sets the AMI the profile launches, looking up the current one in the profile's
+// region when the profile gives an alias or parameter path. It is looked up again on each
+// launch, so a long running wake proxy picks up new releases.
+func (p *LaunchProfile) resolveAMI(sess *session.Session) error {
+	parameter := amiParameter(p.AMI)
+	if parameter == "" {
+		p.image = p.AMI
+		return nil
+	}
+
+	output, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{Name: aws.String(parameter)})
+	if err != nil {
+		return fmt.Errorf("error looking up AMI %s: %s", p.AMI, err.Error())
+	}
+	p.image = aws.StringValue(output.Parameter.Value)
+	if !strings.HasPrefix(p.image, "ami-") {
+		return fmt.Errorf("parameter %s holds %q, not an AMI ID", parameter, p.image)
+	}
+
+	fmt.Printf("Using %s for %s.\n", p.image, p.AMI)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// autoScalingGroup is the Auto Scaling group this instance is in, or "" if it isn't in one.
+var autoScalingGroup string
+
+// terminatingSelf is set once the daemon has asked the group to terminate the instance
+// itself, after shutting down, so the group's termination isn't handled as a scale in.
+var terminatingSelf bool
+
+// getTargetLifecycleState returns the lifecycle state the Auto Scaling group is moving this
+// instance to, or "" if the instance isn't in a group.
+func getTargetLifecycleState(metadata *ec2metadata.EC2Metadata) (string, error) {
+	state, err := metadata.GetMetadata("autoscaling/target-lifecycle-state")
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return state, nil
+}
+
+// findAutoScalingGroup returns the Auto Scaling group this instance is in, or "" if it
+// isn't in one. The metadata is checked first so instances outside a group don't need
+// permission to describe groups.
+func findAutoScalingGroup(instanceID string, metadata *ec2metadata.EC2Metadata, sess *session.Session) (string, error) {
+	state, err := getTargetLifecycleState(metadata)
+	if err != nil {
+		return "", fmt.Errorf("error getting target lifecycle state: %s", err.Error())
+	}
+
+	if state == "" {
+		return "", nil
+	}
+
+	output, err := autoscaling.New(sess).DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing auto scaling instance: %s", err.Error())
+	}
+
+	if len(output.AutoScalingInstances) == 0 {
+		return "", nil
+	}
+
+	return *output.AutoScalingInstances[0].AutoScalingGroupName, nil
+}
+
+// terminatingHooks returns the names of the group's terminating lifecycle hooks, or just
+// the configured one.
+func terminatingHooks(userData *GameServerUserData, service *autoscaling.AutoScaling) ([]string, error) {
+	if userData.LifecycleHookName != "" {
+		return []string{userData.LifecycleHookName}, nil
+	}
+
+	output, err := service.DescribeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(autoScalingGroup),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing lifecycle hooks: %s", err.Error())
+	}
+
+	hooks := []string{}
+	for _, hook := range output.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleTransition) == "autoscaling:EC2_INSTANCE_TERMINATING" {
+			hooks = append(hooks, *hook.LifecycleHookName)
+		}
+	}
+
+	return hooks, nil
+}
+
+// completeLifecycleAction tells the Auto Scaling group the instance is done shutting down,
+// so it can be terminated without waiting for the hook to time out. The hook only becomes
+// active shortly after the group decides to terminate the instance, so completing it is
+// retried for a while.
+func completeLifecycleAction(userData *GameServerUserData, instanceID string, sess *session.Session) error {
+	service := autoscaling.New(sess)
+
+	hooks, err := terminatingHooks(userData, service)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			_, err = service.CompleteLifecycleAction(&autoscaling.CompleteLifecycleActionInput{
+				AutoScalingGroupName:  aws.String(autoScalingGroup),
+				LifecycleHookName:     aws.String(hook),
+				InstanceId:            aws.String(instanceID),
+				LifecycleActionResult: aws.String("CONTINUE"),
+			})
+			if err == nil {
+				fmt.Printf("Completed lifecycle hook %s.\n", hook)
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("error completing lifecycle hook %s: %s", hook, err.Error())
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}
+
+	return nil
+}
+
+// handleScaleIn shuts the game down cleanly when the Auto Scaling group is terminating the
+// instance, whether it is scaling in or capacity rebalancing, then lets the group finish.
+func handleScaleIn(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	fmt.Println("Auto Scaling group is terminating the instance.")
+	handleInterruption(userData, instanceID, sess, &instanceAction{Action: "scale-in"})
+
+	err := completeLifecycleAction(userData, instanceID, sess)
+	if err != nil {
+		fmt.Printf("Error completing lifecycle action: %s\n", err.Error())
+	}
+}
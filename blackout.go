@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdays maps day names, full or abbreviated, to their weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// parseClock parses an HH:MM time of day into minutes after midnight. 24:00 is allowed for
+// the end of the day.
+func parseClock(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", clock)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", clock)
+	}
+
+	total := hours*60 + minutes
+	if hours < 0 || minutes < 0 || minutes > 59 || total > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", clock)
+	}
+
+	return total, nil
+}
+
+// validateIdleBlackout makes sure a blackout window can be used.
+func validateIdleBlackout(blackout IdleBlackout) error {
+	for _, day := range blackout.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("invalid blackout day %q", day)
+		}
+	}
+
+	start, err := parseClock(blackout.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(blackout.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("blackout window %s-%s is empty", blackout.Start, blackout.End)
+	}
+
+	if blackout.TimeZone != "" {
+		_, err = time.LoadLocation(blackout.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid blackout time zone: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// inBlackout reports whether the time falls in the blackout window. A window ending before
+// it starts runs past midnight, and belongs to the day it starts on.
+func inBlackout(blackout IdleBlackout, now time.Time) bool {
+	location := time.UTC
+	if blackout.TimeZone != "" {
+		// Already validated.
+		location, _ = time.LoadLocation(blackout.TimeZone)
+	}
+	now = now.In(location)
+
+	start, _ := parseClock(blackout.Start)
+	end, _ := parseClock(blackout.End)
+	minute := now.Hour()*60 + now.Minute()
+
+	onDay := func(day time.Weekday) bool {
+		if len(blackout.Days) == 0 {
+			return true
+		}
+		for _, name := range blackout.Days {
+			if weekdays[strings.ToLower(name)] == day {
+				return true
+			}
+		}
+		return false
+	}
+
+	if start < end {
+		return onDay(now.Weekday()) && minute >= start && minute < end
+	}
+
+	// Past midnight, the window started yesterday.
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	return onDay(now.Weekday()) && minute >= start || onDay(yesterday) && minute < end
+}
+
+// activeBlackout returns the blackout window the time falls in, or nil if there isn't one.
+func activeBlackout(blackouts []IdleBlackout, now time.Time) *IdleBlackout {
+	for i := range blackouts {
+		if inBlackout(blackouts[i], now) {
+			return &blackouts[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// budgetInterval is how often the daemon adds what the instance has cost to the month's
+// spending.
+const budgetInterval = time.Minute
+
+// budgetThresholds are the percentages of the monthly budget notified when spending
+// reaches them.
+var budgetThresholds = []int{50, 80, 100}
+
+// tagBudgetCounted is put on the instance with the time its cost has been counted up to,
+// so the daemon starting again doesn't count it twice.
+const tagBudgetCounted = "aws-spot-game-server:budget-counted"
+
+// budgetState is kept in SSM so a month's spending adds up across instances.
+type budgetState struct {
+	Month string
+	Spent float64
+}
+
+// budgetMonth returns the month spending is counted in, like "2026-10".
+func budgetMonth(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+// getBudgetState reads the budget state, starting the month again if the state is from an
+// earlier one.
+func getBudgetState(service *ssm.SSM, name string) (*budgetState, error) {
+	state := &budgetState{}
+
+	parameter, err := service.GetParameter(&ssm.GetParameterInput{Name: aws.String(name)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		err = nil
+	} else if err == nil {
+		err = json.Unmarshal([]byte(*parameter.Parameter.Value), state)
+		if err != nil {
+			return nil, fmt.Errorf("budget state was malformed: %s", err.Error())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if month := budgetMonth(time.Now()); state.Month != month {
+		state = &budgetState{Month: month}
+	}
+	return state, nil
+}
+
+// putBudgetState writes the budget state.
+func putBudgetState(service *ssm.SSM, name string, state *budgetState) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = service.PutParameter(&ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Value:     aws.String(string(contents)),
+		Type:      aws.String(ssm.ParameterTypeString),
+		Overwrite: aws.Bool(true),
+	})
+
+	return err
+}
+
+// getSpent returns this month's spending so far, from the budget table if there is one.
+func getSpent(userData *GameServerUserData, sess *session.Session) (float64, error) {
+	if userData.BudgetTable == "" {
+		state, err := getBudgetState(ssm.New(sess), userData.BudgetParameter)
+		if err != nil {
+			return 0, err
+		}
+		return state.Spent, nil
+	}
+
+	item, err := dynamodb.New(sess).GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(userData.BudgetTable),
+		Key:            budgetKey(userData),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return spentAttribute(item.Item)
+}
+
+// budgetKey returns the budget table key of this month's spending.
+func budgetKey(userData *GameServerUserData) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Budget": {S: aws.String(userData.BudgetParameter)},
+		"Month":  {S: aws.String(budgetMonth(time.Now()))},
+	}
+}
+
+// spentAttribute reads the spending in a budget table item, 0 if there is none yet.
+func spentAttribute(item map[string]*dynamodb.AttributeValue) (float64, error) {
+	if item["Spent"] == nil || item["Spent"].N == nil {
+		return 0, nil
+	}
+	spent, err := strconv.ParseFloat(*item["Spent"].N, 64)
+	if err != nil {
+		return 0, fmt.Errorf("budget spending was malformed: %s", err.Error())
+	}
+	return spent, nil
+}
+
+// checkBudget returns an error if this month's spending has reached the monthly budget, so
+// nothing more is launched or started until next month.
+func checkBudget(userData *GameServerUserData, sess *session.Session) error {
+	if userData.MonthlyBudget <= 0 {
+		return nil
+	}
+
+	spent, err := getSpent(userData, sess)
+	if err != nil {
+		return fmt.Errorf("error getting budget state: %s", err.Error())
+	}
+	if spent >= userData.MonthlyBudget {
+		return fmt.Errorf("$%.2f of the $%.2f monthly budget has been spent, not starting %s until next month",
+			spent, userData.MonthlyBudget, userData.GameName)
+	}
+	return nil
+}
+
+// trackBudget adds what the instance costs to the month's spending as it runs, and notifies
+// as spending passes each threshold. Once the budget is spent the instance is shut down.
+// Counting starts where the instance's budget-counted tag says it got to, unless the
+// instance has been started since, and time it spends stopped or hibernated isn't counted.
+func trackBudget(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	service := ec2.New(sess)
+	instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err == nil && (len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0) {
+		err = fmt.Errorf("instance %s not found", instanceID)
+	}
+	if err != nil {
+		fmt.Printf("Error describing instance, not tracking the budget: %s\n", err.Error())
+		return
+	}
+	instance := instances.Reservations[0].Instances[0]
+
+	// LaunchTime is when the instance last started, so it is later than the tag after a stop.
+	counted := aws.TimeValue(instance.LaunchTime)
+	for _, tag := range instance.Tags {
+		if *tag.Key != tagBudgetCounted {
+			continue
+		}
+		tagged, err := time.Parse(time.RFC3339, *tag.Value)
+		if err == nil && tagged.After(counted) {
+			counted = tagged
+		}
+	}
+
+	go func() {
+		// Time is measured on the monotonic clock, which stands still while the instance is
+		// hibernated, so only the time since the last tick it was running for is counted.
+		ticked := time.Now()
+		if since := ticked.Sub(counted); since > 0 {
+			ticked = ticked.Add(-since)
+		}
+		for {
+			time.Sleep(budgetInterval)
+
+			now := time.Now()
+			from := now.Add(-now.Sub(ticked))
+			cost, _, err := instanceCost(sess, service, instance, from, now)
+			if err != nil {
+				fmt.Printf("Error working out the instance's cost: %s\n", err.Error())
+				continue
+			}
+
+			spent, err := addSpending(userData, sess, cost)
+			if err != nil {
+				fmt.Printf("Error adding to the month's spending: %s\n", err.Error())
+				continue
+			}
+			ticked = now
+
+			_, err = service.CreateTags(&ec2.CreateTagsInput{
+				Resources: []*string{aws.String(instanceID)},
+				Tags:      []*ec2.Tag{{Key: aws.String(tagBudgetCounted), Value: aws.String(now.UTC().Format(time.RFC3339))}},
+			})
+			if err != nil {
+				fmt.Printf("Error tagging how far the budget has been counted: %s\n", err.Error())
+			}
+
+			if spent >= userData.MonthlyBudget {
+				shutDownInstance(userData, instanceID, sess, "budget",
+					fmt.Sprintf("Terminating the instance, $%.2f of the $%.2f monthly budget has been spent.", spent, userData.MonthlyBudget))
+				return
+			}
+		}
+	}()
+}
+
+// addSpending adds the cost to the month's spending and notifies for any threshold it
+// passes. It returns the month's spending. The budget table adds to it atomically, so
+// games sharing a budget don't lose each other's spending as they can with the parameter.
+func addSpending(userData *GameServerUserData, sess *session.Session, cost float64) (float64, error) {
+	var spent float64
+	if userData.BudgetTable != "" {
+		output, err := dynamodb.New(sess).UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:        aws.String(userData.BudgetTable),
+			Key:              budgetKey(userData),
+			UpdateExpression: aws.String("ADD Spent :cost"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":cost": {N: aws.String(strconv.FormatFloat(cost, 'f', -1, 64))},
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+		})
+		if err != nil {
+			return 0, err
+		}
+		spent, err = spentAttribute(output.Attributes)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		service := ssm.New(sess)
+		state, err := getBudgetState(service, userData.BudgetParameter)
+		if err != nil {
+			return 0, err
+		}
+		state.Spent += cost
+		err = putBudgetState(service, userData.BudgetParameter, state)
+		if err != nil {
+			return 0, err
+		}
+		spent = state.Spent
+	}
+
+	// Whoever's spending takes it past a threshold notifies, so it is only notified once.
+	passed := 0
+	for _, threshold := range budgetThresholds {
+		limit := userData.MonthlyBudget * float64(threshold) / 100
+		if spent-cost < limit && spent >= limit {
+			passed = threshold
+		}
+	}
+	if passed > 0 {
+		notify(userData, sess, fmt.Sprintf("%d%% of the monthly budget spent", passed),
+			fmt.Sprintf("$%.2f of the $%.2f monthly budget has been spent in %s.", spent, userData.MonthlyBudget, budgetMonth(time.Now())))
+	}
+	return spent, nil
+}
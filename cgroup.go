@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupPeriod is the CPU limit's accounting period, in microseconds.
+const cgroupPeriod = 100000
+
+// cgroupEnabled reports whether the game runs with resource limits.
+func cgroupEnabled(userData *GameServerUserData) bool {
+	return userData.GameMemoryLimit > 0 || userData.GameCPULimit > 0
+}
+
+// cgroupPath is the game's cgroup. It sits at the top of the hierarchy rather than under
+// the daemon's service, since a cgroup with processes of its own can't hand controllers on.
+func cgroupPath(userData *GameServerUserData) string {
+	return filepath.Join(cgroupRoot, "aws-spot-game-server-"+userData.GameName)
+}
+
+// setUpCgroup creates the game's cgroup with its limits. The game's processes can use no
+// more than GameMemoryLimit MiB between them, and are all killed together if they go over,
+// leaving the daemon and the rest of the instance alone.
+func setUpCgroup(userData *GameServerUserData) error {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cgroup v2 isn't available: %s", err.Error())
+	}
+
+	err = writeCgroupFile(cgroupRoot, "cgroup.subtree_control", "+memory +cpu")
+	if err != nil {
+		return err
+	}
+
+	path := cgroupPath(userData)
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating cgroup: %s", err.Error())
+	}
+
+	if userData.GameMemoryLimit > 0 {
+		err = writeCgroupFile(path, "memory.max", strconv.Itoa(userData.GameMemoryLimit*1024*1024))
+		if err != nil {
+			return err
+		}
+
+		// Swapping would just drag the whole instance down with the game. There is no swap
+		// file to limit without swap, so this can fail.
+		writeCgroupFile(path, "memory.swap.max", "0")
+
+		err = writeCgroupFile(path, "memory.oom.group", "1")
+		if err != nil {
+			return err
+		}
+	}
+
+	if userData.GameCPULimit > 0 {
+		quota := int(userData.GameCPULimit * cgroupPeriod)
+		err = writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupPeriod))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// joinCgroup moves the process into the game's cgroup. Its children follow it from then on.
+func joinCgroup(userData *GameServerUserData, pid int) error {
+	return writeCgroupFile(cgroupPath(userData), "cgroup.procs", strconv.Itoa(pid))
+}
+
+// cgroupOOMKills returns how many times the kernel has killed the game for running out of
+// memory.
+func cgroupOOMKills(userData *GameServerUserData) int {
+	data, err := ioutil.ReadFile(filepath.Join(cgroupPath(userData), "memory.events"))
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			kills, _ := strconv.Atoi(fields[1])
+			return kills
+		}
+	}
+	return 0
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("error setting %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// systemOOMKills returns how many processes the kernel has killed for running out of memory
+// since boot, anywhere on the instance.
+func systemOOMKills() int {
+	data, err := ioutil.ReadFile("/proc/vmstat")
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			kills, _ := strconv.Atoi(fields[1])
+			return kills
+		}
+	}
+	return 0
+}
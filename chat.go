@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// chatCommand runs a command from chat, split into fields, and returns the reply, or nothing
+// if it isn't a command. Prefix is how commands are typed, for the help. Commands that change
+// anything are only taken from admins.
+func chatCommand(userData *GameServerUserData, instanceID string, sess *session.Session, prefix string, fields []string, from string, admin bool) string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	switch fields[0] {
+	case "status":
+		return describeStatus(userData, currentStatus())
+	case "players":
+		players := controlPlayers{Count: currentStatus().Players}
+		if sessions != nil {
+			players.Names = sessions.players()
+		}
+		return describeOnline(players)
+	case "stop", "extend":
+	case "help":
+		return fmt.Sprintf("Commands: %[1]sstatus, %[1]splayers, %[1]sextend [minutes], %[1]sstop", prefix)
+	default:
+		return ""
+	}
+
+	if !admin {
+		return fmt.Sprintf("Sorry %s, only admins can do that.", from)
+	}
+
+	if fields[0] == "stop" {
+		fmt.Printf("Shutting down on request from %s.\n", from)
+		go shutDownInstance(userData, instanceID, sess, "requested", fmt.Sprintf("Terminating the instance on request from %s.", from))
+		return "Shutting down."
+	}
+
+	duration := time.Duration(userData.KeepAliveDuration) * time.Second
+	if len(fields) > 1 {
+		minutes, err := strconv.Atoi(fields[1])
+		if err != nil || minutes <= 0 {
+			return fmt.Sprintf("Usage: %sextend [minutes]", prefix)
+		}
+		duration = time.Duration(minutes) * time.Minute
+	}
+
+	until := keepAlive(duration)
+	fmt.Printf("Kept alive until %s on request from %s.\n", until.Format(time.RFC3339), from)
+	return fmt.Sprintf("Keeping %s up until at least %s UTC.", userData.GameName, until.UTC().Format("15:04"))
+}
+
+// isChatAdmin reports whether a chat user may run commands that change anything, which
+// everyone may if no admins are given.
+func isChatAdmin(admins []string, userID string) bool {
+	if len(admins) == 0 {
+		return true
+	}
+
+	for _, id := range admins {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// describeStatus describes the daemon's status in a sentence for chat.
+func describeStatus(userData *GameServerUserData, status daemonStatus) string {
+	description := fmt.Sprintf("%s is %s%s, up %s", userData.GameName, status.State, describePlayers(status.Players),
+		time.Since(status.StartedAt).Round(time.Minute))
+	if until := keptAlive(userData); !until.IsZero() {
+		description += fmt.Sprintf(", kept up until %s UTC", until.UTC().Format("15:04"))
+	}
+	return description + "."
+}
+
+// describeOnline describes who is online for chat.
+func describeOnline(players controlPlayers) string {
+	if players.Count < 0 {
+		return "No probe counts players."
+	}
+
+	description := fmt.Sprintf("%d online.", players.Count)
+	if len(players.Names) > 0 {
+		description += " " + strings.Join(players.Names, ", ")
+	}
+	return description
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// queuedCommand is a command sent through the command queue. Command is one of stop,
+// restart, backup, say, or extend. Message is what say broadcasts, and Duration the seconds
+// extend holds the game up for, defaulting to KeepAliveDuration. InstanceID and Game, if
+// set, pick which daemon takes the command when several share the queue.
+type queuedCommand struct {
+	Command    string `json:"command"`
+	Message    string `json:"message"`
+	Duration   int    `json:"duration"`
+	InstanceID string `json:"instance_id"`
+	Game       string `json:"game"`
+}
+
+// Commands for other daemons are put back on the queue hidden for otherCommandVisibility,
+// so daemons sharing the queue don't keep receiving each other's. Commands older than
+// staleCommandAge are deleted without being run, so an old stop doesn't catch a new
+// instance and commands for games that aren't running don't pile up.
+const otherCommandVisibility = 10
+const staleCommandAge = 15 * time.Minute
+
+// watchCommandQueue long polls CommandQueueURL for commands and runs them, so tooling off
+// the instance can control the game with no inbound access to it.
+func watchCommandQueue(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	service := sqs.New(sess)
+
+	go func() {
+		var backoff time.Duration
+		for {
+			if backoff > 0 {
+				time.Sleep(backoff)
+			}
+
+			output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+				QueueUrl:            aws.String(userData.CommandQueueURL),
+				MaxNumberOfMessages: aws.Int64(10),
+				WaitTimeSeconds:     aws.Int64(20),
+				AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameSentTimestamp)},
+			})
+			if err != nil {
+				fmt.Printf("Error receiving from command queue: %s\n", err.Error())
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			others := 0
+			for _, message := range output.Messages {
+				command := &queuedCommand{}
+				err := json.Unmarshal([]byte(aws.StringValue(message.Body)), command)
+				if err != nil {
+					// It will never parse, don't leave it to come round again.
+					fmt.Printf("Error parsing queued command: %s\n", err.Error())
+				} else if age := messageAge(message); age > staleCommandAge {
+					fmt.Printf("Dropping queued %s command sent %s ago.\n", command.Command, age.Round(time.Second))
+					command.Command = ""
+				} else if (command.InstanceID != "" && command.InstanceID != instanceID) ||
+					(command.Game != "" && command.Game != userData.GameName) {
+					// Someone else's command, make it visible again shortly for whoever it is for.
+					others++
+					_, err = service.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+						QueueUrl:          aws.String(userData.CommandQueueURL),
+						ReceiptHandle:     message.ReceiptHandle,
+						VisibilityTimeout: aws.Int64(otherCommandVisibility),
+					})
+					if err != nil {
+						fmt.Printf("Error releasing queued command: %s\n", err.Error())
+					}
+					continue
+				}
+
+				// Deleted before running, a stop shouldn't be run again by the next instance.
+				_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(userData.CommandQueueURL),
+					ReceiptHandle: message.ReceiptHandle,
+				})
+				if err != nil {
+					fmt.Printf("Error deleting queued command: %s\n", err.Error())
+				}
+
+				if command.Command != "" {
+					runQueuedCommand(userData, instanceID, sess, command)
+				}
+			}
+
+			backoff = nextQueueBackoff(backoff, len(output.Messages) > 0 && others == len(output.Messages))
+		}
+	}()
+	fmt.Println("Watching the command queue.")
+}
+
+// messageAge returns how long ago the message was sent, or 0 if that isn't known.
+func messageAge(message *sqs.Message) time.Duration {
+	sent, err := strconv.ParseInt(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Since(time.Unix(0, sent*int64(time.Millisecond)))
+}
+
+// runQueuedCommand runs a command from the queue, logging how it went.
+func runQueuedCommand(userData *GameServerUserData, instanceID string, sess *session.Session, command *queuedCommand) {
+	fmt.Printf("Running queued %s command.\n", command.Command)
+
+	switch command.Command {
+	case "stop":
+		go shutDownInstance(userData, instanceID, sess, "requested", "Terminating the instance on a queued request.")
+	case "restart":
+		err := restartGames(context.Background(), userData)
+		if err != nil {
+			fmt.Printf("Error restarting: %s\n", err.Error())
+		}
+	case "backup":
+		controlMu.Lock()
+		result, err := backupNow(userData, sess)
+		controlMu.Unlock()
+		if err != nil {
+			fmt.Printf("Error backing up: %s\n", err.Error())
+		} else {
+			fmt.Println(result)
+		}
+	case "say":
+		if command.Message == "" {
+			fmt.Println("Queued say command has no message.")
+			return
+		}
+		err := rconEveryGame(userData, userData.RCONSayCommand+" "+command.Message)
+		if err != nil {
+			fmt.Printf("Error broadcasting message: %s\n", err.Error())
+		}
+	case "extend":
+		duration := time.Duration(userData.KeepAliveDuration) * time.Second
+		if command.Duration > 0 {
+			duration = time.Duration(command.Duration) * time.Second
+		}
+		until := keepAlive(duration)
+		fmt.Printf("Kept alive until %s.\n", until.Format(time.RFC3339))
+	default:
+		fmt.Printf("Unknown queued command %s.\n", command.Command)
+	}
+}
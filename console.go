@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultConsoleSocket is where the console is attached to unless configured otherwise.
+const defaultConsoleSocket = "/run/aws-spot-game-server/console.sock"
+
+// gameConsole connects the game's stdin and output to whoever is attached to the console
+// socket. Output is only passed on, not kept, so attaching shows what the game says from
+// then on.
+type gameConsole struct {
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	clients map[net.Conn]bool
+}
+
+// attach makes stdin the game's input, or nil once the game has exited.
+func (c *gameConsole) attach(stdin io.WriteCloser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stdin = stdin
+}
+
+// Write passes the game's output on to every attached client. A client that can't keep up
+// is dropped rather than holding up the game.
+func (c *gameConsole) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for client := range c.clients {
+		client.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := client.Write(p)
+		if err != nil {
+			client.Close()
+			delete(c.clients, client)
+		}
+	}
+	return len(p), nil
+}
+
+// send writes a line of console input to the game.
+func (c *gameConsole) send(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stdin == nil {
+		return fmt.Errorf("game is not running")
+	}
+	_, err := io.WriteString(c.stdin, line+"\n")
+	return err
+}
+
+// serve passes what a client types on to the game until it disconnects.
+func (c *gameConsole) serve(client net.Conn) {
+	c.mu.Lock()
+	c.clients[client] = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.clients, client)
+		c.mu.Unlock()
+		client.Close()
+	}()
+
+	scanner := bufio.NewScanner(client)
+	for scanner.Scan() {
+		err := c.send(scanner.Text())
+		if err != nil {
+			c.mu.Lock()
+			fmt.Fprintf(client, "Error sending to the game: %s\n", err.Error())
+			c.mu.Unlock()
+		}
+	}
+}
+
+// serveConsole listens on the console socket. Only root can connect, since the console can
+// do anything the game's operators can.
+func serveConsole(userData *GameServerUserData) (*gameConsole, error) {
+	listener, err := listenSocket(userData.ConsoleSocket)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on console socket: %s", err.Error())
+	}
+
+	console := &gameConsole{clients: map[net.Conn]bool{}}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				fmt.Printf("Error accepting console connection: %s\n", err.Error())
+				return
+			}
+			go console.serve(client)
+		}
+	}()
+
+	fmt.Printf("Console listening on %s.\n", userData.ConsoleSocket)
+	return console, nil
+}
+
+// runConsole attaches the terminal to the game's console until stdin ends, Ctrl-D at a
+// terminal, or the daemon goes away. It is run as "aws-spot-game-server ctl console".
+func runConsole(args []string) int {
+	flags := flag.NewFlagSet("console", flag.ExitOnError)
+	socket := flags.String("socket", defaultConsoleSocket, "console socket")
+	name := flags.String("game", "", "game to attach to, when running several")
+	flags.Parse(args)
+
+	if *name != "" {
+		*socket = filepath.Join(filepath.Dir(defaultConsoleSocket), *name+".sock")
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Printf("Error connecting to the console: %s\n", err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(os.Stdout, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, os.Stdin)
+		done <- struct{}{}
+	}()
+
+	<-done
+	return 0
+}
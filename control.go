@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// defaultControlSocket is where the control socket is unless configured otherwise.
+const defaultControlSocket = "/run/aws-spot-game-server/control.sock"
+
+// controlResult is the body of a control API response.
+type controlResult struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// controlPlayers is the body of a players response. Count is -1 when no probe counts them.
+type controlPlayers struct {
+	Count int      `json:"count"`
+	Names []string `json:"names,omitempty"`
+}
+
+// serveControl serves the control API on ControlAddress, over TLS when there is a
+// certificate. Clients need one of the tokens, and a certificate signed by ControlClientCA
+// when there is one.
+func serveControl(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	tokens, err := getControlTokens(userData, sess)
+	if err != nil {
+		// Serving without the tokens would leave the API open.
+		fmt.Printf("Error getting control tokens, not serving control API: %s\n", err.Error())
+		return
+	}
+
+	server := &http.Server{
+		Addr:    userData.ControlAddress,
+		Handler: requireToken(tokens, controlHandler(userData, instanceID, sess)),
+	}
+
+	if userData.ControlClientCA != "" {
+		pem, err := ioutil.ReadFile(userData.ControlClientCA)
+		if err != nil {
+			fmt.Printf("Error reading control client CA, not serving control API: %s\n", err.Error())
+			return
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fmt.Printf("No certificates in control client CA %s, not serving control API.\n", userData.ControlClientCA)
+			return
+		}
+
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	go func() {
+		var err error
+		if userData.ControlTLSCert != "" {
+			err = server.ListenAndServeTLS(userData.ControlTLSCert, userData.ControlTLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			fmt.Printf("Error serving control API: %s\n", err.Error())
+		}
+	}()
+	fmt.Printf("Control API listening on %s.\n", userData.ControlAddress)
+}
+
+// getControlTokens returns ControlToken and the tokens in the ControlTokenSecretID secret,
+// one per line.
+func getControlTokens(userData *GameServerUserData, sess *session.Session) ([]string, error) {
+	tokens := []string{}
+	if userData.ControlToken != "" {
+		tokens = append(tokens, userData.ControlToken)
+	}
+
+	if userData.ControlTokenSecretID == "" {
+		return tokens, nil
+	}
+
+	secret, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(userData.ControlTokenSecretID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting control token secret: %s", err.Error())
+	}
+
+	for _, line := range strings.Split(aws.StringValue(secret.SecretString), "\n") {
+		token := strings.TrimSpace(line)
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	if len(tokens) == 0 && userData.ControlClientCA == "" {
+		return nil, fmt.Errorf("no tokens in control token secret")
+	}
+	return tokens, nil
+}
+
+// serveControlSocket serves the control API on the control socket for "ctl". There is no
+// token, only root can connect.
+func serveControlSocket(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	listener, err := listenSocket(userData.ControlSocket)
+	if err != nil {
+		fmt.Printf("Error listening on control socket: %s\n", err.Error())
+		return
+	}
+
+	go func() {
+		err := http.Serve(listener, controlHandler(userData, instanceID, sess))
+		if err != nil {
+			fmt.Printf("Error serving control socket: %s\n", err.Error())
+		}
+	}()
+	fmt.Printf("Control socket listening on %s.\n", userData.ControlSocket)
+}
+
+// listenSocket listens on a unix socket only root can connect to.
+func listenSocket(path string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating socket directory: %s", err.Error())
+	}
+
+	// Left behind by a daemon that didn't exit cleanly.
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error securing socket: %s", err.Error())
+	}
+
+	return listener, nil
+}
+
+// controlMu makes sure there is only one backup or restart at a time, from whichever
+// control endpoint.
+var controlMu sync.Mutex
+
+// controlHandler handles the control API:
+//
+//	GET  /status            the daemon's status, like the status file
+//	GET  /players           how many players are online, and who when sessions are tracked
+//	POST /stop              shut down like a termination and terminate the instance
+//	POST /restart           restart the games
+//	POST /backup            save and back up the game storage now
+//	POST /extend            hold the game up for KeepAliveDuration seconds, or duration seconds
+//	GET  /events            events as they happen, one JSON object a line
+//	GET  /console           the game's console over a WebSocket, or the console page
+//	GET  /whitelist         the players on the whitelist
+//	POST /whitelist/add     add player to the whitelist
+//	POST /whitelist/remove  take player off the whitelist
+//	GET  /                  the dashboard
+func controlHandler(userData *GameServerUserData, instanceID string, sess *session.Session) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentStatus())
+	})
+
+	mux.HandleFunc("/players", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		players := controlPlayers{Count: currentStatus().Players}
+		if sessions != nil {
+			players.Names = sessions.players()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(players)
+	})
+
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		fmt.Println("Shutting down on request.")
+		go shutDownInstance(userData, instanceID, sess, "requested", "Terminating the instance on request.")
+		writeControl(w, http.StatusAccepted, controlResult{Result: "shutting down"})
+	})
+
+	mux.HandleFunc("/restart", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		fmt.Println("Restarting on request.")
+		err := restartGames(r.Context(), userData)
+		if err != nil {
+			writeControl(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+			return
+		}
+		writeControl(w, http.StatusOK, controlResult{Result: "restarted"})
+	})
+
+	mux.HandleFunc("/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		controlMu.Lock()
+		defer controlMu.Unlock()
+
+		fmt.Println("Backing up on request.")
+		result, err := backupNow(userData, sess)
+		if err != nil {
+			writeControl(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+			return
+		}
+		writeControl(w, http.StatusOK, controlResult{Result: result})
+	})
+
+	mux.HandleFunc("/extend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		duration := time.Duration(userData.KeepAliveDuration) * time.Second
+		if value := r.FormValue("duration"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				writeControl(w, http.StatusBadRequest, controlResult{Error: "duration must be a number of seconds"})
+				return
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+
+		until := keepAlive(duration)
+		fmt.Printf("Kept alive until %s.\n", until.Format(time.RFC3339))
+		writeControl(w, http.StatusOK, controlResult{Result: "kept alive until " + until.UTC().Format(time.RFC3339)})
+	})
+
+	mux.HandleFunc("/whitelist", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		players, err := listWhitelist(userData)
+		if err != nil {
+			writeControl(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(controlWhitelist{Players: players})
+	})
+
+	for _, action := range []string{"add", "remove"} {
+		add := action == "add"
+		mux.HandleFunc("/whitelist/"+action, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+				return
+			}
+
+			player := r.FormValue("player")
+			err := changeWhitelist(userData, player, add)
+			if err != nil {
+				writeControl(w, http.StatusInternalServerError, controlResult{Error: err.Error()})
+				return
+			}
+
+			if add {
+				fmt.Printf("Added %s to the whitelist.\n", player)
+				writeControl(w, http.StatusOK, controlResult{Result: "added " + player})
+			} else {
+				fmt.Printf("Removed %s from the whitelist.\n", player)
+				writeControl(w, http.StatusOK, controlResult{Result: "removed " + player})
+			}
+		})
+	}
+
+	mux.HandleFunc("/events", serveEvents)
+	mux.HandleFunc("/console", serveWebConsole)
+
+	serveDashboard(mux, userData, instanceID, sess)
+	return mux
+}
+
+// restartGames saves the world and restarts every game, giving them five minutes.
+func restartGames(ctx context.Context, userData *GameServerUserData) error {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+
+	err := rconEveryGame(userData, userData.RCONSaveCommand)
+	if err != nil {
+		fmt.Printf("Error saving world: %s\n", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	for _, game := range games {
+		err := game.restart(ctx)
+		if err != nil {
+			return fmt.Errorf("error restarting %s: %s", game.userData.GameName, err.Error())
+		}
+	}
+	return nil
+}
+
+// requireToken only lets requests with one of the tokens as a bearer token, or as the basic
+// auth password for browsers, through. With no tokens every request is let through, for
+// when client certificates are the only auth. Browsers send the password and certificate
+// with requests other sites make too, so requests that change anything must come from the
+// API's own pages.
+func requireToken(tokens []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && crossOrigin(r) {
+			writeControl(w, http.StatusForbidden, controlResult{Error: "cross-origin request"})
+			return
+		}
+
+		if len(tokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		authorization := []byte(r.Header.Get("Authorization"))
+		_, password, basic := r.BasicAuth()
+		for _, token := range tokens {
+			if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) == 1 ||
+				(basic && subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="aws-spot-game-server"`)
+		writeControl(w, http.StatusUnauthorized, controlResult{Error: "unauthorized"})
+	})
+}
+
+// crossOrigin reports whether a browser sent the request from another site. Requests from
+// other clients carry neither header and aren't cross-origin.
+func crossOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Host != r.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// writeControl writes a control API response.
+func writeControl(w http.ResponseWriter, code int, result controlResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(result)
+}
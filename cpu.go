@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc. It is 100 on every Linux
+// platform EC2 runs.
+const clockTicks = 100
+
+// cpuChecker finds the game idle when its processes, all the descendants of the shell that
+// started it, use less than the threshold of one core since the last sample. It suits games
+// that pause their simulation when nobody is on, like Factorio.
+type cpuChecker struct {
+	userData *GameServerUserData
+	percent  float64
+
+	lastTicks uint64
+	lastTime  time.Time
+}
+
+func (c *cpuChecker) check() (bool, int, error) {
+	pid := 0
+	if game := supervisorFor(c.userData); game != nil {
+		pid = int(atomic.LoadInt32(&game.pid))
+	}
+	if pid == 0 {
+		return false, -1, fmt.Errorf("game isn't running")
+	}
+
+	ticks, err := processTreeTicks(pid)
+	if err != nil {
+		return false, -1, err
+	}
+
+	now := time.Now()
+	lastTicks, lastTime := c.lastTicks, c.lastTime
+	c.lastTicks, c.lastTime = ticks, now
+
+	if lastTime.IsZero() || ticks < lastTicks {
+		// Nothing to compare with yet, or the game was restarted.
+		return false, -1, nil
+	}
+
+	usage := float64(ticks-lastTicks) / clockTicks / now.Sub(lastTime).Seconds() * 100
+	fmt.Printf("Game CPU usage is %.1f%%.\n", usage)
+
+	return usage < c.percent, -1, nil
+}
+
+// processTreeTicks adds up the user and system CPU time of the process and all its
+// descendants.
+func processTreeTicks(root int) (uint64, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return 0, err
+	}
+
+	parents := map[int]int{}
+	ticks := map[int]uint64{}
+	for _, stat := range stats {
+		contents, err := ioutil.ReadFile(stat)
+		if err != nil {
+			// The process exited.
+			continue
+		}
+
+		// The command name is in parentheses and may contain spaces, so the fields are
+		// counted from the last closing parenthesis.
+		line := string(contents)
+		end := strings.LastIndex(line, ")")
+		if end < 0 {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(line[:strings.Index(line, "(")]))
+		if err != nil {
+			continue
+		}
+
+		// After the name: state, ppid, ... utime is the 12th and stime the 13th.
+		fields := strings.Fields(line[end+1:])
+		if len(fields) < 13 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+
+		parents[pid] = ppid
+		ticks[pid] = utime + stime
+	}
+
+	if _, ok := parents[root]; !ok {
+		return 0, fmt.Errorf("game process %d not found", root)
+	}
+
+	var total uint64
+	for pid := range parents {
+		for ancestor := pid; ancestor > 1; ancestor = parents[ancestor] {
+			if ancestor == root {
+				total += ticks[pid]
+				break
+			}
+		}
+	}
+
+	return total, nil
+}
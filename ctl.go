@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ctlUsage lists the ctl commands.
+const ctlUsage = "Usage: aws-spot-game-server ctl console|status|players|events|stop|restart|backup now|extend [minutes]|whitelist [add|remove <player>]"
+
+// runCtl runs a command against the daemon running on this instance. It is run as
+// "aws-spot-game-server ctl <command>", and returns the exit status.
+func runCtl(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(ctlUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "console":
+		return runConsole(args[1:])
+	case "status":
+		return runControlCommand("status", http.MethodGet, "/status", args[1:])
+	case "players":
+		return runControlCommand("players", http.MethodGet, "/players", args[1:])
+	case "events":
+		return runEvents(args[1:])
+	case "stop":
+		return runControlCommand("stop", http.MethodPost, "/stop", args[1:])
+	case "restart":
+		return runControlCommand("restart", http.MethodPost, "/restart", args[1:])
+	case "extend":
+		path := "/extend"
+		if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+			minutes, err := strconv.Atoi(args[1])
+			if err != nil || minutes <= 0 {
+				fmt.Println("Usage: aws-spot-game-server ctl extend [minutes]")
+				return 2
+			}
+			path += "?duration=" + strconv.Itoa(minutes*60)
+			args = args[1:]
+		}
+		return runControlCommand("extend", http.MethodPost, path, args[1:])
+	case "whitelist":
+		if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+			return runControlCommand("whitelist", http.MethodGet, "/whitelist", args[1:])
+		}
+		if len(args) < 3 || (args[1] != "add" && args[1] != "remove") {
+			fmt.Println("Usage: aws-spot-game-server ctl whitelist [add|remove <player>]")
+			return 2
+		}
+		return runControlCommand("whitelist", http.MethodPost, "/whitelist/"+args[1]+"?player="+url.QueryEscape(args[2]), args[3:])
+	case "backup":
+		if len(args) < 2 || args[1] != "now" {
+			fmt.Println("Usage: aws-spot-game-server ctl backup now")
+			return 2
+		}
+		return runControlCommand("backup", http.MethodPost, "/backup", args[2:])
+	default:
+		fmt.Printf("Unknown ctl command %s.\n", args[0])
+		fmt.Println(ctlUsage)
+		return 2
+	}
+}
+
+// runControlCommand calls the control API over the control socket and prints what it
+// answers.
+func runControlCommand(name string, method string, path string, args []string) int {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	socket := flags.String("socket", defaultControlSocket, "control socket")
+	flags.Parse(args)
+
+	client := &http.Client{
+		// Backups and restarts take a while.
+		Timeout:   10 * time.Minute,
+		Transport: socketTransport(*socket),
+	}
+
+	request, err := http.NewRequest(method, "http://daemon"+path, nil)
+	if err != nil {
+		fmt.Printf("Error creating request: %s\n", err.Error())
+		return 1
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Printf("Error connecting to the daemon: %s\n", err.Error())
+		return 1
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		fmt.Printf("Error reading response: %s\n", err.Error())
+		return 1
+	}
+
+	var result controlResult
+	if json.Unmarshal(body, &result) == nil && (result.Result != "" || result.Error != "") {
+		if result.Error != "" {
+			fmt.Printf("Error: %s\n", result.Error)
+			return 1
+		}
+		fmt.Println(result.Result)
+		return 0
+	}
+
+	if name == "whitelist" {
+		var whitelist controlWhitelist
+		err = json.Unmarshal(body, &whitelist)
+		if err == nil {
+			fmt.Printf("%d whitelisted.\n", len(whitelist.Players))
+			if len(whitelist.Players) > 0 {
+				fmt.Println(strings.Join(whitelist.Players, "\n"))
+			}
+			return 0
+		}
+	}
+
+	if name == "players" {
+		var players controlPlayers
+		err = json.Unmarshal(body, &players)
+		if err == nil {
+			printPlayers(players)
+			return 0
+		}
+	}
+
+	var indented bytes.Buffer
+	err = json.Indent(&indented, body, "", "  ")
+	if err != nil {
+		fmt.Print(string(body))
+		return 0
+	}
+	fmt.Println(indented.String())
+	return 0
+}
+
+// printPlayers prints how many players are online and who.
+func printPlayers(players controlPlayers) {
+	if players.Count < 0 {
+		fmt.Println("No probe counts players.")
+	} else {
+		fmt.Printf("%d online.\n", players.Count)
+	}
+
+	if len(players.Names) > 0 {
+		fmt.Println(strings.Join(players.Names, "\n"))
+	}
+}
+
+// runEvents prints events from the daemon as they happen until interrupted.
+func runEvents(args []string) int {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	socket := flags.String("socket", defaultControlSocket, "control socket")
+	flags.Parse(args)
+
+	// No timeout, the stream lasts as long as the daemon.
+	client := &http.Client{Transport: socketTransport(*socket)}
+	response, err := client.Get("http://daemon/events")
+	if err != nil {
+		fmt.Printf("Error connecting to the daemon: %s\n", err.Error())
+		return 1
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var result controlResult
+		json.NewDecoder(response.Body).Decode(&result)
+		fmt.Printf("Error: %s\n", result.Error)
+		return 1
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event gameEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			fmt.Println("The daemon went away.")
+			return 0
+		}
+		if err != nil {
+			fmt.Printf("Error reading events: %s\n", err.Error())
+			return 1
+		}
+		fmt.Println(describeEvent(event))
+	}
+}
+
+// socketTransport connects to the daemon over the control socket.
+func socketTransport(socket string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// dashboardStatus is what the dashboard shows. IdleShutdownIn is the seconds until an idle
+// shutdown, 0 while the game isn't counting as idle. SpotPrice is empty for on-demand
+// instances.
+type dashboardStatus struct {
+	State          string    `json:"state"`
+	StartedAt      time.Time `json:"started_at"`
+	Players        int       `json:"players"`
+	Names          []string  `json:"names,omitempty"`
+	IdleShutdownIn int       `json:"idle_shutdown_in,omitempty"`
+	InstanceType   string    `json:"instance_type,omitempty"`
+	SpotPrice      string    `json:"spot_price,omitempty"`
+}
+
+// spotPriceMu guards the instance's type and spot price, looked up at most every 5 minutes.
+var spotPriceMu sync.Mutex
+var spotPriceType string
+var spotPrice string
+var spotPriceAt time.Time
+
+// serveDashboard serves the dashboard at / and what it shows at /dashboard.json.
+func serveDashboard(mux *http.ServeMux, userData *GameServerUserData, instanceID string, sess *session.Session) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeControl(w, http.StatusNotFound, controlResult{Error: "not found"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, dashboardHTML)
+	})
+
+	mux.HandleFunc("/dashboard.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+			return
+		}
+
+		current := currentStatus()
+		dashboard := dashboardStatus{
+			State:     current.State,
+			StartedAt: current.StartedAt,
+			Players:   current.Players,
+		}
+		if sessions != nil {
+			dashboard.Names = sessions.players()
+		}
+		if current.IdleCount > 0 {
+			dashboard.IdleShutdownIn = (userData.IdleConsecutiveTimesForShutdown - current.IdleCount) * userData.IdleInterval
+		}
+
+		instanceType, price, err := currentSpotPrice(instanceID, sess)
+		if err != nil {
+			fmt.Printf("Error getting spot price: %s\n", err.Error())
+		}
+		dashboard.InstanceType = instanceType
+		dashboard.SpotPrice = price
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dashboard)
+	})
+}
+
+// currentSpotPrice returns the instance's type and the current spot price for it in its
+// availability zone, in dollars an hour.
+func currentSpotPrice(instanceID string, sess *session.Session) (string, string, error) {
+	spotPriceMu.Lock()
+	defer spotPriceMu.Unlock()
+
+	if time.Since(spotPriceAt) < 5*time.Minute {
+		return spotPriceType, spotPrice, nil
+	}
+
+	service := ec2.New(sess)
+	instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error describing instance: %s", err.Error())
+	}
+	if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		return "", "", fmt.Errorf("instance %s not found", instanceID)
+	}
+	instance := instances.Reservations[0].Instances[0]
+
+	price := ""
+	if aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+		history, err := service.DescribeSpotPriceHistory(&ec2.DescribeSpotPriceHistoryInput{
+			InstanceTypes:       []*string{instance.InstanceType},
+			AvailabilityZone:    instance.Placement.AvailabilityZone,
+			ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+			StartTime:           aws.Time(time.Now()),
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("error describing spot price history: %s", err.Error())
+		}
+		if len(history.SpotPriceHistory) > 0 {
+			price = aws.StringValue(history.SpotPriceHistory[0].SpotPrice)
+		}
+	}
+
+	spotPriceType = aws.StringValue(instance.InstanceType)
+	spotPrice = price
+	spotPriceAt = time.Now()
+	return spotPriceType, spotPrice, nil
+}
+
+// dashboardHTML is the dashboard page. It polls /dashboard.json and calls the control API,
+// with the browser passing on the credentials it was asked for.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Game server</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 2em auto; padding: 0 1em; }
+dt { font-weight: bold; margin-top: 0.5em; }
+button { font-size: 1em; margin: 1em 0.5em 0 0; padding: 0.5em 1em; }
+#message { margin-top: 1em; }
+</style>
+</head>
+<body>
+<h1>Game server</h1>
+<dl>
+<dt>State</dt><dd id="state">-</dd>
+<dt>Players online</dt><dd id="players">-</dd>
+<dt>Up for</dt><dd id="uptime">-</dd>
+<dt>Idle shutdown</dt><dd id="idle">-</dd>
+<dt>Instance</dt><dd id="instance">-</dd>
+</dl>
+<button onclick="act('backup', 'Back up the server now?')">Back up</button>
+<button onclick="act('stop', 'Stop the server? Everyone online is kicked.')">Stop</button>
+<p><a href="console">Console</a></p>
+<div id="message"></div>
+<script>
+function duration(seconds) {
+  var hours = Math.floor(seconds / 3600), minutes = Math.floor(seconds % 3600 / 60);
+  return hours > 0 ? hours + "h " + minutes + "m" : minutes + "m " + Math.floor(seconds % 60) + "s";
+}
+
+function show(id, text) {
+  document.getElementById(id).textContent = text;
+}
+
+function refresh() {
+  fetch("dashboard.json").then(function(response) { return response.json(); }).then(function(status) {
+    show("state", status.state);
+    var players = status.players < 0 ? "unknown" : String(status.players);
+    if (status.names && status.names.length > 0) {
+      players += " (" + status.names.join(", ") + ")";
+    }
+    show("players", players);
+    show("uptime", duration((Date.now() - Date.parse(status.started_at)) / 1000));
+    show("idle", status.idle_shutdown_in ? "in about " + duration(status.idle_shutdown_in) : "not idle");
+    var instance = status.instance_type || "-";
+    if (status.spot_price) {
+      instance += ", spot $" + Number(status.spot_price).toFixed(4) + "/hour";
+    }
+    show("instance", instance);
+  }).catch(function(err) {
+    show("message", "Can't reach the server: " + err);
+  });
+}
+
+function act(action, question) {
+  if (!confirm(question)) {
+    return;
+  }
+  show("message", "Working...");
+  fetch(action, {method: "POST"}).then(function(response) { return response.json(); }).then(function(result) {
+    show("message", result.error ? "Error: " + result.error : result.result);
+    refresh();
+  }).catch(function(err) {
+    show("message", "Error: " + err);
+  });
+}
+
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// discordAPI is where the Discord REST API is.
+const discordAPI = "https://discord.com/api/v10"
+
+// discordMessage is a message in a Discord channel, as much of it as the bot needs.
+type discordMessage struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Author  struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Bot      bool   `json:"bot"`
+	} `json:"author"`
+}
+
+// discordBot posts events to a Discord channel and answers commands in it. It only uses the
+// REST API, polling the channel for commands, so it needs no gateway connection.
+type discordBot struct {
+	userData   *GameServerUserData
+	instanceID string
+	sess       *session.Session
+	token      string
+	client     *http.Client
+}
+
+// runDiscordBot starts the Discord bot, with its token from DiscordTokenSecretID.
+func runDiscordBot(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	token, err := getDiscordToken(userData, sess)
+	if err != nil {
+		fmt.Printf("Error getting Discord token, not running the Discord bot: %s\n", err.Error())
+		return
+	}
+
+	bot := &discordBot{
+		userData:   userData,
+		instanceID: instanceID,
+		sess:       sess,
+		token:      token,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+
+	// Commands sent before the bot started, maybe to an instance long gone, are ignored.
+	after, err := bot.lastMessageID()
+	if err != nil {
+		fmt.Printf("Error reading Discord channel, not running the Discord bot: %s\n", err.Error())
+		return
+	}
+
+	go bot.postEvents()
+	go bot.answerCommands(after)
+	fmt.Printf("Discord bot running in channel %s.\n", userData.DiscordChannelID)
+}
+
+// getDiscordToken reads the bot token from Secrets Manager.
+func getDiscordToken(userData *GameServerUserData, sess *session.Session) (string, error) {
+	secret, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(userData.DiscordTokenSecretID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting Discord token secret: %s", err.Error())
+	}
+
+	return strings.TrimSpace(aws.StringValue(secret.SecretString)), nil
+}
+
+// postEvents posts events to the channel, except idle ticks, which would drown it.
+func (b *discordBot) postEvents() {
+	events, _ := followEvents()
+
+	err := b.post(fmt.Sprintf("%s is starting.", b.userData.GameName))
+	if err != nil {
+		fmt.Printf("Error posting to Discord: %s\n", err.Error())
+	}
+
+	for event := range events {
+		if event.Event == "idle-tick" {
+			continue
+		}
+
+		err := b.post(fmt.Sprintf("**%s**: %s", b.userData.GameName, event.Message))
+		if err != nil {
+			fmt.Printf("Error posting to Discord: %s\n", err.Error())
+		}
+	}
+}
+
+// answerCommands polls the channel for commands every DiscordPollInterval seconds and
+// answers them.
+func (b *discordBot) answerCommands(after string) {
+	for {
+		time.Sleep(time.Duration(b.userData.DiscordPollInterval) * time.Second)
+
+		messages, err := b.messages(after)
+		if err != nil {
+			fmt.Printf("Error reading Discord channel: %s\n", err.Error())
+			continue
+		}
+
+		// Discord returns the newest first.
+		for i := len(messages) - 1; i >= 0; i-- {
+			message := messages[i]
+			after = message.ID
+			if message.Author.Bot || !strings.HasPrefix(message.Content, "!") {
+				continue
+			}
+
+			reply := b.command(message)
+			if reply == "" {
+				continue
+			}
+
+			err := b.post(reply)
+			if err != nil {
+				fmt.Printf("Error posting to Discord: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// command runs a command from the channel and returns the reply, or nothing for a message
+// that isn't a command.
+func (b *discordBot) command(message discordMessage) string {
+	fields := strings.Fields(strings.TrimPrefix(message.Content, "!"))
+	return chatCommand(b.userData, b.instanceID, b.sess, "!", fields, message.Author.Username,
+		isChatAdmin(b.userData.DiscordAdminIDs, message.Author.ID))
+}
+
+// lastMessageID returns the ID of the newest message in the channel, or nothing if it is
+// empty.
+func (b *discordBot) lastMessageID() (string, error) {
+	var messages []discordMessage
+	err := b.call(http.MethodGet, "/channels/"+b.userData.DiscordChannelID+"/messages?limit=1", nil, &messages)
+	if err != nil || len(messages) == 0 {
+		return "", err
+	}
+	return messages[0].ID, nil
+}
+
+// messages returns the messages in the channel after the one given.
+func (b *discordBot) messages(after string) ([]discordMessage, error) {
+	path := "/channels/" + b.userData.DiscordChannelID + "/messages?limit=50"
+	if after != "" {
+		path += "&after=" + after
+	}
+
+	var messages []discordMessage
+	err := b.call(http.MethodGet, path, nil, &messages)
+	return messages, err
+}
+
+// post posts a message to the channel.
+func (b *discordBot) post(content string) error {
+	return b.call(http.MethodPost, "/channels/"+b.userData.DiscordChannelID+"/messages", map[string]string{"content": content}, nil)
+}
+
+// call calls the Discord API, decoding the response into result if given. Rate limited
+// calls are retried once after the wait Discord asks for.
+func (b *discordBot) call(method string, path string, payload interface{}, result interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest(method, discordAPI+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bot "+b.token)
+		request.Header.Set("User-Agent", "DiscordBot (https://github.com/pneisen/aws-spot-game-server, 1)")
+		if payload != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+
+		response, err := b.client.Do(request)
+		if err != nil {
+			return err
+		}
+
+		if response.StatusCode == http.StatusTooManyRequests && attempt == 0 {
+			var limited struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.NewDecoder(response.Body).Decode(&limited)
+			response.Body.Close()
+			time.Sleep(time.Duration(limited.RetryAfter*1000) * time.Millisecond)
+			continue
+		}
+
+		defer response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return fmt.Errorf("Discord returned %s", response.Status)
+		}
+
+		if result == nil {
+			return nil
+		}
+		return json.NewDecoder(response.Body).Decode(result)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// monitorDiskSpace watches the free space on the game storage and warns when it drops
+// below the threshold, growing the volume as well if that is enabled. It warns once when
+// the threshold is crossed rather than every check. EBS only allows a volume to be modified
+// every six hours, so after trying to grow it, it waits that long before trying again.
+func monitorDiskSpace(userData *GameServerUserData, sess *session.Session) {
+	go func() {
+		warned := false
+		var nextGrow time.Time
+		for {
+			time.Sleep(time.Duration(userData.DiskCheckInterval) * time.Second)
+
+			var stat syscall.Statfs_t
+			err := syscall.Statfs(mountPoint, &stat)
+			if err != nil {
+				fmt.Printf("Error checking disk space: %s\n", err.Error())
+				continue
+			}
+
+			freePercent := int(stat.Bavail * 100 / stat.Blocks)
+			if freePercent >= userData.DiskFreeThresholdPercent {
+				warned = false
+				continue
+			}
+
+			if !warned {
+				notify(userData, sess, "Low disk space", fmt.Sprintf("Only %d%% of the game storage is free.", freePercent))
+				warned = true
+			}
+
+			if userData.DiskAutoGrowPercent > 0 && userData.StorageType == "ebs" && len(userData.VolumeIDs) == 0 {
+				if time.Now().Before(nextGrow) {
+					continue
+				}
+				modifiable, err := volumeModifiableAt(ec2.New(sess), userData.VolumeID)
+				if err == nil && time.Now().Before(modifiable) {
+					fmt.Printf("Volume can't be grown until %s.\n", modifiable.Format(time.RFC3339))
+					nextGrow = modifiable
+					continue
+				}
+
+				nextGrow = time.Now().Add(volumeModifyCooldown)
+				err = growVolume(userData, sess)
+				if err != nil {
+					notify(userData, sess, "Volume grow failed", err.Error())
+				} else {
+					notify(userData, sess, "Volume grown", "The game volume was grown to make more space.")
+				}
+			}
+		}
+	}()
+}
+
+// growVolume grows the game volume by the auto grow percentage and then grows the
+// filesystem into the new space.
+func growVolume(userData *GameServerUserData, sess *session.Session) error {
+	service := ec2.New(sess)
+
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(userData.VolumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing volume: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return fmt.Errorf("volume %s not found", userData.VolumeID)
+	}
+
+	size := *volumes.Volumes[0].Size
+	newSize := size + (size*int64(userData.DiskAutoGrowPercent)+99)/100
+	if userData.DiskMaxSize > 0 && newSize > userData.DiskMaxSize {
+		newSize = userData.DiskMaxSize
+	}
+
+	if newSize <= size {
+		return fmt.Errorf("volume is already at its maximum size of %d GiB", size)
+	}
+
+	fmt.Printf("Growing volume from %d to %d GiB.\n", size, newSize)
+	_, err = service.ModifyVolume(&ec2.ModifyVolumeInput{
+		VolumeId: aws.String(userData.VolumeID),
+		Size:     aws.Int64(newSize),
+	})
+	if err != nil {
+		return fmt.Errorf("error modifying volume: %s", err.Error())
+	}
+
+	// The new size is usable once the modification reaches optimizing.
+	ready := false
+	for i := 0; i < 60; i++ {
+		time.Sleep(5 * time.Second)
+
+		modifications, err := service.DescribeVolumesModifications(&ec2.DescribeVolumesModificationsInput{
+			VolumeIds: []*string{aws.String(userData.VolumeID)},
+		})
+		if err != nil {
+			return fmt.Errorf("error checking volume modification: %s", err.Error())
+		}
+
+		if len(modifications.VolumesModifications) == 0 {
+			continue
+		}
+
+		state := *modifications.VolumesModifications[0].ModificationState
+		if state == ec2.VolumeModificationStateFailed {
+			return fmt.Errorf("volume modification failed")
+		}
+
+		if state == ec2.VolumeModificationStateOptimizing || state == ec2.VolumeModificationStateCompleted {
+			ready = true
+			break
+		}
+	}
+
+	if !ready {
+		return fmt.Errorf("timed out waiting for the volume modification")
+	}
+
+	deviceFile, found := findDeviceFile(userData.VolumeID, "/dev/sdf")
+	if !found {
+		return fmt.Errorf("device file not found")
+	}
+
+	if userData.LUKSEncrypted {
+		err = resizeLUKS()
+		if err != nil {
+			return fmt.Errorf("error resizing encrypted volume: %s", err.Error())
+		}
+		deviceFile = "/dev/mapper/" + luksName
+	}
+
+	return growFileSystem(deviceFile, userData.FileSystemType)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDockerDataPath is where the game storage is mounted in the container unless
+// configured otherwise, matching images like itzg/minecraft-server.
+const defaultDockerDataPath = "/data"
+
+// invalidContainerName matches what can't go in a container name.
+var invalidContainerName = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// containerName is the name the game's container is run under.
+func containerName(userData *GameServerUserData) string {
+	return "aws-spot-game-server-" + invalidContainerName.ReplaceAllString(userData.GameName, "-")
+}
+
+// containerized reports whether the game runs in Docker, as a container or a compose stack.
+func containerized(userData *GameServerUserData) bool {
+	return userData.DockerImage != "" || userData.ComposeFile != ""
+}
+
+// pullImage pulls the game's images, keeping the local copies if the registry can't be
+// reached.
+func pullImage(userData *GameServerUserData) {
+	var err error
+	if userData.ComposeFile != "" {
+		fmt.Printf("Pulling the images of %s.\n", userData.ComposeFile)
+		err = runDocker(context.Background(), composeArgs(userData, "pull")...)
+	} else {
+		fmt.Printf("Pulling %s.\n", userData.DockerImage)
+		err = runDocker(context.Background(), "pull", userData.DockerImage)
+	}
+	if err != nil {
+		fmt.Printf("Error pulling, using the local images: %s\n", err.Error())
+	}
+}
+
+// composeArgs returns the docker arguments running a compose command on the game's stack.
+func composeArgs(userData *GameServerUserData, args ...string) []string {
+	return append([]string{"compose", "--file", userData.ComposeFile, "--project-name", containerName(userData)}, args...)
+}
+
+// composeCommand returns the command bringing the game's compose stack up in the
+// foreground. It exits once every service has. RunEnv is available to the compose file's
+// variables.
+func composeCommand(userData *GameServerUserData) *exec.Cmd {
+	runDocker(context.Background(), composeArgs(userData, "down", "--remove-orphans")...)
+
+	cmd := exec.Command("docker", composeArgs(userData, "up", "--remove-orphans")...)
+	cmd.Env = append(os.Environ(), runEnvironment(userData)...)
+	return cmd
+}
+
+// gameContainers returns the IDs or names of the game's containers.
+func gameContainers(userData *GameServerUserData) []string {
+	if userData.ComposeFile == "" {
+		return []string{containerName(userData)}
+	}
+
+	output, err := exec.Command("docker", composeArgs(userData, "ps", "--all", "--quiet")...).Output()
+	if err != nil {
+		return []string{}
+	}
+	return strings.Fields(string(output))
+}
+
+// dockerCommand returns the command running the game's container in the foreground, with
+// the game storage mounted and the ports published. The container's output is the
+// command's, and signals sent to the command are passed on to the container. A container
+// left over from before is removed first.
+func dockerCommand(userData *GameServerUserData) *exec.Cmd {
+	name := containerName(userData)
+	runDocker(context.Background(), "rm", "--force", name)
+
+	args := []string{"run", "--name", name, "--interactive", "--init",
+		"--volume", mountPoint + ":" + userData.DockerDataPath,
+		"--stop-timeout", strconv.Itoa(userData.StopKillTimeout),
+	}
+	for _, port := range userData.DockerPorts {
+		args = append(args, "--publish", port)
+	}
+	for _, variable := range runEnvironment(userData) {
+		args = append(args, "--env", variable)
+	}
+	if userData.StopSignal != "" {
+		args = append(args, "--stop-signal", userData.StopSignal)
+	}
+	if userData.GameMemoryLimit > 0 {
+		args = append(args, "--memory", strconv.Itoa(userData.GameMemoryLimit)+"m", "--memory-swap", strconv.Itoa(userData.GameMemoryLimit)+"m")
+	}
+	if userData.GameCPULimit > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(userData.GameCPULimit, 'f', -1, 64))
+	}
+	args = append(args, userData.DockerImage)
+	args = append(args, userData.RunArgs...)
+
+	return exec.Command("docker", args...)
+}
+
+// stopContainer stops the game's container with its stop signal, killing it after the kill
+// timeout.
+func stopContainer(ctx context.Context, userData *GameServerUserData) error {
+	timeout := strconv.Itoa(userData.StopKillTimeout)
+	if userData.ComposeFile != "" {
+		return runDocker(ctx, composeArgs(userData, "stop", "--timeout", timeout)...)
+	}
+	return runDocker(ctx, "stop", "--time", timeout, containerName(userData))
+}
+
+// killContainer kills the game's containers outright.
+func killContainer(userData *GameServerUserData) error {
+	if userData.ComposeFile != "" {
+		return runDocker(context.Background(), composeArgs(userData, "kill")...)
+	}
+	return runDocker(context.Background(), "kill", containerName(userData))
+}
+
+// containerOOMKilled reports whether any of the game's containers was killed for running
+// out of memory.
+func containerOOMKilled(userData *GameServerUserData) bool {
+	containers := gameContainers(userData)
+	if len(containers) == 0 {
+		return false
+	}
+
+	args := append([]string{"inspect", "--format", "{{.State.OOMKilled}}"}, containers...)
+	output, err := exec.Command("docker", args...).Output()
+	return err == nil && strings.Contains(string(output), "true")
+}
+
+// containerHealth returns an error if an image's own health check finds one of the game's
+// containers unhealthy. A container without a health check is always healthy.
+func containerHealth(userData *GameServerUserData, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	containers := gameContainers(userData)
+	if len(containers) == 0 {
+		return fmt.Errorf("no containers running")
+	}
+
+	args := append([]string{"inspect", "--format", "{{.Name}} {{if .State.Health}}{{.State.Health.Status}}{{end}}"}, containers...)
+	output, err := exec.CommandContext(ctx, "docker", args...).Output()
+	if err != nil {
+		return fmt.Errorf("error inspecting containers: %s", err.Error())
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == "unhealthy" {
+			return fmt.Errorf("container %s is unhealthy", strings.TrimPrefix(fields[0], "/"))
+		}
+	}
+	return nil
+}
+
+func runDocker(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
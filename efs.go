@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// mountEFS mounts the configured EFS file system on the mount point, either through the
+// efs-utils mount helper or directly over NFS with the options AWS recommends.
+func mountEFS(userData *GameServerUserData, region string) error {
+	err := createMountPoint()
+	if err != nil {
+		return err
+	}
+
+	options := []string{}
+	var source, fsType string
+	if userData.EFSMountHelper {
+		fsType = "efs"
+		source = userData.EFSFileSystemID + ":" + userData.EFSPath
+		options = append(options, "tls")
+		if userData.EFSMountTargetIP != "" {
+			options = append(options, "mounttargetip="+userData.EFSMountTargetIP)
+		}
+	} else {
+		fsType = "nfs4"
+		host := userData.EFSMountTargetIP
+		if host == "" {
+			host = fmt.Sprintf("%s.efs.%s.amazonaws.com", userData.EFSFileSystemID, region)
+		}
+		source = host + ":" + userData.EFSPath
+		options = append(options, "nfsvers=4.1", "rsize=1048576", "wsize=1048576", "hard", "timeo=600", "retrans=2", "noresvport")
+	}
+
+	if userData.MountOptions != "" {
+		options = append(options, userData.MountOptions)
+	}
+
+	fmt.Printf("Mounting EFS file system %s.\n", userData.EFSFileSystemID)
+	cmd := exec.Command("/bin/mount", "-t", fsType, "-o", strings.Join(options, ","), source, mountPoint)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("error mounting EFS file system: %s", err.Error())
+	}
+
+	fmt.Println("EFS file system mounted.")
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// watchersMu guards watchers, the channels of everyone following events, on the control
+// API or in chat.
+var watchersMu sync.Mutex
+var watchers = map[chan gameEvent]bool{}
+
+// watchEvent passes an event to everyone following events and to the webhooks. Besides the
+// published events there are player-joined, player-left, and idle-tick, which would be too
+// noisy for the topic, and boot-started, dns-set, volume-mounted, game-started, and
+// terminated. Watchers that fall behind miss events rather than holding the daemon up.
+func watchEvent(userData *GameServerUserData, event string, message string, detail map[string]string) {
+	statusMu.Lock()
+	instanceID := status.InstanceID
+	statusMu.Unlock()
+
+	watched := gameEvent{
+		Event:      event,
+		Game:       userData.GameName,
+		InstanceID: instanceID,
+		Time:       time.Now().UTC(),
+		Message:    message,
+		Detail:     detail,
+	}
+
+	sendWebhooks(userData, watched)
+
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for watcher := range watchers {
+		select {
+		case watcher <- watched:
+		default:
+		}
+	}
+}
+
+// followEvents starts following events, until stop is called.
+func followEvents() (<-chan gameEvent, func()) {
+	watcher := make(chan gameEvent, 64)
+	watchersMu.Lock()
+	watchers[watcher] = true
+	watchersMu.Unlock()
+
+	return watcher, func() {
+		watchersMu.Lock()
+		delete(watchers, watcher)
+		watchersMu.Unlock()
+	}
+}
+
+// serveEvents streams events as they happen, one JSON object a line, until the client goes
+// away.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeControl(w, http.StatusMethodNotAllowed, controlResult{Error: "method not allowed"})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeControl(w, http.StatusInternalServerError, controlResult{Error: "streaming not supported"})
+		return
+	}
+
+	watcher, stop := followEvents()
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-watcher:
+			err := encoder.Encode(event)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// describeEvent is how ctl prints an event.
+func describeEvent(event gameEvent) string {
+	return fmt.Sprintf("%s %s: %s", event.Time.Local().Format("15:04:05"), event.Event, event.Message)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// mountFlags maps the generic mount options to their mount(2) flags. Anything not
+// listed here is filesystem specific and gets passed through as mount data.
+var mountFlags = map[string]uintptr{
+	"ro":          syscall.MS_RDONLY,
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// parseMountOptions splits a comma separated option string, like the one used in fstab,
+// into mount flags and the filesystem specific data string.
+func parseMountOptions(options string) (uintptr, string) {
+	var flags uintptr
+	data := []string{}
+
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" || option == "defaults" || option == "rw" {
+			continue
+		}
+
+		flag, ok := mountFlags[option]
+		if ok {
+			flags |= flag
+		} else {
+			data = append(data, option)
+		}
+	}
+
+	return flags, strings.Join(data, ",")
+}
+
+// checkFileSystem runs the appropriate filesystem checker against the unmounted device.
+// ext filesystems are repaired automatically when it is safe to do so, xfs and btrfs are
+// only checked since their repair tools shouldn't be run unattended.
+func checkFileSystem(deviceFile string, fileSystemType string) error {
+	if fileSystemType == "xfs" {
+		err := replayXFSLog(deviceFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cmd *exec.Cmd
+	switch fileSystemType {
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("/sbin/e2fsck", "-p", deviceFile)
+	case "xfs":
+		cmd = exec.Command("/sbin/xfs_repair", "-n", deviceFile)
+	case "btrfs":
+		cmd = exec.Command("/bin/btrfs", "check", "--readonly", deviceFile)
+	default:
+		return fmt.Errorf("no filesystem checker for %s", fileSystemType)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("error running filesystem check: %s", err.Error())
+	}
+
+	// e2fsck exits with 1 or 2 when it found and corrected errors.
+	if cmd.Args[0] == "/sbin/e2fsck" && exitErr.ExitCode() <= 2 {
+		fmt.Println("Filesystem errors were corrected.")
+		return nil
+	}
+
+	return fmt.Errorf("filesystem check exited with status %d", exitErr.ExitCode())
+}
+
+// replayXFSLog mounts and unmounts an xfs filesystem so its log is replayed. A volume
+// detached without unmounting, as after a spot interruption, has a dirty log, which
+// xfs_repair -n doesn't replay and reports as errors.
+func replayXFSLog(deviceFile string) error {
+	directory, err := ioutil.TempDir("", "xfs-replay")
+	if err != nil {
+		return fmt.Errorf("error creating mount point to replay the xfs log: %s", err.Error())
+	}
+	defer os.Remove(directory)
+
+	err = syscall.Mount(deviceFile, directory, "xfs", 0, "")
+	if err != nil {
+		return fmt.Errorf("error mounting to replay the xfs log: %s", err.Error())
+	}
+	err = syscall.Unmount(directory, 0)
+	if err != nil {
+		return fmt.Errorf("error unmounting after replaying the xfs log: %s", err.Error())
+	}
+	return nil
+}
+
+// growFileSystem grows the mounted filesystem to fill its device if the device is larger.
+// Filesystem metadata means the reported size is always smaller than the device, by more
+// on larger filesystems, so the sizes can't tell whether it needs growing. The tools do
+// nothing when it already fills the device, so they are always run instead.
+func growFileSystem(deviceFile string, fileSystemType string) error {
+	fmt.Println("Growing filesystem to fill the device.")
+
+	var cmd *exec.Cmd
+	switch fileSystemType {
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("/sbin/resize2fs", deviceFile)
+	case "xfs":
+		cmd = exec.Command("/usr/sbin/xfs_growfs", mountPoint)
+	case "btrfs":
+		cmd = exec.Command("/bin/btrfs", "filesystem", "resize", "max", mountPoint)
+	default:
+		return fmt.Errorf("no way to grow %s", fileSystemType)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("error running %s: %s", cmd.Args[0], err.Error())
+	}
+
+	fmt.Println("Filesystem grown.")
+	return nil
+}
+
+// createMountPoint creates the directory the game storage is mounted on, if it doesn't
+// exist from an earlier boot.
+func createMountPoint() error {
+	info, err := os.Stat(mountPoint)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+
+	fmt.Println("Creating mount point.")
+	oldUMask := syscall.Umask(0)
+	err = os.Mkdir(mountPoint, 0777)
+	syscall.Umask(oldUMask)
+	if err != nil {
+		return fmt.Errorf("error creating mount point: %s", err.Error())
+	}
+
+	return nil
+}
+
+// isMounted reports whether something is mounted on path.
+func isMounted(path string) (bool, error) {
+	contents, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("error reading mounts: %s", err.Error())
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		// The fifth field is the mount point.
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[4] == path {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// fstabMarker marks the fstab line the daemon manages.
+const fstabMarker = "# aws-spot-game-server"
+
+// writeFstab adds or updates the game volume's line in /etc/fstab. The volume is found by
+// UUID since device names can change between boots, and nofail keeps a missing volume
+// from stopping the instance booting.
+func writeFstab(deviceFile string, fileSystemType string, options string) error {
+	output, err := exec.Command("/sbin/blkid", "-o", "value", "-s", "UUID", deviceFile).Output()
+	if err != nil {
+		return fmt.Errorf("error getting filesystem UUID: %s", err.Error())
+	}
+
+	uuid := strings.TrimSpace(string(output))
+	if uuid == "" {
+		return fmt.Errorf("filesystem has no UUID")
+	}
+
+	if options == "" {
+		options = "defaults"
+	}
+	entry := fmt.Sprintf("UUID=%s %s %s %s,nofail 0 2 %s", uuid, mountPoint, fileSystemType, options, fstabMarker)
+
+	contents, err := ioutil.ReadFile("/etc/fstab")
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(contents), "\n"), "\n") {
+		if strings.HasSuffix(line, fstabMarker) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, entry)
+
+	return ioutil.WriteFile("/etc/fstab", []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// hasFileSystem reports whether the device already holds a filesystem.
+func hasFileSystem(deviceFile string) (bool, error) {
+	cmd := exec.Command("/sbin/blkid", "-o", "value", "-s", "TYPE", deviceFile)
+	output, err := cmd.Output()
+	if err != nil {
+		// blkid exits with 2 when it finds nothing on the device.
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return false, nil
+		}
+		return false, fmt.Errorf("error running blkid: %s", err.Error())
+	}
+
+	return strings.TrimSpace(string(output)) != "", nil
+}
+
+// formatDevice creates a new filesystem on the device.
+func formatDevice(deviceFile string, fileSystemType string) error {
+	fmt.Printf("Formatting %s as %s.\n", deviceFile, fileSystemType)
+	cmd := exec.Command("/sbin/mkfs."+fileSystemType, deviceFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("error formatting %s: %s", deviceFile, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// fleetTag is the tag EC2 puts on the instances of an EC2 Fleet, holding the fleet's ID.
+const fleetTag = "aws:ec2:fleet-id"
+
+// ec2Fleet is the EC2 Fleet keeping this instance running, or "" if it isn't in one.
+var ec2Fleet string
+
+// launchFleet creates an EC2 Fleet that keeps one spot instance of the game running, drawing
+// on every candidate instance type in every candidate subnet so it can move to another pool
+// when one runs short. The fleet launches from the profile's launch template, which is
+// brought up to date first. It returns the ID of the fleet's instance once there is one.
+func launchFleet(service *ec2.EC2, profile *LaunchProfile) (string, error) {
+	templateID, version, err := provisionTemplate(service, profile)
+	if err != nil {
+		return "", err
+	}
+
+	subnets, err := candidateSubnets(service, profile)
+	if err != nil {
+		return "", err
+	}
+
+	overrides := []*ec2.FleetLaunchTemplateOverridesRequest{}
+	for _, subnet := range subnets {
+		if profile.InstanceRequirements != nil {
+			overrides = append(overrides, &ec2.FleetLaunchTemplateOverridesRequest{
+				SubnetId:             aws.String(subnet),
+				InstanceRequirements: profile.InstanceRequirements.request(),
+			})
+			continue
+		}
+		for _, instanceType := range profile.candidateTypes() {
+			override := &ec2.FleetLaunchTemplateOverridesRequest{
+				SubnetId:     aws.String(subnet),
+				InstanceType: aws.String(instanceType),
+			}
+			if profile.MaxPrice != "" {
+				override.MaxPrice = aws.String(profile.MaxPrice)
+			}
+			overrides = append(overrides, override)
+		}
+	}
+
+	strategy := profile.FleetAllocationStrategy
+	if strategy == "" {
+		strategy = ec2.SpotAllocationStrategyCapacityOptimized
+	}
+
+	fmt.Printf("Creating fleet for %s from %d pools, %s.\n", profile.gameData.GameName, len(overrides), strategy)
+	created, err := service.CreateFleet(&ec2.CreateFleetInput{
+		Type: aws.String(ec2.FleetTypeMaintain),
+		TargetCapacitySpecification: &ec2.TargetCapacitySpecificationRequest{
+			TotalTargetCapacity:       aws.Int64(1),
+			DefaultTargetCapacityType: aws.String(ec2.DefaultTargetCapacityTypeSpot),
+		},
+		SpotOptions: &ec2.SpotOptionsRequest{
+			AllocationStrategy:           aws.String(strategy),
+			InstanceInterruptionBehavior: aws.String(ec2.SpotInstanceInterruptionBehaviorTerminate),
+		},
+		LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfigRequest{
+			{
+				LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest{
+					LaunchTemplateId: aws.String(templateID),
+					Version:          aws.String(strconv.FormatInt(version, 10)),
+				},
+				Overrides: overrides,
+			},
+		},
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeFleet),
+				Tags:         []*ec2.Tag{{Key: aws.String(tagGame), Value: aws.String(profile.gameData.GameName)}},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating fleet: %s", err.Error())
+	}
+	fleetID := aws.StringValue(created.FleetId)
+	fmt.Printf("Created fleet %s.\n", fleetID)
+	for _, fleetErr := range created.Errors {
+		fmt.Printf("Fleet error: %s: %s\n", aws.StringValue(fleetErr.ErrorCode), aws.StringValue(fleetErr.ErrorMessage))
+	}
+
+	// A maintain fleet launches in the background.
+	deadline := time.Now().Add(time.Duration(profile.SpotTimeout) * time.Second)
+	for {
+		instances, err := service.DescribeFleetInstances(&ec2.DescribeFleetInstancesInput{FleetId: aws.String(fleetID)})
+		if err == nil && len(instances.ActiveInstances) > 0 {
+			return aws.StringValue(instances.ActiveInstances[0].InstanceId), nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("fleet %s hasn't launched an instance yet, it will keep trying", fleetID)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// findFleet returns the EC2 Fleet the instance is in, or "" if it isn't in one.
+func findFleet(instanceID string, sess *session.Session) (string, error) {
+	output, err := ec2.New(sess).DescribeTags(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{aws.String(instanceID)}},
+			{Name: aws.String("key"), Values: []*string{aws.String(fleetTag)}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing tags: %s", err.Error())
+	}
+
+	if len(output.Tags) == 0 {
+		return "", nil
+	}
+	return aws.StringValue(output.Tags[0].Value), nil
+}
+
+// deleteFleet deletes the fleet and terminates its instance, so the fleet doesn't replace an
+// instance that was shut down on purpose.
+func deleteFleet(sess *session.Session, fleetID string) error {
+	output, err := ec2.New(sess).DeleteFleets(&ec2.DeleteFleetsInput{
+		FleetIds:           []*string{aws.String(fleetID)},
+		TerminateInstances: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	for _, failed := range output.UnsuccessfulFleetDeletions {
+		if failed.Error != nil {
+			return fmt.Errorf("%s", aws.StringValue(failed.Error.Message))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// setGameDefaults sets up the settings for each game. A game starts from the instance's
+// settings, with its own in place of the single game's.
+func setGameDefaults(userData *GameServerUserData) {
+	if len(userData.Games) == 0 {
+		if len(userData.IdleProbes) == 0 && userData.IdlePath != "" {
+			userData.IdleProbes = []IdleProbe{{Type: "script"}}
+		}
+		for i := range userData.IdleProbes {
+			setIdleProbeDefaults(&userData.IdleProbes[i])
+		}
+
+		if userData.HealthCheck != nil {
+			setHealthCheckDefaults(userData.HealthCheck)
+		}
+		setGameHookDefaults(userData)
+
+		userData.games = []*GameServerUserData{userData}
+		return
+	}
+
+	userData.games = []*GameServerUserData{}
+	for _, config := range userData.Games {
+		data := *userData
+		data.Games = nil
+		data.games = nil
+
+		data.GameName = config.Name
+		data.RunPath = config.RunPath
+		data.StopPath = config.StopPath
+		data.IdlePath = config.IdlePath
+		data.RunArgs = config.RunArgs
+		data.RunEnv = config.RunEnv
+		data.IdleProbes = config.IdleProbes
+		data.IdleRule = config.IdleRule
+		data.DockerImage = config.DockerImage
+		data.DockerPorts = config.DockerPorts
+		data.ComposeFile = config.ComposeFile
+		data.ConsoleSocket = filepath.Join(filepath.Dir(userData.ConsoleSocket), config.Name+".sock")
+
+		if config.StopSignal != "" {
+			data.StopSignal = config.StopSignal
+		}
+		if config.RunDirectory != "" {
+			data.RunDirectory = config.RunDirectory
+		}
+		if config.RCONAddress != "" {
+			data.RCONAddress = config.RCONAddress
+		}
+		if config.RCONPassword != "" {
+			data.RCONPassword = config.RCONPassword
+			data.RCONPasswordSecretID = ""
+		}
+
+		if config.HealthCheck != nil {
+			data.HealthCheck = config.HealthCheck
+		}
+		if len(config.PreStartHooks) > 0 {
+			data.PreStartHooks = config.PreStartHooks
+		}
+		if len(config.PostStopHooks) > 0 {
+			data.PostStopHooks = config.PostStopHooks
+		}
+		if data.HealthCheck != nil {
+			setHealthCheckDefaults(data.HealthCheck)
+		}
+		setGameHookDefaults(&data)
+
+		if len(data.IdleProbes) == 0 && data.IdlePath != "" {
+			data.IdleProbes = []IdleProbe{{Type: "script"}}
+		}
+		for i := range data.IdleProbes {
+			setIdleProbeDefaults(&data.IdleProbes[i])
+		}
+
+		userData.games = append(userData.games, &data)
+	}
+}
+
+// validateGames makes sure every game can be run and checked for idle.
+func validateGames(userData *GameServerUserData) error {
+	names := map[string]bool{}
+	for _, data := range userData.games {
+		if len(userData.Games) > 0 {
+			if data.GameName == "" || strings.ContainsAny(data.GameName, "/\x00") {
+				return fmt.Errorf("invalid game name %q", data.GameName)
+			}
+			if names[data.GameName] {
+				return fmt.Errorf("more than one game is called %s", data.GameName)
+			}
+			names[data.GameName] = true
+		}
+
+		err := validateGame(data)
+		if err != nil && len(userData.Games) > 0 {
+			return fmt.Errorf("game %s: %s", data.GameName, err.Error())
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateGame makes sure a game's own settings are valid.
+func validateGame(data *GameServerUserData) error {
+	if data.RunPath == "" && !containerized(data) {
+		return fmt.Errorf("run path is required")
+	}
+
+	if data.StopSignal != "" {
+		_, ok := stopSignals[data.StopSignal]
+		if !ok {
+			return fmt.Errorf("unsupported stop signal: %s", data.StopSignal)
+		}
+	}
+
+	for name := range data.RunEnv {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid run environment variable name %q", name)
+		}
+	}
+
+	if data.DockerImage != "" && data.ComposeFile != "" {
+		return fmt.Errorf("only one of Docker image and compose file can be given")
+	}
+
+	if data.ComposeFile != "" && cgroupEnabled(data) {
+		return fmt.Errorf("compose stacks take their limits from the compose file")
+	}
+
+	if data.HealthCheck != nil && data.HealthCheck.Type == "docker" && !containerized(data) {
+		return fmt.Errorf("docker health checks need a Docker image or compose file")
+	}
+
+	if data.HealthCheck != nil {
+		err := validateHealthCheck(data, data.HealthCheck)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, hook := range append(data.PreStartHooks, data.PostStopHooks...) {
+		if hook.Path == "" {
+			return fmt.Errorf("game hooks need a path")
+		}
+	}
+
+	names := map[string]bool{}
+	for _, probe := range data.IdleProbes {
+		err := validateIdleProbe(data, probe)
+		if err != nil {
+			return err
+		}
+
+		if probe.Type == "cpu" && containerized(data) {
+			// The container's processes aren't the daemon's children.
+			return fmt.Errorf("cpu idle probes don't work with Docker")
+		}
+
+		if names[probe.Name] {
+			return fmt.Errorf("more than one idle probe is called %s", probe.Name)
+		}
+		names[probe.Name] = true
+	}
+
+	if data.IdleRule != "" {
+		_, err := parseIdleRule(data.IdleRule, names)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// anyRCONEnabled reports whether any of the games can be talked to over RCON.
+func anyRCONEnabled(userData *GameServerUserData) bool {
+	for _, data := range userData.games {
+		if rconEnabled(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// rconEveryGame runs the command over RCON on every game that has it, returning the last
+// error.
+func rconEveryGame(userData *GameServerUserData, command string) error {
+	var failed error
+	for _, data := range userData.games {
+		if !rconEnabled(data) {
+			continue
+		}
+
+		_, err := rconCommand(data, command)
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// setGameHookDefaults fills in the timeouts of the game's hooks.
+func setGameHookDefaults(data *GameServerUserData) {
+	for _, hooks := range [][]GameHook{data.PreStartHooks, data.PostStopHooks} {
+		for i := range hooks {
+			if hooks[i].Timeout <= 0 {
+				hooks[i].Timeout = 300
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// setHealthCheckDefaults fills in how often the health check runs and how forgiving it is.
+func setHealthCheckDefaults(check *HealthCheck) {
+	if check.Interval <= 0 {
+		check.Interval = 30
+	}
+
+	if check.Timeout <= 0 {
+		check.Timeout = 5
+	}
+
+	if check.Failures <= 0 {
+		check.Failures = 3
+	}
+
+	if check.StartPeriod <= 0 {
+		check.StartPeriod = 300
+	}
+
+	if check.Command == "" && check.Type == "rcon" {
+		check.Command = "list"
+	}
+
+	if check.Address == "" {
+		switch check.Type {
+		case "minecraft":
+			check.Address = "127.0.0.1:25565"
+		case "a2s":
+			check.Address = "127.0.0.1:27015"
+		}
+	}
+}
+
+// validateHealthCheck makes sure the health check can be run.
+func validateHealthCheck(userData *GameServerUserData, check *HealthCheck) error {
+	switch check.Type {
+	case "tcp":
+		if check.Address == "" {
+			return fmt.Errorf("tcp health checks need an address")
+		}
+	case "rcon":
+		if !rconEnabled(userData) {
+			return fmt.Errorf("rcon health checks need an RCON password")
+		}
+	case "minecraft", "a2s", "docker":
+	default:
+		return fmt.Errorf("unknown health check type: %s", check.Type)
+	}
+
+	return nil
+}
+
+// checkHealth returns an error if the game doesn't answer.
+func checkHealth(userData *GameServerUserData, check *HealthCheck) error {
+	timeout := time.Duration(check.Timeout) * time.Second
+	switch check.Type {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", check.Address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "minecraft":
+		_, err := pingMinecraft(check.Address, timeout)
+		return err
+	case "a2s":
+		_, err := queryA2SInfo(check.Address, timeout)
+		return err
+	case "docker":
+		return containerHealth(userData, timeout)
+	default:
+		client, err := dialRCON(userData.RCONAddress, userData.RCONPassword, timeout)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		_, err = client.command(check.Command)
+		return err
+	}
+}
+
+// watchHealth checks the game until it exits, and kills it once it has failed the health
+// check too many times in a row. It gets StartPeriod seconds to start answering first.
+func (s *supervisor) watchHealth(exited <-chan struct{}) {
+	check := s.userData.HealthCheck
+	started := time.Now()
+	failures := 0
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(time.Duration(check.Interval) * time.Second):
+		}
+
+		if s.isStopping() || time.Since(started) < time.Duration(check.StartPeriod)*time.Second {
+			continue
+		}
+
+		err := checkHealth(s.userData, check)
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		fmt.Printf("%s failed its health check (%d of %d): %s\n", s.userData.GameName, failures, check.Failures, err.Error())
+		if failures < check.Failures {
+			continue
+		}
+
+		s.mu.Lock()
+		s.unhealthy = true
+		s.mu.Unlock()
+
+		fmt.Printf("%s stopped responding, killing it.\n", s.userData.GameName)
+		s.kill(exited)
+		return
+	}
+}
+
+// kill stops a game that isn't responding. A stop script would most likely hang along with
+// the game, so it is sent the stop signal, SIGTERM by default, and killed if that doesn't
+// work.
+func (s *supervisor) kill(exited <-chan struct{}) {
+	// Docker passes the signal on to the container.
+	err := s.signal(s.stopSignal())
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	select {
+	case <-exited:
+		return
+	case <-time.After(time.Duration(s.userData.StopKillTimeout) * time.Second):
+	}
+
+	err = s.forceKill()
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// runIdleHooks runs the idle hooks in order before the idle action. Scripts get the game
+// name, instance ID, and action in GAME_NAME, INSTANCE_ID, and IDLE_ACTION. Webhooks are
+// POSTed JSON with the message in both content and text, so Discord and Slack webhooks
+// can be used as is. A failing hook is logged and doesn't stop the shutdown.
+func runIdleHooks(userData *GameServerUserData, instanceID string) {
+	message := fmt.Sprintf("%s has been idle too long, the instance will %s.", userData.GameName, userData.IdleAction)
+
+	for i, hook := range userData.IdleHooks {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hook.Timeout)*time.Second)
+
+		var err error
+		if hook.URL != "" {
+			fmt.Printf("Idle hook %d: posting to webhook.\n", i+1)
+			err = postWebhook(ctx, hook.URL, map[string]string{
+				"event":      "idle-shutdown",
+				"game":       userData.GameName,
+				"instanceId": instanceID,
+				"action":     userData.IdleAction,
+				"content":    message,
+				"text":       message,
+			})
+		} else {
+			fmt.Printf("Idle hook %d: running %s.\n", i+1, hook.Path)
+			cmd := exec.CommandContext(ctx, hook.Path, hook.Args...)
+			cmd.Env = append(os.Environ(),
+				"GAME_NAME="+userData.GameName,
+				"INSTANCE_ID="+instanceID,
+				"IDLE_ACTION="+userData.IdleAction,
+			)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			err = cmd.Run()
+			if ctx.Err() != nil {
+				err = fmt.Errorf("timed out")
+			}
+		}
+		cancel()
+
+		if err != nil {
+			fmt.Printf("Idle hook %d failed: %s\n", i+1, err.Error())
+		}
+	}
+}
+
+// postWebhook POSTs the payload as JSON, failing on anything but a 2xx response.
+func postWebhook(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+
+	return nil
+}
+
+// runGameHooks runs the game's pre-start or post-stop hooks in order, as the game would be
+// run, and returns the first failure.
+func runGameHooks(userData *GameServerUserData, kind string, hooks []GameHook, credential *syscall.Credential, env []string) error {
+	for i, hook := range hooks {
+		fmt.Printf("%s hook %d: running %s.\n", kind, i+1, hook.Path)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hook.Timeout)*time.Second)
+		cmd := exec.CommandContext(ctx, hook.Path, hook.Args...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		cmd.Dir = userData.RunDirectory
+		cmd.Env = append(env, "GAME_NAME="+userData.GameName)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out")
+		}
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("%s hook %s failed: %s", kind, hook.Path, err.Error())
+		}
+	}
+
+	return nil
+}
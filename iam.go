@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// ssmManagedPolicy lets SSM run commands on the instance, which stop and the SSM document
+// need.
+const ssmManagedPolicy = "arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore"
+
+// policyStatement is one statement of an IAM policy document.
+type policyStatement struct {
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string]interface{} `json:",omitempty"`
+}
+
+// runProvisionIAM creates the role and instance profile the daemon runs with, with a policy
+// allowing just what the profile's user data uses: its DNS record's zone, the instances and
+// volumes tagged with the game, and the buckets, topics, secrets, queues, and parameters it
+// names. Running it again brings the policy up to date.
+func runProvisionIAM(args []string) int {
+	flags := flag.NewFlagSet("provision iam", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	ssmCore := flags.Bool("ssm", true, "attach AmazonSSMManagedInstanceCore so stop and the SSM document work")
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	roleName := "aws-spot-game-server-" + profile.gameData.GameName
+	service := iam.New(profile.session())
+
+	trust, _ := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Effect":    "Allow",
+			"Action":    "sts:AssumeRole",
+			"Principal": map[string]string{"Service": "ec2.amazonaws.com"},
+		}},
+	})
+
+	var roleARN string
+	role, err := service.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		created, err := service.CreateRole(&iam.CreateRoleInput{
+			RoleName:                 aws.String(roleName),
+			AssumeRolePolicyDocument: aws.String(string(trust)),
+			Description:              aws.String("aws-spot-game-server daemon for " + profile.gameData.GameName),
+			Tags:                     []*iam.Tag{{Key: aws.String(tagGame), Value: aws.String(profile.gameData.GameName)}},
+		})
+		if err != nil {
+			fmt.Printf("Error creating role: %s\n", err.Error())
+			return 1
+		}
+		roleARN = aws.StringValue(created.Role.Arn)
+		fmt.Printf("Created role %s.\n", roleName)
+	} else if err != nil {
+		fmt.Printf("Error getting role: %s\n", err.Error())
+		return 1
+	} else {
+		roleARN = aws.StringValue(role.Role.Arn)
+	}
+
+	document, err := json.Marshal(map[string]interface{}{
+		"Version":   "2012-10-17",
+		"Statement": daemonPolicy(profile.gameData, roleARN, profile.AutoScalingGroup),
+	})
+	if err != nil {
+		fmt.Printf("Error writing policy: %s\n", err.Error())
+		return 1
+	}
+	_, err = service.PutRolePolicy(&iam.PutRolePolicyInput{
+		RoleName:       aws.String(roleName),
+		PolicyName:     aws.String("aws-spot-game-server"),
+		PolicyDocument: aws.String(string(document)),
+	})
+	if err != nil {
+		fmt.Printf("Error putting role policy: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Put the policy on %s.\n", roleName)
+
+	if *ssmCore {
+		_, err = service.AttachRolePolicy(&iam.AttachRolePolicyInput{
+			RoleName:  aws.String(roleName),
+			PolicyArn: aws.String(ssmManagedPolicy),
+		})
+		if err != nil {
+			fmt.Printf("Error attaching %s: %s\n", ssmManagedPolicy, err.Error())
+			return 1
+		}
+	}
+
+	var instanceProfile *iam.InstanceProfile
+	found, err := service.GetInstanceProfile(&iam.GetInstanceProfileInput{InstanceProfileName: aws.String(roleName)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		created, err := service.CreateInstanceProfile(&iam.CreateInstanceProfileInput{
+			InstanceProfileName: aws.String(roleName),
+			Tags:                []*iam.Tag{{Key: aws.String(tagGame), Value: aws.String(profile.gameData.GameName)}},
+		})
+		if err != nil {
+			fmt.Printf("Error creating instance profile: %s\n", err.Error())
+			return 1
+		}
+		instanceProfile = created.InstanceProfile
+		fmt.Printf("Created instance profile %s.\n", roleName)
+	} else if err != nil {
+		fmt.Printf("Error getting instance profile: %s\n", err.Error())
+		return 1
+	} else {
+		instanceProfile = found.InstanceProfile
+	}
+
+	if len(instanceProfile.Roles) == 0 {
+		_, err = service.AddRoleToInstanceProfile(&iam.AddRoleToInstanceProfileInput{
+			InstanceProfileName: aws.String(roleName),
+			RoleName:            aws.String(roleName),
+		})
+		if err != nil {
+			fmt.Printf("Error adding the role to the instance profile: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	fmt.Printf("Role:             %s\n", roleARN)
+	fmt.Printf("Instance profile: %s\n", aws.StringValue(instanceProfile.Arn))
+	if profile.InstanceProfile != roleName && profile.InstanceProfile != aws.StringValue(instanceProfile.Arn) {
+		fmt.Printf("Set the profile's InstanceProfile to %s to use it.\n", aws.StringValue(instanceProfile.Arn))
+	}
+	return 0
+}
+
+// daemonPolicy returns the statements allowing what the user data has the daemon do. The
+// daemon's own instance and the game's volumes are matched by their game tag, which launch
+// and the daemon put on them, and what the daemon creates must be tagged with it.
+// Lifecycle hooks are only completed in the given Auto Scaling group, if there is one.
+func daemonPolicy(userData *GameServerUserData, roleARN string, autoScalingGroup string) []policyStatement {
+	game := userData.GameName
+	tagged := map[string]map[string]interface{}{
+		"StringEquals": {"aws:ResourceTag/" + tagGame: game},
+	}
+	requestTagged := map[string]map[string]interface{}{
+		"StringEquals": {"aws:RequestTag/" + tagGame: game},
+	}
+
+	statements := []policyStatement{
+		{
+			Effect: "Allow",
+			Action: []string{
+				"ec2:DescribeInstances", "ec2:DescribeInstanceAttribute", "ec2:DescribeVolumes",
+				"ec2:DescribeSnapshots", "ec2:DescribeTags", "ec2:DescribeSpotInstanceRequests",
+				"ec2:DescribeSpotPriceHistory", "ec2:DescribeAvailabilityZones", "ec2:DescribeSubnets",
+				"ec2:DescribeVolumesModifications", "ec2:DescribeFleetInstances", "pricing:GetProducts",
+				"autoscaling:DescribeAutoScalingInstances", "autoscaling:DescribeLifecycleHooks",
+			},
+			Resource: []string{"*"},
+		},
+		{
+			Effect: "Allow",
+			Action: []string{
+				"ec2:AttachVolume", "ec2:DetachVolume", "ec2:ModifyVolume", "ec2:CreateTags",
+				"ec2:DeleteTags", "ec2:TerminateInstances", "ec2:StopInstances", "ec2:DeleteFleets",
+				"ec2:DeleteSnapshot", "ec2:CreateSnapshot", "ec2:CancelSpotInstanceRequests", "ec2:DeleteVolume",
+			},
+			Resource: []string{
+				"arn:aws:ec2:*:*:instance/*", "arn:aws:ec2:*:*:volume/*", "arn:aws:ec2:*:*:fleet/*",
+				"arn:aws:ec2:*::snapshot/*", "arn:aws:ec2:*:*:spot-instances-request/*",
+			},
+			Condition: tagged,
+		},
+		{
+			Effect:   "Allow",
+			Action:   []string{"ssm:GetParameter", "ssm:PutParameter", "ssm:DeleteParameter"},
+			Resource: []string{"arn:aws:ssm:*:*:parameter/aws-spot-game-server/" + game + "/*"},
+		},
+	}
+
+	// Without a group given, any group tagged with the game will do.
+	groups := policyStatement{
+		Effect:    "Allow",
+		Action:    []string{"autoscaling:CompleteLifecycleAction", "autoscaling:TerminateInstanceInAutoScalingGroup"},
+		Resource:  []string{"arn:aws:autoscaling:*:*:autoScalingGroup:*:autoScalingGroupName/*"},
+		Condition: tagged,
+	}
+	if autoScalingGroup != "" {
+		groups.Resource = []string{"arn:aws:autoscaling:*:*:autoScalingGroup:*:autoScalingGroupName/" + autoScalingGroup}
+		groups.Condition = nil
+	}
+	statements = append(statements, groups)
+
+	if userData.HostedZone != "" {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"route53:ChangeResourceRecordSets", "route53:ListResourceRecordSets"},
+			Resource: []string{"arn:aws:route53:::hostedzone/" + strings.TrimPrefix(userData.HostedZone, "/hostedzone/")},
+		}, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"route53:GetChange"},
+			Resource: []string{"arn:aws:route53:::change/*"},
+		})
+	}
+
+	// Parameters can be shared between games, outside the game's own path.
+	parameters := []string{}
+	shared := []string{userData.ReplacementStateParameter}
+	if userData.BudgetTable == "" {
+		shared = append(shared, userData.BudgetParameter)
+	}
+	for _, parameter := range shared {
+		if !strings.HasPrefix(parameter, "/aws-spot-game-server/"+game+"/") {
+			parameters = append(parameters, "arn:aws:ssm:*:*:parameter"+parameter)
+		}
+	}
+	if len(parameters) > 0 {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"ssm:GetParameter", "ssm:PutParameter"},
+			Resource: uniqueStrings(parameters),
+		})
+	}
+
+	// The budget table may hold other budgets too.
+	if userData.BudgetTable != "" {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"dynamodb:GetItem", "dynamodb:UpdateItem"},
+			Resource: []string{"arn:aws:dynamodb:*:*:table/" + userData.BudgetTable},
+			Condition: map[string]map[string]interface{}{
+				"ForAllValues:StringEquals": {"dynamodb:LeadingKeys": []string{userData.BudgetParameter}},
+			},
+		})
+	}
+
+	// Volumes given by ID may not carry the game tag.
+	volumes := []string{}
+	for _, volumeID := range append([]string{userData.VolumeID}, userData.VolumeIDs...) {
+		if volumeID != "" {
+			volumes = append(volumes, "arn:aws:ec2:*:*:volume/"+volumeID)
+		}
+	}
+	if len(volumes) > 0 {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"ec2:AttachVolume", "ec2:DetachVolume", "ec2:ModifyVolume", "ec2:CreateTags", "ec2:CreateSnapshot"},
+			Resource: volumes,
+		})
+	}
+
+	// What the daemon creates has to be tagged with the game as it is created. The snapshots
+	// volumes are created from, and the images, subnets, and so on instances are launched
+	// with, aren't created, so can't be.
+	snapshots := userData.SnapshotOnShutdown || userData.SnapshotInterval > 0 || userData.SnapshotID != "" || len(userData.SnapshotTags) > 0
+	createsVolumes := userData.StorageType == "ebs" && userData.VolumeID == "" && len(userData.VolumeIDs) == 0
+	replaces := userData.ReplaceOnInterruption || userData.RebalanceAction == "replace"
+	creates := []string{}
+	if snapshots {
+		statements = append(statements, policyStatement{
+			Effect:    "Allow",
+			Action:    []string{"ec2:CreateSnapshot"},
+			Resource:  []string{"arn:aws:ec2:*::snapshot/*"},
+			Condition: requestTagged,
+		})
+		creates = append(creates, "CreateSnapshot")
+	}
+	if snapshots || createsVolumes {
+		statements = append(statements, policyStatement{
+			Effect:    "Allow",
+			Action:    []string{"ec2:CreateVolume"},
+			Resource:  []string{"arn:aws:ec2:*:*:volume/*"},
+			Condition: requestTagged,
+		}, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"ec2:CreateVolume"},
+			Resource: []string{"arn:aws:ec2:*::snapshot/*"},
+		})
+		creates = append(creates, "CreateVolume")
+	}
+	if replaces {
+		statements = append(statements, policyStatement{
+			Effect:    "Allow",
+			Action:    []string{"ec2:RunInstances"},
+			Resource:  []string{"arn:aws:ec2:*:*:instance/*"},
+			Condition: requestTagged,
+		}, policyStatement{
+			Effect: "Allow",
+			Action: []string{"ec2:RunInstances"},
+			Resource: []string{
+				"arn:aws:ec2:*::image/*", "arn:aws:ec2:*:*:subnet/*", "arn:aws:ec2:*:*:network-interface/*",
+				"arn:aws:ec2:*:*:security-group/*", "arn:aws:ec2:*:*:key-pair/*", "arn:aws:ec2:*:*:volume/*",
+				"arn:aws:ec2:*:*:spot-instances-request/*",
+			},
+		}, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"iam:PassRole"},
+			Resource: []string{roleARN},
+		})
+		creates = append(creates, "RunInstances")
+	}
+	if len(creates) > 0 {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"ec2:CreateTags"},
+			Resource: []string{"*"},
+			Condition: map[string]map[string]interface{}{
+				"StringEquals": {"ec2:CreateAction": creates},
+			},
+		})
+	}
+
+	// The game storage and the logs can share a bucket, under their own prefixes.
+	buckets := map[string][]string{}
+	if userData.S3Bucket != "" {
+		buckets[userData.S3Bucket] = append(buckets[userData.S3Bucket], userData.S3Prefix)
+	}
+	if userData.LogBucket != "" {
+		buckets[userData.LogBucket] = append(buckets[userData.LogBucket], userData.LogPrefix)
+	}
+	bucketNames := []string{}
+	for bucket := range buckets {
+		bucketNames = append(bucketNames, bucket)
+	}
+	sort.Strings(bucketNames)
+	for _, bucket := range bucketNames {
+		objects := []string{}
+		for _, prefix := range buckets[bucket] {
+			objects = append(objects, "arn:aws:s3:::"+bucket+"/"+strings.TrimPrefix(prefix, "/")+"*")
+		}
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"s3:ListBucket"},
+			Resource: []string{"arn:aws:s3:::" + bucket},
+		}, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject"},
+			Resource: uniqueStrings(objects),
+		})
+	}
+
+	topics := uniqueStrings(nonEmpty(userData.NotifyTopicARN, userData.EventTopicARN))
+	if len(topics) > 0 {
+		statements = append(statements, policyStatement{Effect: "Allow", Action: []string{"sns:Publish"}, Resource: topics})
+	}
+
+	secrets := []string{}
+	for _, secret := range nonEmpty(userData.LUKSKeySecretID, userData.ControlTokenSecretID, userData.DiscordTokenSecretID,
+		userData.SlackSigningSecretID, userData.RCONPasswordSecretID) {
+		if !strings.HasPrefix(secret, "arn:") {
+			// Secret ARNs end in a random suffix.
+			secret = "arn:aws:secretsmanager:*:*:secret:" + secret + "-*"
+		}
+		secrets = append(secrets, secret)
+	}
+	if len(secrets) > 0 {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"secretsmanager:GetSecretValue"},
+			Resource: uniqueStrings(secrets),
+		})
+	}
+	if userData.MetricsNamespace != "" {
+		statements = append(statements, policyStatement{Effect: "Allow", Action: []string{"cloudwatch:PutMetricData"}, Resource: []string{"*"}})
+	}
+	if key := userData.RequiredKMSKeyID; key != "" {
+		// verifyVolumeEncryption resolves the key, which may be given by ID, ARN, or alias.
+		describe := policyStatement{Effect: "Allow", Action: []string{"kms:DescribeKey"}}
+		switch {
+		case strings.HasPrefix(key, "alias/"):
+			describe.Resource = []string{"arn:aws:kms:*:*:key/*"}
+			describe.Condition = map[string]map[string]interface{}{"StringEquals": {"kms:RequestAlias": key}}
+		case strings.HasPrefix(key, "arn:") && strings.Contains(key, ":alias/"):
+			describe.Resource = []string{"arn:aws:kms:*:*:key/*"}
+			describe.Condition = map[string]map[string]interface{}{"StringEquals": {"kms:RequestAlias": key[strings.Index(key, ":alias/")+1:]}}
+		case strings.HasPrefix(key, "arn:"):
+			describe.Resource = []string{key}
+		default:
+			describe.Resource = []string{"arn:aws:kms:*:*:key/" + key}
+		}
+		statements = append(statements, describe)
+	}
+	if userData.LUKSKeyCiphertext != "" {
+		statements = append(statements, policyStatement{Effect: "Allow", Action: []string{"kms:Decrypt"}, Resource: []string{"*"}})
+	}
+
+	queues := []string{}
+	for _, queueURL := range nonEmpty(userData.CommandQueueURL, userData.InterruptionQueueURL) {
+		if arn := queueARN(queueURL); arn != "" {
+			queues = append(queues, arn)
+		}
+	}
+	if len(queues) > 0 {
+		statements = append(statements, policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility"},
+			Resource: uniqueStrings(queues),
+		})
+	}
+
+	return statements
+}
+
+// queueARN returns the ARN of the SQS queue at the URL, like
+// https://sqs.us-east-1.amazonaws.com/123456789012/queue, or "" if it isn't one.
+func queueARN(queueURL string) string {
+	parsed, err := url.Parse(queueURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.Split(parsed.Host, ".")
+	path := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(host) < 3 || host[0] != "sqs" || len(path) != 2 {
+		return ""
+	}
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", host[1], path[0], path[1])
+}
+
+// nonEmpty returns the values that aren't empty.
+func nonEmpty(values ...string) []string {
+	kept := []string{}
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+// uniqueStrings returns the values without repeats, in their first order.
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// sortedKeys returns the map's keys in order.
+func sortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestQueueARN(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/game", "arn:aws:sqs:us-east-1:123456789012:game"},
+		{"https://sqs.eu-west-2.amazonaws.com/123456789012/game.fifo/", "arn:aws:sqs:eu-west-2:123456789012:game.fifo"},
+		{"https://queue.amazonaws.com/123456789012/game", ""},
+		{"https://sqs.us-east-1.amazonaws.com/game", ""},
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/game/extra", ""},
+		{"not a url", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := queueARN(test.url); got != test.want {
+			t.Errorf("queueARN(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestDaemonPolicyBuckets(t *testing.T) {
+	userData := &GameServerUserData{
+		GameName: "test", S3Bucket: "games", S3Prefix: "world/", LogBucket: "games", LogPrefix: "/logs/",
+		RequiredKMSKeyID: "alias/games",
+	}
+	statements := daemonPolicy(userData, "arn:aws:iam::123456789012:role/test", "")
+
+	objects := map[string]bool{}
+	describeKey := false
+	for _, statement := range statements {
+		for _, action := range statement.Action {
+			switch action {
+			case "s3:PutObject":
+				for _, resource := range statement.Resource {
+					objects[resource] = true
+				}
+			case "kms:DescribeKey":
+				describeKey = statement.Condition["StringEquals"]["kms:RequestAlias"] == "alias/games"
+			}
+		}
+	}
+
+	for _, want := range []string{"arn:aws:s3:::games/world/*", "arn:aws:s3:::games/logs/*"} {
+		if !objects[want] {
+			t.Errorf("no s3:PutObject on %s, got %v", want, objects)
+		}
+	}
+	if !describeKey {
+		t.Errorf("no kms:DescribeKey on the alias")
+	}
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// idleChecker is a configured idle probe.
+type idleChecker interface {
+	// check returns whether the game is idle and how many players are online, or -1 if the
+	// probe can't tell.
+	check() (bool, int, error)
+}
+
+// scriptChecker runs the idle script. Exit status 0 means idle and any other status means
+// active. The script timing out, being killed, or not running at all is a failure, handled
+// as the failure policy says. The script can also print the number of players online.
+type scriptChecker struct {
+	userData *GameServerUserData
+	pattern  *regexp.Regexp
+	sess     *session.Session
+}
+
+func (c *scriptChecker) check() (bool, int, error) {
+	output, timedOut, err := runIdleScript(c.userData.IdlePath, time.Duration(c.userData.IdleScriptTimeout)*time.Second)
+	if timedOut {
+		err = fmt.Errorf("idle script timed out after %d seconds", c.userData.IdleScriptTimeout)
+	} else if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		return false, c.players(output), nil
+	} else if err != nil {
+		err = fmt.Errorf("idle script failed: %s", err.Error())
+	} else {
+		return true, c.players(output), nil
+	}
+
+	switch c.userData.IdleScriptFailure {
+	case "count":
+		fmt.Printf("%s, counting it as idle.\n", err.Error())
+		return true, -1, nil
+	case "alert":
+		notify(c.userData, c.sess, "Idle script failed", err.Error())
+	}
+	return false, -1, err
+}
+
+// runIdleScript runs the idle script in its own process group and returns what it printed.
+// Anything it started is killed with it, whether it times out or not, since something left
+// holding its output open would otherwise keep the check waiting.
+func runIdleScript(path string, timeout time.Duration) ([]byte, bool, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	cmd := exec.Command(path)
+	cmd.Stdout = writer
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		return nil, false, err
+	}
+
+	output := &bytes.Buffer{}
+	read := make(chan struct{})
+	go func() {
+		io.Copy(output, reader)
+		close(read)
+	}()
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- cmd.Wait()
+	}()
+
+	timedOut := false
+	select {
+	case err = <-waited:
+	case <-time.After(timeout):
+		timedOut = true
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		err = <-waited
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	// Something that left the process group can still hold the output open, so don't
+	// wait on it for long.
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		reader.Close()
+		<-read
+	}
+	return output.Bytes(), timedOut, err
+}
+
+// players reads the player count the script printed, or returns -1 if it didn't print one.
+// With a pattern its first group is the count, otherwise the output has to be just a number.
+func (c *scriptChecker) players(output []byte) int {
+	if c.pattern != nil {
+		players, err := parsePlayerCount(c.pattern, string(output))
+		if err != nil {
+			return -1
+		}
+		return players
+	}
+
+	players, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || players < 0 {
+		return -1
+	}
+	return players
+}
+
+// tcpChecker counts established TCP connections to the game ports.
+type tcpChecker struct {
+	ports []int
+}
+
+func (c *tcpChecker) check() (bool, int, error) {
+	count, err := countConnections(c.ports)
+	if err != nil {
+		return false, -1, err
+	}
+
+	return count == 0, count, nil
+}
+
+// countConnections counts the established TCP connections, over IPv4 and IPv6, whose local
+// port is one of the ports.
+func countConnections(ports []int) (int, error) {
+	wanted := map[int64]bool{}
+	for _, port := range ports {
+		wanted[int64(port)] = true
+	}
+
+	count := 0
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		contents, err := ioutil.ReadFile(table)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// No IPv6.
+				continue
+			}
+			return 0, fmt.Errorf("error reading %s: %s", table, err.Error())
+		}
+
+		// Skip the header. The local address is ip:port in hex and state 01 is established.
+		lines := strings.Split(string(contents), "\n")
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[3] != "01" {
+				continue
+			}
+
+			colon := strings.LastIndex(fields[1], ":")
+			if colon < 0 {
+				continue
+			}
+
+			port, err := strconv.ParseInt(fields[1][colon+1:], 16, 64)
+			if err == nil && wanted[port] {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// setIdleProbeDefaults fills in a probe's name, how long it needs to be idle, and what it
+// queries.
+func setIdleProbeDefaults(probe *IdleProbe) {
+	if probe.Name == "" {
+		probe.Name = probe.Type
+	}
+
+	if probe.Intervals <= 0 {
+		probe.Intervals = 1
+	}
+
+	if probe.Type == "rcon" && probe.Command == "" {
+		probe.Command = "list"
+	}
+
+	if probe.Type == "network" && probe.BytesPerSecond <= 0 {
+		probe.BytesPerSecond = 2048
+	}
+
+	if probe.Type == "cpu" && probe.CPUPercent <= 0 {
+		probe.CPUPercent = 5
+	}
+
+	if probe.Address == "" {
+		switch probe.Type {
+		case "minecraft":
+			probe.Address = "127.0.0.1:25565"
+		case "a2s":
+			probe.Address = "127.0.0.1:27015"
+		}
+	}
+}
+
+// validateIdleProbe makes sure an idle probe can be run.
+func validateIdleProbe(userData *GameServerUserData, probe IdleProbe) error {
+	if probe.Pattern != "" {
+		_, err := regexp.Compile(probe.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid %s idle probe pattern: %s", probe.Name, err.Error())
+		}
+	}
+
+	switch probe.Type {
+	case "script":
+		if userData.IdlePath == "" {
+			return fmt.Errorf("script idle probes need an idle path")
+		}
+	case "tcp":
+		if len(probe.Ports) == 0 {
+			return fmt.Errorf("tcp idle probes need ports")
+		}
+	case "rcon":
+		if !rconEnabled(userData) {
+			return fmt.Errorf("rcon idle probes need an RCON password")
+		}
+	case "cpu":
+	case "network":
+		for _, port := range probe.Ports {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("invalid network idle probe port: %d", port)
+			}
+		}
+	case "minecraft", "a2s":
+		_, _, err := net.SplitHostPort(probe.Address)
+		if err != nil {
+			return fmt.Errorf("invalid %s idle probe address: %s", probe.Type, err.Error())
+		}
+	default:
+		return fmt.Errorf("unknown idle probe: %s", probe.Type)
+	}
+
+	return nil
+}
+
+// newIdleChecker returns the checker for a validated probe, setting up anything it needs.
+func newIdleChecker(userData *GameServerUserData, probe IdleProbe, sess *session.Session) (idleChecker, error) {
+	switch probe.Type {
+	case "tcp":
+		return &tcpChecker{ports: probe.Ports}, nil
+	case "minecraft":
+		return &minecraftChecker{address: probe.Address}, nil
+	case "a2s":
+		return &a2sChecker{address: probe.Address}, nil
+	case "rcon":
+		pattern := firstNumber
+		if probe.Pattern != "" {
+			pattern = regexp.MustCompile(probe.Pattern)
+		}
+		return &rconChecker{userData: userData, command: probe.Command, pattern: pattern}, nil
+	case "network":
+		checker := &networkChecker{iface: probe.Interface, ports: probe.Ports, bytesPerSecond: probe.BytesPerSecond}
+		if len(probe.Ports) > 0 {
+			err := setUpAccounting(probe.Ports)
+			if err != nil {
+				return nil, err
+			}
+		} else if checker.iface == "" {
+			iface, err := defaultInterface()
+			if err != nil {
+				return nil, err
+			}
+			checker.iface = iface
+		}
+		return checker, nil
+	case "cpu":
+		return &cpuChecker{userData: userData, percent: probe.CPUPercent}, nil
+	default:
+		checker := &scriptChecker{userData: userData, sess: sess}
+		if probe.Pattern != "" {
+			checker.pattern = regexp.MustCompile(probe.Pattern)
+		}
+		return checker, nil
+	}
+}
+
+// idleProbeState is a probe being checked, with how many checks in a row it has found the
+// game idle.
+type idleProbeState struct {
+	name      string
+	checker   idleChecker
+	intervals int
+	streak    int
+}
+
+// idleGame is a game being checked for idle, with its probes and the rule deciding from
+// them whether it is idle.
+type idleGame struct {
+	userData *GameServerUserData
+	probes   []*idleProbeState
+	rule     idleRule
+}
+
+// newIdleGame sets up the game's probes. It returns nil if the game can't be checked or
+// stopped, so it would never be shut down and neither would the instance.
+func newIdleGame(userData *GameServerUserData, sess *session.Session) *idleGame {
+	if len(userData.IdleProbes) == 0 {
+		return nil
+	}
+
+	game := &idleGame{userData: userData}
+	names := map[string]bool{}
+	for _, probe := range userData.IdleProbes {
+		if probe.Type == "script" {
+			_, err := os.Stat(userData.IdlePath)
+			if err != nil {
+				// If the idle path doesn't exit, no reason to run the goroutine
+				return nil
+			}
+		}
+		checker, err := newIdleChecker(userData, probe, sess)
+		if err != nil {
+			// Without all of the probes the game could be shut down while it's in use.
+			fmt.Printf("Error setting up %s idle probe, not checking for idle: %s\n", probe.Name, err.Error())
+			return nil
+		}
+		game.probes = append(game.probes, &idleProbeState{name: probe.Name, checker: checker, intervals: probe.Intervals})
+		names[probe.Name] = true
+	}
+
+	if userData.IdleRule != "" {
+		// Already validated.
+		game.rule, _ = parseIdleRule(userData.IdleRule, names)
+	}
+
+	_, err := os.Stat(userData.StopPath)
+	if err != nil && userData.StopSignal == "" {
+		// if the game can't be stopped, no reason to run the goroutine
+		return nil
+	}
+
+	return game
+}
+
+// checkIdle checks whether the games are idle every IdleInterval seconds, and shuts down
+// and terminates the instance once they have all been idle IdleConsecutiveTimesForShutdown
+// times in a row.
+func checkIdle(userData *GameServerUserData, instanceID string, metadata *ec2metadata.EC2Metadata, sess *session.Session) {
+	idleGames := []*idleGame{}
+	for _, data := range userData.games {
+		game := newIdleGame(data, sess)
+		if game == nil {
+			return
+		}
+		idleGames = append(idleGames, game)
+	}
+
+	if userData.KeepAliveAddress != "" {
+		serveKeepAlive(userData)
+	}
+
+	// Spin this off in a goroutine
+	go func() {
+		started := time.Now()
+		graceEnd := started.Add(time.Duration(userData.IdleGracePeriod) * time.Second)
+		count := 0
+		for {
+			idle, players := checkGames(idleGames)
+			if sessions != nil && userData.SessionSource == "probe" {
+				sessions.updateFromProbes(allProbes(idleGames))
+			}
+
+			if time.Now().Before(graceEnd) {
+				// The probes still run, so the ones comparing against the last check are
+				// ready when the grace period ends.
+				fmt.Printf("Game server starting up%s, not counting for another %s.\n",
+					describePlayers(players), time.Until(graceEnd).Round(time.Second))
+			} else if until := keptAlive(userData); !until.IsZero() {
+				fmt.Printf("Game server %s%s, but kept alive until %s.\n",
+					idleState(idle), describePlayers(players), until.Format(time.RFC3339))
+				count = 0
+			} else if blackout := activeBlackout(userData.IdleBlackouts, time.Now()); blackout != nil {
+				fmt.Printf("Game server %s%s, but idle shutdown is blacked out until %s.\n",
+					idleState(idle), describePlayers(players), blackout.End)
+				count = 0
+			} else if !idle {
+				// Game server is not idle, reset the count.
+				fmt.Printf("Game server active%s, resetting count.\n", describePlayers(players))
+				count = 0
+			} else {
+				// Game server is idle, increment the count and check the threshold.
+				fmt.Printf("Game server idle%s, incrementing count.\n", describePlayers(players))
+				count = count + 1
+				if count >= userData.IdleConsecutiveTimesForShutdown && !warnIdleShutdown(userData, idleGames) {
+					fmt.Println("Game server active again, idle shutdown cancelled.")
+					count = 0
+				} else if count >= userData.IdleConsecutiveTimesForShutdown && userData.IdleAction == "hibernate" && hibernateIdle(userData, instanceID, metadata, sess) {
+					count = 0
+				} else if count >= userData.IdleConsecutiveTimesForShutdown {
+					// We have been idle too long. Shutdown.
+					shuttingDown.Add(1)
+					defer shuttingDown.Done()
+
+					idleShutdown(userData, instanceID, sess)
+					return
+				}
+			}
+
+			updateStatus(func(status *daemonStatus) {
+				status.Players = players
+				status.IdleCount = count
+			})
+			watchEvent(userData, "idle-tick", fmt.Sprintf("Game server %s%s, idle count %d of %d.",
+				idleState(idle), describePlayers(players), count, userData.IdleConsecutiveTimesForShutdown),
+				map[string]string{"idle": strconv.FormatBool(idle), "players": strconv.Itoa(players), "count": strconv.Itoa(count)})
+			if userData.MetricsNamespace != "" {
+				putIdleMetrics(userData, sess, idle, players, count, time.Since(started))
+			}
+			time.Sleep(time.Duration(userData.IdleInterval) * time.Second)
+		}
+	}()
+}
+
+// warnIdleShutdown warns the players of the coming idle shutdown, then keeps checking the
+// probes for the warning period. It returns false if a game turned active, calling the
+// shutdown off.
+func warnIdleShutdown(userData *GameServerUserData, idleGames []*idleGame) bool {
+	if userData.IdleWarningPeriod <= 0 {
+		return true
+	}
+
+	end := time.Now().Add(time.Duration(userData.IdleWarningPeriod) * time.Second)
+	interval := 10 * time.Second
+	if userData.IdleInterval < 10 {
+		interval = time.Duration(userData.IdleInterval) * time.Second
+	}
+
+	// Warn straight away, then every minute.
+	var lastWarning time.Time
+	for time.Until(end) > 0 {
+		if time.Since(lastWarning) >= time.Minute {
+			message := strings.Replace(userData.IdleWarningMessage, "{remaining}", describeRemaining(time.Until(end)), -1)
+			err := rconEveryGame(userData, userData.RCONSayCommand+" "+message)
+			if err != nil {
+				fmt.Printf("Error warning players: %s\n", err.Error())
+			}
+			lastWarning = time.Now()
+		}
+
+		time.Sleep(interval)
+
+		idle, _ := checkGames(idleGames)
+		if !idle {
+			err := rconEveryGame(userData, userData.RCONSayCommand+" Shutdown cancelled.")
+			if err != nil {
+				fmt.Printf("Error telling players: %s\n", err.Error())
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// describeRemaining describes the time left in a warning, rounded to minutes until the
+// last one.
+func describeRemaining(remaining time.Duration) string {
+	if remaining > time.Minute {
+		minutes := int((remaining + 30*time.Second) / time.Minute)
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	return fmt.Sprintf("%d seconds", int(remaining.Seconds()+0.5))
+}
+
+// checkProbes runs every probe and returns whether the rule, or every probe without one,
+// finds the game idle, along with the highest player count any of them reported. A probe
+// that fails makes the game count as active, so a broken probe never shuts the game down.
+func checkProbes(probes []*idleProbeState, rule idleRule) (bool, int) {
+	idle := map[string]bool{}
+	failed := false
+	allIdle := true
+	players := -1
+	for _, probe := range probes {
+		probeIdle, probePlayers, err := probe.checker.check()
+		if err != nil {
+			fmt.Printf("Error checking %s idle probe: %s\n", probe.name, err.Error())
+			failed = true
+			probeIdle = false
+		}
+
+		if probeIdle {
+			probe.streak++
+		} else {
+			probe.streak = 0
+		}
+		idle[probe.name] = probe.streak >= probe.intervals
+		if !idle[probe.name] {
+			allIdle = false
+		}
+
+		if probePlayers > players {
+			players = probePlayers
+		}
+	}
+
+	if failed {
+		return false, players
+	}
+	if rule == nil {
+		return allIdle, players
+	}
+	return rule.eval(idle), players
+}
+
+// checkGames checks every game, and returns whether they are all idle along with the total
+// player count they reported, or -1 if none did.
+func checkGames(idleGames []*idleGame) (bool, int) {
+	allIdle := true
+	total := -1
+	for _, game := range idleGames {
+		idle, players := checkProbes(game.probes, game.rule)
+		if len(idleGames) > 1 {
+			fmt.Printf("%s %s%s.\n", game.userData.GameName, idleState(idle), describePlayers(players))
+		}
+
+		if !idle {
+			allIdle = false
+		}
+		if players >= 0 {
+			if total < 0 {
+				total = 0
+			}
+			total += players
+		}
+	}
+	return allIdle, total
+}
+
+// allProbes returns the probes of every game.
+func allProbes(idleGames []*idleGame) []*idleProbeState {
+	probes := []*idleProbeState{}
+	for _, game := range idleGames {
+		probes = append(probes, game.probes...)
+	}
+	return probes
+}
+
+// idleState describes whether the game is idle for the log.
+func idleState(idle bool) string {
+	if idle {
+		return "idle"
+	}
+	return "active"
+}
+
+// describePlayers describes a player count for the log, or nothing if it isn't known.
+func describePlayers(players int) string {
+	if players < 0 {
+		return ""
+	}
+	if players == 1 {
+		return " with 1 player"
+	}
+	return fmt.Sprintf(" with %d players", players)
+}
+
+// hibernateIdle hibernates the instance with the game still running, so it carries on where
+// it left off when the instance is started again, and returns true once it has resumed. It
+// returns false if the instance can't hibernate, and the game should be shut down instead.
+func hibernateIdle(userData *GameServerUserData, instanceID string, metadata *ec2metadata.EC2Metadata, sess *session.Session) bool {
+	runIdleHooks(userData, instanceID)
+
+	configured, err := metadata.GetMetadata("hibernation/configured")
+	if err != nil || configured != "true" {
+		fmt.Println("Instance wasn't launched with hibernation enabled, stopping it instead.")
+		return false
+	}
+
+	err = rconEveryGame(userData, userData.RCONSaveCommand)
+	if err != nil {
+		fmt.Printf("Error saving world: %s\n", err.Error())
+	}
+
+	fmt.Println("Game server has been idle too long. Hibernating.")
+	setStatusState("hibernating")
+	publishEvent(userData, instanceID, sess, "hibernating", "Hibernating the instance after the game went idle.", nil)
+	err = stopInstance(instanceID, true, sess)
+	if err != nil {
+		fmt.Printf("%s, stopping it instead.\n", err.Error())
+		return false
+	}
+
+	resumeAfterHibernation(userData, metadata, sess)
+	return true
+}
+
+// idleShutdown stops the idle game, cleans up, and terminates or stops the instance.
+func idleShutdown(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	fmt.Printf("Game server has been idle too long. Calling stop and exiting.\n")
+	setStatusState("shutting-down")
+
+	// Hibernating already ran the hooks before falling back to stopping.
+	if userData.IdleAction != "hibernate" {
+		runIdleHooks(userData, instanceID)
+	}
+
+	if userData.IdleAction == "stop" || userData.IdleAction == "hibernate" {
+		// The instance starts again with the volume still attached.
+		keepAttached = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	err := stopGame(ctx, userData)
+	cancel()
+	if err != nil {
+		fmt.Printf("Error calling stop: %s\n", err.Error())
+	} else {
+		publishEvent(userData, instanceID, sess, "stopped", "The idle game server stopped cleanly.", nil)
+	}
+
+	// Game logs are usually on the game volume, so they have to go before the snapshot
+	// unmounts it.
+	if userData.LogBucket != "" {
+		ctx, cancel = context.WithTimeout(context.Background(), 1*time.Minute)
+		err = uploadLogs(ctx, userData, instanceID, sess)
+		cancel()
+		if err != nil {
+			fmt.Printf("Error uploading logs: %s\n", err.Error())
+		}
+	}
+
+	if userData.SnapshotOnShutdown {
+		err = snapshotOnShutdown(userData, "idle shutdown", sess)
+		if err != nil {
+			fmt.Printf("Error taking shutdown snapshot: %s\n", err.Error())
+		}
+	}
+
+	// Release the volume before terminating, since termination takes this process with it.
+	releaseVolume(userData, instanceID, sess)
+
+	if userData.IdleAction == "stop" || userData.IdleAction == "hibernate" {
+		publishEvent(userData, instanceID, sess, "stopping", "Stopping the instance after the game went idle.", nil)
+		err = stopInstance(instanceID, false, sess)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	// Terminate the instance as well.
+	publishEvent(userData, instanceID, sess, "terminating", "Terminating the instance after the game went idle.", nil)
+	terminateInstance(userData, instanceID, false, sess)
+}
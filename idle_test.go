@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunIdleScript(t *testing.T) {
+	directory, err := ioutil.TempDir("", "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	tests := []struct {
+		name     string
+		script   string
+		output   string
+		timedOut bool
+		exitCode int
+	}{
+		{name: "idle", script: "echo 3", output: "3\n"},
+		{name: "active", script: "echo 1; exit 1", output: "1\n", exitCode: 1},
+		// The shell runs sleep as a child, which holds the output open.
+		{name: "hung child", script: "sleep 6; echo 0", timedOut: true, exitCode: -1},
+		{name: "lingering child", script: "sleep 6 & echo 2", output: "2\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(directory, "idle.sh")
+			err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+test.script+"\n"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			output, timedOut, err := runIdleScript(path, time.Second)
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("took %s", elapsed)
+			}
+			if string(output) != test.output || timedOut != test.timedOut {
+				t.Errorf("got %q timed out %t, want %q timed out %t", output, timedOut, test.output, test.timedOut)
+			}
+
+			exitCode := 0
+			if exitErr, ok := err.(interface{ ExitCode() int }); ok {
+				exitCode = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if exitCode != test.exitCode {
+				t.Errorf("exit code %d, want %d", exitCode, test.exitCode)
+			}
+		})
+	}
+}
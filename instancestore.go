@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// instanceStoreModel is the NVMe model number instance store drives report.
+const instanceStoreModel = "Amazon EC2 NVMe Instance Storage"
+
+// findInstanceStoreDevices returns the instance's local NVMe drives.
+func findInstanceStoreDevices() []string {
+	devices := []string{}
+
+	namespaces, _ := filepath.Glob("/sys/block/nvme*n1")
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		contents, err := ioutil.ReadFile(filepath.Join(namespace, "device", "model"))
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimSpace(string(contents)) == instanceStoreModel {
+			devices = append(devices, filepath.Join("/dev", filepath.Base(namespace)))
+		}
+	}
+
+	return devices
+}
+
+// mountInstanceStore formats the first instance store drive if it is blank, which it is
+// on every fresh launch, and mounts it as the game directory.
+func mountInstanceStore(userData *GameServerUserData) error {
+	mounted, err := isMounted(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		fmt.Println("Instance store is already mounted.")
+		return nil
+	}
+
+	devices := findInstanceStoreDevices()
+	if len(devices) == 0 {
+		return fmt.Errorf("no instance store drives found")
+	}
+	deviceFile := devices[0]
+	fmt.Printf("Using instance store drive %s.\n", deviceFile)
+
+	formatted, err := hasFileSystem(deviceFile)
+	if err != nil {
+		return err
+	}
+
+	if !formatted {
+		err = formatDevice(deviceFile, userData.FileSystemType)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = createMountPoint()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Mounting %s instance store.\n", userData.FileSystemType)
+	flags, data := parseMountOptions(userData.MountOptions)
+	err = syscall.Mount(deviceFile, mountPoint, userData.FileSystemType, flags, data)
+	if err != nil {
+		return fmt.Errorf("error mounting instance store: %s", err.Error())
+	}
+
+	fmt.Println("Instance store mounted.")
+	return nil
+}
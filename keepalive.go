@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keepAliveMu guards keepAliveUntil, the time the last keep alive request holds the game up
+// until.
+var keepAliveMu sync.Mutex
+var keepAliveUntil time.Time
+
+// keepAlive holds the game up for the duration.
+func keepAlive(duration time.Duration) time.Time {
+	keepAliveMu.Lock()
+	defer keepAliveMu.Unlock()
+
+	until := time.Now().Add(duration)
+	if until.After(keepAliveUntil) {
+		keepAliveUntil = until
+	}
+	return keepAliveUntil
+}
+
+// keptAlive returns when the game is being held up until, or the zero time if it isn't. The
+// keep alive file counts from the last time it was touched.
+func keptAlive(userData *GameServerUserData) time.Time {
+	keepAliveMu.Lock()
+	until := keepAliveUntil
+	keepAliveMu.Unlock()
+
+	if userData.KeepAliveFile != "" {
+		info, err := os.Stat(userData.KeepAliveFile)
+		if err == nil {
+			fileUntil := info.ModTime().Add(time.Duration(userData.KeepAliveDuration) * time.Second)
+			if fileUntil.After(until) {
+				until = fileUntil
+			}
+		}
+	}
+
+	if until.Before(time.Now()) {
+		return time.Time{}
+	}
+	return until
+}
+
+// serveKeepAlive serves the keep alive endpoint. A POST to /keepalive with the token as a
+// bearer token holds the game up for KeepAliveDuration seconds, or the seconds in the
+// duration parameter.
+func serveKeepAlive(userData *GameServerUserData) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keepalive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		expected := []byte("Bearer " + userData.KeepAliveToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		duration := time.Duration(userData.KeepAliveDuration) * time.Second
+		if value := r.FormValue("duration"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				http.Error(w, "duration must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+
+		until := keepAlive(duration)
+		fmt.Printf("Kept alive until %s.\n", until.Format(time.RFC3339))
+		fmt.Fprintf(w, "kept alive until %s\n", until.UTC().Format(time.RFC3339))
+	})
+
+	go func() {
+		err := http.ListenAndServe(userData.KeepAliveAddress, mux)
+		if err != nil {
+			fmt.Printf("Error serving keep alive endpoint: %s\n", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// runLaunch launches a spot instance for the game in a launch profile, or a fleet keeping
+// one running, and waits for it to come up. It is run from a workstation as
+// "aws-spot-game-server launch -profile <name>", and returns the exit status.
+func runLaunch(args []string) int {
+	flags := flag.NewFlagSet("launch", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	force := flags.Bool("force", false, "launch even if the game already has an instance")
+	wait := flags.Duration("wait", 10*time.Minute, "how long to wait for the instance to run, 0 to not wait")
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	service := ec2.New(sess)
+	game := profile.gameData.GameName
+
+	if !*force {
+		existing, err := findGameInstances(service, game)
+		if err != nil {
+			fmt.Printf("Error looking for instances: %s\n", err.Error())
+			return 1
+		}
+		if len(existing) > 0 {
+			fmt.Printf("%s already has instance %s (%s). Use -force to launch another.\n",
+				game, aws.StringValue(existing[0].InstanceId), aws.StringValue(existing[0].State.Name))
+			return 1
+		}
+	}
+
+	err = checkBudget(profile.gameData, sess)
+	if err == nil {
+		err = profile.resolveAMI(sess)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	var instanceID string
+	if profile.Fleet {
+		instanceID, err = launchFleet(service, profile)
+	} else {
+		instanceID, err = launchCheapest(sess, service, profile)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Launched %s.\n", instanceID)
+
+	if *wait == 0 {
+		return 0
+	}
+
+	instance, err := waitForRunning(service, instanceID, *wait)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	fmt.Printf("%s is running in %s", instanceID, aws.StringValue(instance.Placement.AvailabilityZone))
+	if instance.PublicIpAddress != nil {
+		fmt.Printf(" at %s", aws.StringValue(instance.PublicIpAddress))
+	}
+	fmt.Println(".")
+	fmt.Printf("The game will be at %s once the daemon has set DNS and started it.\n", strings.TrimSuffix(profile.gameData.DNSName, "."))
+	return 0
+}
+
+// launchCheapest launches the cheapest spot option for the profile, moving on to the next
+// when one has no capacity, and falling back to on-demand when the user data allows it.
+// It returns the instance's ID.
+func launchCheapest(sess *session.Session, service *ec2.EC2, profile *LaunchProfile) (string, error) {
+	err := profile.resolveInstanceTypes(service)
+	if err != nil {
+		return "", err
+	}
+
+	options, err := rankSpotOptions(service, profile)
+	if err != nil {
+		if len(profile.candidateTypes()) > 1 || len(profile.SubnetIDs) > 1 {
+			return "", err
+		}
+		// Nothing to choose between, so launch as configured without the prices.
+		fmt.Printf("Error checking spot prices: %s\n", err.Error())
+		options = []spotOption{{InstanceType: profile.candidateTypes()[0], SubnetID: profile.SubnetID}}
+	} else {
+		fmt.Println("Spot options, best first:")
+		for _, option := range options {
+			fmt.Printf("  %s\n", describeSpotOption(option))
+		}
+	}
+
+	var instance *ec2.Instance
+	for _, option := range options {
+		fmt.Printf("Launching %s %s spot instance for %s.\n", option.InstanceType, profile.image, profile.gameData.GameName)
+		instance, err = launchSpot(service, profile, option)
+		if err == nil {
+			break
+		}
+		if !capacityError(err) {
+			return "", err
+		}
+		fmt.Println(err.Error())
+	}
+
+	fallback := profile.gameData.OnDemandFallback
+	if instance != nil && fallback {
+		// A spot instance can still be terminated for want of capacity before it runs.
+		spotID := aws.StringValue(instance.InstanceId)
+		instance, err = waitForRunning(service, spotID, time.Duration(profile.SpotTimeout)*time.Second)
+		if err != nil {
+			fmt.Println(err.Error())
+			_, err = service.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String(spotID)}})
+			if err != nil {
+				fmt.Printf("Error terminating %s: %s\n", spotID, err.Error())
+			}
+		}
+	}
+	if instance == nil && fallback {
+		instance, err = launchProfileOnDemand(sess, service, profile, options)
+		if err != nil {
+			return "", err
+		}
+		notify(profile.gameData, sess, "Fell back to on-demand",
+			fmt.Sprintf("Spot capacity wasn't available, so %s was launched on demand.", aws.StringValue(instance.InstanceId)))
+	}
+	if instance == nil {
+		return "", fmt.Errorf("no spot capacity in any of the options")
+	}
+	return aws.StringValue(instance.InstanceId), nil
+}
+
+// launchSpot requests a spot instance of the option's type in its subnet, otherwise as the
+// profile describes, with the profile's user data. The request is one-time unless the
+// profile is persistent.
+func launchSpot(service *ec2.EC2, profile *LaunchProfile, option spotOption) (*ec2.Instance, error) {
+	input, err := launchInput(service, profile)
+	if err != nil {
+		return nil, err
+	}
+	input.InstanceType = aws.String(option.InstanceType)
+	if option.SubnetID != "" {
+		input.SubnetId = aws.String(option.SubnetID)
+	}
+	input.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{
+		MarketType: aws.String(ec2.MarketTypeSpot),
+		SpotOptions: &ec2.SpotMarketOptions{
+			SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+			InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+		},
+	}
+	if profile.MaxPrice != "" {
+		input.InstanceMarketOptions.SpotOptions.MaxPrice = aws.String(profile.MaxPrice)
+	}
+	if profile.Persistent {
+		input.InstanceMarketOptions.SpotOptions.SpotInstanceType = aws.String(ec2.SpotInstanceTypePersistent)
+		input.InstanceMarketOptions.SpotOptions.InstanceInterruptionBehavior = aws.String(ec2.InstanceInterruptionBehaviorStop)
+	}
+	// The daemon may only cancel spot requests tagged with its game.
+	input.TagSpecifications = append(input.TagSpecifications, &ec2.TagSpecification{
+		ResourceType: aws.String(ec2.ResourceTypeSpotInstancesRequest),
+		Tags:         []*ec2.Tag{{Key: aws.String(tagGame), Value: aws.String(profile.gameData.GameName)}},
+	})
+
+	reservation, err := service.RunInstances(input)
+	if err != nil {
+		return nil, fmt.Errorf("error launching instance: %w", err)
+	}
+	return reservation.Instances[0], nil
+}
+
+// launchProfileOnDemand launches the best option's instance type on demand, trying the
+// subnets it was offered in.
+func launchProfileOnDemand(sess *session.Session, service *ec2.EC2, profile *LaunchProfile, options []spotOption) (*ec2.Instance, error) {
+	input, err := launchInput(service, profile)
+	if err != nil {
+		return nil, err
+	}
+	input.InstanceType = aws.String(options[0].InstanceType)
+
+	subnets := []string{}
+	for _, option := range options {
+		if option.InstanceType == options[0].InstanceType {
+			subnets = append(subnets, option.SubnetID)
+		}
+	}
+
+	reservation, err := launchOnDemand(sess, service, input, subnets, profile.gameData.OnDemandMaxPrice)
+	if err != nil {
+		return nil, err
+	}
+	return reservation.Instances[0], nil
+}
+
+// capacityError reports whether the launch failed for want of spot capacity at the price, so
+// another type or zone might succeed.
+func capacityError(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case "InsufficientInstanceCapacity", "SpotMaxPriceTooLow", "Unsupported":
+		return true
+	}
+	return false
+}
+
+// launchInput is the request for an instance as the profile describes, before choosing how
+// it is paid for.
+func launchInput(service *ec2.EC2, profile *LaunchProfile) (*ec2.RunInstancesInput, error) {
+	game := profile.gameData.GameName
+	tags := []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String(game)},
+		{Key: aws.String(tagGame), Value: aws.String(game)},
+	}
+	keys := []string{}
+	for key := range profile.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(profile.Tags[key])})
+	}
+
+	input := &ec2.RunInstancesInput{
+		ImageId:      aws.String(profile.image),
+		InstanceType: aws.String(profile.InstanceType),
+		UserData:     aws.String(base64.StdEncoding.EncodeToString(profile.UserData)),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+		TagSpecifications: []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: tags},
+		},
+	}
+	if profile.SubnetID != "" {
+		input.SubnetId = aws.String(profile.SubnetID)
+	}
+	if profile.KeyName != "" {
+		input.KeyName = aws.String(profile.KeyName)
+	}
+	if len(profile.SecurityGroupIDs) > 0 {
+		input.SecurityGroupIds = aws.StringSlice(profile.SecurityGroupIDs)
+	}
+	if strings.HasPrefix(profile.InstanceProfile, "arn:") {
+		input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(profile.InstanceProfile)}
+	} else if profile.InstanceProfile != "" {
+		input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Name: aws.String(profile.InstanceProfile)}
+	}
+	if profile.RootVolumeSize > 0 {
+		// The root device's name depends on the AMI.
+		images, err := service.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(profile.image)}})
+		if err != nil {
+			return nil, fmt.Errorf("error describing AMI: %s", err.Error())
+		}
+		if len(images.Images) == 0 {
+			return nil, fmt.Errorf("AMI %s not found", profile.image)
+		}
+
+		input.BlockDeviceMappings = []*ec2.BlockDeviceMapping{
+			{
+				DeviceName: images.Images[0].RootDeviceName,
+				Ebs: &ec2.EbsBlockDevice{
+					VolumeSize:          aws.Int64(profile.RootVolumeSize),
+					VolumeType:          aws.String(ec2.VolumeTypeGp3),
+					DeleteOnTermination: aws.Bool(true),
+				},
+			},
+		}
+	}
+	return input, nil
+}
+
+// findGameInstances returns the game's instances that haven't been terminated, found by
+// their game tag.
+func findGameInstances(service *ec2.EC2, game string) ([]*ec2.Instance, error) {
+	found := []*ec2.Instance{}
+	err := service.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + tagGame), Values: []*string{aws.String(game)}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"})},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, reservation := range page.Reservations {
+			found = append(found, reservation.Instances...)
+		}
+		return true
+	})
+	return found, err
+}
+
+// waitForRunning waits for the instance to be running, for up to the timeout.
+func waitForRunning(service *ec2.EC2, instanceID string, timeout time.Duration) (*ec2.Instance, error) {
+	fmt.Printf("Waiting for %s to run.\n", instanceID)
+	deadline := time.Now().Add(timeout)
+	for {
+		instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		})
+		// A brand new instance isn't always visible straight away.
+		if err == nil && len(instances.Reservations) > 0 && len(instances.Reservations[0].Instances) > 0 {
+			instance := instances.Reservations[0].Instances[0]
+			switch aws.StringValue(instance.State.Name) {
+			case ec2.InstanceStateNameRunning:
+				return instance, nil
+			case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+				reason := "no reason given"
+				if instance.StateReason != nil {
+					reason = aws.StringValue(instance.StateReason.Message)
+				}
+				return nil, fmt.Errorf("%s was terminated: %s", instanceID, reason)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("gave up waiting for %s to run", instanceID)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// rotatingLog is a log file that is rotated once it reaches its maximum size. The current
+// file is name, and older ones are name.1 (the newest) to name.N.
+type rotatingLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openRotatingLog opens, or creates, the log file in the directory.
+func openRotatingLog(dir string, name string, maxSize int64, maxFiles int) (*rotatingLog, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating log directory: %s", err.Error())
+	}
+
+	log := &rotatingLog{path: filepath.Join(dir, name), maxSize: maxSize, maxFiles: maxFiles}
+	err = log.open()
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (l *rotatingLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log: %s", err.Error())
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening log: %s", err.Error())
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write writes to the log, rotating it first if this would take it past the maximum size.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			// Keep writing to the current file rather than losing output.
+			fmt.Printf("Error rotating %s: %s\n", l.path, err.Error())
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files along, dropping the oldest, and starts a new file.
+func (l *rotatingLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+
+	err = os.Rename(l.path, l.path+".1")
+	if err != nil {
+		l.open()
+		return err
+	}
+
+	return l.open()
+}
+
+// Close closes the log file.
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// outputTail keeps the end of the game's output, for telling what happened when it crashes.
+type outputTail struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// outputTailSize is how much of the game's output is kept.
+const outputTailSize = 16 * 1024
+
+func (t *outputTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.data = append(t.data, p...)
+	if len(t.data) > outputTailSize {
+		t.data = append([]byte{}, t.data[len(t.data)-outputTailSize:]...)
+	}
+	return len(p), nil
+}
+
+// lines returns up to the last count lines of output.
+func (t *outputTail) lines(count int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := strings.Split(strings.TrimRight(string(t.data), "\n"), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// uploadLogs tars up the game's log directory and the daemon's log and uploads them to
+// the log bucket, keyed by date and instance ID, so there is something to look at after the
+// instance is gone. Without a daemon log file the journal for this boot is used.
+func uploadLogs(ctx context.Context, userData *GameServerUserData, instanceID string, sess *session.Session) error {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(gz)
+
+	if userData.GameLogPath != "" {
+		err := filepath.Walk(userData.GameLogPath, func(file string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+
+			relative, err := filepath.Rel(userData.GameLogPath, file)
+			if err != nil {
+				return err
+			}
+
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			return addToArchive(archive, path.Join("game", filepath.ToSlash(relative)), contents, info.ModTime())
+		})
+		if err != nil {
+			// The daemon's log is still worth having.
+			fmt.Printf("Error archiving game logs: %s\n", err.Error())
+		}
+	}
+
+	if userData.DaemonLogPath != "" {
+		contents, err := ioutil.ReadFile(userData.DaemonLogPath)
+		if err != nil {
+			fmt.Printf("Error reading daemon log: %s\n", err.Error())
+		} else {
+			err = addToArchive(archive, "daemon.log", contents, time.Now())
+			if err != nil {
+				return fmt.Errorf("error archiving daemon log: %s", err.Error())
+			}
+		}
+	} else {
+		contents, err := exec.CommandContext(ctx, "/bin/journalctl", "-b", "--no-pager", "-o", "short-iso").Output()
+		if err != nil {
+			fmt.Printf("Error reading journal: %s\n", err.Error())
+		} else {
+			err = addToArchive(archive, "journal.log", contents, time.Now())
+			if err != nil {
+				return fmt.Errorf("error archiving journal: %s", err.Error())
+			}
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return fmt.Errorf("error archiving logs: %s", err.Error())
+	}
+	err = gz.Close()
+	if err != nil {
+		return fmt.Errorf("error compressing logs: %s", err.Error())
+	}
+
+	prefix := strings.TrimPrefix(userData.LogPrefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s%s/%s-%s.tar.gz", prefix, now.Format("2006-01-02"), instanceID, now.Format("150405"))
+
+	fmt.Printf("Uploading logs to s3://%s/%s.\n", userData.LogBucket, key)
+	_, err = s3manager.NewUploader(sess).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(userData.LogBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buffer.Bytes()),
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading logs: %s", err.Error())
+	}
+
+	return nil
+}
+
+// addToArchive adds a file to the tar archive. Logs are read in full first since they may
+// still be growing, and the header has to have the right size.
+func addToArchive(archive *tar.Writer, name string, contents []byte, modTime time.Time) error {
+	err := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(contents)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Write(contents)
+	return err
+}
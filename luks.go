@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// luksName is the device mapper name the opened volume gets.
+const luksName = "gamevol"
+
+// getLUKSKey fetches the volume key from Secrets Manager, or decrypts it with KMS.
+func getLUKSKey(userData *GameServerUserData, sess *session.Session) ([]byte, error) {
+	if userData.LUKSKeySecretID != "" {
+		service := secretsmanager.New(sess)
+		secret, err := service.GetSecretValue(&secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(userData.LUKSKeySecretID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error getting LUKS key secret: %s", err.Error())
+		}
+
+		if secret.SecretBinary != nil {
+			return secret.SecretBinary, nil
+		}
+		return []byte(aws.StringValue(secret.SecretString)), nil
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(userData.LUKSKeyCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("LUKS key ciphertext was malformed: %s", err.Error())
+	}
+
+	service := kms.New(sess)
+	decrypted, err := service.Decrypt(&kms.DecryptInput{
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting LUKS key: %s", err.Error())
+	}
+
+	return decrypted.Plaintext, nil
+}
+
+// openLUKS opens the encrypted device with the key and returns the decrypted device.
+// The key is passed on stdin so it never touches the disk or the process list.
+func openLUKS(deviceFile string, key []byte) (string, error) {
+	_, err := os.Stat("/dev/mapper/" + luksName)
+	if err == nil {
+		// Still open from before a reboot.
+		return "/dev/mapper/" + luksName, nil
+	}
+
+	cmd := exec.Command("/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", deviceFile, luksName)
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("error opening encrypted volume: %s", err.Error())
+	}
+
+	return "/dev/mapper/" + luksName, nil
+}
+
+// resizeLUKS grows the opened mapping to fill the underlying device.
+func resizeLUKS() error {
+	cmd := exec.Command("/sbin/cryptsetup", "resize", luksName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// closeLUKS closes the opened mapping so the volume can be detached.
+func closeLUKS() error {
+	cmd := exec.Command("/sbin/cryptsetup", "close", luksName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
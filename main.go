@@ -1,23 +1,33 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"net/http"
+	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/route53"
 )
 
+// mountPoint is where the game volume is mounted.
+const mountPoint = "/mnt/game"
+
+// defaultRunUser is the user the game server runs as unless configured otherwise.
+const defaultRunUser = "ubuntu"
+
 // GameServerUserData is the data retrieved from the AWS UserData spec'd in the launch.
+// The user data is either a JSON object using these field names, or the original
+// pipe delimited format holding the first eight fields in order.
 type GameServerUserData struct {
 	HostedZone                      string
 	DNSName                         string
@@ -27,8 +37,626 @@ type GameServerUserData struct {
 	IdlePath                        string
 	IdleInterval                    int
 	IdleConsecutiveTimesForShutdown int
+
+	// What to do with the instance once the game has been shut down for being idle:
+	// "terminate" (the default), or "stop" to keep the root volume for a faster restart, for
+	// on-demand instances and persistent spot requests. "hibernate" hibernates the instance
+	// without shutting the game down, so it resumes warm, and stops it if the instance wasn't
+	// launched with hibernation enabled.
+	IdleAction string
+
+	// Scripts and webhooks run, in order, before the idle action, e.g. for a last backup or
+	// to post to Discord.
+	IdleHooks []IdleHook
+
+	// Seconds to warn players over RCON before an idle shutdown (default 0, no warning).
+	// The probes keep running meanwhile, and the shutdown is called off if the game turns
+	// active. {remaining} in IdleWarningMessage is replaced with the time left.
+	IdleWarningPeriod  int
+	IdleWarningMessage string
+
+	// Ways of holding the game up while nobody is playing, e.g. for admin work. A POST to
+	// /keepalive on KeepAliveAddress with KeepAliveToken as a bearer token, or touching
+	// KeepAliveFile, keeps the game from counting as idle for KeepAliveDuration seconds
+	// (default 3600).
+	KeepAliveAddress  string
+	KeepAliveToken    string
+	KeepAliveFile     string
+	KeepAliveDuration int
+
+	// Seconds after the game starts during which it never counts as idle, for games that
+	// take a long time to start. Defaults to 0.
+	IdleGracePeriod int
+
+	// Windows during which the game is never shut down for being idle, like a regular game
+	// night.
+	IdleBlackouts []IdleBlackout
+
+	// Seconds the idle script may run before it is killed (default 60), and what to do when
+	// it times out or crashes: "reset" the idle count (the default), "count" it as idle, or
+	// "alert" with a notification and reset the count.
+	IdleScriptTimeout int
+	IdleScriptFailure string
+
+	// The probes that decide whether the game is idle. Defaults to the IdlePath script.
+	IdleProbes []IdleProbe
+
+	// Boolean expression over the probe names deciding when the game is idle, using and,
+	// or, not, and parentheses, e.g. "minecraft and network". Defaults to every probe being
+	// idle. If any probe fails the game counts as active, whatever the rule says.
+	IdleRule string
+
+	// Where the game lives: "ebs" (the default) for an EBS volume, "efs" for an EFS file
+	// system, "s3" to keep the game directory on the root volume synced with S3, or
+	// "instance-store" to keep it on the instance's local NVMe drive synced with S3.
+	StorageType string
+
+	// EFS file system to mount when StorageType is "efs". EFSMountTargetIP picks a specific
+	// mount target instead of relying on the file system's DNS name, and EFSMountHelper
+	// mounts with efs-utils (amazon-efs-utils) instead of plain NFS.
+	EFSFileSystemID  string
+	EFSPath          string
+	EFSMountTargetIP string
+	EFSMountHelper   bool
+
+	// S3 location the game directory is synced with when StorageType is "s3". The
+	// directory is downloaded at boot, uploaded every S3SyncInterval seconds (default 300)
+	// and one last time on shutdown. Local deletes are only synced if S3SyncDeletes is set.
+	S3Bucket       string
+	S3Prefix       string
+	S3SyncInterval int
+	S3SyncDeletes  bool
+
+	// Filesystem on the game volume and the options used to mount it (e.g. "noatime,nouuid").
+	FileSystemType string
+	MountOptions   string
+
+	// Add the game volume to /etc/fstab so it is mounted again if the instance reboots. Only
+	// plain EBS volumes are written, encrypted and RAID volumes need the daemon to set them up.
+	WriteFstab bool
+
+	// Check the filesystem before mounting it. FsckOnFailure is "abort" (the default)
+	// to refuse to mount a filesystem that couldn't be repaired, or "continue" to mount it anyway.
+	FsckBeforeMount bool
+	FsckOnFailure   string
+
+	// Grow the filesystem to fill the volume if the volume was resized.
+	GrowFileSystem bool
+
+	// Refuse to use the volume unless it is EBS encrypted, with RequiredKMSKeyID if given.
+	// The key can be a key ID, key ARN, or alias.
+	RequireEncryptedVolume bool
+	RequiredKMSKeyID       string
+
+	// Volumes to stripe together with mdadm RAID0 instead of using the single VolumeID. A new
+	// array is created and formatted if none of the volumes has been part of one yet.
+	VolumeIDs []string
+
+	// The game volume is LUKS encrypted. The key is either the Secrets Manager secret
+	// LUKSKeySecretID, or LUKSKeyCiphertext, a base64 KMS ciphertext of the key.
+	LUKSEncrypted     bool
+	LUKSKeySecretID   string
+	LUKSKeyCiphertext string
+
+	// Name of the game, used when tagging the resources the daemon creates. Defaults to the DNS name.
+	GameName string
+
+	// When no VolumeID is given, a new volume is created in the instance's availability zone
+	// from SnapshotID, or from the most recent snapshot carrying all of SnapshotTags.
+	SnapshotID   string
+	SnapshotTags map[string]string
+	VolumeType   string
+
+	// With no volume or snapshot given, the volume this game used last time is reused, or
+	// a new one of VolumeSize GiB (default 20) is created and formatted. The volume is found
+	// again by its game tag, or through the SSM parameter VolumeSSMParameter if given.
+	VolumeSize         int64
+	VolumeSSMParameter string
+
+	// gp3 performance to give the volume before the game starts, and optionally the steady
+	// state performance to drop back to VolumeBoostDuration seconds (default 600) later. EBS
+	// only allows a volume to be modified every six hours, so a boost lasts at least that.
+	VolumeIOPS             int64
+	VolumeThroughput       int64
+	VolumeSteadyIOPS       int64
+	VolumeSteadyThroughput int64
+	VolumeBoostDuration    int
+
+	// Warn when free space on the game storage drops below DiskFreeThresholdPercent, checked
+	// every DiskCheckInterval seconds (default 300). With DiskAutoGrowPercent set, a single
+	// EBS volume is also grown by that percentage, up to DiskMaxSize GiB if given.
+	DiskFreeThresholdPercent int
+	DiskCheckInterval        int
+	DiskAutoGrowPercent      int
+	DiskMaxSize              int64
+
+	// Address to serve the game's public status on at /status.json, e.g. ":8081", for a
+	// community website to show whether the game is up. It needs no token and can't change
+	// anything, is cached for PublicStatusCacheTime seconds (default 10), and each client
+	// gets 30 requests a minute. PublicStatusMOTD is shown instead of the game's own MOTD,
+	// and player names are only shown with PublicStatusShowNames.
+	PublicStatusAddress   string
+	PublicStatusCacheTime int
+	PublicStatusMOTD      string
+	PublicStatusShowNames bool
+
+	// Address to serve Prometheus metrics on at /metrics, e.g. ":9100": players online, the
+	// idle streak, uptime, game restarts, and whether the spot instance is being interrupted.
+	PrometheusAddress string
+
+	// CloudWatch namespace the idle check publishes players online, idle streak, and uptime
+	// metrics to every IdleInterval. Not set, no metrics are published.
+	MetricsNamespace string
+
+	// Player session tracking, for play time reports. SessionSource is "probe" to follow who
+	// the a2s or minecraft idle probe says is online, or "log" to follow SessionLogPath for
+	// lines matching SessionJoinPattern and SessionLeavePattern, whose first group is the
+	// player (defaults match Minecraft's). Sessions are appended to SessionFile (default
+	// on the game volume) or put in the DynamoDB SessionTable, keyed by Game and Start.
+	SessionSource       string
+	SessionLogPath      string
+	SessionJoinPattern  string
+	SessionLeavePattern string
+	SessionFile         string
+	SessionTable        string
+
+	// Hold DNS back until the game answers DNSReadyCheck, so players don't connect to a game
+	// that is still loading, giving up and setting it anyway after DNSReadyTimeout seconds
+	// (default 900). With DNSReadyName, DNSName is set at boot as usual and DNSReadyName is
+	// the record held back instead. The check runs every Interval seconds, default 5.
+	DNSReadyCheck   *HealthCheck
+	DNSReadyName    string
+	DNSReadyTimeout int
+
+	// SNS topic that notifications are published to.
+	NotifyTopicARN string
+
+	// SNS topic that interruption and shutdown events are published to as JSON. Defaults to
+	// NotifyTopicARN.
+	EventTopicARN string
+
+	// games holds the settings for each game, one per entry in Games or just the user data
+	// itself for a single game.
+	games []*GameServerUserData
+
+	// provisioned is set when the volume was just created blank and needs formatting.
+	provisioned bool
+
+	// Unmount and snapshot the game volume before an idle shutdown or spot termination.
+	SnapshotOnShutdown bool
+
+	// Take a snapshot every SnapshotInterval seconds while the game runs. SnapshotFreeze
+	// freezes the filesystem while the snapshot is started so it is consistent on disk.
+	SnapshotInterval int
+	SnapshotFreeze   bool
+
+	// Seconds between checks for a spot interruption notice. Defaults to 5.
+	TerminationCheckInterval int
+
+	// What to do on an EC2 rebalance recommendation, which often comes well before the
+	// interruption notice: "notify" (the default), "shutdown" to shut down gracefully right
+	// away, or "replace" to shut down and launch a replacement instance.
+	RebalanceAction string
+
+	// Launch a replacement spot instance with the same configuration and user data once an
+	// interruption has been handled. Replacements are at least ReplacementCooldown seconds
+	// (default 900) apart, tracked in the SSM parameter ReplacementStateParameter (default
+	// /aws-spot-game-server/<game name>/replacement). ReplacementSubnetIDs are tried in order
+	// instead of this instance's subnet, to get out of a zone that is short on capacity.
+	ReplaceOnInterruption     bool
+	ReplacementCooldown       int
+	ReplacementStateParameter string
+	ReplacementSubnetIDs      []string
+
+	// Fall back to on-demand when spot capacity can't be had: when a replacement can't be
+	// launched as spot in any subnet, or once there have been OnDemandAfterInterruptions
+	// (default 3) interruptions within a day, and when launching from a profile. Nothing is
+	// launched on demand if it costs over OnDemandMaxPrice dollars an hour, when given.
+	OnDemandFallback           bool
+	OnDemandAfterInterruptions int
+	OnDemandMaxPrice           string
+
+	// Most to spend running the game's instances in a calendar month (UTC), in dollars. Their
+	// cost at the spot or on-demand price is added up in the SSM parameter BudgetParameter
+	// (default /aws-spot-game-server/<game name>/budget). Notifications go out at 50%, 80%,
+	// and 100%, and once it is spent the instance shuts down and launching, resuming, and
+	// replacing are refused until the next month. With BudgetTable, spending is added up in
+	// that DynamoDB table instead, keyed by Budget (the BudgetParameter) and Month, both
+	// strings. Games can share a budget there by giving the same BudgetParameter, since the
+	// table adds to it atomically.
+	MonthlyBudget   float64
+	BudgetParameter string
+	BudgetTable     string
+
+	// The steps run, in order, when a spot interruption is detected. Defaults to stop, then
+	// snapshot if SnapshotOnShutdown is set, then release, then the DNSShutdownAction. With
+	// RCON configured the default starts by warning the players and saving the world.
+	TerminationSteps []ShutdownStep
+
+	// What to do with the game's DNS record on interruption: "keep" (the default), "delete",
+	// or "point" to point it at DNSShutdownTarget, e.g. a server that says the game is down.
+	DNSShutdownAction string
+	DNSShutdownTarget string
+
+	// The user the game runs as (default ubuntu), and its group, defaulting to the user's
+	// primary group. The user's other groups are kept.
+	RunUser  string
+	RunGroup string
+
+	// Arguments passed to the run path, after any already in it, and environment variables
+	// for the game, e.g. JVM flags or the world name.
+	RunArgs []string
+	RunEnv  map[string]string
+
+	// Directory the game is started in, e.g. /mnt/game. Defaults to the daemon's own.
+	RunDirectory string
+
+	// Start the game with only a basic environment instead of the daemon's, and the PATH to
+	// give it, defaulting to the standard system directories in a clean environment.
+	RunCleanEnvironment bool
+	RunSearchPath       string
+
+	// Directory the game's output is written to as game.log, as well as the daemon's output.
+	// The log is rotated at GameLogMaxSize MiB (default 10), keeping GameLogMaxFiles old
+	// ones (default 5). Put it on the game storage to keep it between instances.
+	GameLogDirectory string
+	GameLogMaxSize   int
+	GameLogMaxFiles  int
+
+	// Signal to stop the game with when there is no stop script, default SIGTERM. It is
+	// sent to the game's whole process group, and anything still running StopKillTimeout
+	// seconds later (default 30) is killed. The kill also follows a stop script that leaves
+	// the game running.
+	StopSignal      string
+	StopKillTimeout int
+
+	// Games to run side by side on the instance, each with its own run and stop scripts and
+	// idle probes, instead of the single game given by the fields above. The instance is only
+	// shut down for being idle once every game is.
+	Games []GameConfig
+
+	// Run the game as a Docker container of DockerImage instead of running RunPath. The game
+	// storage is mounted in the container at DockerDataPath (default /data), DockerPorts are
+	// published like "25565:25565" or "27015:27015/udp", RunEnv is passed in as the
+	// container's environment and RunArgs as its command. The image's own health check, if
+	// it has one, is the docker health check type.
+	DockerImage    string
+	DockerDataPath string
+	DockerPorts    []string
+
+	// Compose file, usually on the game storage, whose stack is brought up as the game
+	// instead, for games that ship as a server plus helpers like a map renderer or a bot.
+	// Stopping the game stops the whole stack. RunEnv is available to the file's variables,
+	// and resource limits go in the file.
+	ComposeFile string
+
+	// Keep the game's stdin open as a console, which root can attach to on ConsoleSocket
+	// (default /run/aws-spot-game-server/console.sock) with "ctl console", like attaching to
+	// a screen session. The control API also serves it over a WebSocket at /console, with a
+	// page for browsers.
+	Console       bool
+	ConsoleSocket string
+
+	// Limits on the game's processes, kept with a cgroup: GameMemoryLimit in MiB and
+	// GameCPULimit in cores, e.g. 1.5. A game that runs out of memory is killed on its own,
+	// then restarted like a crash, rather than taking the daemon and the instance with it.
+	GameMemoryLimit int
+	GameCPULimit    float64
+
+	// Check that the game still answers, and restart it when it doesn't, for games that can
+	// hang while their process keeps running.
+	HealthCheck *HealthCheck
+
+	// File the daemon's status is kept in as JSON for scripts and monitoring (default
+	// /run/aws-spot-game-server/status.json): the daemon's state, the games' processes, the
+	// players online, and where the game storage is mounted.
+	StatusFile string
+
+	// Address to serve the control API on, e.g. ":8080", with ControlToken as a bearer
+	// token. It has the status, and can stop the instance, restart the games, back up the
+	// game storage and hold the game up, for dashboards, bots and admin without SSH. A
+	// dashboard for browsers is served at /, which takes the token as the password.
+	// ControlTokenSecretID adds the tokens in a Secrets Manager secret, one per line, so each
+	// client can have its own.
+	ControlAddress       string
+	ControlToken         string
+	ControlTokenSecretID string
+
+	// Certificate and key files to serve the control API over TLS with, and a CA file whose
+	// certificates clients must present, for mutual TLS. With a client CA the tokens are
+	// optional.
+	ControlTLSCert  string
+	ControlTLSKey   string
+	ControlClientCA string
+
+	// Unix socket the control API is also on for "ctl" (default
+	// /run/aws-spot-game-server/control.sock). Only root can connect, so it needs no token.
+	ControlSocket string
+
+	// Discord bot that posts the game's events to DiscordChannelID and answers !status,
+	// !players, !extend, and !stop there, with its token in the Secrets Manager secret
+	// DiscordTokenSecretID. The channel is read every DiscordPollInterval seconds (default
+	// 5), so the bot needs the message content intent. With DiscordAdminIDs, only those
+	// users can extend or stop the game.
+	DiscordTokenSecretID string
+	DiscordChannelID     string
+	DiscordPollInterval  int
+	DiscordAdminIDs      []string
+
+	// Slack incoming webhook the game's events are posted to. With SlackCommandAddress, a
+	// slash command pointed at /slack there can get the status and players, extend, or stop
+	// the game. Slack only calls HTTPS, so it is served with ControlTLSCert if given, and
+	// requests are checked with the signing secret in the Secrets Manager secret
+	// SlackSigningSecretID. With SlackAdminIDs, only those users can extend or stop the game.
+	SlackWebhookURL      string
+	SlackCommandAddress  string
+	SlackSigningSecretID string
+	SlackAdminIDs        []string
+
+	// SQS queue polled for commands as JSON, like {"command": "say", "message": "Hi"}, so
+	// tooling and Lambdas can stop, restart, back up, message, or extend the game with no
+	// inbound access to the instance. Commands with an instance_id or game that isn't this
+	// one are left on the queue, and commands over 15 minutes old are dropped.
+	CommandQueueURL string
+
+	// MQTT broker the daemon's state and players online are published to, retained, at
+	// MQTTTopic/state and MQTTTopic/players, with every event as JSON at MQTTTopic/events,
+	// for home automation. The broker is like tcp://host:1883, or tls://host:8883 with
+	// MQTTClientCert and MQTTClientKey for AWS IoT Core. MQTTTopic defaults to
+	// aws-spot-game-server/<game name>, and MQTTClientID to aws-spot-game-server-<game name>.
+	MQTTBroker     string
+	MQTTTopic      string
+	MQTTClientID   string
+	MQTTUsername   string
+	MQTTPassword   string
+	MQTTCACert     string
+	MQTTClientCert string
+	MQTTClientKey  string
+
+	// How the control API manages the whitelist. By default it runs WhitelistAddCommand
+	// (default "whitelist add {player}"), WhitelistRemoveCommand (default "whitelist remove
+	// {player}"), and WhitelistListCommand (default "whitelist list") over RCON. With
+	// WhitelistFile it edits the file instead, a JSON array of objects with a name if it ends
+	// in .json, like Minecraft's whitelist.json, or one name a line otherwise, and then runs
+	// WhitelistReloadCommand over RCON, if given, for the game to read it again.
+	WhitelistFile          string
+	WhitelistReloadCommand string
+	WhitelistAddCommand    string
+	WhitelistRemoveCommand string
+	WhitelistListCommand   string
+
+	// Webhooks the game's lifecycle events are POSTed to as JSON, for any automation.
+	Webhooks []Webhook
+
+	// Scripts run before each start of the game, e.g. to sync mods or patch configs, and
+	// after each time it exits, e.g. to compress logs. A pre-start hook failing stops the
+	// game from starting, like a crash. Post-stop hook failures are only logged.
+	PreStartHooks []GameHook
+	PostStopHooks []GameHook
+
+	// Cron expression to restart the game on, e.g. "0 5 * * *" for 5am every day in
+	// RestartTimeZone (an IANA name, default UTC), for games that get worse the longer they
+	// run. Players are warned RestartWarningPeriod seconds beforehand (default 300) over
+	// RCON with RestartWarningMessage, and the world is saved first.
+	RestartSchedule       string
+	RestartTimeZone       string
+	RestartWarningPeriod  int
+	RestartWarningMessage string
+
+	// How a crashed game is restarted. A crash is restarted after GameRestartBackoff
+	// seconds (default 5), doubling each time up to five minutes, and the daemon gives up
+	// after GameRestartLimit (default 5, -1 to never restart) crashes in a row. A game that
+	// ran for GameStableTime seconds (default 600) before crashing starts the count again.
+	GameRestartLimit   int
+	GameRestartBackoff int
+	GameStableTime     int
+
+	// What to do once a game has crashed too often to restart: "keep" (the default) leaves
+	// the instance up with the volume mounted to debug it, and "terminate" shuts down like
+	// a termination and terminates the instance to stop paying for it.
+	GameCrashAction string
+
+	// Seconds the whole shutdown pipeline may take (default 100). An interruption notice
+	// gives two minutes, so the budget is also cut short to finish before the deadline.
+	ShutdownBudget int
+
+	// The game's RCON port (default 127.0.0.1:25575) and password, used to talk to players
+	// and run console commands. RCONPasswordSecretID reads the password from Secrets Manager
+	// instead, keeping it out of the user data.
+	RCONAddress          string
+	RCONPassword         string
+	RCONPasswordSecretID string
+
+	// Console commands for broadcasting a message (default "say") and saving the world
+	// (default "save-all").
+	RCONSayCommand  string
+	RCONSaveCommand string
+
+	// Message broadcast by the warn step. {remaining} is replaced with the time left,
+	// e.g. "90 seconds".
+	TerminationWarningMessage string
+
+	// SQS queue fed by EventBridge rules for "EC2 Spot Instance Interruption Warning" (and
+	// optionally "EC2 Instance Rebalance Recommendation") events, watched alongside the
+	// instance metadata. Events for other instances are left on the queue.
+	InterruptionQueueURL string
+
+	// Where logs are uploaded on shutdown. GameLogPath is the game's log directory, and
+	// DaemonLogPath the daemon's log file, with the journal used if it isn't set.
+	LogBucket     string
+	LogPrefix     string
+	GameLogPath   string
+	DaemonLogPath string
+
+	// Terminating lifecycle hook to complete when running in an Auto Scaling group. Defaults
+	// to every terminating hook on the group.
+	LifecycleHookName string
+
+	// Seconds to wait for another live instance to release a Multi-Attach volume before
+	// giving up. Defaults to 300.
+	MultiAttachLockTimeout int
+
+	// Seconds to wait for a normal detach from a dead instance before forcing it. Defaults to 60.
+	ForceDetachGracePeriod int
+
+	// Retention policy for the snapshots the daemon takes. The most recent SnapshotRetainLast
+	// are kept, along with the newest snapshot of each of the last SnapshotRetainDaily days
+	// and SnapshotRetainWeekly weeks. Everything else is deleted. All zero disables pruning.
+	SnapshotRetainLast   int
+	SnapshotRetainDaily  int
+	SnapshotRetainWeekly int
 }
 
+// ShutdownStep is one step of the shutdown pipeline. Action is one of:
+//
+//	exec       - run Path with Args
+//	stop       - stop the games with their stop scripts or stop signals
+//	snapshot   - unmount the volume and snapshot it
+//	warn       - broadcast TerminationWarningMessage over RCON
+//	save       - run RCONSaveCommand over RCON
+//	delete-dns - delete the game's DNS records
+//	point-dns  - point the game's DNS record at DNSShutdownTarget, deleting the ready record
+//	logs       - upload the game and daemon logs to LogBucket
+//	release    - unmount and detach the volume
+//
+// Timeout is in seconds and defaults to a value suiting the action. A step that times out
+// is abandoned and the pipeline moves on to the next one. Priority decides which steps are
+// skipped when the shutdown budget runs short, 1 being the most important. It defaults to 1
+// for warn, stop, and save, 2 for release, 3 for snapshot, and 4 for everything else.
+type ShutdownStep struct {
+	Action   string
+	Path     string
+	Args     []string
+	Timeout  int
+	Priority int
+}
+
+// IdleHook is run before the idle action. It either runs Path with Args, or POSTs to the
+// webhook URL. Timeout is in seconds and defaults to 30.
+type IdleHook struct {
+	Path    string
+	Args    []string
+	URL     string
+	Timeout int
+}
+
+// Webhook is POSTed every event in Events, or every event but idle-tick without any. With
+// a Secret, the X-Signature-256 header is "sha256=" and the hex HMAC-SHA256 of the body. A
+// failed delivery is tried again up to Retries times (default 3, -1 for none), and each try
+// is given Timeout seconds (default 10).
+type Webhook struct {
+	URL     string
+	Secret  string
+	Events  []string
+	Retries int
+	Timeout int
+}
+
+// GameHook is a script run around the game, as the run user in the run directory with
+// the game's environment plus GAME_NAME, and GAME_EXIT_STATUS after the game exits. Timeout is
+// in seconds and defaults to 300.
+type GameHook struct {
+	Path    string
+	Args    []string
+	Timeout int
+}
+
+// IdleBlackout is a weekly window when idle shutdown is suppressed. Days are day names
+// like "Fri" or "Friday", every day if empty. Start and End are HH:MM, End can be 24:00, and
+// a window whose End is before its Start runs past midnight. TimeZone is an IANA name like
+// "America/Chicago", defaulting to UTC.
+type IdleBlackout struct {
+	Days     []string
+	Start    string
+	End      string
+	TimeZone string
+}
+
+// IdleProbe is one way of telling whether the game is idle. Name is what IdleRule calls it,
+// defaulting to Type, and Intervals is how many checks in a row it has to find the game idle
+// before it counts as idle (default 1). Type is one of:
+//
+//	script    - run IdlePath, exit status 0 means idle. If the script prints the number of
+//	            players online, or Pattern matches it in the output, it is used for logs and
+//	            metrics
+//	tcp       - idle when there are no established TCP connections to any of Ports
+//	minecraft - idle when a server list ping of Address (default 127.0.0.1:25565) shows no
+//	            players online
+//	rcon      - run Command (default "list") over RCON and take the first number in the
+//	            output, or the first group of the Pattern regular expression, as the number
+//	            of players online
+//	a2s       - idle when a Steam A2S_INFO query of Address (default 127.0.0.1:27015) shows
+//	            no players online, for Valheim, ARK, CS and other Steam games. Address is the
+//	            query port, which isn't always the game port (Valheim's is one above it).
+//	network   - idle when the traffic to and from Ports, or through Interface (default the
+//	            one with the default route) without ports, stays under BytesPerSecond
+//	            (default 2048). For games with no way to ask how many players are online.
+//	cpu       - idle when the game's processes use less than CPUPercent (default 5) of one
+//	            core
+type IdleProbe struct {
+	Name           string
+	Type           string
+	Intervals      int
+	Ports          []int
+	Address        string
+	Command        string
+	Pattern        string
+	Interface      string
+	BytesPerSecond int64
+	CPUPercent     float64
+}
+
+// GameConfig is one of several games run on the instance. Name identifies the game in logs,
+// notifications, and its console socket, and names its game log. RunPath, StopPath,
+// IdlePath, RunArgs, RunEnv, IdleProbes, IdleRule, DockerImage, DockerPorts, and
+// ComposeFile work like the fields of the same name for a single game. StopSignal,
+// RunDirectory, RCONAddress, RCONPassword, HealthCheck, PreStartHooks, and PostStopHooks
+// default to the instance's ones.
+type GameConfig struct {
+	Name          string
+	RunPath       string
+	StopPath      string
+	StopSignal    string
+	IdlePath      string
+	RunArgs       []string
+	RunEnv        map[string]string
+	RunDirectory  string
+	IdleProbes    []IdleProbe
+	IdleRule      string
+	RCONAddress   string
+	RCONPassword  string
+	HealthCheck   *HealthCheck
+	PreStartHooks []GameHook
+	PostStopHooks []GameHook
+	DockerImage   string
+	DockerPorts   []string
+	ComposeFile   string
+}
+
+// HealthCheck checks that the game answers every Interval seconds (default 30), giving up
+// on each check after Timeout seconds (default 5). After Failures failed checks in a row
+// (default 3) the game is killed and restarted like a crash. Nothing is checked for the
+// first StartPeriod seconds (default 300) after the game starts. Type is one of:
+//
+//	tcp       - connect to Address
+//	minecraft - server list ping Address (default 127.0.0.1:25565)
+//	a2s       - Steam A2S_INFO query Address (default 127.0.0.1:27015)
+//	rcon      - run Command (default "list") over RCON
+//	docker    - the containers' own health checks, for DockerImage or ComposeFile
+type HealthCheck struct {
+	Type        string
+	Address     string
+	Command     string
+	Interval    int
+	Timeout     int
+	Failures    int
+	StartPeriod int
+}
+
+// shuttingDown tracks shutdown work in progress, so main doesn't exit as soon as the
+// game stops and cut that work off.
+var shuttingDown sync.WaitGroup
+
 func getInstanceRegion(metadata *ec2metadata.EC2Metadata) (string, error) {
 	region, err := metadata.Region()
 	return region, err
@@ -40,6 +668,12 @@ func getInstanceID(metadata *ec2metadata.EC2Metadata) (string, error) {
 	return id, err
 }
 
+func getAvailabilityZone(metadata *ec2metadata.EC2Metadata) (string, error) {
+	zone, err := metadata.GetMetadata("placement/availability-zone")
+
+	return zone, err
+}
+
 func getPublicIP(metadata *ec2metadata.EC2Metadata) (string, error) {
 	publicIP, err := metadata.GetMetadata("public-ipv4")
 
@@ -52,6 +686,32 @@ func getUserData(metadata *ec2metadata.EC2Metadata) (*GameServerUserData, error)
 		return nil, err
 	}
 
+	var parsed *GameServerUserData
+	if strings.HasPrefix(strings.TrimSpace(userData), "{") {
+		parsed = &GameServerUserData{}
+		err = json.Unmarshal([]byte(userData), parsed)
+		if err != nil {
+			return nil, fmt.Errorf("user data JSON was malformed: %s", err.Error())
+		}
+	} else {
+		parsed, err = parseLegacyUserData(userData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	setDefaults(parsed)
+
+	err = validateUserData(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// parseLegacyUserData parses the original pipe delimited user data format.
+func parseLegacyUserData(userData string) (*GameServerUserData, error) {
 	sliced := strings.Split(strings.Trim(string(userData), "\n"), "|")
 
 	if len(sliced) != 8 {
@@ -80,93 +740,477 @@ func getUserData(metadata *ec2metadata.EC2Metadata) (*GameServerUserData, error)
 	}, nil
 }
 
-func checkTermination(userData *GameServerUserData) {
-	_, err := os.Stat(userData.StopPath)
-	if err != nil {
-		// if the stop path doesn't exit, no reason to run the goroutine
-		return
+// setDefaults fills in any optional user data that wasn't given.
+func setDefaults(userData *GameServerUserData) {
+	if userData.StorageType == "" {
+		userData.StorageType = "ebs"
+	}
+
+	if userData.EFSPath == "" {
+		userData.EFSPath = "/"
+	}
+
+	if userData.S3SyncInterval <= 0 {
+		userData.S3SyncInterval = 300
+	}
+
+	if userData.FileSystemType == "" {
+		userData.FileSystemType = "ext4"
+	}
+
+	if userData.FsckOnFailure == "" {
+		userData.FsckOnFailure = "abort"
+	}
+
+	if userData.GameName == "" {
+		userData.GameName = strings.TrimSuffix(userData.DNSName, ".")
+	}
+
+	if userData.VolumeType == "" {
+		userData.VolumeType = "gp3"
+	}
+
+	if userData.VolumeSize <= 0 {
+		userData.VolumeSize = 20
+	}
+
+	if userData.DiskCheckInterval <= 0 {
+		userData.DiskCheckInterval = 300
+	}
+
+	if userData.VolumeBoostDuration <= 0 {
+		userData.VolumeBoostDuration = 600
+	}
+
+	if userData.TerminationCheckInterval <= 0 {
+		userData.TerminationCheckInterval = 5
+	}
+
+	if userData.RCONAddress == "" {
+		userData.RCONAddress = "127.0.0.1:25575"
+	}
+
+	if userData.RCONSayCommand == "" {
+		userData.RCONSayCommand = "say"
+	}
+
+	if userData.RCONSaveCommand == "" {
+		userData.RCONSaveCommand = "save-all"
+	}
+
+	if userData.TerminationWarningMessage == "" {
+		userData.TerminationWarningMessage = "Server shutting down in {remaining} - AWS reclaimed the instance."
+	}
+
+	if userData.EventTopicARN == "" {
+		userData.EventTopicARN = userData.NotifyTopicARN
+	}
+
+	if userData.SessionJoinPattern == "" {
+		userData.SessionJoinPattern = `(\w+) joined the game`
+	}
+
+	if userData.SessionLeavePattern == "" {
+		userData.SessionLeavePattern = `(\w+) left the game`
+	}
+
+	if userData.SessionFile == "" {
+		userData.SessionFile = defaultSessionFile
+	}
+
+	if userData.RunUser == "" {
+		userData.RunUser = defaultRunUser
+	}
+
+	if userData.GameLogMaxSize <= 0 {
+		userData.GameLogMaxSize = 10
+	}
+
+	if userData.GameLogMaxFiles <= 0 {
+		userData.GameLogMaxFiles = 5
+	}
+
+	// The game's own log is what's worth uploading on shutdown.
+	if userData.GameLogPath == "" {
+		userData.GameLogPath = userData.GameLogDirectory
+	}
+
+	if userData.ConsoleSocket == "" {
+		userData.ConsoleSocket = defaultConsoleSocket
+	}
+
+	if userData.GameCrashAction == "" {
+		userData.GameCrashAction = "keep"
+	}
+
+	if userData.RestartTimeZone == "" {
+		userData.RestartTimeZone = "UTC"
+	}
+
+	if userData.RestartWarningPeriod <= 0 {
+		userData.RestartWarningPeriod = 300
+	}
+
+	if userData.RestartWarningMessage == "" {
+		userData.RestartWarningMessage = "Server restarting in {remaining}."
+	}
+
+	if userData.DNSReadyTimeout <= 0 {
+		userData.DNSReadyTimeout = 900
+	}
+
+	if userData.DNSReadyCheck != nil {
+		if userData.DNSReadyCheck.Interval <= 0 {
+			userData.DNSReadyCheck.Interval = 5
+		}
+		setHealthCheckDefaults(userData.DNSReadyCheck)
+	}
+
+	if userData.DockerDataPath == "" {
+		userData.DockerDataPath = defaultDockerDataPath
+	}
+
+	if userData.ControlSocket == "" {
+		userData.ControlSocket = defaultControlSocket
+	}
+
+	if userData.DiscordPollInterval <= 0 {
+		userData.DiscordPollInterval = 5
+	}
+
+	if userData.StatusFile == "" {
+		userData.StatusFile = defaultStatusFile
+	}
+
+	if userData.StopKillTimeout <= 0 {
+		userData.StopKillTimeout = 30
+	}
+
+	if userData.GameRestartLimit == 0 {
+		userData.GameRestartLimit = 5
+	}
+
+	if userData.GameRestartBackoff <= 0 {
+		userData.GameRestartBackoff = 5
+	}
+
+	if userData.GameStableTime <= 0 {
+		userData.GameStableTime = 600
+	}
+
+	if userData.IdleScriptTimeout <= 0 {
+		userData.IdleScriptTimeout = 60
+	}
+
+	if userData.IdleScriptFailure == "" {
+		userData.IdleScriptFailure = "reset"
+	}
+
+	if userData.IdleAction == "" {
+		userData.IdleAction = "terminate"
+	}
+
+	for i := range userData.IdleHooks {
+		if userData.IdleHooks[i].Timeout <= 0 {
+			userData.IdleHooks[i].Timeout = 30
+		}
+	}
+
+	if userData.WhitelistAddCommand == "" {
+		userData.WhitelistAddCommand = "whitelist add {player}"
+	}
+
+	if userData.WhitelistRemoveCommand == "" {
+		userData.WhitelistRemoveCommand = "whitelist remove {player}"
+	}
+
+	if userData.WhitelistListCommand == "" {
+		userData.WhitelistListCommand = "whitelist list"
+	}
+
+	if userData.PublicStatusCacheTime <= 0 {
+		userData.PublicStatusCacheTime = 10
+	}
+
+	if userData.MQTTTopic == "" {
+		userData.MQTTTopic = "aws-spot-game-server/" + userData.GameName
+	}
+
+	if userData.MQTTClientID == "" {
+		userData.MQTTClientID = "aws-spot-game-server-" + userData.GameName
+	}
+
+	for i := range userData.Webhooks {
+		if userData.Webhooks[i].Retries == 0 {
+			userData.Webhooks[i].Retries = 3
+		}
+		if userData.Webhooks[i].Timeout <= 0 {
+			userData.Webhooks[i].Timeout = 10
+		}
+	}
+
+	if userData.KeepAliveDuration <= 0 {
+		userData.KeepAliveDuration = 3600
+	}
+
+	if userData.IdleWarningMessage == "" {
+		userData.IdleWarningMessage = "Server shutting down in {remaining} since nobody is playing."
+	}
+
+	if userData.DNSShutdownAction == "" {
+		userData.DNSShutdownAction = "keep"
+	}
+
+	if userData.ShutdownBudget <= 0 {
+		userData.ShutdownBudget = 100
+	}
+
+	if userData.ReplacementCooldown <= 0 {
+		userData.ReplacementCooldown = 900
+	}
+
+	if userData.ReplacementStateParameter == "" {
+		userData.ReplacementStateParameter = "/aws-spot-game-server/" + userData.GameName + "/replacement"
+	}
+
+	if userData.BudgetParameter == "" {
+		userData.BudgetParameter = "/aws-spot-game-server/" + userData.GameName + "/budget"
+	}
+
+	if userData.OnDemandAfterInterruptions <= 0 {
+		userData.OnDemandAfterInterruptions = 3
+	}
+
+	if userData.RebalanceAction == "" {
+		userData.RebalanceAction = "notify"
+	}
+
+	if userData.MultiAttachLockTimeout <= 0 {
+		userData.MultiAttachLockTimeout = 300
+	}
+
+	if userData.ForceDetachGracePeriod <= 0 {
+		userData.ForceDetachGracePeriod = 60
+	}
+
+	// The shutdown steps depend on the games.
+	setGameDefaults(userData)
+
+	if len(userData.TerminationSteps) == 0 {
+		if anyRCONEnabled(userData) {
+			userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "warn"}, ShutdownStep{Action: "save"})
+		}
+		userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "stop"})
+		// Game logs are usually on the game volume, so they have to go before it is released.
+		if userData.LogBucket != "" {
+			userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "logs"})
+		}
+		if userData.SnapshotOnShutdown {
+			userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "snapshot"})
+		}
+		userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "release"})
+
+		switch userData.DNSShutdownAction {
+		case "delete":
+			userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "delete-dns"})
+		case "point":
+			userData.TerminationSteps = append(userData.TerminationSteps, ShutdownStep{Action: "point-dns"})
+		}
+	}
+
+	for i := range userData.TerminationSteps {
+		setShutdownStepDefaults(&userData.TerminationSteps[i])
+	}
+}
+
+// validateUserData makes sure the required user data is present and sane.
+func validateUserData(userData *GameServerUserData) error {
+	if userData.HostedZone == "" || userData.DNSName == "" {
+		return fmt.Errorf("hosted zone and DNS name are required")
+	}
+
+	switch userData.StorageType {
+	case "ebs":
+		if len(userData.VolumeIDs) > 0 && userData.VolumeID != "" {
+			return fmt.Errorf("only one of volume ID and RAID volume IDs can be given")
+		}
+
+		if len(userData.VolumeIDs) == 1 || len(userData.VolumeIDs) > 10 {
+			return fmt.Errorf("RAID needs between 2 and 10 volume IDs")
+		}
+
+		if len(userData.VolumeIDs) > 0 && (userData.SnapshotOnShutdown || userData.SnapshotInterval > 0) {
+			return fmt.Errorf("snapshots are not supported for RAID volumes")
+		}
+	case "efs":
+		if userData.EFSFileSystemID == "" {
+			return fmt.Errorf("an EFS file system ID is required")
+		}
+	case "s3", "instance-store":
+		// Instance store doesn't survive the instance, so S3 is what keeps the game.
+		if userData.S3Bucket == "" {
+			return fmt.Errorf("an S3 bucket is required")
+		}
+	default:
+		return fmt.Errorf("unsupported storage type: %s", userData.StorageType)
+	}
+
+	switch userData.DNSShutdownAction {
+	case "keep", "delete":
+	case "point":
+		if net.ParseIP(userData.DNSShutdownTarget).To4() == nil {
+			return fmt.Errorf("DNS shutdown target must be an IPv4 address")
+		}
+	default:
+		return fmt.Errorf("DNS shutdown action must be keep, delete, or point")
+	}
+
+	for _, step := range userData.TerminationSteps {
+		err := validateShutdownStep(userData, step)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch userData.RebalanceAction {
+	case "notify", "shutdown", "replace":
+	default:
+		return fmt.Errorf("rebalance action must be notify, shutdown, or replace")
+	}
+
+	if userData.OnDemandMaxPrice != "" {
+		if _, err := strconv.ParseFloat(userData.OnDemandMaxPrice, 64); err != nil {
+			return fmt.Errorf("on-demand max price must be a number of dollars")
+		}
+	}
+
+	if userData.MonthlyBudget < 0 {
+		return fmt.Errorf("monthly budget can't be negative")
+	}
+
+	if userData.LUKSEncrypted && userData.LUKSKeySecretID == "" && userData.LUKSKeyCiphertext == "" {
+		return fmt.Errorf("a LUKS key secret ID or ciphertext is required")
+	}
+
+	if (userData.SnapshotOnShutdown || userData.SnapshotInterval > 0) && userData.StorageType != "ebs" {
+		return fmt.Errorf("snapshots are only supported for EBS storage")
+	}
+
+	err := validateGames(userData)
+	if err != nil {
+		return err
+	}
+
+	switch userData.FileSystemType {
+	case "ext2", "ext3", "ext4", "xfs", "btrfs":
+	default:
+		return fmt.Errorf("unsupported filesystem type: %s", userData.FileSystemType)
+	}
+
+	if userData.DNSReadyCheck != nil {
+		if userData.DNSReadyCheck.Type == "docker" && !containerized(userData) {
+			return fmt.Errorf("docker DNS ready checks need a Docker image or compose file")
+		}
+
+		err := validateHealthCheck(userData, userData.DNSReadyCheck)
+		if err != nil {
+			return err
+		}
+	}
+
+	if userData.GameCrashAction != "keep" && userData.GameCrashAction != "terminate" {
+		return fmt.Errorf("game crash action must be keep or terminate")
+	}
+
+	if userData.RestartSchedule != "" {
+		_, err := parseCron(userData.RestartSchedule)
+		if err != nil {
+			return err
+		}
+
+		_, err = time.LoadLocation(userData.RestartTimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid restart time zone: %s", err.Error())
+		}
+	}
+
+	if userData.GameMemoryLimit < 0 || userData.GameCPULimit < 0 {
+		return fmt.Errorf("game limits can't be negative")
+	}
+
+	if userData.FsckOnFailure != "abort" && userData.FsckOnFailure != "continue" {
+		return fmt.Errorf("fsck on failure must be abort or continue")
+	}
+
+	err = validateSessionTracking(userData)
+	if err != nil {
+		return err
+	}
+
+	switch userData.IdleScriptFailure {
+	case "reset", "count", "alert":
+	default:
+		return fmt.Errorf("idle script failure must be reset, count, or alert")
+	}
+
+	switch userData.IdleAction {
+	case "terminate", "stop", "hibernate":
+	default:
+		return fmt.Errorf("idle action must be terminate, stop, or hibernate")
+	}
+
+	for _, hook := range userData.IdleHooks {
+		if (hook.Path == "") == (hook.URL == "") {
+			return fmt.Errorf("idle hooks need either a path or a URL")
+		}
+	}
+
+	if (userData.MQTTClientCert == "") != (userData.MQTTClientKey == "") {
+		return fmt.Errorf("MQTT needs both a client certificate and key")
+	}
+
+	for _, webhook := range userData.Webhooks {
+		if webhook.URL == "" {
+			return fmt.Errorf("webhooks need a URL")
+		}
+	}
+
+	if userData.ControlAddress != "" && userData.ControlToken == "" && userData.ControlTokenSecretID == "" && userData.ControlClientCA == "" {
+		return fmt.Errorf("the control API needs a token or a client CA")
+	}
+
+	if (userData.ControlTLSCert == "") != (userData.ControlTLSKey == "") {
+		return fmt.Errorf("the control API needs both a TLS certificate and key")
 	}
 
-	// Spin this off in a goroutine
-	go func() {
-		// TODO: Replace with a call to the metadata and use spot/instance-action.
-		resp, err := http.Get("http://169.254.169.254/latest/meta-data/spot/termination-time")
-		if err != nil {
-			fmt.Printf("Error getting termination time: %s\n", err.Error())
-		} else {
-			if resp.StatusCode != 404 {
-				fmt.Printf("We got notification of termination. Calling stop and exiting.\n")
-				cmd := exec.Command(userData.StopPath)
-				err := cmd.Run()
-				if err != nil {
-					fmt.Printf("Error calling stop: %s\n", err.Error())
-				}
-				return
-			}
-			resp.Body.Close()
-		}
+	if userData.ControlClientCA != "" && userData.ControlTLSCert == "" {
+		return fmt.Errorf("client certificates need the control API served over TLS")
+	}
 
-		// Sleep 5 seconds and check again.
-		time.Sleep(5 * time.Second)
-	}()
-}
+	if (userData.DiscordTokenSecretID == "") != (userData.DiscordChannelID == "") {
+		return fmt.Errorf("the Discord bot needs both a token secret and a channel")
+	}
 
-func checkIdle(userData *GameServerUserData, instanceID string, sess *session.Session) {
-	_, err := os.Stat(userData.IdlePath)
-	if err != nil {
-		// If the idle path doesn't exit, no reason to run the goroutine
-		return
+	if userData.SlackCommandAddress != "" && userData.SlackSigningSecretID == "" {
+		return fmt.Errorf("Slack commands need a signing secret")
 	}
 
-	_, err = os.Stat(userData.StopPath)
-	if err != nil {
-		// if the stop path doesn't exit, no reason to run the goroutine
-		return
-	}
-
-	// Spin this off in a goroutine
-	go func() {
-		count := 0
-		for {
-			// Call the idle script. If the exit status is 0, the game server is idle and should count this iteration.
-			// Otherwise, the server is not idle and we reset the count.
-			cmd := exec.Command(userData.IdlePath)
-			err := cmd.Run()
-			if err != nil {
-				// exit status != 0, game server is not idle, reset the count.
-				fmt.Println("Game server active, resetting count.")
-				count = 0
-			} else {
-				// exit status == 0, game server is idle, increment the count and check the threshold.
-				fmt.Println("Game server idle, incrementing count.")
-				count = count + 1
-				if count >= userData.IdleConsecutiveTimesForShutdown {
-					// We have been idle too long. Shutdown.
-					fmt.Printf("Game server has been idle too long. Calling stop and exiting.\n")
-					cmd := exec.Command(userData.StopPath)
-					err := cmd.Run()
-					if err != nil {
-						fmt.Printf("Error calling stop: %s\n", err.Error())
-					}
-
-					// Terminate the instance as well.
-					service := ec2.New(sess)
-
-					input := &ec2.TerminateInstancesInput{
-						DryRun:      aws.Bool(false),
-						InstanceIds: []*string{aws.String(instanceID)},
-					}
-
-					_, err = service.TerminateInstances(input)
-					if err != nil {
-						fmt.Printf("Terminating instances failed: %s\n", err.Error())
-					}
-					return
-				}
-			}
-			time.Sleep(time.Duration(userData.IdleInterval) * time.Second)
+	if userData.KeepAliveAddress != "" && userData.KeepAliveToken == "" {
+		return fmt.Errorf("the keep alive endpoint needs a token")
+	}
+
+	if userData.IdleWarningPeriod > 0 && !anyRCONEnabled(userData) {
+		return fmt.Errorf("idle warnings need RCON")
+	}
+
+	for _, blackout := range userData.IdleBlackouts {
+		err := validateIdleBlackout(blackout)
+		if err != nil {
+			return err
 		}
-	}()
+	}
+
+	return nil
 }
 
 func setDNS(userData *GameServerUserData, metadata *ec2metadata.EC2Metadata, sess *session.Session) error {
@@ -176,6 +1220,30 @@ func setDNS(userData *GameServerUserData, metadata *ec2metadata.EC2Metadata, ses
 		return fmt.Errorf("error getting public IP: %s", err.Error())
 	}
 
+	err = upsertDNS(userData, publicIP, sess)
+	if err != nil {
+		return err
+	}
+
+	if userData.DNSReadyName != "" && gameReady() {
+		err = upsertRecord(userData, userData.DNSReadyName, publicIP, sess)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("DNS set.")
+	watchEvent(userData, "dns-set", fmt.Sprintf("%s points at %s.", userData.DNSName, publicIP), map[string]string{"ip": publicIP})
+	return nil
+}
+
+// upsertDNS points the game's A record at the IP address.
+func upsertDNS(userData *GameServerUserData, ip string, sess *session.Session) error {
+	return upsertRecord(userData, userData.DNSName, ip, sess)
+}
+
+// upsertRecord points an A record in the game's hosted zone at the IP address.
+func upsertRecord(userData *GameServerUserData, name string, ip string, sess *session.Session) error {
 	service := route53.New(sess)
 	var ttl int64 = 300
 	input := &route53.ChangeResourceRecordSetsInput{
@@ -184,12 +1252,12 @@ func setDNS(userData *GameServerUserData, metadata *ec2metadata.EC2Metadata, ses
 				{
 					Action: aws.String("UPSERT"),
 					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(userData.DNSName),
+						Name: aws.String(name),
 						Type: aws.String("A"),
 						TTL:  &ttl,
 						ResourceRecords: []*route53.ResourceRecord{
 							{
-								Value: aws.String(publicIP),
+								Value: aws.String(ip),
 							},
 						},
 					},
@@ -200,33 +1268,108 @@ func setDNS(userData *GameServerUserData, metadata *ec2metadata.EC2Metadata, ses
 		HostedZoneId: aws.String(userData.HostedZone),
 	}
 
-	_, err = service.ChangeResourceRecordSets(input)
+	_, err := service.ChangeResourceRecordSets(input)
 	if err != nil {
 		return fmt.Errorf("error setting DNS: %s", err.Error())
 	}
 
-	fmt.Println("DNS set.")
 	return nil
 }
 
-func mountVolume(userData *GameServerUserData, instanceID string, sess *session.Session) error {
-	service := ec2.New(sess)
+// deleteDNS deletes the game's A record, and the ready record if there is one.
+func deleteDNS(userData *GameServerUserData, sess *session.Session) error {
+	if userData.DNSReadyName != "" {
+		err := deleteRecord(userData, userData.DNSReadyName, sess)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := deleteRecord(userData, userData.DNSName, sess)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("DNS deleted.")
+	return nil
+}
+
+// deleteRecord deletes an A record in the game's hosted zone. Route53 needs the record
+// exactly as it is to delete it, so it is looked up first.
+func deleteRecord(userData *GameServerUserData, recordName string, sess *session.Session) error {
+	service := route53.New(sess)
+
+	name := strings.TrimSuffix(recordName, ".") + "."
+	records, err := service.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(userData.HostedZone),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String("A"),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return fmt.Errorf("error looking up DNS: %s", err.Error())
+	}
+
+	if len(records.ResourceRecordSets) == 0 || *records.ResourceRecordSets[0].Name != name || *records.ResourceRecordSets[0].Type != "A" {
+		// Already gone.
+		return nil
+	}
+
+	input := &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{
+				{
+					Action:            aws.String("DELETE"),
+					ResourceRecordSet: records.ResourceRecordSets[0],
+				},
+			},
+			Comment: aws.String("Game Server"),
+		},
+		HostedZoneId: aws.String(userData.HostedZone),
+	}
+
+	_, err = service.ChangeResourceRecordSets(input)
+	if err != nil {
+		return fmt.Errorf("error deleting DNS: %s", err.Error())
+	}
+
+	return nil
+}
+
+// attachVolume attaches a volume to this instance as the requested device and returns
+// the device file it shows up as.
+func attachVolume(service *ec2.EC2, userData *GameServerUserData, volumeID string, device string, instanceID string) (string, error) {
+	fmt.Printf("Attaching volume %s.\n", volumeID)
 
-	fmt.Println("Attaching volume.")
+	// After a reboot the volume is still attached from the first boot.
+	attached, err := isVolumeAttached(service, volumeID, instanceID)
+	if err != nil {
+		fmt.Printf("Error checking volume attachment: %s\n", err.Error())
+	}
+	if attached {
+		fmt.Println("Volume is already attached to this instance.")
+	}
 
 	// Try for up to 2 minutes
-	attached := false
-	for i := 0; i < 24; i++ {
+	for i := 0; i < 24 && !attached; i++ {
 		input := &ec2.AttachVolumeInput{
-			Device:     aws.String("/dev/sdf"),
+			Device:     aws.String(device),
 			InstanceId: aws.String(instanceID),
-			VolumeId:   aws.String(userData.VolumeID),
+			VolumeId:   aws.String(volumeID),
 		}
 
 		_, err := service.AttachVolume(input)
 
 		if err != nil {
 			fmt.Printf("Error attaching volume: %s\n", err.Error())
+
+			// The volume is often still attached to the instance this one replaced.
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "VolumeInUse" {
+				err = detachFromDeadInstance(service, volumeID, instanceID, userData.ForceDetachGracePeriod)
+				if err != nil {
+					fmt.Printf("Error detaching volume: %s\n", err.Error())
+				}
+			}
 		} else {
 			attached = true
 			break
@@ -235,7 +1378,7 @@ func mountVolume(userData *GameServerUserData, instanceID string, sess *session.
 	}
 
 	if !attached {
-		return fmt.Errorf("errors attaching volume - giving up")
+		return "", fmt.Errorf("errors attaching volume - giving up")
 	}
 
 	fmt.Println("Volume attached. Looking for device file")
@@ -243,65 +1386,232 @@ func mountVolume(userData *GameServerUserData, instanceID string, sess *session.
 	deviceFile := ""
 	// Try for up to 2 minutes
 	for i := 0; i < 24; i++ {
-		_, err := os.Stat("/dev/xvdf")
-		_, err2 := os.Stat("/dev/nvme1n1")
-		if err == nil || err2 == nil {
-			found = true
-			if err != nil {
-				deviceFile = "/dev/nvme1n1"
-			} else {
-				deviceFile = "/dev/xvdf"
-			}
+		deviceFile, found = findDeviceFile(volumeID, device)
+		if found {
 			break
 		}
 		time.Sleep(5 * time.Second)
 	}
 
 	if !found {
-		return fmt.Errorf("Device file not found")
+		return "", fmt.Errorf("Device file not found")
 	}
+	fmt.Printf("Found device file %s.\n", deviceFile)
 
-	fmt.Println("Creating mount point.")
-	oldUMask := syscall.Umask(0)
-	err := os.Mkdir("/mnt/game", 0777)
-	if err != nil {
-		return fmt.Errorf("error creating mount point: %s", err.Error())
+	return deviceFile, nil
+}
+
+func mountVolume(userData *GameServerUserData, instanceID string, sess *session.Session) error {
+	service := ec2.New(sess)
+
+	if userData.RequireEncryptedVolume || userData.RequiredKMSKeyID != "" {
+		fmt.Println("Verifying volume encryption.")
+		for _, volumeID := range gameVolumeIDs(userData) {
+			err := verifyVolumeEncryption(service, userData, volumeID, sess)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println("Volume encryption verified.")
 	}
-	syscall.Umask(oldUMask)
 
-	fmt.Println("Mounting volume.")
-	err = syscall.Mount(deviceFile, "/mnt/game", "ext4", 0, "")
-	if err != nil {
-		return fmt.Errorf("error mounting volume: %s", err.Error())
+	for _, volumeID := range gameVolumeIDs(userData) {
+		err := acquireMountLock(service, userData, volumeID, instanceID)
+		if err != nil {
+			return err
+		}
 	}
 
-	fmt.Println("Volume mounted.")
+	var deviceFile string
+	if len(userData.VolumeIDs) > 0 {
+		deviceFiles := []string{}
+		for i, volumeID := range userData.VolumeIDs {
+			// Members are attached as /dev/sdf, /dev/sdg, and so on.
+			device := fmt.Sprintf("/dev/sd%c", 'f'+i)
+			memberFile, err := attachVolume(service, userData, volumeID, device, instanceID)
+			if err != nil {
+				return err
+			}
+			deviceFiles = append(deviceFiles, memberFile)
+		}
 
-	return nil
-}
+		var err error
+		deviceFile, err = assembleRAID(deviceFiles, userData.FileSystemType)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		deviceFile, err = attachVolume(service, userData, userData.VolumeID, "/dev/sdf", instanceID)
+		if err != nil {
+			return err
+		}
 
-func startGame(userData *GameServerUserData) error {
-	_, err := os.Stat(userData.RunPath)
-	if err != nil {
-		return fmt.Errorf("error starting game server: %s", err.Error())
+		if userData.provisioned {
+			// Double check, formatting a volume that has a filesystem would lose the game.
+			formatted, err := hasFileSystem(deviceFile)
+			if err != nil {
+				return err
+			}
+
+			if !formatted {
+				err = formatDevice(deviceFile, userData.FileSystemType)
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	fmt.Println("Starting game server.")
-	//	screen := "/usr/bin/screen -dm -S gameserver /bin/bash " + userData.RunPath
-	//	cmd := exec.Command("/bin/su", "ubuntu", "-c", screen)
-	cmd := exec.Command("/bin/su", "ubuntu", "-c", userData.RunPath)
-	cmd.Stdout = os.Stdout
+	if userData.LUKSEncrypted {
+		fmt.Println("Opening encrypted volume.")
+		key, err := getLUKSKey(userData, sess)
+		if err != nil {
+			return err
+		}
+
+		deviceFile, err = openLUKS(deviceFile, key)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Encrypted volume opened.")
+	}
 
-	err = cmd.Run()
+	mounted, err := isMounted(mountPoint)
 	if err != nil {
-		return fmt.Errorf("game server returned error: %s", err.Error())
+		return err
+	}
+
+	if mounted {
+		fmt.Println("Volume is already mounted.")
+	} else {
+		if userData.FsckBeforeMount {
+			fmt.Println("Checking filesystem.")
+			err := checkFileSystem(deviceFile, userData.FileSystemType)
+			if err != nil {
+				if userData.FsckOnFailure == "abort" {
+					return fmt.Errorf("filesystem check failed: %s", err.Error())
+				}
+				fmt.Printf("Filesystem check failed, mounting anyway: %s\n", err.Error())
+			} else {
+				fmt.Println("Filesystem check passed.")
+			}
+		}
+
+		err = createMountPoint()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Mounting %s volume.\n", userData.FileSystemType)
+		flags, data := parseMountOptions(userData.MountOptions)
+		err = syscall.Mount(deviceFile, mountPoint, userData.FileSystemType, flags, data)
+		if err != nil {
+			return fmt.Errorf("error mounting volume: %s", err.Error())
+		}
+
+		fmt.Println("Volume mounted.")
+	}
+
+	if userData.WriteFstab {
+		if userData.LUKSEncrypted || len(userData.VolumeIDs) > 0 {
+			fmt.Println("Not writing fstab for an encrypted or RAID volume.")
+		} else {
+			err = writeFstab(deviceFile, userData.FileSystemType, userData.MountOptions)
+			if err != nil {
+				fmt.Printf("Error writing fstab: %s\n", err.Error())
+			}
+		}
+	}
+
+	if userData.GrowFileSystem {
+		if userData.LUKSEncrypted {
+			err = resizeLUKS()
+			if err != nil {
+				fmt.Printf("Error resizing encrypted volume: %s\n", err.Error())
+			}
+		}
+
+		err = growFileSystem(deviceFile, userData.FileSystemType)
+		if err != nil {
+			// Not fatal, the game can still run on the filesystem it has.
+			fmt.Printf("Error growing filesystem: %s\n", err.Error())
+		}
 	}
 
-	fmt.Println("Game server done.")
 	return nil
 }
 
+// startGame runs every game until they have all exited, and returns the last error.
+func startGame(userData *GameServerUserData, instanceID string, sess *session.Session) error {
+	for _, game := range games {
+		if containerized(game.userData) {
+			pullImage(game.userData)
+			continue
+		}
+
+		_, err := os.Stat(game.userData.RunPath)
+		if err != nil {
+			return fmt.Errorf("error starting game server: %s", err.Error())
+		}
+	}
+
+	errs := make(chan error, len(games))
+	for _, game := range games {
+		go func(game *supervisor) {
+			err := game.run()
+			if game.hasGivenUp() && userData.GameCrashAction == "terminate" {
+				shutDownInstance(userData, instanceID, sess, "crash loop", "Terminating the instance after the game crashed too often.")
+			}
+			errs <- err
+		}(game)
+	}
+
+	var failed error
+	for range games {
+		err := <-errs
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "install":
+			os.Exit(runInstall(os.Args[2:]))
+		case "launch":
+			os.Exit(runLaunch(os.Args[2:]))
+		case "ssm-document":
+			os.Exit(runSSMDocument(os.Args[2:]))
+		case "provision":
+			os.Exit(runProvision(os.Args[2:]))
+		case "wake":
+			os.Exit(runWake(os.Args[2:]))
+		case "stop":
+			os.Exit(runStop(os.Args[2:]))
+		case "terminate":
+			os.Exit(runTerminate(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "pause":
+			os.Exit(runPause(os.Args[2:]))
+		case "resume":
+			os.Exit(runResume(os.Args[2:]))
+		default:
+			fmt.Printf("Unknown command %s.\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
+	startWatchdog()
+
 	metadata := ec2metadata.New(session.New())
 
 	fmt.Println("Getting user data.")
@@ -311,6 +1621,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	startStatusFile(userData)
+
 	fmt.Println("Getting instance region.")
 	region, err := getInstanceRegion(metadata)
 	if err != nil {
@@ -326,25 +1638,224 @@ func main() {
 	}
 
 	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	updateStatus(func(status *daemonStatus) {
+		status.InstanceID = instanceID
+	})
+	watchEvent(userData, "boot-started", fmt.Sprintf("Instance %s is booting.", instanceID), nil)
 
-	err = setDNS(userData, metadata, sess)
-	if err != nil {
-		fmt.Printf("Error setting DNS: %s\n", err.Error())
-		os.Exit(1)
+	if userData.RCONPasswordSecretID != "" {
+		fmt.Println("Getting RCON password.")
+		userData.RCONPassword, err = getRCONPassword(userData, sess)
+		if err != nil {
+			fmt.Printf("Error getting RCON password: %s\n", err.Error())
+			os.Exit(1)
+		}
+		for _, data := range userData.games {
+			if data.RCONPasswordSecretID != "" {
+				data.RCONPassword = userData.RCONPassword
+			}
+		}
+	}
+
+	if userData.StorageType == "ebs" && len(userData.VolumeIDs) == 0 {
+		fmt.Println("Getting instance availability zone.")
+		zone, err := getAvailabilityZone(metadata)
+		if err != nil {
+			fmt.Printf("Error getting availability zone: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if userData.VolumeID == "" {
+			userData.VolumeID, err = findAttachedVolume(userData, instanceID, sess)
+			if err != nil {
+				fmt.Printf("Error looking for an attached volume: %s\n", err.Error())
+				os.Exit(1)
+			}
+			if userData.VolumeID != "" {
+				fmt.Printf("Resuming with volume %s still attached.\n", userData.VolumeID)
+			}
+		}
+
+		if userData.VolumeID == "" {
+			if userData.SnapshotID != "" || len(userData.SnapshotTags) > 0 {
+				userData.VolumeID, err = createVolumeFromSnapshot(userData, zone, sess)
+			} else {
+				userData.VolumeID, err = findOrProvisionVolume(userData, zone, sess)
+			}
+			if err != nil {
+				fmt.Printf("Error creating volume: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+
+		userData.VolumeID, err = moveVolumeToZone(userData, zone, sess)
+		if err != nil {
+			fmt.Printf("Error moving volume to %s: %s\n", zone, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if userData.DNSReadyCheck == nil || userData.DNSReadyName != "" {
+		err = setDNS(userData, metadata, sess)
+		if err != nil {
+			fmt.Printf("Error setting DNS: %s\n", err.Error())
+			os.Exit(1)
+		}
 	}
 
-	err = mountVolume(userData, instanceID, sess)
+	switch userData.StorageType {
+	case "efs":
+		err = mountEFS(userData, region)
+	case "s3":
+		err = createMountPoint()
+		if err == nil {
+			err = downloadFromS3(userData, sess)
+		}
+	case "instance-store":
+		err = mountInstanceStore(userData)
+		if err == nil {
+			err = downloadFromS3(userData, sess)
+		}
+	default:
+		err = mountVolume(userData, instanceID, sess)
+	}
 	if err != nil {
 		fmt.Printf("Error mounting volume: %s\n", err.Error())
+		releaseVolume(userData, instanceID, sess)
 		os.Exit(1)
 	}
 
-	checkTermination(userData)
+	updateStatus(func(status *daemonStatus) {
+		status.Mount = &mountStatus{Path: mountPoint, StorageType: userData.StorageType}
+		if userData.StorageType == "ebs" {
+			status.Mount.VolumeIDs = gameVolumeIDs(userData)
+		}
+	})
+	watchEvent(userData, "volume-mounted", fmt.Sprintf("The game storage is mounted on %s.", mountPoint), nil)
+	deleteStaleVolumes(sess)
+
+	if userData.StorageType == "ebs" && (userData.VolumeIOPS > 0 || userData.VolumeThroughput > 0) {
+		tuneVolumePerformance(userData, sess)
+	}
+
+	if userData.DiskFreeThresholdPercent > 0 && userData.StorageType != "efs" {
+		monitorDiskSpace(userData, sess)
+	}
+
+	if userData.SnapshotInterval > 0 {
+		snapshotPeriodically(userData, sess)
+	}
+
+	if userData.SessionSource != "" {
+		trackSessions(userData, sess)
+	}
+
+	for _, data := range userData.games {
+		game := newSupervisor(data, sess)
+		if userData.Console {
+			game.console, err = serveConsole(data)
+			if err != nil {
+				// The game runs fine without it.
+				fmt.Printf("Error starting console: %s\n", err.Error())
+			}
+		}
+		games = append(games, game)
+	}
+
+	handleSignals(userData)
+
+	serveControlSocket(userData, instanceID, sess)
+	if userData.ControlAddress != "" {
+		serveControl(userData, instanceID, sess)
+	}
+
+	if userData.DiscordTokenSecretID != "" {
+		runDiscordBot(userData, instanceID, sess)
+	}
+
+	if userData.CommandQueueURL != "" {
+		watchCommandQueue(userData, instanceID, sess)
+	}
+
+	if userData.PublicStatusAddress != "" {
+		servePublicStatus(userData)
+	}
+
+	if userData.PrometheusAddress != "" {
+		servePrometheus(userData)
+	}
+
+	if userData.MQTTBroker != "" {
+		publishMQTT(userData)
+	}
+
+	if userData.SlackWebhookURL != "" {
+		postSlackEvents(userData)
+	}
+
+	if userData.SlackCommandAddress != "" {
+		serveSlackCommands(userData, instanceID, sess)
+	}
+
+	autoScalingGroup, err = findAutoScalingGroup(instanceID, metadata, sess)
+	if err != nil {
+		// Shutdown still works without the group, the hook just has to time out.
+		fmt.Printf("Error finding auto scaling group: %s\n", err.Error())
+	} else if autoScalingGroup != "" {
+		fmt.Printf("Running in auto scaling group %s.\n", autoScalingGroup)
+	}
+
+	ec2Fleet, err = findFleet(instanceID, sess)
+	if err != nil {
+		// Shutting down still terminates the instance, but the fleet will replace it.
+		fmt.Printf("Error finding fleet: %s\n", err.Error())
+	} else if ec2Fleet != "" {
+		fmt.Printf("Running in fleet %s.\n", ec2Fleet)
+	}
+
+	checkTermination(userData, instanceID, metadata, sess)
 
-	checkIdle(userData, instanceID, sess)
+	checkIdle(userData, instanceID, metadata, sess)
 
-	err = startGame(userData)
+	if userData.MonthlyBudget > 0 {
+		trackBudget(userData, instanceID, sess)
+	}
+
+	if userData.RestartSchedule != "" {
+		scheduleRestarts(userData)
+	}
+
+	setStatusState("running")
+
+	if userData.DNSReadyCheck != nil {
+		publishWhenReady(userData, metadata, sess)
+	}
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	err = startGame(userData, instanceID, sess)
 	if err != nil {
 		fmt.Printf("Error starting game: %s\n", err.Error())
 	}
+
+	shuttingDown.Wait()
+
+	if userData.GameCrashAction == "keep" {
+		for _, game := range games {
+			if game.hasGivenUp() {
+				// Still watching for interruptions, which shut down as usual, until the daemon
+				// is told to stop.
+				fmt.Println("Keeping the instance up with the volume mounted for debugging.")
+				setStatusState("crashed")
+				<-stopRequested
+				break
+			}
+		}
+	}
+
+	releaseVolume(userData, instanceID, sess)
+	waitForWebhooks(30 * time.Second)
 }
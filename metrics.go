@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// putIdleMetrics publishes what the idle check saw to CloudWatch, with the game name as the
+// dimension. The player count is left out when the probes can't tell.
+func putIdleMetrics(userData *GameServerUserData, sess *session.Session, idle bool, players int, streak int, uptime time.Duration) {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("Game"), Value: aws.String(userData.GameName)},
+	}
+	now := time.Now()
+
+	idleValue := 0.0
+	if idle {
+		idleValue = 1
+	}
+
+	data := []*cloudwatch.MetricDatum{
+		{
+			MetricName: aws.String("Idle"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(idleValue),
+			Unit:       aws.String(cloudwatch.StandardUnitNone),
+		},
+		{
+			MetricName: aws.String("IdleStreak"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(float64(streak)),
+			Unit:       aws.String(cloudwatch.StandardUnitCount),
+		},
+		{
+			MetricName: aws.String("Uptime"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(uptime.Seconds()),
+			Unit:       aws.String(cloudwatch.StandardUnitSeconds),
+		},
+	}
+	if players >= 0 {
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String("PlayersOnline"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(float64(players)),
+			Unit:       aws.String(cloudwatch.StandardUnitCount),
+		})
+	}
+
+	_, err := cloudwatch.New(sess).PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(userData.MetricsNamespace),
+		MetricData: data,
+	})
+	if err != nil {
+		fmt.Printf("Error publishing metrics: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// minecraftStatus is the part of the server list ping response the daemon uses.
+// Description is the MOTD, either a string or a chat component.
+type minecraftStatus struct {
+	Version struct {
+		Name string `json:"name"`
+	} `json:"version"`
+	Description json.RawMessage `json:"description"`
+	Players     struct {
+		Online int `json:"online"`
+		Max    int `json:"max"`
+		Sample []struct {
+			Name string `json:"name"`
+		} `json:"sample"`
+	} `json:"players"`
+}
+
+// minecraftChecker asks a Minecraft server how many players are online with a server list
+// ping, the same request the multiplayer screen makes.
+type minecraftChecker struct {
+	address string
+}
+
+func (c *minecraftChecker) check() (bool, int, error) {
+	status, err := pingMinecraft(c.address, 5*time.Second)
+	if err != nil {
+		return false, -1, err
+	}
+
+	return status.Players.Online == 0, status.Players.Online, nil
+}
+
+// playerNames returns the players in the status sample. Servers only include up to a dozen,
+// and some hide them.
+func (c *minecraftChecker) playerNames() ([]string, error) {
+	status, err := pingMinecraft(c.address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, player := range status.Players.Sample {
+		names = append(names, player.Name)
+	}
+	return names, nil
+}
+
+// pingMinecraft gets the server's status with the server list ping protocol.
+func pingMinecraft(address string, timeout time.Duration) (*minecraftStatus, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %s", address, err.Error())
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portString)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %s", address, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Handshake: protocol version -1 since any will do for status, the address, and next
+	// state 1 for status.
+	var handshake bytes.Buffer
+	writeVarInt(&handshake, 0x00)
+	writeVarInt(&handshake, -1)
+	writeVarInt(&handshake, int32(len(host)))
+	handshake.WriteString(host)
+	binary.Write(&handshake, binary.BigEndian, uint16(port))
+	writeVarInt(&handshake, 1)
+
+	// Status request, which has no fields.
+	var request bytes.Buffer
+	writeVarInt(&request, 0x00)
+
+	var packets bytes.Buffer
+	for _, packet := range []*bytes.Buffer{&handshake, &request} {
+		writeVarInt(&packets, int32(packet.Len()))
+		packets.Write(packet.Bytes())
+	}
+	_, err = conn.Write(packets.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error sending status request: %s", err.Error())
+	}
+
+	reader := bufio.NewReader(conn)
+	length, err := readVarInt(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status response: %s", err.Error())
+	}
+	if length <= 0 || length > 1<<21 {
+		return nil, fmt.Errorf("status response has bad length %d", length)
+	}
+
+	packet := make([]byte, length)
+	_, err = io.ReadFull(reader, packet)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status response: %s", err.Error())
+	}
+
+	body := bytes.NewReader(packet)
+	id, err := readVarInt(body)
+	if err != nil || id != 0x00 {
+		return nil, fmt.Errorf("unexpected status response packet")
+	}
+	jsonLength, err := readVarInt(body)
+	if err != nil || jsonLength < 0 || int(jsonLength) > body.Len() {
+		return nil, fmt.Errorf("status response is malformed")
+	}
+	contents := make([]byte, jsonLength)
+	io.ReadFull(body, contents)
+
+	status := &minecraftStatus{}
+	err = json.Unmarshal(contents, status)
+	if err != nil {
+		return nil, fmt.Errorf("status response was malformed: %s", err.Error())
+	}
+
+	return status, nil
+}
+
+// writeVarInt writes a protocol VarInt, seven bits at a time with the high bit set on every
+// byte but the last. Negative numbers take the full five bytes.
+func writeVarInt(buffer *bytes.Buffer, value int32) {
+	unsigned := uint32(value)
+	for {
+		if unsigned&^0x7f == 0 {
+			buffer.WriteByte(byte(unsigned))
+			return
+		}
+		buffer.WriteByte(byte(unsigned&0x7f | 0x80))
+		unsigned >>= 7
+	}
+}
+
+// readVarInt reads a protocol VarInt.
+func readVarInt(reader io.ByteReader) (int32, error) {
+	var value uint32
+	for i := uint(0); i < 5; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+
+	return 0, fmt.Errorf("VarInt is too long")
+}
+
+// minecraftText returns the plain text of a chat component, or of a plain string.
+func minecraftText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+
+	var component struct {
+		Text  string            `json:"text"`
+		Extra []json.RawMessage `json:"extra"`
+	}
+	if json.Unmarshal(raw, &component) != nil {
+		return ""
+	}
+
+	text = component.Text
+	for _, extra := range component.Extra {
+		text += minecraftText(extra)
+	}
+	return text
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// mqttKeepAlive is how long the broker waits without hearing from the daemon before
+// dropping it. The daemon pings at half that.
+const mqttKeepAlive = 60 * time.Second
+
+// mqttClient publishes to an MQTT broker with MQTT 3.1.1, at most once, which is all the
+// status needs. It reconnects whenever a publish finds the connection gone.
+type mqttClient struct {
+	userData *GameServerUserData
+	conn     net.Conn
+}
+
+// publishMQTT publishes the daemon's state and players online, retained, to MQTTTopic/state
+// and MQTTTopic/players whenever they change, and every event as JSON to
+// MQTTTopic/events.
+func publishMQTT(userData *GameServerUserData) {
+	client := &mqttClient{userData: userData}
+	events, _ := followEvents()
+
+	go func() {
+		state := ""
+		players := -2
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event := <-events:
+				payload, err := json.Marshal(event)
+				if err == nil {
+					err = client.publish(userData.MQTTTopic+"/events", payload, false)
+				}
+				if err != nil {
+					fmt.Printf("Error publishing to MQTT: %s\n", err.Error())
+				}
+			case <-ticker.C:
+				err := client.ping()
+				if err != nil {
+					fmt.Printf("Error pinging MQTT broker: %s\n", err.Error())
+				}
+			}
+
+			current := currentStatus()
+			if current.State != state {
+				err := client.publish(userData.MQTTTopic+"/state", []byte(current.State), true)
+				if err != nil {
+					fmt.Printf("Error publishing to MQTT: %s\n", err.Error())
+				} else {
+					state = current.State
+				}
+			}
+			if current.Players != players {
+				err := client.publish(userData.MQTTTopic+"/players", []byte(strconv.Itoa(current.Players)), true)
+				if err != nil {
+					fmt.Printf("Error publishing to MQTT: %s\n", err.Error())
+				} else {
+					players = current.Players
+				}
+			}
+		}
+	}()
+	fmt.Printf("Publishing status to MQTT topic %s.\n", userData.MQTTTopic)
+}
+
+// publish publishes the payload to the topic at QoS 0.
+func (c *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	var flags byte = 0x30
+	if retain {
+		flags |= 0x01
+	}
+
+	body := append(mqttString(topic), payload...)
+	return c.send(flags, body)
+}
+
+// ping keeps the connection open while there is nothing to publish.
+func (c *mqttClient) ping() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.send(0xC0, nil)
+}
+
+// send writes a packet, dropping the connection if it fails so the next publish reconnects.
+func (c *mqttClient) send(header byte, body []byte) error {
+	packet := append([]byte{header}, mqttLength(len(body))...)
+	packet = append(packet, body...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// connect connects to MQTTBroker, if not already connected. The broker is a URL like
+// tcp://host:1883, or tls://host:8883 for AWS IoT Core, which also needs the client
+// certificate. The broker's answers to pings are read and thrown away in the background.
+func (c *mqttClient) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+
+	broker, err := url.Parse(c.userData.MQTTBroker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker: %s", err.Error())
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch broker.Scheme {
+	case "tls", "ssl", "mqtts":
+		config, err := c.tlsConfig(broker.Hostname())
+		if err != nil {
+			return err
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", broker.Host, config)
+		if err != nil {
+			return err
+		}
+	default:
+		conn, err = dialer.Dial("tcp", broker.Host)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Variable header: protocol name and level 4 (3.1.1), flags, keep alive.
+	var flags byte = 0x02 // clean session
+	if c.userData.MQTTUsername != "" {
+		flags |= 0x80
+		if c.userData.MQTTPassword != "" {
+			flags |= 0x40
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags)
+	body = append(body, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	body = append(body, mqttString(c.userData.MQTTClientID)...)
+	if c.userData.MQTTUsername != "" {
+		body = append(body, mqttString(c.userData.MQTTUsername)...)
+		if c.userData.MQTTPassword != "" {
+			body = append(body, mqttString(c.userData.MQTTPassword)...)
+		}
+	}
+
+	packet := append([]byte{0x10}, mqttLength(len(body))...)
+	packet = append(packet, body...)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(packet)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	var ack [4]byte
+	_, err = io.ReadFull(conn, ack[:])
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error reading MQTT connect acknowledgement: %s", err.Error())
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("MQTT broker refused the connection with code %d", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	go io.Copy(ioutil.Discard, conn)
+	c.conn = conn
+	return nil
+}
+
+// tlsConfig is the TLS configuration for the broker, trusting MQTTCACert as well as the
+// system's CAs, and presenting MQTTClientCert if given.
+func (c *mqttClient) tlsConfig(serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+
+	if c.userData.MQTTCACert != "" {
+		pem, err := ioutil.ReadFile(c.userData.MQTTCACert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading MQTT CA: %s", err.Error())
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in MQTT CA %s", c.userData.MQTTCACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.userData.MQTTClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(c.userData.MQTTClientCert, c.userData.MQTTClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading MQTT client certificate: %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// mqttString encodes a string as MQTT does, prefixed with its length.
+func mqttString(value string) []byte {
+	encoded := make([]byte, 2, 2+len(value))
+	binary.BigEndian.PutUint16(encoded, uint16(len(value)))
+	return append(encoded, value...)
+}
+
+// mqttLength encodes a packet's remaining length, seven bits a byte.
+func mqttLength(length int) []byte {
+	encoded := []byte{}
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
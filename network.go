@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accountingChain is the iptables chain whose rules count the game port traffic. Its rules
+// have no target, so they only count packets and never change what happens to them.
+const accountingChain = "GAMESERVER-ACCT"
+
+// networkChecker samples traffic and finds the game idle when the rate since the last
+// sample is below the threshold. With ports it counts the traffic to and from them with
+// iptables, otherwise everything through the interface, which includes the daemon's own
+// traffic.
+type networkChecker struct {
+	iface          string
+	ports          []int
+	bytesPerSecond int64
+
+	lastBytes int64
+	lastTime  time.Time
+}
+
+func (c *networkChecker) check() (bool, int, error) {
+	var bytes int64
+	var err error
+	if len(c.ports) > 0 {
+		bytes, err = accountedBytes()
+	} else {
+		bytes, err = interfaceBytes(c.iface)
+	}
+	if err != nil {
+		return false, -1, err
+	}
+
+	now := time.Now()
+	lastBytes, lastTime := c.lastBytes, c.lastTime
+	c.lastBytes, c.lastTime = bytes, now
+
+	if lastTime.IsZero() || bytes < lastBytes {
+		// Nothing to compare with yet, or the counters were reset.
+		return false, -1, nil
+	}
+
+	rate := int64(float64(bytes-lastBytes) / now.Sub(lastTime).Seconds())
+	fmt.Printf("Game traffic is %d bytes per second.\n", rate)
+
+	return rate < c.bytesPerSecond, -1, nil
+}
+
+// defaultInterface returns the interface the default route goes through.
+func defaultInterface() (string, error) {
+	contents, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", fmt.Errorf("error reading routes: %s", err.Error())
+	}
+
+	for _, line := range strings.Split(string(contents), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("no default route")
+}
+
+// interfaceBytes returns the bytes received and sent through the interface.
+func interfaceBytes(iface string) (int64, error) {
+	var total int64
+	for _, counter := range []string{"rx_bytes", "tx_bytes"} {
+		contents, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "statistics", counter))
+		if err != nil {
+			return 0, fmt.Errorf("error reading %s counter: %s", iface, err.Error())
+		}
+
+		value, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s counter is malformed", iface)
+		}
+		total += value
+	}
+
+	return total, nil
+}
+
+// setUpAccounting creates the accounting chain, with a rule for each direction of each
+// port over TCP and UDP, and sends all traffic through it. It starts from scratch in case
+// an earlier run left the chain behind.
+func setUpAccounting(ports []int) error {
+	runIptables("-D", "INPUT", "-j", accountingChain)
+	runIptables("-D", "OUTPUT", "-j", accountingChain)
+	runIptables("-F", accountingChain)
+	runIptables("-X", accountingChain)
+
+	err := runIptables("-N", accountingChain)
+	if err != nil {
+		return err
+	}
+
+	for _, port := range ports {
+		for _, protocol := range []string{"tcp", "udp"} {
+			for _, direction := range []string{"--dport", "--sport"} {
+				err = runIptables("-A", accountingChain, "-p", protocol, direction, strconv.Itoa(port))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, chain := range []string{"INPUT", "OUTPUT"} {
+		err = runIptables("-I", chain, "-j", accountingChain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// accountedBytes returns the bytes counted by the accounting chain's rules.
+func accountedBytes() (int64, error) {
+	output, err := exec.Command("/usr/sbin/iptables", "-w", "-L", accountingChain, "-v", "-x", "-n").Output()
+	if err != nil {
+		return 0, fmt.Errorf("error reading traffic counters: %s", err.Error())
+	}
+
+	// The first two lines are the chain and column headers, the second column is bytes.
+	var total int64
+	for _, line := range strings.Split(string(output), "\n")[2:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			total += value
+		}
+	}
+
+	return total, nil
+}
+
+// runIptables runs iptables, waiting for the lock if something else holds it.
+func runIptables(args ...string) error {
+	output, err := exec.Command("/usr/sbin/iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running iptables %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// notify logs a notification and publishes it to the SNS topic, if one is configured.
+func notify(userData *GameServerUserData, sess *session.Session, subject string, message string) {
+	fmt.Printf("%s: %s\n", subject, message)
+
+	if userData.NotifyTopicARN == "" {
+		return
+	}
+
+	_, err := sns.New(sess).Publish(&sns.PublishInput{
+		TopicArn: aws.String(userData.NotifyTopicARN),
+		Subject:  aws.String(fmt.Sprintf("[%s] %s", userData.GameName, subject)),
+		Message:  aws.String(message),
+	})
+	if err != nil {
+		fmt.Printf("Error publishing notification: %s\n", err.Error())
+	}
+}
+
+// gameEvent is a lifecycle event, published as JSON for anything reading the topic with
+// code. Event is one of interruption, stopped, snapshot, stopping, hibernating, or
+// terminating, and on the control API and webhooks also the events watchEvent lists.
+type gameEvent struct {
+	Event      string            `json:"event"`
+	Game       string            `json:"game"`
+	InstanceID string            `json:"instanceId,omitempty"`
+	Time       time.Time         `json:"time"`
+	Message    string            `json:"message"`
+	Detail     map[string]string `json:"detail,omitempty"`
+}
+
+// publishEvent logs an event and publishes it to the event topic, if one is configured.
+// Email and SMS subscribers get the readable message instead of the JSON, and the event
+// name is set as a message attribute so subscriptions can filter on it.
+func publishEvent(userData *GameServerUserData, instanceID string, sess *session.Session, event string, message string, detail map[string]string) {
+	fmt.Printf("Event %s: %s\n", event, message)
+	watchEvent(userData, event, message, detail)
+
+	if userData.EventTopicARN == "" {
+		return
+	}
+
+	body, err := json.Marshal(gameEvent{
+		Event:      event,
+		Game:       userData.GameName,
+		InstanceID: instanceID,
+		Time:       time.Now().UTC(),
+		Message:    message,
+		Detail:     detail,
+	})
+	if err != nil {
+		fmt.Printf("Error encoding event: %s\n", err.Error())
+		return
+	}
+
+	structured, err := json.Marshal(map[string]string{
+		"default": string(body),
+		"email":   message,
+		"sms":     fmt.Sprintf("[%s] %s", userData.GameName, message),
+	})
+	if err != nil {
+		fmt.Printf("Error encoding event: %s\n", err.Error())
+		return
+	}
+
+	// Events are published in the middle of shutting down, so don't let a slow SNS hold
+	// that up.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = sns.New(sess).PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn:         aws.String(userData.EventTopicARN),
+		Subject:          aws.String(fmt.Sprintf("[%s] %s", userData.GameName, event)),
+		Message:          aws.String(string(structured)),
+		MessageStructure: aws.String("json"),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"event": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(event),
+			},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Error publishing event: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/pricing"
+)
+
+// priceListProduct is the part of a price list entry holding the on-demand price.
+type priceListProduct struct {
+	Terms struct {
+		OnDemand map[string]struct {
+			PriceDimensions map[string]struct {
+				PricePerUnit map[string]string `json:"pricePerUnit"`
+			} `json:"priceDimensions"`
+		} `json:"OnDemand"`
+	} `json:"terms"`
+}
+
+// onDemandPrice returns the on-demand price of a Linux instance of the type in the region, in
+// dollars an hour, from the price list.
+func onDemandPrice(sess *session.Session, region string, instanceType string) (float64, error) {
+	// The price list is only served from a few regions, but covers them all.
+	service := pricing.New(sess, aws.NewConfig().WithRegion("us-east-1"))
+
+	filters := []*pricing.Filter{}
+	for field, value := range map[string]string{
+		"regionCode":      region,
+		"instanceType":    instanceType,
+		"operatingSystem": "Linux",
+		"tenancy":         "Shared",
+		"preInstalledSw":  "NA",
+		"capacitystatus":  "Used",
+		"licenseModel":    "No License required",
+	} {
+		filters = append(filters, &pricing.Filter{
+			Type:  aws.String(pricing.FilterTypeTermMatch),
+			Field: aws.String(field),
+			Value: aws.String(value),
+		})
+	}
+
+	output, err := service.GetProducts(&pricing.GetProductsInput{
+		ServiceCode: aws.String("AmazonEC2"),
+		Filters:     filters,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting the on-demand price: %s", err.Error())
+	}
+
+	for _, item := range output.PriceList {
+		content, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		product := priceListProduct{}
+		if json.Unmarshal(content, &product) != nil {
+			continue
+		}
+		for _, term := range product.Terms.OnDemand {
+			for _, dimension := range term.PriceDimensions {
+				price, err := strconv.ParseFloat(dimension.PricePerUnit["USD"], 64)
+				if err == nil && price > 0 {
+					return price, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("no on-demand price for %s in %s", instanceType, region)
+}
+
+// launchOnDemand launches the instance on demand instead of as spot, trying the subnets in
+// order. Nothing is launched if the on-demand price is over maxPrice dollars an hour, when
+// given.
+func launchOnDemand(sess *session.Session, service *ec2.EC2, input *ec2.RunInstancesInput, subnets []string, maxPrice string) (*ec2.Reservation, error) {
+	instanceType := aws.StringValue(input.InstanceType)
+	if maxPrice != "" {
+		limit, err := strconv.ParseFloat(maxPrice, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid on-demand price cap %q", maxPrice)
+		}
+
+		price, err := onDemandPrice(sess, aws.StringValue(service.Config.Region), instanceType)
+		if err != nil {
+			return nil, err
+		}
+		if price > limit {
+			return nil, fmt.Errorf("on-demand %s is $%.4f/hour, over the cap of $%.4f", instanceType, price, limit)
+		}
+	}
+
+	input.InstanceMarketOptions = nil
+	if len(subnets) == 0 {
+		subnets = []string{aws.StringValue(input.SubnetId)}
+	}
+
+	var reservation *ec2.Reservation
+	var err error
+	for _, subnet := range subnets {
+		where := "the default subnet"
+		if subnet != "" {
+			input.SubnetId = aws.String(subnet)
+			where = subnet
+		}
+		fmt.Printf("Launching on-demand %s in %s.\n", instanceType, where)
+		reservation, err = service.RunInstances(input)
+		if err == nil {
+			return reservation, nil
+		}
+		fmt.Printf("Error launching on-demand in %s: %s\n", where, err.Error())
+	}
+	return nil, fmt.Errorf("error launching on-demand instance: %s", err.Error())
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// runPause stops the game's instance from a workstation, as "aws-spot-game-server pause
+// -profile <name>", keeping its root volume and the game's volume attached so resume brings
+// it back quickly. The daemon shuts the game down gracefully when the instance stops. Spot
+// instances can only be paused when launched from a persistent request. It returns the exit
+// status.
+func runPause(args []string) int {
+	flags := flag.NewFlagSet("pause", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	wait := flags.Duration("wait", 10*time.Minute, "how long to wait for the instance to stop, 0 to not wait")
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	service := ec2.New(sess)
+	instance, err := findGameInstance(service, profile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	instanceID := aws.StringValue(instance.InstanceId)
+
+	if state := aws.StringValue(instance.State.Name); state != ec2.InstanceStateNameRunning {
+		fmt.Printf("%s is %s, not running.\n", instanceID, state)
+		return 1
+	}
+
+	err = stopInstance(instanceID, false, sess)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Pausing %s.\n", instanceID)
+
+	if *wait == 0 {
+		return 0
+	}
+
+	err = waitForState(service, instanceID, ec2.InstanceStateNameStopped, *wait)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("%s is paused. Resume it with: aws-spot-game-server resume -profile %s\n", instanceID, profile.name)
+	return 0
+}
+
+// runResume starts the game's stopped instance again from a workstation, as
+// "aws-spot-game-server resume -profile <name>". It returns the exit status.
+func runResume(args []string) int {
+	flags := flag.NewFlagSet("resume", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	wait := flags.Duration("wait", 10*time.Minute, "how long to wait for the instance to run, 0 to not wait")
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	service := ec2.New(sess)
+	instance, err := findGameInstance(service, profile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	instanceID := aws.StringValue(instance.InstanceId)
+
+	if state := aws.StringValue(instance.State.Name); state != ec2.InstanceStateNameStopped {
+		fmt.Printf("%s is %s, not stopped.\n", instanceID, state)
+		return 1
+	}
+
+	err = checkBudget(profile.gameData, sess)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	_, err = service.StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{aws.String(instanceID)}})
+	if err != nil {
+		fmt.Printf("Error starting %s: %s\n", instanceID, err.Error())
+		if strings.Contains(err.Error(), "IncorrectSpotRequestState") {
+			fmt.Println("The spot request is waiting for capacity, AWS will start the instance once there is some.")
+		}
+		return 1
+	}
+	fmt.Printf("Resuming %s.\n", instanceID)
+
+	if *wait == 0 {
+		return 0
+	}
+
+	instance, err = waitForRunning(service, instanceID, *wait)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("%s is running", instanceID)
+	if instance.PublicIpAddress != nil {
+		fmt.Printf(" at %s", aws.StringValue(instance.PublicIpAddress))
+	}
+	fmt.Println(".")
+	return 0
+}
+
+// waitForState waits for the instance to reach the state, for up to the timeout.
+func waitForState(service *ec2.EC2, instanceID string, state string, timeout time.Duration) error {
+	fmt.Printf("Waiting for %s to be %s.\n", instanceID, state)
+	deadline := time.Now().Add(timeout)
+	for {
+		instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		})
+		if err == nil && len(instances.Reservations) > 0 && len(instances.Reservations[0].Instances) > 0 {
+			if aws.StringValue(instances.Reservations[0].Instances[0].State.Name) == state {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gave up waiting for %s to be %s", instanceID, state)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// cancelSpotRequest cancels the persistent spot request the instance was launched from, if
+// any, so terminating the instance on purpose doesn't have the request launch another.
+func cancelSpotRequest(sess *session.Session, instanceID string) error {
+	service := ec2.New(sess)
+	instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing instance: %s", err.Error())
+	}
+	if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		return nil
+	}
+
+	requestID := instances.Reservations[0].Instances[0].SpotInstanceRequestId
+	if requestID == nil {
+		return nil
+	}
+
+	requests, err := service.DescribeSpotInstanceRequests(&ec2.DescribeSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{requestID},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing spot request: %s", err.Error())
+	}
+	if len(requests.SpotInstanceRequests) == 0 || aws.StringValue(requests.SpotInstanceRequests[0].Type) != ec2.SpotInstanceTypePersistent {
+		return nil
+	}
+
+	_, err = service.CancelSpotInstanceRequests(&ec2.CancelSpotInstanceRequestsInput{
+		SpotInstanceRequestIds: []*string{requestID},
+	})
+	if err != nil {
+		return fmt.Errorf("error cancelling spot request %s: %s", aws.StringValue(requestID), err.Error())
+	}
+	fmt.Printf("Cancelled persistent spot request %s.\n", aws.StringValue(requestID))
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// shutdownDeadlineMargin is kept free before an interruption deadline, since the instance
+// can go away a little before the time in the notice.
+const shutdownDeadlineMargin = 10 * time.Second
+
+// setShutdownStepDefaults fills in a step's timeout and priority. Warning the players only
+// takes a moment and is what they notice, so it is as important as saving and stopping.
+func setShutdownStepDefaults(step *ShutdownStep) {
+	if step.Timeout <= 0 {
+		switch step.Action {
+		case "warn":
+			step.Timeout = 5
+		case "delete-dns", "point-dns":
+			step.Timeout = 10
+		case "save":
+			step.Timeout = 15
+		case "snapshot", "logs":
+			step.Timeout = 20
+		case "stop", "release":
+			step.Timeout = 45
+		default:
+			step.Timeout = 30
+		}
+	}
+
+	if step.Priority <= 0 {
+		switch step.Action {
+		case "warn", "stop", "save":
+			step.Priority = 1
+		case "release":
+			step.Priority = 2
+		case "snapshot":
+			step.Priority = 3
+		default:
+			step.Priority = 4
+		}
+	}
+}
+
+// validateShutdownStep makes sure a shutdown step can be run.
+func validateShutdownStep(userData *GameServerUserData, step ShutdownStep) error {
+	switch step.Action {
+	case "exec":
+		if step.Path == "" {
+			return fmt.Errorf("exec shutdown steps need a path")
+		}
+	case "snapshot":
+		if userData.StorageType != "ebs" || len(userData.VolumeIDs) > 0 {
+			return fmt.Errorf("snapshot shutdown steps need a single EBS volume")
+		}
+	case "warn", "save":
+		if !anyRCONEnabled(userData) {
+			return fmt.Errorf("%s shutdown steps need RCON", step.Action)
+		}
+	case "point-dns":
+		if net.ParseIP(userData.DNSShutdownTarget).To4() == nil {
+			return fmt.Errorf("point-dns shutdown steps need a DNS shutdown target")
+		}
+	case "logs":
+		if userData.LogBucket == "" {
+			return fmt.Errorf("logs shutdown steps need a log bucket")
+		}
+	case "stop", "delete-dns", "release":
+	default:
+		return fmt.Errorf("unknown shutdown step: %s", step.Action)
+	}
+
+	return nil
+}
+
+// runShutdownSteps runs the shutdown steps in order within the shutdown budget. The
+// deadline is when the instance goes away, or zero if that isn't known. Each step gets what
+// shutdownStepTimeout leaves it, and is skipped if nothing is left.
+func runShutdownSteps(userData *GameServerUserData, instanceID string, sess *session.Session, steps []ShutdownStep, reason string, deadline time.Time) {
+	budgetEnd := time.Now().Add(time.Duration(userData.ShutdownBudget) * time.Second)
+	if !deadline.IsZero() && deadline.Add(-shutdownDeadlineMargin).Before(budgetEnd) {
+		budgetEnd = deadline.Add(-shutdownDeadlineMargin)
+	}
+	fmt.Printf("Shutting down with a budget of %s.\n", time.Until(budgetEnd).Round(time.Second))
+
+	for i, step := range steps {
+		timeout := shutdownStepTimeout(steps, i, time.Until(budgetEnd))
+		if timeout <= 0 {
+			fmt.Printf("Skipping shutdown step %d: %s, out of time.\n", i+1, step.Action)
+			continue
+		}
+
+		fmt.Printf("Shutdown step %d: %s, with %s.\n", i+1, step.Action, timeout.Round(time.Second))
+		start := time.Now()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := runShutdownStep(ctx, userData, instanceID, sess, step, reason, deadline)
+		cancel()
+
+		if err != nil {
+			fmt.Printf("Shutdown step %s failed after %s: %s\n", step.Action, time.Since(start).Round(time.Millisecond), err.Error())
+		} else {
+			fmt.Printf("Shutdown step %s done in %s.\n", step.Action, time.Since(start).Round(time.Millisecond))
+			if step.Action == "stop" {
+				publishEvent(userData, instanceID, sess, "stopped", "The game server stopped cleanly.", nil)
+			}
+		}
+	}
+}
+
+// shutdownStepTimeout returns how long step i can have with the remaining budget. The time
+// the later, more important steps could need is set aside first, and the step gets what is
+// left, up to its own timeout.
+func shutdownStepTimeout(steps []ShutdownStep, i int, remaining time.Duration) time.Duration {
+	var reserved time.Duration
+	for _, later := range steps[i+1:] {
+		if later.Priority < steps[i].Priority {
+			reserved += time.Duration(later.Timeout) * time.Second
+		}
+	}
+
+	timeout := time.Duration(steps[i].Timeout) * time.Second
+	if available := remaining - reserved; available < timeout {
+		timeout = available
+	}
+	return timeout
+}
+
+// runShutdownStep runs a single step, giving up on it if the context ends first.
+func runShutdownStep(ctx context.Context, userData *GameServerUserData, instanceID string, sess *session.Session, step ShutdownStep, reason string, deadline time.Time) error {
+	if step.Action == "exec" {
+		return runCommandContext(ctx, step.Path, step.Args...)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		switch step.Action {
+		case "warn":
+			remaining := "a moment"
+			if !deadline.IsZero() {
+				remaining = fmt.Sprintf("%d seconds", int(time.Until(deadline).Seconds()))
+			}
+			message := strings.Replace(userData.TerminationWarningMessage, "{remaining}", remaining, -1)
+			done <- rconEveryGame(userData, userData.RCONSayCommand+" "+message)
+		case "save":
+			done <- rconEveryGame(userData, userData.RCONSaveCommand)
+		case "stop":
+			done <- stopGame(ctx, userData)
+		case "snapshot":
+			done <- snapshotOnShutdown(userData, reason, sess)
+		case "delete-dns":
+			done <- deleteDNS(userData, sess)
+		case "point-dns":
+			err := upsertDNS(userData, userData.DNSShutdownTarget, sess)
+			if err == nil && userData.DNSReadyName != "" {
+				// The game isn't ready any more.
+				err = deleteRecord(userData, userData.DNSReadyName, sess)
+			}
+			done <- err
+		case "logs":
+			done <- uploadLogs(ctx, userData, instanceID, sess)
+		case "release":
+			releaseVolume(userData, instanceID, sess)
+			done <- nil
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The step keeps going in the background, but the rest of the pipeline can't wait.
+		return fmt.Errorf("timed out")
+	}
+}
+
+// runCommandContext runs a command with its output going to the daemon's, killing it if
+// the context ends.
+func runCommandContext(ctx context.Context, path string, args ...string) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out")
+	}
+
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDefaultShutdownSteps runs the default pipeline through the budget with every step
+// taking all of its time, the worst case.
+func TestDefaultShutdownSteps(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData GameServerUserData
+		want     map[string]time.Duration
+	}{
+		{
+			name:     "plain",
+			userData: GameServerUserData{DNSName: "game.example.com."},
+			want:     map[string]time.Duration{"stop": 45 * time.Second, "release": 45 * time.Second},
+		},
+		{
+			name:     "rcon",
+			userData: GameServerUserData{DNSName: "game.example.com.", RCONPasswordSecretID: "rcon"},
+			want: map[string]time.Duration{
+				"warn": 5 * time.Second, "save": 15 * time.Second, "stop": 45 * time.Second, "release": 35 * time.Second,
+			},
+		},
+		{
+			name: "everything",
+			userData: GameServerUserData{
+				DNSName: "game.example.com.", RCONPasswordSecretID: "rcon", LogBucket: "logs",
+				SnapshotOnShutdown: true, DNSShutdownAction: "delete",
+			},
+			want: map[string]time.Duration{
+				"warn": 5 * time.Second, "save": 15 * time.Second, "stop": 45 * time.Second,
+				"logs": 0, "snapshot": 0, "release": 35 * time.Second, "delete-dns": 0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userData := test.userData
+			setDefaults(&userData)
+			steps := userData.TerminationSteps
+
+			remaining := time.Duration(userData.ShutdownBudget) * time.Second
+			got := map[string]time.Duration{}
+			for i, step := range steps {
+				timeout := shutdownStepTimeout(steps, i, remaining)
+				if timeout < 0 {
+					timeout = 0
+				}
+				got[step.Action] = timeout
+				remaining -= timeout
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got steps %v, want %v", got, test.want)
+			}
+			for action, want := range test.want {
+				if got[action] != want {
+					t.Errorf("%s got %s, want %s", action, got[action], want)
+				}
+			}
+		})
+	}
+}
+
+// TestShutdownStepTimeout checks time is set aside for later, more important steps only.
+func TestShutdownStepTimeout(t *testing.T) {
+	steps := []ShutdownStep{
+		{Action: "warn", Timeout: 5, Priority: 4},
+		{Action: "stop", Timeout: 45, Priority: 1},
+		{Action: "release", Timeout: 45, Priority: 2},
+	}
+
+	tests := []struct {
+		step      int
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{0, 100 * time.Second, 5 * time.Second},
+		{0, 92 * time.Second, 2 * time.Second},
+		{0, 90 * time.Second, 0},
+		{1, 60 * time.Second, 45 * time.Second},
+		{1, 30 * time.Second, 30 * time.Second},
+		{2, 10 * time.Second, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		got := shutdownStepTimeout(steps, test.step, test.remaining)
+		if got != test.want {
+			t.Errorf("step %d with %s got %s, want %s", test.step, test.remaining, got, test.want)
+		}
+	}
+}
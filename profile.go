@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// LaunchProfile is how a game is launched from a workstation, kept as JSON in
+// <profile>.json in the profiles directory (default ~/.aws-spot-game-server). UserData is the
+// daemon's user data, as a JSON object, and also names the game, whose instances are tagged
+// with it so the other workstation commands can find them.
+type LaunchProfile struct {
+	Region string
+
+	// AMI to launch, and the instance type. The AMI can be an ID, an alias for the current
+	// release of a distribution like "ubuntu-22.04" or "ubuntu-22.04-arm64", or the path of
+	// an SSM parameter holding one, looked up in the region at launch. With InstanceTypes,
+	// the cheapest of them in any of the subnets is launched instead, and with
+	// InstanceRequirements the cheapest of the types matching them.
+	AMI                  string
+	InstanceType         string
+	InstanceTypes        []string
+	InstanceRequirements *InstanceRequirements
+
+	// Subnet to launch into, defaulting to the default VPC's, and the key pair for SSH. With
+	// SubnetIDs, the one in the zone with the cheapest spot price is launched into.
+	SubnetID  string
+	SubnetIDs []string
+	KeyName   string
+
+	// Lowest spot placement score, 1 to 10, for a zone to be tried before the others,
+	// defaulting to 1.
+	MinPlacementScore int64
+
+	// Security groups and the instance profile, a name or ARN, giving the daemon its
+	// permissions.
+	SecurityGroupIDs []string
+	InstanceProfile  string
+
+	// The security group "provision security-group" keeps, named SecurityGroupName (default
+	// aws-spot-game-server-<game name>). GamePorts, like "tcp/25565" or "udp/27015-27016",
+	// are open to everyone, and AdminPorts, like SSH, RCON, and the control API, only to
+	// AdminCIDRs.
+	SecurityGroupName string
+	GamePorts         []string
+	AdminPorts        []string
+	AdminCIDRs        []string
+
+	// Most to pay for spot an hour, in dollars, defaulting to the on-demand price.
+	MaxPrice string
+
+	// Launch from a persistent spot request that stops the instance on interruption instead
+	// of terminating it, and starts it again once there is capacity. The instance keeps its
+	// volumes, and can be paused and resumed, which suits the user data's IdleAction "stop".
+	Persistent bool
+
+	// Seconds to wait for a spot instance to run before giving up on it, default 300, when
+	// the user data's OnDemandFallback has an on-demand instance launched instead.
+	SpotTimeout int64
+
+	// Size of the root volume in GiB, defaulting to the AMI's.
+	RootVolumeSize int64
+
+	// Tags added to the instance, besides its name and game.
+	Tags map[string]string
+
+	// Auto Scaling group the game's instances run in, if any, which the instance role may
+	// complete lifecycle actions and terminate instances in. Without it, the role may do so
+	// in groups tagged with the game.
+	AutoScalingGroup string
+
+	// Name of the launch template "provision template" keeps, defaulting to
+	// aws-spot-game-server-<game name>.
+	LaunchTemplateName string
+
+	// Launch through an EC2 Fleet that keeps one spot instance running, drawing on every
+	// instance type and subnet, instead of launching the cheapest option once. The fleet
+	// replaces interrupted instances itself, so the user data shouldn't ReplaceOnInterruption.
+	// FleetAllocationStrategy is "capacity-optimized" (the default) or
+	// "price-capacity-optimized".
+	Fleet                   bool
+	FleetAllocationStrategy string
+
+	// Where the wake proxy listens for players trying to join while the game is down,
+	// what it tells them (default "Starting the server, try again in a minute or two."),
+	// and the least seconds between its launches (default 300).
+	WakeListeners []WakeListener
+	WakeMessage   string
+	WakeCooldown  int
+
+	UserData json.RawMessage
+
+	// name is the profile's name, gameData its parsed user data, image the AMI ID the AMI
+	// resolved to, and requirements the instance requirements with the architectures filled
+	// in, once resolved.
+	name         string
+	gameData     *GameServerUserData
+	image        string
+	requirements *ec2.InstanceRequirementsWithMetadataRequest
+}
+
+// defaultProfileDirectory is where launch profiles are kept, under the home directory.
+const defaultProfileDirectory = ".aws-spot-game-server"
+
+// profileFlags adds the flags picking a launch profile to a command's flags.
+func profileFlags(flags *flag.FlagSet) (*string, *string) {
+	name := flags.String("profile", "", "launch profile, <profiles>/<profile>.json")
+	directory := flags.String("profiles", "", "directory of launch profiles, default ~/"+defaultProfileDirectory)
+	return name, directory
+}
+
+// loadProfile reads and checks a launch profile.
+func loadProfile(name string, directory string) (*LaunchProfile, error) {
+	if name == "" {
+		return nil, fmt.Errorf("a profile is required")
+	}
+
+	if directory == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("error finding home directory: %s", err.Error())
+		}
+		directory = filepath.Join(home, defaultProfileDirectory)
+	}
+
+	path := name
+	if !strings.HasSuffix(name, ".json") {
+		path = filepath.Join(directory, name+".json")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading profile: %s", err.Error())
+	}
+
+	profile := &LaunchProfile{name: strings.TrimSuffix(filepath.Base(path), ".json")}
+	err = json.Unmarshal(content, profile)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s was malformed: %s", path, err.Error())
+	}
+
+	if len(profile.UserData) == 0 {
+		return nil, fmt.Errorf("profile %s has no user data", path)
+	}
+
+	profile.gameData = &GameServerUserData{}
+	err = json.Unmarshal(profile.UserData, profile.gameData)
+	if err != nil {
+		return nil, fmt.Errorf("user data in profile %s was malformed: %s", path, err.Error())
+	}
+	setDefaults(profile.gameData)
+
+	err = validateUserData(profile.gameData)
+	if err != nil {
+		return nil, fmt.Errorf("user data in profile %s is invalid: %s", path, err.Error())
+	}
+
+	if profile.SpotTimeout <= 0 {
+		profile.SpotTimeout = 300
+	}
+
+	if profile.AMI == "" || (profile.InstanceType == "" && len(profile.InstanceTypes) == 0 && profile.InstanceRequirements == nil) {
+		return nil, fmt.Errorf("profile %s needs an AMI and an instance type", path)
+	}
+
+	err = validAMI(profile.AMI)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s is invalid: %s", path, err.Error())
+	}
+
+	if profile.WakeMessage == "" {
+		profile.WakeMessage = "Starting the server, try again in a minute or two."
+	}
+
+	if profile.WakeCooldown <= 0 {
+		profile.WakeCooldown = 300
+	}
+
+	for _, listener := range profile.WakeListeners {
+		switch listener.Protocol {
+		case "minecraft", "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("profile %s wake listener protocols must be minecraft, tcp, or udp", path)
+		}
+	}
+
+	if profile.Persistent && profile.Fleet {
+		return nil, fmt.Errorf("profile %s can't launch a persistent request through a fleet", path)
+	}
+
+	switch profile.FleetAllocationStrategy {
+	case "", ec2.SpotAllocationStrategyCapacityOptimized, ec2.SpotAllocationStrategyPriceCapacityOptimized:
+	default:
+		return nil, fmt.Errorf("profile %s fleet allocation strategy must be capacity-optimized or price-capacity-optimized", path)
+	}
+
+	if profile.InstanceRequirements != nil {
+		err = profile.InstanceRequirements.validate()
+		if err != nil {
+			return nil, fmt.Errorf("profile %s is invalid: %s", path, err.Error())
+		}
+	}
+
+	return profile, nil
+}
+
+// session returns a session in the profile's region, or the default one.
+func (p *LaunchProfile) session() *session.Session {
+	config := &aws.Config{}
+	if p.Region != "" {
+		config.Region = aws.String(p.Region)
+	}
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// servePrometheus serves the daemon's and games' metrics in the Prometheus text format at
+// /metrics on PrometheusAddress.
+func servePrometheus(userData *GameServerUserData) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, userData, currentStatus())
+	})
+
+	go func() {
+		err := http.ListenAndServe(userData.PrometheusAddress, mux)
+		if err != nil {
+			fmt.Printf("Error serving Prometheus metrics: %s\n", err.Error())
+		}
+	}()
+	fmt.Printf("Prometheus metrics listening on %s.\n", userData.PrometheusAddress)
+}
+
+// writePrometheus writes the metrics. The players online are left out when no probe counts
+// them.
+func writePrometheus(w io.Writer, userData *GameServerUserData, status daemonStatus) {
+	instance := fmt.Sprintf(`instance_id="%s"`, prometheusLabel(status.InstanceID))
+
+	if status.Players >= 0 {
+		writeMetric(w, "game_server_players_online", "gauge", "Players online.")
+		fmt.Fprintf(w, "game_server_players_online{%s} %d\n", instance, status.Players)
+	}
+
+	writeMetric(w, "game_server_idle_streak", "gauge", "Idle checks in a row that found the game idle.")
+	fmt.Fprintf(w, "game_server_idle_streak{%s} %d\n", instance, status.IdleCount)
+
+	writeMetric(w, "game_server_idle_streak_limit", "gauge", "Idle checks in a row before the game is shut down.")
+	fmt.Fprintf(w, "game_server_idle_streak_limit{%s} %d\n", instance, userData.IdleConsecutiveTimesForShutdown)
+
+	writeMetric(w, "game_server_uptime_seconds", "gauge", "Seconds since the daemon started.")
+	fmt.Fprintf(w, "game_server_uptime_seconds{%s} %.0f\n", instance, time.Since(status.StartedAt).Seconds())
+
+	writeMetric(w, "game_server_spot_interrupted", "gauge", "1 once a spot interruption is being handled.")
+	fmt.Fprintf(w, "game_server_spot_interrupted{%s} %d\n", instance, atomic.LoadInt32(&spotInterrupted))
+
+	writeMetric(w, "game_server_state", "gauge", "1 for the daemon's current state.")
+	fmt.Fprintf(w, "game_server_state{%s,state=\"%s\"} 1\n", instance, prometheusLabel(status.State))
+
+	writeMetric(w, "game_server_game_running", "gauge", "1 while the game's process is running.")
+	for _, game := range status.Games {
+		running := 0
+		if game.PID != 0 {
+			running = 1
+		}
+		fmt.Fprintf(w, "game_server_game_running{%s,game=\"%s\"} %d\n", instance, prometheusLabel(game.Name), running)
+	}
+
+	writeMetric(w, "game_server_game_restarts_total", "counter", "Times the game has been restarted after crashing.")
+	for _, game := range status.Games {
+		fmt.Fprintf(w, "game_server_game_restarts_total{%s,game=\"%s\"} %d\n", instance, prometheusLabel(game.Name), game.Restarts)
+	}
+
+	writeMetric(w, "game_server_game_uptime_seconds", "gauge", "Seconds since the game's process started.")
+	for _, game := range status.Games {
+		if game.StartedAt != nil {
+			fmt.Fprintf(w, "game_server_game_uptime_seconds{%s,game=\"%s\"} %.0f\n", instance, prometheusLabel(game.Name), time.Since(*game.StartedAt).Seconds())
+		}
+	}
+}
+
+// writeMetric writes a metric's help and type.
+func writeMetric(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// prometheusLabel escapes a label value.
+var prometheusLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
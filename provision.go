@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const provisionUsage = `Usage: aws-spot-game-server provision <command> -profile <name>
+
+Commands:
+  template          create or update the game's EC2 launch template
+  security-group    create or update the game's security group [-my-ip]
+  iam               create or update the daemon's role and instance profile [-ssm=false]`
+
+// runProvision sets up the AWS resources a launch profile needs, run from a workstation as
+// "aws-spot-game-server provision <command>". It returns the exit status.
+func runProvision(args []string) int {
+	if len(args) == 0 {
+		fmt.Println(provisionUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "template":
+		return runProvisionTemplate(args[1:])
+	case "security-group":
+		return runProvisionSecurityGroup(args[1:])
+	case "iam":
+		return runProvisionIAM(args[1:])
+	default:
+		fmt.Printf("Unknown provision command %s.\n", args[0])
+		fmt.Println(provisionUsage)
+		return 2
+	}
+}
+
+// runProvisionTemplate creates or updates the profile's launch template.
+func runProvisionTemplate(args []string) int {
+	flags := flag.NewFlagSet("provision template", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	err = profile.resolveAMI(sess)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	_, _, err = provisionTemplate(ec2.New(sess), profile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// provisionTemplate creates the profile's launch template, or adds a version to it and
+// makes that the default when the profile has changed since the last one. Each version's
+// description records a hash of what went into it, so an unchanged profile adds nothing.
+// It returns the template's ID and the version that matches the profile.
+func provisionTemplate(service *ec2.EC2, profile *LaunchProfile) (string, int64, error) {
+	templateName := profile.templateName()
+
+	data, err := templateData(service, profile)
+	if err != nil {
+		return "", 0, err
+	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return "", 0, fmt.Errorf("error hashing template: %s", err.Error())
+	}
+	sum := sha256.Sum256(content)
+	description := fmt.Sprintf("aws-spot-game-server profile %s %s", profile.name, hex.EncodeToString(sum[:])[:16])
+
+	described, err := service.DescribeLaunchTemplates(&ec2.DescribeLaunchTemplatesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("launch-template-name"), Values: []*string{aws.String(templateName)}}},
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error describing launch templates: %s", err.Error())
+	}
+
+	if len(described.LaunchTemplates) == 0 {
+		created, err := service.CreateLaunchTemplate(&ec2.CreateLaunchTemplateInput{
+			LaunchTemplateName: aws.String(templateName),
+			VersionDescription: aws.String(description),
+			LaunchTemplateData: data,
+			TagSpecifications: []*ec2.TagSpecification{
+				{
+					ResourceType: aws.String(ec2.ResourceTypeLaunchTemplate),
+					Tags:         []*ec2.Tag{{Key: aws.String(tagGame), Value: aws.String(profile.gameData.GameName)}},
+				},
+			},
+		})
+		if err != nil {
+			return "", 0, fmt.Errorf("error creating launch template: %s", err.Error())
+		}
+		templateID := aws.StringValue(created.LaunchTemplate.LaunchTemplateId)
+		version := aws.Int64Value(created.LaunchTemplate.LatestVersionNumber)
+		fmt.Printf("Created launch template %s (%s), version %d.\n", templateName, templateID, version)
+		return templateID, version, nil
+	}
+
+	template := described.LaunchTemplates[0]
+	templateID := aws.StringValue(template.LaunchTemplateId)
+	latest, err := service.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: template.LaunchTemplateId,
+		Versions:         []*string{aws.String("$Latest")},
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error describing launch template versions: %s", err.Error())
+	}
+	if len(latest.LaunchTemplateVersions) > 0 && aws.StringValue(latest.LaunchTemplateVersions[0].VersionDescription) == description {
+		version := aws.Int64Value(latest.LaunchTemplateVersions[0].VersionNumber)
+		if version != aws.Int64Value(template.DefaultVersionNumber) {
+			fmt.Printf("%s is up to date at version %d, but version %d is the default.\n", templateName, version, aws.Int64Value(template.DefaultVersionNumber))
+		} else {
+			fmt.Printf("%s is already up to date at version %d.\n", templateName, version)
+		}
+		return templateID, version, nil
+	}
+
+	created, err := service.CreateLaunchTemplateVersion(&ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateId:   template.LaunchTemplateId,
+		VersionDescription: aws.String(description),
+		LaunchTemplateData: data,
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating launch template version: %s", err.Error())
+	}
+	version := aws.Int64Value(created.LaunchTemplateVersion.VersionNumber)
+
+	_, err = service.ModifyLaunchTemplate(&ec2.ModifyLaunchTemplateInput{
+		LaunchTemplateId: template.LaunchTemplateId,
+		DefaultVersion:   aws.String(strconv.FormatInt(version, 10)),
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error making version %d the default: %s", version, err.Error())
+	}
+
+	fmt.Printf("Updated launch template %s to version %d.\n", templateName, version)
+	return templateID, version, nil
+}
+
+// templateName returns the name of the profile's launch template.
+func (p *LaunchProfile) templateName() string {
+	if p.LaunchTemplateName != "" {
+		return p.LaunchTemplateName
+	}
+	return "aws-spot-game-server-" + p.gameData.GameName
+}
+
+// templateData is the launch template for the profile: everything launch would request,
+// leaving out the subnet and how the instance is paid for, and the instance type when the
+// profile has a choice of them, so a launch or fleet using the template can pick those.
+func templateData(service *ec2.EC2, profile *LaunchProfile) (*ec2.RequestLaunchTemplateData, error) {
+	input, err := launchInput(service, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &ec2.RequestLaunchTemplateData{
+		ImageId:          input.ImageId,
+		UserData:         input.UserData,
+		KeyName:          input.KeyName,
+		SecurityGroupIds: input.SecurityGroupIds,
+	}
+	if len(profile.candidateTypes()) == 1 && profile.InstanceRequirements == nil {
+		data.InstanceType = aws.String(profile.candidateTypes()[0])
+	}
+	if input.IamInstanceProfile != nil {
+		data.IamInstanceProfile = &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{
+			Arn:  input.IamInstanceProfile.Arn,
+			Name: input.IamInstanceProfile.Name,
+		}
+	}
+	for _, mapping := range input.BlockDeviceMappings {
+		data.BlockDeviceMappings = append(data.BlockDeviceMappings, &ec2.LaunchTemplateBlockDeviceMappingRequest{
+			DeviceName: mapping.DeviceName,
+			Ebs: &ec2.LaunchTemplateEbsBlockDeviceRequest{
+				VolumeSize:          mapping.Ebs.VolumeSize,
+				VolumeType:          mapping.Ebs.VolumeType,
+				DeleteOnTermination: mapping.Ebs.DeleteOnTermination,
+			},
+		})
+	}
+	for _, specification := range input.TagSpecifications {
+		data.TagSpecifications = append(data.TagSpecifications, &ec2.LaunchTemplateTagSpecificationRequest{
+			ResourceType: specification.ResourceType,
+			Tags:         specification.Tags,
+		})
+	}
+	return data, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minecraftFormatting matches the color and style codes in a Minecraft MOTD.
+var minecraftFormatting = regexp.MustCompile(`§.`)
+
+// publicStatusRate is how many requests a client may make a minute.
+const publicStatusRate = 30
+
+// publicStatus is what anyone can see about the game. Online is whether the game is up and
+// running. Version and MOTD come from the game when a minecraft or a2s probe can ask it.
+type publicStatus struct {
+	Game       string    `json:"game"`
+	Online     bool      `json:"online"`
+	Version    string    `json:"version,omitempty"`
+	MOTD       string    `json:"motd,omitempty"`
+	Players    int       `json:"players"`
+	MaxPlayers int       `json:"max_players,omitempty"`
+	Names      []string  `json:"names,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// publicStatusServer serves the public status, answering from a copy at most
+// PublicStatusCacheTime seconds old so visitors can't hammer the game with queries.
+type publicStatusServer struct {
+	userData *GameServerUserData
+
+	// cacheMu guards the cached status, and requestsMu the request counts since window.
+	cacheMu    sync.Mutex
+	cached     []byte
+	cachedAt   time.Time
+	requestsMu sync.Mutex
+	requests   map[string]int
+	window     time.Time
+}
+
+// servePublicStatus serves /status.json on PublicStatusAddress, with no authentication and
+// nothing that changes anything, so it can be opened to the world.
+func servePublicStatus(userData *GameServerUserData) {
+	server := &publicStatusServer{userData: userData, requests: map[string]int{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", server.serve)
+
+	// Clients that are slow on purpose mustn't be able to hold connections open.
+	httpServer := &http.Server{
+		Addr:              userData.PublicStatusAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil {
+			fmt.Printf("Error serving public status: %s\n", err.Error())
+		}
+	}()
+	fmt.Printf("Public status listening on %s.\n", userData.PublicStatusAddress)
+}
+
+func (s *publicStatusServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !s.allow(client) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	body := s.status()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", s.userData.PublicStatusCacheTime))
+	w.Write(body)
+}
+
+// allow counts a request from the client and reports whether it is under the rate limit.
+// The counts start again every minute.
+func (s *publicStatusServer) allow(client string) bool {
+	s.requestsMu.Lock()
+	defer s.requestsMu.Unlock()
+
+	if time.Since(s.window) >= time.Minute {
+		s.requests = map[string]int{}
+		s.window = time.Now()
+	}
+
+	s.requests[client]++
+	return s.requests[client] <= publicStatusRate
+}
+
+// status returns the public status as JSON, asking the game again once the cached copy is
+// too old.
+func (s *publicStatusServer) status() []byte {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.cached != nil && time.Since(s.cachedAt) < time.Duration(s.userData.PublicStatusCacheTime)*time.Second {
+		return s.cached
+	}
+
+	current := currentStatus()
+	public := publicStatus{
+		Game:      s.userData.GameName,
+		Online:    current.State == "running",
+		MOTD:      s.userData.PublicStatusMOTD,
+		Players:   current.Players,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if public.Online {
+		for _, game := range current.Games {
+			if game.State != "running" {
+				public.Online = false
+			}
+		}
+	}
+	if s.userData.PublicStatusShowNames && sessions != nil {
+		public.Names = sessions.players()
+	}
+	if public.Online {
+		askGame(s.userData, &public)
+	}
+
+	body, err := json.Marshal(public)
+	if err != nil {
+		fmt.Printf("Error writing public status: %s\n", err.Error())
+		return []byte("{}")
+	}
+
+	s.cached = body
+	s.cachedAt = time.Now()
+	return body
+}
+
+// askGame fills in the version, MOTD, and most players from the first minecraft or a2s
+// probe. A MOTD in the user data is kept over the game's.
+func askGame(userData *GameServerUserData, public *publicStatus) {
+	for _, data := range userData.games {
+		for _, probe := range data.IdleProbes {
+			switch probe.Type {
+			case "minecraft":
+				status, err := pingMinecraft(probe.Address, 2*time.Second)
+				if err != nil {
+					return
+				}
+				public.Version = status.Version.Name
+				public.MaxPlayers = status.Players.Max
+				if public.MOTD == "" {
+					public.MOTD = strings.TrimSpace(minecraftFormatting.ReplaceAllString(minecraftText(status.Description), ""))
+				}
+				return
+			case "a2s":
+				info, err := queryA2SInfo(probe.Address, 2*time.Second)
+				if err != nil {
+					return
+				}
+				public.Version = info.Version
+				public.MaxPlayers = info.MaxPlayers
+				if public.MOTD == "" {
+					public.MOTD = info.Name
+				}
+				return
+			}
+		}
+	}
+}
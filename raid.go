@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// raidDevice is the md device the game volumes are assembled into.
+const raidDevice = "/dev/md0"
+
+// raidArray is the md device the array is running as. udev may have assembled it already
+// under another name, like /dev/md127.
+var raidArray = raidDevice
+
+// assembleRAID assembles the member devices into a RAID0 array. If none of them carries
+// an md superblock the volumes are new, so the array is created and formatted instead, as
+// long as none of them has anything else on it either.
+func assembleRAID(deviceFiles []string, fileSystemType string) (string, error) {
+	uuid := ""
+	for _, deviceFile := range deviceFiles {
+		memberUUID, err := raidMemberUUID(deviceFile)
+		if err != nil {
+			return "", err
+		}
+		if memberUUID != "" {
+			uuid = memberUUID
+		}
+	}
+
+	if uuid != "" {
+		array, err := findRAID(uuid)
+		if err != nil {
+			return "", err
+		}
+		if array != "" {
+			state, err := ioutil.ReadFile("/sys/block/" + filepath.Base(array) + "/md/array_state")
+			if err == nil && strings.TrimSpace(string(state)) != "inactive" && strings.TrimSpace(string(state)) != "clear" {
+				fmt.Printf("RAID array is already assembled as %s.\n", array)
+				raidArray = array
+				return array, nil
+			}
+
+			// Partly assembled, holding on to some of the members.
+			err = runMdadm("--stop", array)
+			if err != nil {
+				return "", fmt.Errorf("error stopping partly assembled RAID array %s: %s", array, err.Error())
+			}
+		}
+
+		fmt.Println("Assembling RAID array.")
+		args := append([]string{"--assemble", raidDevice}, deviceFiles...)
+		err = runMdadm(args...)
+		if err != nil {
+			return "", fmt.Errorf("error assembling RAID array: %s", err.Error())
+		}
+
+		fmt.Println("RAID array assembled.")
+		raidArray = raidDevice
+		return raidDevice, nil
+	}
+
+	// --run skips mdadm's own check for data on the members, so make it here.
+	for _, deviceFile := range deviceFiles {
+		exists, err := hasFileSystem(deviceFile)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("%s isn't an md member but has data on it, not creating a RAID array over it", deviceFile)
+		}
+	}
+
+	fmt.Println("Creating RAID array.")
+	args := []string{"--create", raidDevice, "--run", "--level=0", "--raid-devices=" + strconv.Itoa(len(deviceFiles))}
+	args = append(args, deviceFiles...)
+	err := runMdadm(args...)
+	if err != nil {
+		return "", fmt.Errorf("error creating RAID array: %s", err.Error())
+	}
+	raidArray = raidDevice
+
+	err = formatDevice(raidDevice, fileSystemType)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println("RAID array created.")
+	return raidDevice, nil
+}
+
+// raidMemberUUID returns the UUID of the array the device is a member of, or "" if it
+// carries no md superblock.
+func raidMemberUUID(deviceFile string) (string, error) {
+	output, err := exec.Command("/sbin/mdadm", "--examine", "--export", deviceFile).Output()
+	if err != nil {
+		// mdadm exits with 1 when there is no superblock, anything else is a failure to look.
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("error examining %s: %s", deviceFile, err.Error())
+	}
+
+	return mdadmField(string(output), "MD_UUID"), nil
+}
+
+// findRAID returns the md device running the array with the UUID, or "" if it isn't
+// running. --detail --scan lists running arrays as lines like
+// "ARRAY /dev/md/0 metadata=1.2 name=host:0 UUID=...".
+func findRAID(uuid string) (string, error) {
+	output, err := exec.Command("/sbin/mdadm", "--detail", "--scan").Output()
+	if err != nil {
+		return "", fmt.Errorf("error scanning RAID arrays: %s", err.Error())
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "ARRAY" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			if field != "UUID="+uuid {
+				continue
+			}
+			device, err := filepath.EvalSymlinks(fields[1])
+			if err != nil {
+				return fields[1], nil
+			}
+			return device, nil
+		}
+	}
+	return "", nil
+}
+
+// mdadmField returns the value of a KEY=value line in mdadm's --export output.
+func mdadmField(output string, key string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			return strings.TrimPrefix(line, key+"=")
+		}
+	}
+	return ""
+}
+
+// stopRAID stops the array so its member volumes can be detached.
+func stopRAID() error {
+	return runMdadm("--stop", raidArray)
+}
+
+func runMdadm(args ...string) error {
+	cmd := exec.Command("/sbin/mdadm", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
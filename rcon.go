@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Source RCON packet types. Minecraft, Valheim (via plugins), ARK, Rust and most Source
+// engine games speak this protocol.
+const (
+	rconResponseValue = 0
+	rconExecCommand   = 2
+	rconAuthResponse  = 2
+	rconAuth          = 3
+)
+
+// rconClient is a connection to a game's RCON port.
+type rconClient struct {
+	conn    net.Conn
+	timeout time.Duration
+	nextID  int32
+}
+
+// dialRCON connects to the RCON port and authenticates with the password.
+func dialRCON(address string, password string, timeout time.Duration) (*rconClient, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to RCON: %s", err.Error())
+	}
+
+	client := &rconClient{conn: conn, timeout: timeout, nextID: 1}
+
+	id, err := client.send(rconAuth, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Some servers send an empty response value before the auth response.
+	for {
+		responseID, responseType, _, err := client.receive()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if responseType != rconAuthResponse {
+			continue
+		}
+
+		if responseID == -1 || responseID != id {
+			conn.Close()
+			return nil, fmt.Errorf("RCON authentication failed")
+		}
+
+		return client, nil
+	}
+}
+
+// command runs a console command and returns its output.
+func (c *rconClient) command(command string) (string, error) {
+	id, err := c.send(rconExecCommand, command)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		responseID, responseType, body, err := c.receive()
+		if err != nil {
+			return "", err
+		}
+
+		if responseID == id && responseType == rconResponseValue {
+			return body, nil
+		}
+	}
+}
+
+// Close closes the connection.
+func (c *rconClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rconClient) send(packetType int32, body string) (int32, error) {
+	id := c.nextID
+	c.nextID++
+
+	// Size covers the ID, the type, the body and its terminator, and the empty string.
+	packet := &bytes.Buffer{}
+	binary.Write(packet, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(packet, binary.LittleEndian, id)
+	binary.Write(packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(packet.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("error writing to RCON: %s", err.Error())
+	}
+
+	return id, nil
+}
+
+func (c *rconClient) receive() (int32, int32, string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	var size int32
+	err := binary.Read(c.conn, binary.LittleEndian, &size)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error reading from RCON: %s", err.Error())
+	}
+
+	if size < 10 || size > 1<<20 {
+		return 0, 0, "", fmt.Errorf("RCON packet size %d is invalid", size)
+	}
+
+	packet := make([]byte, size)
+	_, err = io.ReadFull(c.conn, packet)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error reading from RCON: %s", err.Error())
+	}
+
+	id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+	packetType := int32(binary.LittleEndian.Uint32(packet[4:8]))
+	body := string(bytes.TrimRight(packet[8:], "\x00"))
+
+	return id, packetType, body, nil
+}
+
+// rconCommand connects to the game's RCON port, runs one command, and disconnects.
+func rconCommand(userData *GameServerUserData, command string) (string, error) {
+	client, err := dialRCON(userData.RCONAddress, userData.RCONPassword, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return client.command(command)
+}
+
+// rconEnabled reports whether an RCON password is configured.
+func rconEnabled(userData *GameServerUserData) bool {
+	return userData.RCONPassword != "" || userData.RCONPasswordSecretID != ""
+}
+
+// getRCONPassword fetches the RCON password from Secrets Manager.
+func getRCONPassword(userData *GameServerUserData, sess *session.Session) (string, error) {
+	secret, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(userData.RCONPasswordSecretID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting RCON password secret: %s", err.Error())
+	}
+
+	return aws.StringValue(secret.SecretString), nil
+}
+
+// firstNumber matches the first whole number in command output.
+var firstNumber = regexp.MustCompile(`\d+`)
+
+// rconChecker runs a command over RCON, like Minecraft's list, and reads the number of
+// players online from the output.
+type rconChecker struct {
+	userData *GameServerUserData
+	command  string
+	pattern  *regexp.Regexp
+}
+
+func (c *rconChecker) check() (bool, int, error) {
+	output, err := rconCommand(c.userData, c.command)
+	if err != nil {
+		return false, -1, err
+	}
+
+	players, err := parsePlayerCount(c.pattern, output)
+	if err != nil {
+		return false, -1, err
+	}
+
+	return players == 0, players, nil
+}
+
+// parsePlayerCount reads a player count from command output with the pattern. Its first
+// group is the count, or the whole match if it has no groups.
+func parsePlayerCount(pattern *regexp.Regexp, output string) (int, error) {
+	match := pattern.FindStringSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("no player count in %q", output)
+	}
+
+	count := match[0]
+	if len(match) > 1 {
+		count = match[1]
+	}
+
+	players, err := strconv.Atoi(count)
+	if err != nil {
+		return 0, fmt.Errorf("player count %q is not a number", count)
+	}
+
+	return players, nil
+}
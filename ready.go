@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ready is set to 1 once the game has answered the DNS ready check.
+var ready int32
+
+// gameReady reports whether the game has answered the DNS ready check.
+func gameReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// publishWhenReady waits for the game to answer the DNS ready check, then sets DNS. If it
+// doesn't answer in time DNS is set anyway, since a game that's slow to answer is better
+// than one nobody can find.
+func publishWhenReady(userData *GameServerUserData, metadata *ec2metadata.EC2Metadata, sess *session.Session) {
+	check := userData.DNSReadyCheck
+
+	go func() {
+		deadline := time.Now().Add(time.Duration(userData.DNSReadyTimeout) * time.Second)
+		for {
+			err := checkHealth(userData, check)
+			if err == nil {
+				fmt.Println("Game server is answering, setting DNS.")
+				break
+			}
+			if time.Now().After(deadline) {
+				fmt.Printf("Game server still isn't answering (%s), setting DNS anyway.\n", err.Error())
+				break
+			}
+			time.Sleep(time.Duration(check.Interval) * time.Second)
+		}
+
+		atomic.StoreInt32(&ready, 1)
+		err := setDNS(userData, metadata, sess)
+		if err != nil {
+			fmt.Printf("Error setting DNS: %s\n", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// runStatus reports on the game from a workstation, as "aws-spot-game-server status -profile
+// <name>": its instance, address, uptime, players, what the session has cost so far, and
+// the month's spending against the budget.
+// Players are asked for with the game's minecraft and a2s idle probes, at the instance's
+// public address. It returns the exit status.
+func runStatus(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	service := ec2.New(sess)
+	game := profile.gameData.GameName
+
+	instances, err := findGameInstances(service, game)
+	if err != nil {
+		fmt.Printf("Error looking for instances: %s\n", err.Error())
+		return 1
+	}
+	if profile.gameData.MonthlyBudget > 0 {
+		spent, err := getSpent(profile.gameData, sess)
+		if err != nil {
+			fmt.Printf("Error getting budget state: %s\n", err.Error())
+		} else {
+			fmt.Printf("Budget:   $%.2f of $%.2f spent in %s\n", spent, profile.gameData.MonthlyBudget, budgetMonth(time.Now()))
+		}
+	}
+
+	if len(instances) == 0 {
+		fmt.Printf("%s isn't running.\n", game)
+		return 0
+	}
+
+	for _, instance := range instances {
+		printInstanceStatus(sess, service, profile, instance)
+	}
+	return 0
+}
+
+// printInstanceStatus prints what is known about one of the game's instances.
+func printInstanceStatus(sess *session.Session, service *ec2.EC2, profile *LaunchProfile, instance *ec2.Instance) {
+	state := aws.StringValue(instance.State.Name)
+	instanceType := aws.StringValue(instance.InstanceType)
+	zone := aws.StringValue(instance.Placement.AvailabilityZone)
+	spot := aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot
+
+	lifecycle := "on-demand"
+	if spot {
+		lifecycle = "spot"
+	}
+	fmt.Printf("Game:     %s\n", profile.gameData.GameName)
+	fmt.Printf("Instance: %s (%s, %s %s in %s)\n", aws.StringValue(instance.InstanceId), state, lifecycle, instanceType, zone)
+
+	if state != ec2.InstanceStateNameRunning {
+		return
+	}
+
+	address := aws.StringValue(instance.PublicIpAddress)
+	dnsName := strings.TrimSuffix(profile.gameData.DNSName, ".")
+	if address != "" {
+		fmt.Printf("Address:  %s -> %s\n", dnsName, address)
+	} else {
+		fmt.Printf("Address:  %s, no public IP\n", dnsName)
+	}
+
+	launched := aws.TimeValue(instance.LaunchTime)
+	uptime := time.Since(launched)
+	fmt.Printf("Uptime:   %s\n", uptime.Round(time.Minute))
+
+	if address != "" {
+		for _, data := range profile.gameData.games {
+			players, err := askPlayers(data, address)
+			if err != nil {
+				fmt.Printf("Players:  %s: %s\n", data.GameName, err.Error())
+			} else if players != "" {
+				fmt.Printf("Players:  %s: %s\n", data.GameName, players)
+			}
+		}
+	}
+
+	cost, price, err := instanceCost(sess, service, instance, launched, time.Now())
+	if err != nil {
+		fmt.Printf("Cost:     %s\n", err.Error())
+		return
+	}
+	fmt.Printf("Cost:     $%.4f/hour, about $%.2f this session\n", price, cost)
+}
+
+// askPlayers asks the game how many players are online with its first minecraft or a2s idle
+// probe, at the instance's public address instead of the probe's own. It returns "" when the
+// game has no probe that can ask.
+func askPlayers(data *GameServerUserData, address string) (string, error) {
+	for _, probe := range data.IdleProbes {
+		if probe.Type != "minecraft" && probe.Type != "a2s" {
+			continue
+		}
+
+		_, port, err := net.SplitHostPort(probe.Address)
+		if err != nil {
+			return "", fmt.Errorf("invalid probe address %s", probe.Address)
+		}
+		target := net.JoinHostPort(address, port)
+
+		if probe.Type == "minecraft" {
+			status, err := pingMinecraft(target, 5*time.Second)
+			if err != nil {
+				return "", err
+			}
+			names := []string{}
+			for _, player := range status.Players.Sample {
+				names = append(names, player.Name)
+			}
+			return describePlayerCount(status.Players.Online, status.Players.Max, names), nil
+		}
+
+		info, err := queryA2SInfo(target, 5*time.Second)
+		if err != nil {
+			return "", err
+		}
+		names := []string{}
+		if players, err := queryA2SPlayers(target, 5*time.Second); err == nil {
+			for _, player := range players {
+				if player.Name != "" {
+					names = append(names, player.Name)
+				}
+			}
+		}
+		return describePlayerCount(info.Players-info.Bots, info.MaxPlayers, names), nil
+	}
+	return "", nil
+}
+
+// describePlayerCount describes how many players are online out of the most, and who.
+func describePlayerCount(online int, max int, names []string) string {
+	description := fmt.Sprintf("%d/%d", online, max)
+	if len(names) > 0 {
+		description += " (" + strings.Join(names, ", ") + ")"
+	}
+	return description
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// replacementState is kept in SSM so replacements can be rate limited across instances.
+// Interruptions are counted from CountingSince, starting again after a day.
+type replacementState struct {
+	LastLaunch    time.Time
+	LaunchedBy    string
+	Replacement   string
+	Interruptions int
+	CountingSince time.Time
+}
+
+// getReplacementState reads the replacement state, returning an empty state if there is none.
+func getReplacementState(service *ssm.SSM, name string) (*replacementState, error) {
+	state := &replacementState{}
+
+	parameter, err := service.GetParameter(&ssm.GetParameterInput{Name: aws.String(name)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(*parameter.Parameter.Value), state)
+	if err != nil {
+		return nil, fmt.Errorf("replacement state was malformed: %s", err.Error())
+	}
+
+	return state, nil
+}
+
+// putReplacementState writes the replacement state.
+func putReplacementState(service *ssm.SSM, name string, state *replacementState) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = service.PutParameter(&ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Value:     aws.String(string(contents)),
+		Type:      aws.String(ssm.ParameterTypeString),
+		Overwrite: aws.Bool(true),
+	})
+
+	return err
+}
+
+// launchReplacement launches a spot instance configured like this one, with the same user
+// data, so the game comes back on its own. Nothing is launched if the last replacement was
+// within the cooldown, so a capacity crunch doesn't turn into a launch loop.
+func launchReplacement(userData *GameServerUserData, instanceID string, sess *session.Session) error {
+	err := checkBudget(userData, sess)
+	if err != nil {
+		return err
+	}
+
+	ssmService := ssm.New(sess)
+	state, err := getReplacementState(ssmService, userData.ReplacementStateParameter)
+	if err != nil {
+		return fmt.Errorf("error getting replacement state: %s", err.Error())
+	}
+
+	if time.Since(state.CountingSince) > 24*time.Hour {
+		state.Interruptions = 0
+		state.CountingSince = time.Now().UTC()
+	}
+	state.Interruptions++
+	if since := time.Since(state.LastLaunch); since < time.Duration(userData.ReplacementCooldown)*time.Second {
+		putReplacementState(ssmService, userData.ReplacementStateParameter, state)
+		return fmt.Errorf("last replacement was launched %s ago, not launching another during the cooldown", since.Round(time.Second))
+	}
+
+	service := ec2.New(sess)
+	instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing instance: %s", err.Error())
+	}
+
+	if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+	instance := instances.Reservations[0].Instances[0]
+
+	attribute, err := service.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+		InstanceId: aws.String(instanceID),
+		Attribute:  aws.String(ec2.InstanceAttributeNameUserData),
+	})
+	if err != nil {
+		return fmt.Errorf("error getting user data: %s", err.Error())
+	}
+
+	securityGroups := []*string{}
+	for _, group := range instance.SecurityGroups {
+		securityGroups = append(securityGroups, group.GroupId)
+	}
+
+	// The game tag is set whatever this instance has, since the daemon may only launch
+	// instances tagged with its game.
+	tags := []*ec2.Tag{{Key: aws.String(tagGame), Value: aws.String(userData.GameName)}}
+	for _, tag := range instance.Tags {
+		if !strings.HasPrefix(*tag.Key, "aws:") && *tag.Key != tagGame {
+			tags = append(tags, tag)
+		}
+	}
+
+	input := &ec2.RunInstancesInput{
+		ImageId:          instance.ImageId,
+		InstanceType:     instance.InstanceType,
+		KeyName:          instance.KeyName,
+		SecurityGroupIds: securityGroups,
+		UserData:         attribute.UserData.Value,
+		MinCount:         aws.Int64(1),
+		MaxCount:         aws.Int64(1),
+		InstanceMarketOptions: &ec2.InstanceMarketOptionsRequest{
+			MarketType: aws.String(ec2.MarketTypeSpot),
+			SpotOptions: &ec2.SpotMarketOptions{
+				SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+				InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+			},
+		},
+	}
+	if instance.IamInstanceProfile != nil {
+		input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: instance.IamInstanceProfile.Arn}
+	}
+	if options := instance.MetadataOptions; options != nil {
+		input.MetadataOptions = &ec2.InstanceMetadataOptionsRequest{
+			HttpEndpoint:            options.HttpEndpoint,
+			HttpProtocolIpv6:        options.HttpProtocolIpv6,
+			HttpPutResponseHopLimit: options.HttpPutResponseHopLimit,
+			HttpTokens:              options.HttpTokens,
+			InstanceMetadataTags:    options.InstanceMetadataTags,
+		}
+	}
+	if instance.HibernationOptions != nil && aws.BoolValue(instance.HibernationOptions.Configured) {
+		input.HibernationOptions = &ec2.HibernationOptionsRequest{Configured: aws.Bool(true)}
+	}
+	input.BlockDeviceMappings, err = replacementBlockDevices(service, instance)
+	if err != nil {
+		return err
+	}
+	input.TagSpecifications = []*ec2.TagSpecification{
+		{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: tags},
+	}
+
+	subnets := userData.ReplacementSubnetIDs
+	if len(subnets) == 0 {
+		subnets = []string{aws.StringValue(instance.SubnetId)}
+	}
+
+	// Spot keeps being taken away, so stop asking for it for a while.
+	onDemand := userData.OnDemandFallback && state.Interruptions >= userData.OnDemandAfterInterruptions
+
+	var reservation *ec2.Reservation
+	if !onDemand {
+		for _, subnet := range subnets {
+			input.SubnetId = aws.String(subnet)
+			fmt.Printf("Launching replacement instance in %s.\n", subnet)
+			reservation, err = service.RunInstances(input)
+			if err == nil {
+				break
+			}
+			fmt.Printf("Error launching replacement in %s: %s\n", subnet, err.Error())
+		}
+		onDemand = err != nil && userData.OnDemandFallback && capacityError(err)
+		if err != nil && !onDemand {
+			return fmt.Errorf("error launching replacement: %s", err.Error())
+		}
+	}
+	if onDemand {
+		reservation, err = launchOnDemand(sess, service, input, subnets, userData.OnDemandMaxPrice)
+		if err != nil {
+			return err
+		}
+		notify(userData, sess, "Fell back to on-demand", fmt.Sprintf("Spot capacity wasn't available, so %s was launched on demand to replace %s.", aws.StringValue(reservation.Instances[0].InstanceId), instanceID))
+	}
+
+	replacement := *reservation.Instances[0].InstanceId
+	state.LastLaunch = time.Now().UTC()
+	state.LaunchedBy = instanceID
+	state.Replacement = replacement
+	err = putReplacementState(ssmService, userData.ReplacementStateParameter, state)
+	if err != nil {
+		fmt.Printf("Error recording replacement state: %s\n", err.Error())
+	}
+
+	notify(userData, sess, "Replacement launched", fmt.Sprintf("Launched %s to replace %s.", replacement, instanceID))
+	return nil
+}
+
+// replacementBlockDevices returns block device mappings giving a replacement the volumes the
+// instance was launched with, like a larger root volume, sized and typed as they are now.
+// Volumes that outlive the instance, like the game's, are left for the replacement's daemon
+// to attach.
+func replacementBlockDevices(service *ec2.EC2, instance *ec2.Instance) ([]*ec2.BlockDeviceMapping, error) {
+	devices := map[string]string{}
+	volumeIDs := []*string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs == nil || !aws.BoolValue(mapping.Ebs.DeleteOnTermination) {
+			continue
+		}
+		devices[*mapping.Ebs.VolumeId] = *mapping.DeviceName
+		volumeIDs = append(volumeIDs, mapping.Ebs.VolumeId)
+	}
+	if len(volumeIDs) == 0 {
+		return nil, nil
+	}
+
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{VolumeIds: volumeIDs})
+	if err != nil {
+		return nil, fmt.Errorf("error describing the instance's volumes: %s", err.Error())
+	}
+
+	mappings := []*ec2.BlockDeviceMapping{}
+	for _, volume := range volumes.Volumes {
+		ebs := &ec2.EbsBlockDevice{
+			DeleteOnTermination: aws.Bool(true),
+			VolumeSize:          volume.Size,
+			VolumeType:          volume.VolumeType,
+		}
+		switch aws.StringValue(volume.VolumeType) {
+		case ec2.VolumeTypeIo1, ec2.VolumeTypeIo2:
+			ebs.Iops = volume.Iops
+		case ec2.VolumeTypeGp3:
+			ebs.Iops = volume.Iops
+			ebs.Throughput = volume.Throughput
+		}
+		if aws.BoolValue(volume.Encrypted) {
+			ebs.Encrypted = volume.Encrypted
+			ebs.KmsKeyId = volume.KmsKeyId
+		}
+		mappings = append(mappings, &ec2.BlockDeviceMapping{
+			DeviceName: aws.String(devices[*volume.VolumeId]),
+			Ebs:        ebs,
+		})
+	}
+	return mappings, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// runReport prints how long each player played in a month, from the sessions file or table.
+// It is run as "aws-spot-game-server report", and returns the exit status.
+func runReport(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	month := flags.String("month", time.Now().UTC().Format("2006-01"), "month to report on, as YYYY-MM")
+	file := flags.String("file", defaultSessionFile, "sessions file")
+	table := flags.String("table", "", "DynamoDB sessions table, instead of the file")
+	game := flags.String("game", "", "game name, required with -table")
+	region := flags.String("region", "", "region of the sessions table")
+	flags.Parse(args)
+
+	start, err := time.Parse("2006-01", *month)
+	if err != nil {
+		fmt.Printf("Invalid month %s, use YYYY-MM.\n", *month)
+		return 2
+	}
+	end := start.AddDate(0, 1, 0)
+
+	var found []playSession
+	if *table != "" {
+		if *game == "" {
+			fmt.Println("A game name is required with -table.")
+			return 2
+		}
+		sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(*region)}))
+		found, err = querySessions(sess, *table, *game, start, end)
+	} else {
+		found, err = readSessions(*file, start, end)
+	}
+	if err != nil {
+		fmt.Printf("Error reading sessions: %s\n", err.Error())
+		return 1
+	}
+
+	// Sessions are counted in the month they started.
+	totals := map[string]time.Duration{}
+	counts := map[string]int{}
+	for _, session := range found {
+		totals[session.Player] += session.End.Sub(session.Start)
+		counts[session.Player]++
+	}
+
+	players := []string{}
+	for player := range totals {
+		players = append(players, player)
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return totals[players[i]] > totals[players[j]]
+	})
+
+	fmt.Printf("Play time for %s:\n", start.Format("January 2006"))
+	if len(players) == 0 {
+		fmt.Println("  Nobody played.")
+	}
+	for _, player := range players {
+		fmt.Printf("  %-24s %10s in %d sessions\n", player, totals[player].Round(time.Minute), counts[player])
+	}
+
+	return 0
+}
+
+// readSessions reads the sessions that started in the time range from a sessions file.
+func readSessions(path string, start time.Time, end time.Time) ([]playSession, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	found := []playSession{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		session := playSession{}
+		err = json.Unmarshal([]byte(line), &session)
+		if err != nil {
+			return nil, fmt.Errorf("session is malformed: %s", err.Error())
+		}
+
+		if !session.Start.Before(start) && session.Start.Before(end) {
+			found = append(found, session)
+		}
+	}
+
+	return found, scanner.Err()
+}
+
+// querySessions queries the sessions that started in the time range from the sessions table.
+func querySessions(sess *session.Session, table string, game string, start time.Time, end time.Time) ([]playSession, error) {
+	found := []playSession{}
+	err := dynamodb.New(sess).QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("Game = :game AND #start BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]*string{
+			"#start": aws.String("Start"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":game": {S: aws.String(game)},
+			":from": {S: aws.String(start.UTC().Format(time.RFC3339Nano))},
+			":to":   {S: aws.String(end.UTC().Format(time.RFC3339Nano))},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			session := playSession{Game: game, Player: aws.StringValue(item["Player"].S)}
+			startValue := strings.SplitN(aws.StringValue(item["Start"].S), "#", 2)[0]
+			session.Start, _ = time.Parse(time.RFC3339Nano, startValue)
+			session.End, _ = time.Parse(time.RFC3339Nano, aws.StringValue(item["End"].S))
+			found = append(found, session)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// InstanceRequirements describes the instance types a game can run on by their attributes,
+// for EC2's attribute-based instance type selection to match. Maximums of 0 are unlimited.
+type InstanceRequirements struct {
+	MinVCPUs     int64
+	MaxVCPUs     int64
+	MinMemoryMiB int64
+	MaxMemoryMiB int64
+
+	// Architectures, "x86_64" or "arm64", defaulting to the AMI's.
+	Architectures []string
+
+	// Whether burstable types like t3 may be used: "included", "excluded" (the default), or
+	// "required".
+	BurstablePerformance string
+
+	// Instance types to leave out, which can have a * wildcard, like "t2.*".
+	ExcludedInstanceTypes []string
+
+	// Leave out types whose spot price is more than this percentage over the cheapest
+	// matching type's, defaulting to EC2's 100.
+	SpotMaxPricePercentageOverLowestPrice int64
+}
+
+// request returns the requirements for the EC2 API.
+func (r *InstanceRequirements) request() *ec2.InstanceRequirementsRequest {
+	request := &ec2.InstanceRequirementsRequest{
+		VCpuCount: &ec2.VCpuCountRangeRequest{Min: aws.Int64(r.MinVCPUs)},
+		MemoryMiB: &ec2.MemoryMiBRequest{Min: aws.Int64(r.MinMemoryMiB)},
+	}
+	if r.MaxVCPUs > 0 {
+		request.VCpuCount.Max = aws.Int64(r.MaxVCPUs)
+	}
+	if r.MaxMemoryMiB > 0 {
+		request.MemoryMiB.Max = aws.Int64(r.MaxMemoryMiB)
+	}
+	if r.BurstablePerformance != "" {
+		request.BurstablePerformance = aws.String(r.BurstablePerformance)
+	}
+	if len(r.ExcludedInstanceTypes) > 0 {
+		request.ExcludedInstanceTypes = aws.StringSlice(r.ExcludedInstanceTypes)
+	}
+	if r.SpotMaxPricePercentageOverLowestPrice > 0 {
+		request.SpotMaxPricePercentageOverLowestPrice = aws.Int64(r.SpotMaxPricePercentageOverLowestPrice)
+	}
+	return request
+}
+
+// validate checks the requirements make sense before asking EC2 for types.
+func (r *InstanceRequirements) validate() error {
+	if r.MinVCPUs < 1 || r.MinMemoryMiB < 1 {
+		return fmt.Errorf("instance requirements need a minimum number of vCPUs and memory")
+	}
+	if (r.MaxVCPUs > 0 && r.MaxVCPUs < r.MinVCPUs) || (r.MaxMemoryMiB > 0 && r.MaxMemoryMiB < r.MinMemoryMiB) {
+		return fmt.Errorf("instance requirement maximums can't be under their minimums")
+	}
+	for _, architecture := range r.Architectures {
+		if architecture != ec2.ArchitectureTypeX8664 && architecture != ec2.ArchitectureTypeArm64 {
+			return fmt.Errorf("instance requirement architectures must be x86_64 or arm64")
+		}
+	}
+	switch r.BurstablePerformance {
+	case "", ec2.BurstablePerformanceIncluded, ec2.BurstablePerformanceExcluded, ec2.BurstablePerformanceRequired:
+	default:
+		return fmt.Errorf("burstable performance must be included, excluded, or required")
+	}
+	return nil
+}
+
+// metadata returns the requirements with the architectures the AMI can run on, filling
+// them in from the AMI when the profile doesn't give them.
+func (r *InstanceRequirements) metadata(service *ec2.EC2, ami string) (*ec2.InstanceRequirementsWithMetadataRequest, error) {
+	architectures := r.Architectures
+	if len(architectures) == 0 {
+		images, err := service.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(ami)}})
+		if err != nil {
+			return nil, fmt.Errorf("error describing AMI: %s", err.Error())
+		}
+		if len(images.Images) == 0 {
+			return nil, fmt.Errorf("AMI %s not found", ami)
+		}
+		architectures = []string{aws.StringValue(images.Images[0].Architecture)}
+	}
+
+	return &ec2.InstanceRequirementsWithMetadataRequest{
+		ArchitectureTypes:    aws.StringSlice(architectures),
+		VirtualizationTypes:  []*string{aws.String(ec2.VirtualizationTypeHvm)},
+		InstanceRequirements: r.request(),
+	}, nil
+}
+
+// resolveInstanceTypes sets the profile's candidate instance types to those matching its
+// instance requirements, if it has any.
+func (p *LaunchProfile) resolveInstanceTypes(service *ec2.EC2) error {
+	if p.InstanceRequirements == nil {
+		return nil
+	}
+
+	metadata, err := p.InstanceRequirements.metadata(service, p.image)
+	if err != nil {
+		return err
+	}
+	p.requirements = metadata
+
+	types := []string{}
+	err = service.GetInstanceTypesFromInstanceRequirementsPages(&ec2.GetInstanceTypesFromInstanceRequirementsInput{
+		ArchitectureTypes:    metadata.ArchitectureTypes,
+		VirtualizationTypes:  metadata.VirtualizationTypes,
+		InstanceRequirements: metadata.InstanceRequirements,
+	}, func(page *ec2.GetInstanceTypesFromInstanceRequirementsOutput, last bool) bool {
+		for _, instanceType := range page.InstanceTypes {
+			types = append(types, aws.StringValue(instanceType.InstanceType))
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error finding instance types for the requirements: %s", err.Error())
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("no instance types match the requirements")
+	}
+
+	sort.Strings(types)
+	fmt.Printf("%d instance types match the requirements.\n", len(types))
+	p.InstanceTypes = types
+	return nil
+}
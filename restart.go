@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleRestarts restarts each game on RestartSchedule. Players are warned over RCON for
+// RestartWarningPeriod seconds beforehand and the world is saved. Only the game's process
+// is restarted, so DNS and the volume are left alone, and the idle count just sees the game
+// as active while it is down.
+func scheduleRestarts(userData *GameServerUserData) {
+	location, _ := time.LoadLocation(userData.RestartTimeZone)
+	schedule, _ := parseCron(userData.RestartSchedule)
+
+	for _, game := range games {
+		go func(game *supervisor) {
+			for {
+				next := schedule.next(time.Now().In(location))
+				if next.IsZero() {
+					fmt.Println("Restart schedule never fires, not restarting.")
+					return
+				}
+
+				warning := time.Duration(userData.RestartWarningPeriod) * time.Second
+				time.Sleep(time.Until(next.Add(-warning)))
+
+				if !game.isStopping() {
+					restartOnSchedule(game, next)
+				}
+
+				// Don't fire twice for the same time.
+				time.Sleep(time.Until(next.Add(time.Minute)))
+			}
+		}(game)
+	}
+}
+
+// restartOnSchedule warns the players in the run up to the restart, saves, and restarts.
+func restartOnSchedule(game *supervisor, at time.Time) {
+	userData := game.userData
+
+	if rconEnabled(userData) {
+		var lastWarning time.Time
+		for time.Until(at) > 0 {
+			if time.Since(lastWarning) >= time.Minute {
+				message := strings.Replace(userData.RestartWarningMessage, "{remaining}", describeRemaining(time.Until(at)), -1)
+				_, err := rconCommand(userData, userData.RCONSayCommand+" "+message)
+				if err != nil {
+					fmt.Printf("Error warning players: %s\n", err.Error())
+				}
+				lastWarning = time.Now()
+			}
+
+			wait := time.Until(at)
+			if wait > 10*time.Second {
+				wait = 10 * time.Second
+			}
+			time.Sleep(wait)
+		}
+
+		_, err := rconCommand(userData, userData.RCONSaveCommand)
+		if err != nil {
+			fmt.Printf("Error saving world: %s\n", err.Error())
+		}
+	} else {
+		time.Sleep(time.Until(at))
+	}
+
+	fmt.Printf("Restarting %s on schedule.\n", userData.GameName)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	err := game.restart(ctx)
+	cancel()
+	if err != nil {
+		fmt.Printf("Error restarting %s: %s\n", userData.GameName, err.Error())
+	}
+}
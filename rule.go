@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// idleRule is a parsed IdleRule expression.
+type idleRule interface {
+	eval(idle map[string]bool) bool
+}
+
+type ruleProbe string
+type ruleNot struct{ operand idleRule }
+type ruleAnd struct{ left, right idleRule }
+type ruleOr struct{ left, right idleRule }
+
+func (r ruleProbe) eval(idle map[string]bool) bool { return idle[string(r)] }
+func (r ruleNot) eval(idle map[string]bool) bool   { return !r.operand.eval(idle) }
+func (r ruleAnd) eval(idle map[string]bool) bool   { return r.left.eval(idle) && r.right.eval(idle) }
+func (r ruleOr) eval(idle map[string]bool) bool    { return r.left.eval(idle) || r.right.eval(idle) }
+
+// ruleParser is a recursive descent parser for idle rules. "not" binds tightest, then
+// "and", then "or", and parentheses group. &&, || and ! work too.
+type ruleParser struct {
+	tokens []string
+	pos    int
+	names  map[string]bool
+}
+
+// parseIdleRule parses an idle rule, making sure every probe it names exists.
+func parseIdleRule(expression string, names map[string]bool) (idleRule, error) {
+	tokens, err := tokenizeRule(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("idle rule is empty")
+	}
+
+	parser := &ruleParser{tokens: tokens, names: names}
+	rule, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q in idle rule", tokens[parser.pos])
+	}
+
+	return rule, nil
+}
+
+// tokenizeRule splits an idle rule into names, operators, and parentheses.
+func tokenizeRule(expression string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == '!':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, fmt.Errorf("unexpected %q in idle rule", string(r))
+			}
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '-' || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			return nil, fmt.Errorf("unexpected %q in idle rule", string(r))
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *ruleParser) parseOr() (idleRule, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (idleRule, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseNot() (idleRule, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return ruleNot{operand}, nil
+	case "(":
+		p.pos++
+		rule, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in idle rule")
+		}
+		p.pos++
+		return rule, nil
+	case "", ")", "and", "&&", "or", "||":
+		return nil, fmt.Errorf("idle rule is missing a probe name")
+	}
+
+	name := p.tokens[p.pos]
+	p.pos++
+	if !p.names[name] {
+		return nil, fmt.Errorf("idle rule names unknown probe %s", name)
+	}
+
+	return ruleProbe(name), nil
+}
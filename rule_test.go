@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestParseIdleRule(t *testing.T) {
+	names := map[string]bool{"players": true, "cpu": true, "net-1": true}
+	tests := []struct {
+		expression string
+		idle       map[string]bool
+		want       bool
+	}{
+		{"players", map[string]bool{"players": true}, true},
+		{"players", map[string]bool{}, false},
+		{"players and cpu", map[string]bool{"players": true}, false},
+		{"players && cpu", map[string]bool{"players": true, "cpu": true}, true},
+		{"players or cpu", map[string]bool{"cpu": true}, true},
+		{"players || cpu", map[string]bool{}, false},
+		{"not players", map[string]bool{}, true},
+		{"!players", map[string]bool{"players": true}, false},
+		{"NOT not players", map[string]bool{"players": true}, true},
+		// "and" binds tighter than "or", and "not" tighter than both.
+		{"players or cpu and net-1", map[string]bool{"players": true}, true},
+		{"(players or cpu) and net-1", map[string]bool{"players": true}, false},
+		{"not players and cpu", map[string]bool{"cpu": true}, true},
+		{"not (players and cpu)", map[string]bool{"players": true, "cpu": true}, false},
+	}
+
+	for _, test := range tests {
+		rule, err := parseIdleRule(test.expression, names)
+		if err != nil {
+			t.Errorf("%q: %s", test.expression, err.Error())
+			continue
+		}
+		if got := rule.eval(test.idle); got != test.want {
+			t.Errorf("%q with %v = %t, want %t", test.expression, test.idle, got, test.want)
+		}
+	}
+}
+
+func TestParseIdleRuleErrors(t *testing.T) {
+	names := map[string]bool{"players": true, "cpu": true}
+	for _, expression := range []string{
+		"",
+		"   ",
+		"players and",
+		"and players",
+		"players cpu",
+		"(players or cpu",
+		"players or cpu)",
+		"players & cpu",
+		"players | cpu",
+		"players and memory",
+		"players; cpu",
+		"not",
+		"()",
+	} {
+		_, err := parseIdleRule(expression, names)
+		if err == nil {
+			t.Errorf("%q parsed", expression)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// syncedFile is what a file looked like the last time it matched S3.
+type syncedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// s3Syncer keeps the game directory in sync with an S3 prefix.
+type s3Syncer struct {
+	bucket  string
+	prefix  string
+	deletes bool
+	sess    *session.Session
+
+	mu     sync.Mutex
+	synced map[string]syncedFile
+}
+
+// gameSync is the syncer for the game directory when using S3 storage.
+var gameSync *s3Syncer
+
+// downloadFromS3 downloads the game directory from S3 and starts syncing changes back.
+func downloadFromS3(userData *GameServerUserData, sess *session.Session) error {
+	prefix := strings.TrimPrefix(userData.S3Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	syncer := &s3Syncer{
+		bucket:  userData.S3Bucket,
+		prefix:  prefix,
+		deletes: userData.S3SyncDeletes,
+		sess:    sess,
+		synced:  map[string]syncedFile{},
+	}
+
+	fmt.Printf("Downloading game from s3://%s/%s.\n", syncer.bucket, syncer.prefix)
+	err := syncer.download(mountPoint)
+	if err != nil {
+		return fmt.Errorf("error downloading from S3: %s", err.Error())
+	}
+
+	credential, _, err := runCredential(userData)
+	if err != nil {
+		return err
+	}
+
+	err = chownTree(mountPoint, credential)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Game downloaded.")
+
+	gameSync = syncer
+	go func() {
+		interval := time.Duration(userData.S3SyncInterval) * time.Second
+		for {
+			time.Sleep(interval)
+			err := syncer.upload(mountPoint)
+			if err != nil {
+				fmt.Printf("Error syncing to S3: %s\n", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// finalS3Sync uploads the game directory one last time before shutdown.
+func finalS3Sync() error {
+	if gameSync == nil {
+		return nil
+	}
+
+	fmt.Println("Syncing game to S3.")
+	err := gameSync.upload(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Game synced to S3.")
+	return nil
+}
+
+// download copies every object under the prefix into dir.
+func (s *s3Syncer) download(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	service := s3.New(s.sess)
+	downloader := s3manager.NewDownloader(s.sess)
+
+	objects := []*s3.Object{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}
+	err := service.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		rel := strings.TrimPrefix(*object.Key, s.prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			// Folder placeholder objects.
+			continue
+		}
+
+		local := filepath.Join(dir, filepath.FromSlash(rel))
+		err := os.MkdirAll(filepath.Dir(local), 0755)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+
+		_, err = downloader.Download(file, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    object.Key,
+		})
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error downloading %s: %s", *object.Key, err.Error())
+		}
+
+		info, err := os.Stat(local)
+		if err != nil {
+			return err
+		}
+		s.synced[rel] = syncedFile{size: info.Size(), modTime: info.ModTime()}
+	}
+
+	return nil
+}
+
+// upload copies every file in dir that changed since it was last synced to S3.
+func (s *s3Syncer) upload(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uploader := s3manager.NewUploader(s.sess)
+
+	seen := map[string]bool{}
+	err := filepath.Walk(dir, func(local string, info os.FileInfo, err error) error {
+		// The game can delete files, like temporary ones, while they are being walked.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, local)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		synced, ok := s.synced[rel]
+		if ok && synced.size == info.Size() && synced.modTime.Equal(info.ModTime()) {
+			return nil
+		}
+
+		file, err := os.Open(local)
+		if os.IsNotExist(err) {
+			delete(seen, rel)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(path.Join(s.prefix, rel)),
+			Body:   file,
+		})
+		if err != nil {
+			return fmt.Errorf("error uploading %s: %s", rel, err.Error())
+		}
+
+		s.synced[rel] = syncedFile{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !s.deletes {
+		return nil
+	}
+
+	service := s3.New(s.sess)
+	for rel := range s.synced {
+		if seen[rel] {
+			continue
+		}
+
+		_, err := service.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(path.Join(s.prefix, rel)),
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting %s: %s", rel, err.Error())
+		}
+		delete(s.synced, rel)
+	}
+
+	return nil
+}
+
+// chownTree gives ownership of everything under dir to the user and group the game runs as.
+func chownTree(dir string, credential *syscall.Credential) error {
+	return filepath.Walk(dir, func(local string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = os.Lchown(local, int(credential.Uid), int(credential.Gid))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
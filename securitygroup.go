@@ -0,0 +1,319 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// portRule is one CIDR allowed in on a protocol's range of ports.
+type portRule struct {
+	Protocol string
+	FromPort int64
+	ToPort   int64
+	CIDR     string
+}
+
+// key identifies the rule for comparing what the group has with what it should have.
+func (r portRule) key() string {
+	return fmt.Sprintf("%s %d-%d %s", r.Protocol, r.FromPort, r.ToPort, r.CIDR)
+}
+
+// permission returns the rule as an ingress permission.
+func (r portRule) permission() *ec2.IpPermission {
+	permission := &ec2.IpPermission{
+		IpProtocol: aws.String(r.Protocol),
+		FromPort:   aws.Int64(r.FromPort),
+		ToPort:     aws.Int64(r.ToPort),
+	}
+	if strings.Contains(r.CIDR, ":") {
+		permission.Ipv6Ranges = []*ec2.Ipv6Range{{CidrIpv6: aws.String(r.CIDR)}}
+	} else {
+		permission.IpRanges = []*ec2.IpRange{{CidrIp: aws.String(r.CIDR)}}
+	}
+	return permission
+}
+
+// parsePorts parses port specs like "tcp/25565" or "udp/27015-27016".
+func parsePorts(specs []string) ([]portRule, error) {
+	rules := []portRule{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "/", 2)
+		if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "udp") {
+			return nil, fmt.Errorf("port %q must be tcp/<port> or udp/<port>, or a range like tcp/<from>-<to>", spec)
+		}
+
+		bounds := strings.SplitN(parts[1], "-", 2)
+		from, err := strconv.ParseInt(bounds[0], 10, 64)
+		to := from
+		if err == nil && len(bounds) == 2 {
+			to, err = strconv.ParseInt(bounds[1], 10, 64)
+		}
+		if err != nil || from < 1 || to > 65535 || to < from {
+			return nil, fmt.Errorf("port %q has an invalid port or range", spec)
+		}
+		rules = append(rules, portRule{Protocol: parts[0], FromPort: from, ToPort: to})
+	}
+	return rules, nil
+}
+
+// runProvisionSecurityGroup creates the profile's security group, or updates it, so it lets
+// in exactly the game ports from anywhere and the admin ports from the admin CIDRs, revoking
+// any other address rules. Rules allowing other security groups in are left alone. With -my-ip
+// the admin ports are opened to this workstation's public IP instead of the admin CIDRs.
+func runProvisionSecurityGroup(args []string) int {
+	flags := flag.NewFlagSet("provision security-group", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	myIP := flags.Bool("my-ip", false, "open the admin ports to this workstation's public IP only")
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	gamePorts, err := parsePorts(profile.GamePorts)
+	if err == nil && len(gamePorts) == 0 {
+		err = fmt.Errorf("profile %s has no game ports", profile.name)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+	adminPorts, err := parsePorts(profile.AdminPorts)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	adminCIDRs := profile.AdminCIDRs
+	if *myIP {
+		address, err := publicIP()
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		adminCIDRs = []string{address}
+		fmt.Printf("Opening the admin ports to %s.\n", address)
+	}
+	if len(adminPorts) > 0 && len(adminCIDRs) == 0 {
+		fmt.Println("The admin ports have no admin CIDRs or -my-ip, so they stay closed.")
+	}
+
+	wanted := map[string]portRule{}
+	for _, rule := range gamePorts {
+		for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+			rule.CIDR = cidr
+			wanted[rule.key()] = rule
+		}
+	}
+	for _, rule := range adminPorts {
+		for _, cidr := range adminCIDRs {
+			rule.CIDR = cidr
+			wanted[rule.key()] = rule
+		}
+	}
+
+	service := ec2.New(profile.session())
+	groupID, err := findOrCreateSecurityGroup(service, profile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	groups, err := service.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{GroupIds: []*string{aws.String(groupID)}})
+	if err != nil {
+		fmt.Printf("Error describing security group %s: %s\n", groupID, err.Error())
+		return 1
+	}
+	if len(groups.SecurityGroups) == 0 {
+		fmt.Printf("Security group %s not found.\n", groupID)
+		return 1
+	}
+
+	existing := map[string]portRule{}
+	for _, permission := range groups.SecurityGroups[0].IpPermissions {
+		rule := portRule{
+			Protocol: aws.StringValue(permission.IpProtocol),
+			FromPort: aws.Int64Value(permission.FromPort),
+			ToPort:   aws.Int64Value(permission.ToPort),
+		}
+		for _, ipRange := range permission.IpRanges {
+			rule.CIDR = aws.StringValue(ipRange.CidrIp)
+			existing[rule.key()] = rule
+		}
+		for _, ipRange := range permission.Ipv6Ranges {
+			rule.CIDR = aws.StringValue(ipRange.CidrIpv6)
+			existing[rule.key()] = rule
+		}
+	}
+
+	revoke := []*ec2.IpPermission{}
+	for _, key := range sortedRuleKeys(existing) {
+		if _, ok := wanted[key]; !ok {
+			fmt.Printf("Revoking %s.\n", key)
+			revoke = append(revoke, existing[key].permission())
+		}
+	}
+	authorize := []*ec2.IpPermission{}
+	for _, key := range sortedRuleKeys(wanted) {
+		if _, ok := existing[key]; !ok {
+			fmt.Printf("Allowing %s.\n", key)
+			authorize = append(authorize, wanted[key].permission())
+		}
+	}
+
+	if len(revoke) > 0 {
+		_, err = service.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: revoke,
+		})
+		if err != nil {
+			fmt.Printf("Error revoking rules: %s\n", err.Error())
+			return 1
+		}
+	}
+	if len(authorize) > 0 {
+		_, err = service.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: authorize,
+		})
+		if err != nil {
+			fmt.Printf("Error allowing rules: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	if len(revoke) == 0 && len(authorize) == 0 {
+		fmt.Printf("%s is already up to date.\n", groupID)
+	} else {
+		fmt.Printf("Updated %s.\n", groupID)
+	}
+
+	listed := false
+	for _, id := range profile.SecurityGroupIDs {
+		listed = listed || id == groupID
+	}
+	if !listed {
+		fmt.Printf("Add %s to the profile's SecurityGroupIDs to use it.\n", groupID)
+	}
+	return 0
+}
+
+// findOrCreateSecurityGroup returns the ID of the profile's security group in the VPC the
+// game launches into, creating it if there isn't one.
+func findOrCreateSecurityGroup(service *ec2.EC2, profile *LaunchProfile) (string, error) {
+	groupName := profile.SecurityGroupName
+	if groupName == "" {
+		groupName = "aws-spot-game-server-" + profile.gameData.GameName
+	}
+
+	vpcID, err := profileVPC(service, profile)
+	if err != nil {
+		return "", err
+	}
+
+	groups, err := service.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("group-name"), Values: []*string{aws.String(groupName)}},
+			{Name: aws.String("vpc-id"), Values: []*string{aws.String(vpcID)}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing security groups: %s", err.Error())
+	}
+	if len(groups.SecurityGroups) > 0 {
+		return aws.StringValue(groups.SecurityGroups[0].GroupId), nil
+	}
+
+	created, err := service.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(groupName),
+		Description: aws.String("Ports for " + profile.gameData.GameName),
+		VpcId:       aws.String(vpcID),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeSecurityGroup),
+				Tags:         []*ec2.Tag{{Key: aws.String(tagGame), Value: aws.String(profile.gameData.GameName)}},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating security group: %s", err.Error())
+	}
+	groupID := aws.StringValue(created.GroupId)
+	fmt.Printf("Created security group %s (%s) in %s.\n", groupName, groupID, vpcID)
+	return groupID, nil
+}
+
+// profileVPC returns the VPC the profile's subnets are in, or the default VPC.
+func profileVPC(service *ec2.EC2, profile *LaunchProfile) (string, error) {
+	subnets := profile.SubnetIDs
+	if len(subnets) == 0 && profile.SubnetID != "" {
+		subnets = []string{profile.SubnetID}
+	}
+
+	if len(subnets) > 0 {
+		described, err := service.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: aws.StringSlice(subnets)})
+		if err != nil {
+			return "", fmt.Errorf("error describing subnets: %s", err.Error())
+		}
+		if len(described.Subnets) == 0 {
+			return "", fmt.Errorf("subnets not found")
+		}
+		return aws.StringValue(described.Subnets[0].VpcId), nil
+	}
+
+	vpcs, err := service.DescribeVpcs(&ec2.DescribeVpcsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("is-default"), Values: []*string{aws.String("true")}}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing VPCs: %s", err.Error())
+	}
+	if len(vpcs.Vpcs) == 0 {
+		return "", fmt.Errorf("there is no default VPC, give the profile a subnet")
+	}
+	return aws.StringValue(vpcs.Vpcs[0].VpcId), nil
+}
+
+// publicIP returns this workstation's public IP as a single address CIDR.
+func publicIP() (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get("https://checkip.amazonaws.com/")
+	if err != nil {
+		return "", fmt.Errorf("error finding public IP: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error finding public IP: %s", err.Error())
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("public IP lookup returned %q", strings.TrimSpace(string(body)))
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// sortedRuleKeys returns the rules' keys in order, so changes are printed predictably.
+func sortedRuleKeys(rules map[string]portRule) []string {
+	keys := []string{}
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
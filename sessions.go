@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// defaultSessionFile is where sessions are recorded by default. It is on the game storage so
+// the history follows the game from instance to instance.
+const defaultSessionFile = mountPoint + "/.aws-spot-game-server/sessions.jsonl"
+
+// playSession is one player's time on the server.
+type playSession struct {
+	Game   string    `json:"game"`
+	Player string    `json:"player"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// playerNamer is an idle checker that can also say who is online.
+type playerNamer interface {
+	playerNames() ([]string, error)
+}
+
+// validateSessionTracking makes sure sessions can be tracked from the configured source.
+func validateSessionTracking(userData *GameServerUserData) error {
+	switch userData.SessionSource {
+	case "":
+	case "probe":
+		for _, probe := range userData.IdleProbes {
+			if probe.Type == "a2s" || probe.Type == "minecraft" {
+				return nil
+			}
+		}
+		return fmt.Errorf("tracking sessions from probes needs an a2s or minecraft idle probe")
+	case "log":
+		if userData.SessionLogPath == "" {
+			return fmt.Errorf("tracking sessions from the log needs a session log path")
+		}
+		for _, pattern := range []string{userData.SessionJoinPattern, userData.SessionLeavePattern} {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid session pattern: %s", err.Error())
+			}
+			if compiled.NumSubexp() < 1 {
+				return fmt.Errorf("session pattern %s needs a group for the player", pattern)
+			}
+		}
+	default:
+		return fmt.Errorf("session source must be probe or log")
+	}
+
+	return nil
+}
+
+// sessionTracker follows who is online and records a session whenever someone leaves.
+type sessionTracker struct {
+	userData *GameServerUserData
+	sess     *session.Session
+
+	mu     sync.Mutex
+	online map[string]time.Time
+}
+
+// sessions is the session tracker, or nil when sessions aren't tracked.
+var sessions *sessionTracker
+
+// trackSessions starts tracking sessions from the game log, if that's the source, or from
+// the idle probes, which the idle check feeds in.
+func trackSessions(userData *GameServerUserData, sess *session.Session) {
+	sessions = &sessionTracker{userData: userData, sess: sess, online: map[string]time.Time{}}
+
+	if userData.SessionSource == "log" {
+		// Already validated.
+		join := regexp.MustCompile(userData.SessionJoinPattern)
+		leave := regexp.MustCompile(userData.SessionLeavePattern)
+		go tailLog(userData.SessionLogPath, func(line string) {
+			if match := join.FindStringSubmatch(line); len(match) > 1 {
+				sessions.join(match[1], time.Now())
+			} else if match := leave.FindStringSubmatch(line); len(match) > 1 {
+				sessions.leave(match[1], time.Now())
+			}
+		})
+	}
+}
+
+func (t *sessionTracker) join(player string, when time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.online[player]; ok {
+		return
+	}
+	fmt.Printf("%s joined.\n", player)
+	t.online[player] = when
+	watchEvent(t.userData, "player-joined", player+" joined.", map[string]string{"player": player})
+}
+
+func (t *sessionTracker) leave(player string, when time.Time) {
+	t.mu.Lock()
+	start, ok := t.online[player]
+	delete(t.online, player)
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	fmt.Printf("%s left after %s.\n", player, when.Sub(start).Round(time.Second))
+	watchEvent(t.userData, "player-left", fmt.Sprintf("%s left after %s.", player, when.Sub(start).Round(time.Second)),
+		map[string]string{"player": player})
+
+	err := t.record(playSession{Game: t.userData.GameName, Player: player, Start: start, End: when})
+	if err != nil {
+		fmt.Printf("Error recording session: %s\n", err.Error())
+	}
+}
+
+// update sets who is online, joining the new players and leaving the ones who are gone.
+func (t *sessionTracker) update(players []string) {
+	now := time.Now()
+	current := map[string]bool{}
+	for _, player := range players {
+		current[player] = true
+		t.join(player, now)
+	}
+
+	t.mu.Lock()
+	gone := []string{}
+	for player := range t.online {
+		if !current[player] {
+			gone = append(gone, player)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, player := range gone {
+		t.leave(player, now)
+	}
+}
+
+// updateFromProbes sets who is online from the first probe that can tell.
+func (t *sessionTracker) updateFromProbes(probes []*idleProbeState) {
+	for _, probe := range probes {
+		namer, ok := probe.checker.(playerNamer)
+		if !ok {
+			continue
+		}
+
+		players, err := namer.playerNames()
+		if err != nil {
+			fmt.Printf("Error getting players from %s idle probe: %s\n", probe.name, err.Error())
+			return
+		}
+		t.update(players)
+		return
+	}
+}
+
+// players returns who is online, in order of name.
+func (t *sessionTracker) players() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	players := []string{}
+	for player := range t.online {
+		players = append(players, player)
+	}
+	sort.Strings(players)
+	return players
+}
+
+// end ends everyone's session, for when the game is shutting down.
+func (t *sessionTracker) end() {
+	t.update(nil)
+}
+
+// record stores a finished session, in DynamoDB if there is a session table, otherwise
+// appended to the sessions file.
+func (t *sessionTracker) record(session playSession) error {
+	if t.userData.SessionTable != "" {
+		_, err := dynamodb.New(t.sess).PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(t.userData.SessionTable),
+			Item: map[string]*dynamodb.AttributeValue{
+				"Game":    {S: aws.String(session.Game)},
+				"Start":   {S: aws.String(session.Start.UTC().Format(time.RFC3339Nano) + "#" + session.Player)},
+				"Player":  {S: aws.String(session.Player)},
+				"End":     {S: aws.String(session.End.UTC().Format(time.RFC3339Nano))},
+				"Seconds": {N: aws.String(fmt.Sprintf("%d", int64(session.End.Sub(session.Start).Seconds())))},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error putting session: %s", err.Error())
+		}
+		return nil
+	}
+
+	line, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(t.userData.SessionFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(t.userData.SessionFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// tailLog follows a log file from its current end, calling handle with each new line. A
+// file that shrinks was rotated or truncated, and is read again from the start.
+func tailLog(path string, handle func(string)) {
+	var offset int64 = -1
+	partial := ""
+	for {
+		func() {
+			file, err := os.Open(path)
+			if err != nil {
+				return
+			}
+			defer file.Close()
+
+			info, err := file.Stat()
+			if err != nil {
+				return
+			}
+			if offset < 0 {
+				offset = info.Size()
+			}
+			if info.Size() < offset {
+				offset = 0
+				partial = ""
+			}
+
+			_, err = file.Seek(offset, io.SeekStart)
+			if err != nil {
+				return
+			}
+
+			reader := bufio.NewReader(file)
+			for {
+				line, err := reader.ReadString('\n')
+				offset += int64(len(line))
+				if err != nil {
+					// Keep the unfinished line for next time.
+					partial += line
+					return
+				}
+				handle(partial + line[:len(line)-1])
+				partial = ""
+			}
+		}()
+
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// releaseOnce makes sure the volume is only released once, no matter how many exit
+// paths race to do it.
+var releaseOnce sync.Once
+
+// keepAttached is set when the instance is being stopped rather than terminated. It starts
+// again with its volumes still attached, so releasing only unmounts them.
+var keepAttached bool
+
+// releaseVolume syncs and unmounts the game volume and detaches it from this instance, so
+// the next instance can attach it right away. It is safe to call on every exit path.
+func releaseVolume(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	releaseOnce.Do(func() {
+		fmt.Println("Releasing volume.")
+
+		// Sessions are recorded on the game storage, so end them before the final sync.
+		if sessions != nil {
+			sessions.end()
+		}
+
+		// Sync before unmounting, instance store data is gone once it is unmounted.
+		err := finalS3Sync()
+		if err != nil {
+			fmt.Printf("Error syncing to S3: %s\n", err.Error())
+			return
+		}
+
+		err = unmountVolume()
+		if err != nil && err != errNotMounted {
+			// Detaching a mounted volume risks the filesystem, leave it for the force detach
+			// on the next launch.
+			fmt.Printf("Error releasing volume: %s\n", err.Error())
+			return
+		}
+
+		if userData.StorageType != "ebs" {
+			fmt.Println("Storage released.")
+			return
+		}
+
+		if keepAttached {
+			fmt.Println("Volume unmounted, leaving it attached for when the instance starts again.")
+			return
+		}
+
+		// The filesystem is unmounted by now, so these failing (most likely because boot
+		// failed before they were set up) doesn't stop the volumes being detached.
+		if userData.LUKSEncrypted {
+			err = closeLUKS()
+			if err != nil {
+				fmt.Printf("Error closing encrypted volume: %s\n", err.Error())
+			}
+		}
+
+		if len(userData.VolumeIDs) > 0 {
+			err = stopRAID()
+			if err != nil {
+				fmt.Printf("Error stopping RAID array: %s\n", err.Error())
+			}
+		}
+
+		service := ec2.New(sess)
+		for _, volumeID := range gameVolumeIDs(userData) {
+			input := &ec2.DetachVolumeInput{
+				InstanceId: aws.String(instanceID),
+				VolumeId:   aws.String(volumeID),
+			}
+			_, err = service.DetachVolume(input)
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "IncorrectState" {
+					// Never attached, or already detached.
+					continue
+				}
+				fmt.Printf("Error detaching volume %s: %s\n", volumeID, err.Error())
+				return
+			}
+
+			err = releaseMountLock(service, volumeID, instanceID)
+			if err != nil {
+				fmt.Printf("Error unlocking volume %s: %s\n", volumeID, err.Error())
+			}
+
+			// A Multi-Attach volume still attached elsewhere never becomes available.
+			err = waitForVolumeAvailable(service, volumeID, 1*time.Minute)
+			if err != nil {
+				fmt.Printf("Error waiting for volume %s to detach: %s\n", volumeID, err.Error())
+			}
+		}
+
+		fmt.Println("Volume released.")
+	})
+}
+
+// terminateInstance terminates this instance. In an Auto Scaling group the group is asked to
+// terminate it instead, lowering the desired capacity unless the instance should be
+// replaced, and the terminating lifecycle hook is completed since shutdown is already done.
+func terminateInstance(userData *GameServerUserData, instanceID string, replace bool, sess *session.Session) {
+	if autoScalingGroup != "" {
+		terminatingSelf = true
+		_, err := autoscaling.New(sess).TerminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(instanceID),
+			ShouldDecrementDesiredCapacity: aws.Bool(!replace),
+		})
+		if err != nil {
+			fmt.Printf("Terminating instance in auto scaling group failed: %s\n", err.Error())
+			return
+		}
+
+		err = completeLifecycleAction(userData, instanceID, sess)
+		if err != nil {
+			fmt.Printf("Error completing lifecycle action: %s\n", err.Error())
+		}
+		announceTerminated(userData, instanceID)
+		return
+	}
+
+	if ec2Fleet != "" && !replace {
+		err := deleteFleet(sess, ec2Fleet)
+		if err == nil {
+			announceTerminated(userData, instanceID)
+			return
+		}
+		// Terminating still stops the bill for now, though the fleet will launch another.
+		fmt.Printf("Deleting fleet %s failed: %s\n", ec2Fleet, err.Error())
+	}
+
+	if !replace {
+		err := cancelSpotRequest(sess, instanceID)
+		if err != nil {
+			// The request will launch another instance, but this one still has to go.
+			fmt.Println(err.Error())
+		}
+	}
+
+	service := ec2.New(sess)
+
+	input := &ec2.TerminateInstancesInput{
+		DryRun:      aws.Bool(false),
+		InstanceIds: []*string{aws.String(instanceID)},
+	}
+
+	_, err := service.TerminateInstances(input)
+	if err != nil {
+		fmt.Printf("Terminating instances failed: %s\n", err.Error())
+		return
+	}
+
+	announceTerminated(userData, instanceID)
+}
+
+// announceTerminated sends the terminated event, waiting a little for the webhooks since
+// the instance may not last long enough for main to.
+func announceTerminated(userData *GameServerUserData, instanceID string) {
+	watchEvent(userData, "terminated", fmt.Sprintf("Instance %s is terminating.", instanceID), nil)
+	waitForWebhooks(10 * time.Second)
+}
+
+// stopInstance stops or hibernates this instance, keeping its root volume. Spot instances
+// can only be stopped when they come from a persistent request.
+func stopInstance(instanceID string, hibernate bool, sess *session.Session) error {
+	_, err := ec2.New(sess).StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+		Hibernate:   aws.Bool(hibernate),
+	})
+	if err != nil {
+		return fmt.Errorf("error stopping instance: %s", err.Error())
+	}
+
+	return nil
+}
+
+// shutdownOnce makes sure the instance is only shut down on request once.
+var shutdownOnce sync.Once
+
+// shutDownInstance runs the shutdown pipeline like a termination and terminates the
+// instance, e.g. once a game has crashed too often or an admin asked. The message is
+// published with the terminating event.
+func shutDownInstance(userData *GameServerUserData, instanceID string, sess *session.Session, reason string, message string) {
+	shutdownOnce.Do(func() {
+		shuttingDown.Add(1)
+		defer shuttingDown.Done()
+
+		setStatusState("shutting-down")
+		publishEvent(userData, instanceID, sess, "terminating", message, nil)
+		runShutdownSteps(userData, instanceID, sess, userData.TerminationSteps, reason, time.Time{})
+		terminateInstance(userData, instanceID, false, sess)
+	})
+}
+
+// stopRequested is closed once the daemon has been told to stop.
+var stopRequested = make(chan struct{})
+
+// handleSignals catches SIGTERM and SIGINT so the daemon doesn't die before it has
+// released the volume. The game is asked to stop, and main releases the volume once it has.
+func handleSignals(userData *GameServerUserData) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("Got %s. Stopping game server.\n", sig.String())
+		sdNotify("STOPPING=1")
+		close(stopRequested)
+		setStatusState("stopping")
+
+		// Without a stop script or stop signal the game has to exit on the signal itself.
+		// systemd sends it to the whole service, but the game has its own process group, so
+		// pass it on in case it came from a terminal.
+		for _, game := range games {
+			_, err := os.Stat(game.userData.StopPath)
+			if err != nil && game.userData.StopSignal == "" {
+				err = game.signal(sig.(syscall.Signal))
+				if err != nil {
+					fmt.Printf("Error passing on %s: %s\n", sig.String(), err.Error())
+				}
+			}
+		}
+
+		err := stopGame(context.Background(), userData)
+		if err != nil {
+			fmt.Printf("Error calling stop: %s\n", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// slackResponse is the reply to a slash command.
+type slackResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// postSlackEvents posts events to the Slack incoming webhook, except idle ticks, which
+// would drown the channel.
+func postSlackEvents(userData *GameServerUserData) {
+	events, _ := followEvents()
+
+	go func() {
+		for event := range events {
+			if event.Event == "idle-tick" {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := postWebhook(ctx, userData.SlackWebhookURL, map[string]string{"text": fmt.Sprintf("*%s*: %s", userData.GameName, event.Message)})
+			cancel()
+			if err != nil {
+				fmt.Printf("Error posting to Slack: %s\n", err.Error())
+			}
+		}
+	}()
+	fmt.Println("Posting events to Slack.")
+}
+
+// serveSlackCommands serves the slash command endpoint at /slack on SlackCommandAddress,
+// over TLS with the control API's certificate if it has one. Requests are checked against
+// the signing secret in SlackSigningSecretID.
+func serveSlackCommands(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	secret, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(userData.SlackSigningSecretID),
+	})
+	if err != nil {
+		// Serving without it would let anyone stop the game.
+		fmt.Printf("Error getting Slack signing secret, not serving slash commands: %s\n", err.Error())
+		return
+	}
+	signingSecret := strings.TrimSpace(aws.StringValue(secret.SecretString))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		if !verifySlackSignature(signingSecret, r.Header, body) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		fields := strings.Fields(form.Get("text"))
+		if len(fields) == 0 {
+			fields = []string{"status"}
+		}
+
+		prefix := form.Get("command") + " "
+		reply := chatCommand(userData, instanceID, sess, prefix, fields, form.Get("user_name"),
+			isChatAdmin(userData.SlackAdminIDs, form.Get("user_id")))
+		if reply == "" {
+			reply = chatCommand(userData, instanceID, sess, prefix, []string{"help"}, "", false)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(slackResponse{ResponseType: "in_channel", Text: reply})
+	})
+
+	server := &http.Server{Addr: userData.SlackCommandAddress, Handler: mux}
+	go func() {
+		var err error
+		if userData.ControlTLSCert != "" {
+			err = server.ListenAndServeTLS(userData.ControlTLSCert, userData.ControlTLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			fmt.Printf("Error serving Slack commands: %s\n", err.Error())
+		}
+	}()
+	fmt.Printf("Slack commands listening on %s.\n", userData.SlackCommandAddress)
+}
+
+// verifySlackSignature checks a request's signature against the signing secret, refusing
+// requests more than five minutes old so they can't be replayed.
+func verifySlackSignature(secret string, header http.Header, body []byte) bool {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := time.Since(time.Unix(seconds, 0))
+	if age > 5*time.Minute || age < -5*time.Minute {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(header.Get("X-Slack-Signature")), []byte(expected))
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// errNotMounted is returned when unmounting a volume that isn't mounted.
+var errNotMounted = errors.New("volume is not mounted")
+
+// unmountVolume flushes and unmounts the game volume. The game may take a moment to
+// exit after being stopped, so a busy mount is retried for up to 30 seconds.
+func unmountVolume() error {
+	// Sessions are recorded on the game storage, so end them while it is still there.
+	if sessions != nil {
+		sessions.end()
+	}
+
+	syscall.Sync()
+
+	var err error
+	for i := 0; i < 30; i++ {
+		err = syscall.Unmount(mountPoint, 0)
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	if err == syscall.EINVAL || err == syscall.ENOENT {
+		return errNotMounted
+	}
+
+	if err != nil {
+		return fmt.Errorf("error unmounting volume: %s", err.Error())
+	}
+
+	return nil
+}
+
+// frozenSnapshotTimeout is the longest the game storage is left frozen waiting for EC2 to
+// start a snapshot.
+const frozenSnapshotTimeout = 20 * time.Second
+
+// createSnapshot starts a snapshot of the game volume, tagged with the game name, the
+// time, and the reason it was taken. The snapshot is point in time as soon as it is
+// created, so there is no need to wait for it to complete.
+func createSnapshot(userData *GameServerUserData, reason string, sess *session.Session) (string, error) {
+	snapshotID, err := startSnapshot(context.Background(), userData, reason, sess)
+	if err != nil {
+		return "", err
+	}
+
+	publishSnapshot(userData, reason, snapshotID, sess)
+	return snapshotID, nil
+}
+
+// startSnapshot makes the CreateSnapshot call for createSnapshot.
+func startSnapshot(ctx context.Context, userData *GameServerUserData, reason string, sess *session.Session) (string, error) {
+	service := ec2.New(sess)
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	input := &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(userData.VolumeID),
+		Description: aws.String(fmt.Sprintf("%s %s at %s", userData.GameName, reason, now)),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(userData.GameName)},
+					{Key: aws.String(tagGame), Value: aws.String(userData.GameName)},
+					{Key: aws.String(tagCreatedAt), Value: aws.String(now)},
+					{Key: aws.String(tagReason), Value: aws.String(reason)},
+				},
+			},
+		},
+	}
+
+	snapshot, err := service.CreateSnapshotWithContext(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("error creating snapshot: %s", err.Error())
+	}
+
+	return *snapshot.SnapshotId, nil
+}
+
+// publishSnapshot publishes the snapshot event.
+func publishSnapshot(userData *GameServerUserData, reason string, snapshotID string, sess *session.Session) {
+	publishEvent(userData, "", sess, "snapshot", fmt.Sprintf("Took %s snapshot %s.", reason, snapshotID),
+		map[string]string{"snapshotId": snapshotID, "volumeId": userData.VolumeID, "reason": reason})
+}
+
+// snapshotOnShutdown unmounts the game volume so it is consistent and snapshots it.
+func snapshotOnShutdown(userData *GameServerUserData, reason string, sess *session.Session) error {
+	fmt.Println("Unmounting volume.")
+	err := unmountVolume()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Creating snapshot.")
+	snapshotID, err := createSnapshot(userData, reason, sess)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Snapshot %s created.\n", snapshotID)
+
+	err = pruneSnapshots(userData, sess)
+	if err != nil {
+		// The new snapshot is safe, so don't fail the shutdown over the old ones.
+		fmt.Printf("Error pruning snapshots: %s\n", err.Error())
+	}
+
+	return nil
+}
+
+// snapshotPeriodically snapshots the mounted game volume on the snapshot interval.
+func snapshotPeriodically(userData *GameServerUserData, sess *session.Session) {
+	go func() {
+		for {
+			time.Sleep(time.Duration(userData.SnapshotInterval) * time.Second)
+
+			fmt.Println("Creating periodic snapshot.")
+			snapshotID, err := createLiveSnapshot(userData, sess)
+			if err != nil {
+				fmt.Printf("Error creating periodic snapshot: %s\n", err.Error())
+				continue
+			}
+			fmt.Printf("Snapshot %s created.\n", snapshotID)
+
+			err = pruneSnapshots(userData, sess)
+			if err != nil {
+				fmt.Printf("Error pruning snapshots: %s\n", err.Error())
+			}
+		}
+	}()
+}
+
+// createLiveSnapshot snapshots the volume while it is mounted, freezing the filesystem
+// around the snapshot creation if configured to. The game can't write while it is frozen,
+// so EC2 only gets frozenSnapshotTimeout to start the snapshot.
+func createLiveSnapshot(userData *GameServerUserData, sess *session.Session) (string, error) {
+	if !userData.SnapshotFreeze {
+		return createSnapshot(userData, "periodic", sess)
+	}
+
+	snapshotID, err := func() (string, error) {
+		err := runFsfreeze("--freeze")
+		if err != nil {
+			return "", fmt.Errorf("error freezing filesystem: %s", err.Error())
+		}
+
+		defer func() {
+			err := runFsfreeze("--unfreeze")
+			if err != nil {
+				fmt.Printf("Error unfreezing filesystem: %s\n", err.Error())
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), frozenSnapshotTimeout)
+		defer cancel()
+		return startSnapshot(ctx, userData, "periodic", sess)
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	publishSnapshot(userData, "periodic", snapshotID, sess)
+	return snapshotID, nil
+}
+
+func runFsfreeze(action string) error {
+	cmd := exec.Command("/sbin/fsfreeze", action, mountPoint)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// pruneSnapshots deletes the snapshots the daemon created for this game that fall
+// outside the retention policy.
+func pruneSnapshots(userData *GameServerUserData, sess *session.Session) error {
+	if userData.SnapshotRetainLast <= 0 && userData.SnapshotRetainDaily <= 0 && userData.SnapshotRetainWeekly <= 0 {
+		return nil
+	}
+
+	service := ec2.New(sess)
+
+	snapshots := []*ec2.Snapshot{}
+	input := &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagGame),
+				Values: []*string{aws.String(userData.GameName)},
+			},
+			{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(tagCreatedAt)},
+			},
+		},
+	}
+	err := service.DescribeSnapshotsPages(input, func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		snapshots = append(snapshots, page.Snapshots...)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("error listing snapshots: %s", err.Error())
+	}
+
+	for _, snapshot := range expiredSnapshots(snapshots, userData.SnapshotRetainLast, userData.SnapshotRetainDaily, userData.SnapshotRetainWeekly) {
+		fmt.Printf("Deleting expired snapshot %s.\n", *snapshot.SnapshotId)
+		_, err := service.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: snapshot.SnapshotId})
+		if err != nil {
+			// Snapshots backing an AMI can't be deleted - keep going with the rest.
+			fmt.Printf("Error deleting snapshot %s: %s\n", *snapshot.SnapshotId, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// expiredSnapshots applies the retention policy and returns the completed snapshots
+// that aren't kept by any of its rules.
+func expiredSnapshots(snapshots []*ec2.Snapshot, last int, daily int, weekly int) []*ec2.Snapshot {
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].StartTime.After(*snapshots[j].StartTime)
+	})
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	expired := []*ec2.Snapshot{}
+	for i, snapshot := range snapshots {
+		keep := i < last
+
+		started := snapshot.StartTime.UTC()
+		day := started.Format("2006-01-02")
+		if !days[day] && len(days) < daily {
+			days[day] = true
+			keep = true
+		}
+
+		year, week := started.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		if !weeks[weekKey] && len(weeks) < weekly {
+			weeks[weekKey] = true
+			keep = true
+		}
+
+		if !keep && *snapshot.State == ec2.SnapshotStateCompleted {
+			expired = append(expired, snapshot)
+		}
+	}
+
+	return expired
+}
+
+// backupNow saves the games and backs up the game storage while it is in use: a snapshot
+// for an EBS volume, or a sync for S3 storage. It returns what it did.
+func backupNow(userData *GameServerUserData, sess *session.Session) (string, error) {
+	err := rconEveryGame(userData, userData.RCONSaveCommand)
+	if err != nil {
+		fmt.Printf("Error saving world: %s\n", err.Error())
+	}
+
+	if gameSync != nil {
+		err = gameSync.upload(mountPoint)
+		if err != nil {
+			return "", fmt.Errorf("error syncing to S3: %s", err.Error())
+		}
+		return "synced to S3", nil
+	}
+
+	if userData.StorageType != "ebs" || len(userData.VolumeIDs) > 0 {
+		return "", fmt.Errorf("backups need a single EBS volume or S3 storage")
+	}
+
+	snapshotID, err := createLiveSnapshot(userData, sess)
+	if err != nil {
+		return "", fmt.Errorf("error creating snapshot: %s", err.Error())
+	}
+
+	err = pruneSnapshots(userData, sess)
+	if err != nil {
+		fmt.Printf("Error pruning snapshots: %s\n", err.Error())
+	}
+
+	return "created snapshot " + snapshotID, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestExpiredSnapshots(t *testing.T) {
+	// Snapshots twice a day for three weeks, from a Monday, the last still pending.
+	start := time.Date(2026, 9, 7, 6, 0, 0, 0, time.UTC)
+	snapshots := func() []*ec2.Snapshot {
+		snapshots := []*ec2.Snapshot{}
+		for i := 0; i < 42; i++ {
+			state := ec2.SnapshotStateCompleted
+			if i == 41 {
+				state = ec2.SnapshotStatePending
+			}
+			snapshots = append(snapshots, &ec2.Snapshot{
+				SnapshotId: aws.String(start.Add(time.Duration(i) * 12 * time.Hour).Format("snap-0102-15")),
+				StartTime:  aws.Time(start.Add(time.Duration(i) * 12 * time.Hour)),
+				State:      aws.String(state),
+			})
+		}
+		return snapshots
+	}
+
+	tests := []struct {
+		name                string
+		last, daily, weekly int
+		kept                []string
+	}{
+		{
+			name: "nothing kept but pending",
+			kept: []string{"snap-0927-18"},
+		},
+		{
+			name: "last",
+			last: 3,
+			kept: []string{"snap-0927-18", "snap-0927-06", "snap-0926-18"},
+		},
+		{
+			name:  "daily",
+			daily: 3,
+			kept:  []string{"snap-0927-18", "snap-0926-18", "snap-0925-18"},
+		},
+		{
+			name:   "weekly",
+			weekly: 2,
+			kept:   []string{"snap-0927-18", "snap-0920-18"},
+		},
+		{
+			name:   "combined",
+			last:   1,
+			daily:  2,
+			weekly: 3,
+			kept:   []string{"snap-0927-18", "snap-0926-18", "snap-0920-18", "snap-0913-18"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			all := snapshots()
+			expired := map[string]bool{}
+			for _, snapshot := range expiredSnapshots(all, test.last, test.daily, test.weekly) {
+				expired[*snapshot.SnapshotId] = true
+			}
+
+			kept := []string{}
+			for _, snapshot := range all {
+				if !expired[*snapshot.SnapshotId] {
+					kept = append(kept, *snapshot.SnapshotId)
+				}
+			}
+			if !reflect.DeepEqual(kept, test.kept) {
+				t.Errorf("kept %v, want %v", kept, test.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// spotOption is an instance type in a subnet the game could be launched in, with the
+// current spot price in its zone and the zone's placement score, 1 to 10, or 0 if unknown.
+type spotOption struct {
+	InstanceType string
+	Zone         string
+	SubnetID     string
+	Price        float64
+	Score        int64
+}
+
+// rankSpotOptions returns every candidate instance type in every candidate subnet, the
+// cheapest first. Zones with a placement score under MinPlacementScore go last, since spot
+// requests there are likely to go unfulfilled or be interrupted soon.
+func rankSpotOptions(service *ec2.EC2, profile *LaunchProfile) ([]spotOption, error) {
+	types := profile.candidateTypes()
+
+	subnets, err := candidateSubnets(service, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	zones := []*string{}
+	for zone := range subnets {
+		zones = append(zones, aws.String(zone))
+	}
+
+	// Only the latest price for each type in each zone is wanted; the history is newest first.
+	prices := map[string]float64{}
+	err = service.DescribeSpotPriceHistoryPages(&ec2.DescribeSpotPriceHistoryInput{
+		Filters:             []*ec2.Filter{{Name: aws.String("availability-zone"), Values: zones}},
+		InstanceTypes:       aws.StringSlice(types),
+		ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+		StartTime:           aws.Time(time.Now()),
+	}, func(page *ec2.DescribeSpotPriceHistoryOutput, last bool) bool {
+		for _, history := range page.SpotPriceHistory {
+			key := aws.StringValue(history.InstanceType) + " " + aws.StringValue(history.AvailabilityZone)
+			if _, seen := prices[key]; seen {
+				continue
+			}
+			price, err := strconv.ParseFloat(aws.StringValue(history.SpotPrice), 64)
+			if err == nil {
+				prices[key] = price
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing spot price history: %s", err.Error())
+	}
+
+	scores, err := placementScores(service, profile, types)
+	if err != nil {
+		// Prices alone still pick a decent option.
+		fmt.Printf("Error getting spot placement scores: %s\n", err.Error())
+	}
+
+	options := []spotOption{}
+	for zone, subnet := range subnets {
+		for _, instanceType := range types {
+			price, ok := prices[instanceType+" "+zone]
+			if !ok {
+				// Not offered in the zone.
+				continue
+			}
+			options = append(options, spotOption{
+				InstanceType: instanceType,
+				Zone:         zone,
+				SubnetID:     subnet,
+				Price:        price,
+				Score:        scores[zone],
+			})
+		}
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("none of %v are offered as spot in the candidate zones", types)
+	}
+
+	sort.Slice(options, func(i, j int) bool {
+		iViable := options[i].Score == 0 || options[i].Score >= profile.MinPlacementScore
+		jViable := options[j].Score == 0 || options[j].Score >= profile.MinPlacementScore
+		if iViable != jViable {
+			return iViable
+		}
+		if options[i].Price != options[j].Price {
+			return options[i].Price < options[j].Price
+		}
+		return options[i].Score > options[j].Score
+	})
+	return options, nil
+}
+
+// candidateTypes returns the instance types the game can be launched as.
+func (p *LaunchProfile) candidateTypes() []string {
+	if len(p.InstanceTypes) > 0 {
+		return p.InstanceTypes
+	}
+	return []string{p.InstanceType}
+}
+
+// candidateSubnets returns the subnets the game can be launched in, one a zone, keyed by
+// zone: SubnetIDs, or SubnetID, or the default VPC's default subnets.
+func candidateSubnets(service *ec2.EC2, profile *LaunchProfile) (map[string]string, error) {
+	input := &ec2.DescribeSubnetsInput{}
+	switch {
+	case len(profile.SubnetIDs) > 0:
+		input.SubnetIds = aws.StringSlice(profile.SubnetIDs)
+	case profile.SubnetID != "":
+		input.SubnetIds = []*string{aws.String(profile.SubnetID)}
+	default:
+		input.Filters = []*ec2.Filter{{Name: aws.String("default-for-az"), Values: []*string{aws.String("true")}}}
+	}
+
+	described, err := service.DescribeSubnets(input)
+	if err != nil {
+		return nil, fmt.Errorf("error describing subnets: %s", err.Error())
+	}
+
+	subnets := map[string]string{}
+	for _, subnet := range described.Subnets {
+		zone := aws.StringValue(subnet.AvailabilityZone)
+		if _, seen := subnets[zone]; !seen {
+			subnets[zone] = aws.StringValue(subnet.SubnetId)
+		}
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("no subnets to launch in")
+	}
+	return subnets, nil
+}
+
+// placementScores returns how likely a spot request for one of the types is to succeed in
+// each zone of the region, keyed by zone name. With instance requirements, those are scored
+// instead of the long list of types matching them.
+func placementScores(service *ec2.EC2, profile *LaunchProfile, types []string) (map[string]int64, error) {
+	input := &ec2.GetSpotPlacementScoresInput{
+		RegionNames:            []*string{service.Config.Region},
+		SingleAvailabilityZone: aws.Bool(true),
+		TargetCapacity:         aws.Int64(1),
+	}
+	if profile.requirements != nil {
+		input.InstanceRequirementsWithMetadata = profile.requirements
+	} else {
+		input.InstanceTypes = aws.StringSlice(types)
+	}
+
+	output, err := service.GetSpotPlacementScores(input)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scores are by zone ID, which maps to a different zone name in each account.
+	zones, err := service.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{})
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, zone := range zones.AvailabilityZones {
+		names[aws.StringValue(zone.ZoneId)] = aws.StringValue(zone.ZoneName)
+	}
+
+	scores := map[string]int64{}
+	for _, score := range output.SpotPlacementScores {
+		scores[names[aws.StringValue(score.AvailabilityZoneId)]] = aws.Int64Value(score.Score)
+	}
+	return scores, nil
+}
+
+// describeSpotOption describes an option for the launch output.
+func describeSpotOption(option spotOption) string {
+	description := fmt.Sprintf("%s in %s at $%.4f/hour", option.InstanceType, option.Zone, option.Price)
+	if option.Score > 0 {
+		description += fmt.Sprintf(", placement score %d", option.Score)
+	}
+	return description
+}
+
+// spotCost returns what a spot instance of the type in the zone has cost between the times,
+// in dollars, following the price as it changed, and the latest price an hour.
+func spotCost(service *ec2.EC2, instanceType string, zone string, from time.Time, to time.Time) (float64, float64, error) {
+	history := []*ec2.SpotPrice{}
+	err := service.DescribeSpotPriceHistoryPages(&ec2.DescribeSpotPriceHistoryInput{
+		Filters:             []*ec2.Filter{{Name: aws.String("availability-zone"), Values: []*string{aws.String(zone)}}},
+		InstanceTypes:       []*string{aws.String(instanceType)},
+		ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+		StartTime:           aws.Time(from),
+		EndTime:             aws.Time(to),
+	}, func(page *ec2.DescribeSpotPriceHistoryOutput, last bool) bool {
+		history = append(history, page.SpotPriceHistory...)
+		return true
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error describing spot price history: %s", err.Error())
+	}
+	if len(history) == 0 {
+		return 0, 0, fmt.Errorf("no spot price for %s in %s", instanceType, zone)
+	}
+
+	// Each price holds from its time until the next one. The first is the one in effect
+	// at the start, so it counts from then.
+	sort.Slice(history, func(i, j int) bool {
+		return aws.TimeValue(history[i].Timestamp).Before(aws.TimeValue(history[j].Timestamp))
+	})
+	cost := 0.0
+	price := 0.0
+	for i, entry := range history {
+		price, err = strconv.ParseFloat(aws.StringValue(entry.SpotPrice), 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("spot price %q is malformed", aws.StringValue(entry.SpotPrice))
+		}
+
+		start := aws.TimeValue(entry.Timestamp)
+		if start.Before(from) {
+			start = from
+		}
+		end := to
+		if i+1 < len(history) {
+			end = aws.TimeValue(history[i+1].Timestamp)
+		}
+		if end.After(start) {
+			cost += price * end.Sub(start).Hours()
+		}
+	}
+	return cost, price, nil
+}
+
+// instanceCost returns what the instance has cost between the times, in dollars, and its
+// latest price an hour, at the spot price or the on-demand price depending on how it was
+// launched.
+func instanceCost(sess *session.Session, service *ec2.EC2, instance *ec2.Instance, from time.Time, to time.Time) (float64, float64, error) {
+	instanceType := aws.StringValue(instance.InstanceType)
+	if aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot {
+		return spotCost(service, instanceType, aws.StringValue(instance.Placement.AvailabilityZone), from, to)
+	}
+
+	price, err := onDemandPrice(sess, aws.StringValue(service.Config.Region), instanceType)
+	if err != nil {
+		return 0, 0, err
+	}
+	return price * to.Sub(from).Hours(), price, nil
+}
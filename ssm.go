@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// defaultSSMDocument is the name the SSM document is published under unless given.
+const defaultSSMDocument = "AwsSpotGameServer-Manage"
+
+// ssmDocument is a Run Command document running ctl on the instance, so admins can manage
+// the game through Systems Manager with no SSH or open ports. The action is limited to the
+// allowed values and minutes to digits, so neither can inject into the script.
+func ssmDocument(path string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemaVersion": "2.2",
+		"description":   "Manage the aws-spot-game-server daemon: status, players, stop, restart, backup, or extend.",
+		"parameters": map[string]interface{}{
+			"action": map[string]interface{}{
+				"type":          "String",
+				"description":   "What to do.",
+				"default":       "status",
+				"allowedValues": []string{"status", "players", "stop", "restart", "backup", "extend"},
+			},
+			"minutes": map[string]interface{}{
+				"type":           "String",
+				"description":    "Minutes to hold the game up for with extend, empty for the daemon's default.",
+				"default":        "",
+				"allowedPattern": "^[0-9]*$",
+			},
+		},
+		"mainSteps": []map[string]interface{}{
+			{
+				"action": "aws:runShellScript",
+				"name":   "ctl",
+				"inputs": map[string]interface{}{
+					"timeoutSeconds": "900",
+					"runCommand": []string{
+						"case '{{ action }}' in",
+						"  backup) exec " + path + " ctl backup now ;;",
+						"  extend) exec " + path + " ctl extend {{ minutes }} ;;",
+						"  *) exec " + path + " ctl '{{ action }}' ;;",
+						"esac",
+					},
+				},
+			},
+		},
+	}
+}
+
+// runSSMDocument publishes the SSM document, or a new default version of it if it already
+// exists. It is run from anywhere with AWS credentials as "aws-spot-game-server
+// ssm-document", and returns the exit status.
+func runSSMDocument(args []string) int {
+	flags := flag.NewFlagSet("ssm-document", flag.ExitOnError)
+	name := flags.String("name", defaultSSMDocument, "name of the SSM document")
+	path := flags.String("path", "/usr/local/bin/aws-spot-game-server", "path of the daemon binary on the instances")
+	region := flags.String("region", "", "region to publish the document in")
+	flags.Parse(args)
+
+	content, err := json.MarshalIndent(ssmDocument(*path), "", "  ")
+	if err != nil {
+		fmt.Printf("Error writing document: %s\n", err.Error())
+		return 1
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(*region)}))
+	service := ssm.New(sess)
+
+	_, err = service.CreateDocument(&ssm.CreateDocumentInput{
+		Name:           aws.String(*name),
+		DocumentType:   aws.String(ssm.DocumentTypeCommand),
+		DocumentFormat: aws.String(ssm.DocumentFormatJson),
+		Content:        aws.String(string(content)),
+	})
+	if err == nil {
+		fmt.Printf("Published %s. Run it with:\n", *name)
+		fmt.Printf("  aws ssm send-command --document-name %s --targets Key=InstanceIds,Values=<instance> --parameters action=status\n", *name)
+		return 0
+	}
+
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ssm.ErrCodeDocumentAlreadyExists {
+		fmt.Printf("Error publishing document: %s\n", err.Error())
+		return 1
+	}
+
+	updated, err := service.UpdateDocument(&ssm.UpdateDocumentInput{
+		Name:            aws.String(*name),
+		DocumentFormat:  aws.String(ssm.DocumentFormatJson),
+		Content:         aws.String(string(content)),
+		DocumentVersion: aws.String("$LATEST"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeDuplicateDocumentContent {
+			fmt.Printf("%s is already up to date.\n", *name)
+			return 0
+		}
+		fmt.Printf("Error updating document: %s\n", err.Error())
+		return 1
+	}
+
+	_, err = service.UpdateDocumentDefaultVersion(&ssm.UpdateDocumentDefaultVersionInput{
+		Name:            aws.String(*name),
+		DocumentVersion: updated.DocumentDescription.DocumentVersion,
+	})
+	if err != nil {
+		fmt.Printf("Error making the new version the default: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Updated %s to version %s.\n", *name, aws.StringValue(updated.DocumentDescription.DocumentVersion))
+	return 0
+}
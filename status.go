@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStatusFile is where the daemon's status is written unless configured otherwise.
+const defaultStatusFile = "/run/aws-spot-game-server/status.json"
+
+// daemonStatus is what the daemon thinks is happening, as written to the status file for
+// scripts and monitoring. State is one of booting, running, shutting-down, hibernating,
+// interrupted, stopping, or crashed. Players is -1 when no probe counts them.
+type daemonStatus struct {
+	PID        int          `json:"pid"`
+	State      string       `json:"state"`
+	StartedAt  time.Time    `json:"started_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+	InstanceID string       `json:"instance_id,omitempty"`
+	Players    int          `json:"players"`
+	IdleCount  int          `json:"idle_count"`
+	Mount      *mountStatus `json:"mount,omitempty"`
+	Games      []gameStatus `json:"games"`
+}
+
+// mountStatus is where the game storage is mounted.
+type mountStatus struct {
+	Path        string   `json:"path"`
+	StorageType string   `json:"storage_type"`
+	VolumeIDs   []string `json:"volume_ids,omitempty"`
+}
+
+// gameStatus is the state of one game's process: running, stopping, or stopped.
+type gameStatus struct {
+	Name      string     `json:"name"`
+	PID       int        `json:"pid,omitempty"`
+	State     string     `json:"state"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	Restarts  int        `json:"restarts"`
+}
+
+// statusMu guards status, the daemon's status, and statusPath, the file it is written to.
+// The path is empty until the status file is started.
+var statusMu sync.Mutex
+var status = daemonStatus{PID: os.Getpid(), State: "booting", StartedAt: time.Now().UTC(), Players: -1}
+var statusPath string
+
+// startStatusFile writes the status file now, then every 10 seconds and whenever the state
+// changes.
+func startStatusFile(userData *GameServerUserData) {
+	err := os.MkdirAll(filepath.Dir(userData.StatusFile), 0755)
+	if err != nil {
+		fmt.Printf("Error creating status file directory: %s\n", err.Error())
+		return
+	}
+
+	statusMu.Lock()
+	statusPath = userData.StatusFile
+	statusMu.Unlock()
+
+	go func() {
+		for {
+			writeStatus()
+			time.Sleep(10 * time.Second)
+		}
+	}()
+}
+
+// updateStatus changes the status and writes it out straight away.
+func updateStatus(change func(status *daemonStatus)) {
+	statusMu.Lock()
+	change(&status)
+	statusMu.Unlock()
+
+	writeStatus()
+}
+
+// setStatusState changes the daemon's state.
+func setStatusState(state string) {
+	updateStatus(func(status *daemonStatus) {
+		status.State = state
+	})
+}
+
+// writeStatus writes the status file, replacing it in one go so readers never see half of
+// it.
+func writeStatus() {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	if statusPath == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(refreshStatus(), "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding status: %s\n", err.Error())
+		return
+	}
+
+	temp := statusPath + ".tmp"
+	err = ioutil.WriteFile(temp, append(data, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(temp, statusPath)
+	}
+	if err != nil {
+		fmt.Printf("Error writing status file: %s\n", err.Error())
+	}
+}
+
+// currentStatus returns a copy of the daemon's status as it is now.
+func currentStatus() daemonStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return refreshStatus()
+}
+
+// refreshStatus brings the status up to date and returns it. statusMu must be held.
+func refreshStatus() daemonStatus {
+	status.UpdatedAt = time.Now().UTC()
+	status.Games = []gameStatus{}
+	for _, game := range games {
+		status.Games = append(status.Games, game.status())
+	}
+	return status
+}
+
+// status returns the state of the game's process.
+func (s *supervisor) status() gameStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := gameStatus{Name: s.userData.GameName, State: "stopped", Restarts: s.restarts}
+	pid := int(atomic.LoadInt32(&s.pid))
+	if pid != 0 {
+		result.PID = pid
+		result.State = "running"
+		started := s.started
+		result.StartedAt = &started
+	}
+	if s.stopping && pid != 0 {
+		result.State = "stopping"
+	}
+	return result
+}
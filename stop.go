@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// runStop shuts the game down gracefully from a workstation, as "aws-spot-game-server stop
+// -profile <name>". The daemon is asked to stop through the SSM document, so it saves, backs
+// up, and terminates the instance itself as it would when idle. If the instance is still up
+// after the wait, it is terminated. It returns the exit status.
+func runStop(args []string) int {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	document := flags.String("document", defaultSSMDocument, "SSM document published with ssm-document")
+	wait := flags.Duration("wait", 10*time.Minute, "how long to wait for the daemon to shut down before terminating")
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	service := ec2.New(sess)
+	instance, err := findGameInstance(service, profile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	instanceID := aws.StringValue(instance.InstanceId)
+
+	if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameRunning {
+		fmt.Printf("Asking %s to shut down.\n", instanceID)
+		output, err := runDocument(sess, *document, instanceID, map[string][]*string{"action": {aws.String("stop")}})
+		if err != nil {
+			fmt.Println(err.Error())
+			fmt.Println("Terminating without a graceful shutdown.")
+		} else {
+			fmt.Print(output)
+			err = waitForTerminated(service, instanceID, *wait)
+			if err == nil {
+				fmt.Printf("%s shut down.\n", instanceID)
+				return 0
+			}
+			fmt.Printf("%s. Terminating it.\n", err.Error())
+		}
+	}
+
+	err = terminateGameInstance(sess, instanceID)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Terminated %s.\n", instanceID)
+	return 0
+}
+
+// runTerminate terminates the game's instance straight away from a workstation, as
+// "aws-spot-game-server terminate -profile <name>", for when the daemon can't shut it down.
+// Anything not yet saved or backed up is lost. It returns the exit status.
+func runTerminate(args []string) int {
+	flags := flag.NewFlagSet("terminate", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+
+	sess := profile.session()
+	instance, err := findGameInstance(ec2.New(sess), profile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	instanceID := aws.StringValue(instance.InstanceId)
+
+	err = terminateGameInstance(sess, instanceID)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Terminated %s.\n", instanceID)
+	return 0
+}
+
+// findGameInstance returns the profile's game's instance, or an error if it has none.
+func findGameInstance(service *ec2.EC2, profile *LaunchProfile) (*ec2.Instance, error) {
+	game := profile.gameData.GameName
+	instances, err := findGameInstances(service, game)
+	if err != nil {
+		return nil, fmt.Errorf("error looking for instances: %s", err.Error())
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("%s has no instance", game)
+	}
+	if len(instances) > 1 {
+		fmt.Printf("%s has %d instances, using %s.\n", game, len(instances), aws.StringValue(instances[0].InstanceId))
+	}
+	return instances[0], nil
+}
+
+// terminateGameInstance terminates the instance, deleting its fleet or cancelling its
+// persistent spot request first so neither launches another.
+func terminateGameInstance(sess *session.Session, instanceID string) error {
+	fleetID, err := findFleet(instanceID, sess)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	if fleetID != "" {
+		err = deleteFleet(sess, fleetID)
+		if err != nil {
+			return fmt.Errorf("error deleting fleet %s: %s", fleetID, err.Error())
+		}
+		return nil
+	}
+
+	err = cancelSpotRequest(sess, instanceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = ec2.New(sess).TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String(instanceID)}})
+	if err != nil {
+		return fmt.Errorf("error terminating %s: %s", instanceID, err.Error())
+	}
+	return nil
+}
+
+// runDocument runs the SSM document on the instance and returns its output once it has
+// finished.
+func runDocument(sess *session.Session, document string, instanceID string, parameters map[string][]*string) (string, error) {
+	service := ssm.New(sess)
+	sent, err := service.SendCommand(&ssm.SendCommandInput{
+		DocumentName: aws.String(document),
+		InstanceIds:  []*string{aws.String(instanceID)},
+		Parameters:   parameters,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error sending command: %s", err.Error())
+	}
+	commandID := sent.Command.CommandId
+
+	deadline := time.Now().Add(2 * time.Minute)
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		invocation, err := service.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+			CommandId:  commandID,
+			InstanceId: aws.String(instanceID),
+		})
+		// The invocation isn't always visible straight away.
+		if err != nil {
+			continue
+		}
+
+		switch aws.StringValue(invocation.Status) {
+		case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusDelayed:
+			continue
+		case ssm.CommandInvocationStatusSuccess:
+			return aws.StringValue(invocation.StandardOutputContent), nil
+		default:
+			output := strings.TrimSpace(aws.StringValue(invocation.StandardErrorContent) + aws.StringValue(invocation.StandardOutputContent))
+			return "", fmt.Errorf("command %s: %s", strings.ToLower(aws.StringValue(invocation.Status)), output)
+		}
+	}
+	return "", fmt.Errorf("gave up waiting for the command to finish")
+}
+
+// waitForTerminated waits for the instance to be terminated, for up to the timeout.
+func waitForTerminated(service *ec2.EC2, instanceID string, timeout time.Duration) error {
+	fmt.Printf("Waiting for %s to shut down.\n", instanceID)
+	deadline := time.Now().Add(timeout)
+	for {
+		instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		})
+		if err == nil && len(instances.Reservations) > 0 && len(instances.Reservations[0].Instances) > 0 {
+			switch aws.StringValue(instances.Reservations[0].Instances[0].State.Name) {
+			case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't shut down within %s", instanceID, timeout)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// supervisor runs the game, restarting it with exponential backoff when it crashes. A crash
+// is the game exiting with an error when nothing asked it to stop. After GameRestartLimit
+// crashes in a row, each within GameStableTime of starting, it gives up.
+type supervisor struct {
+	userData *GameServerUserData
+	sess     *session.Session
+
+	// console is the game's console, or nil when it isn't enabled.
+	console *gameConsole
+
+	// pid is the process ID of the game's shell, or 0 when the game isn't running.
+	pid int32
+
+	// tail is the end of the game's output, for crash notifications.
+	tail outputTail
+
+	// gaveUp is set once the game has crashed too often to restart.
+	gaveUp bool
+
+	mu         sync.Mutex
+	stopping   bool
+	restarting bool
+	unhealthy  bool
+	exited     chan struct{}
+	started    time.Time
+	restarts   int
+}
+
+// games supervises each game, in the order of the user data's games.
+var games []*supervisor
+
+// newSupervisor returns a supervisor for the game.
+func newSupervisor(userData *GameServerUserData, sess *session.Session) *supervisor {
+	return &supervisor{userData: userData, sess: sess}
+}
+
+// supervisorFor returns the supervisor of the game, or nil if there isn't one yet.
+func supervisorFor(userData *GameServerUserData) *supervisor {
+	for _, s := range games {
+		if s.userData == userData {
+			return s
+		}
+	}
+	return nil
+}
+
+// run runs the game until it exits cleanly, is stopped, or crashes too often.
+func (s *supervisor) run() error {
+	crashes := 0
+	backoff := time.Duration(s.userData.GameRestartBackoff) * time.Second
+	for {
+		started := time.Now()
+		err := s.runOnce()
+		if s.takeRestarting() {
+			continue
+		}
+		if err == nil || s.isStopping() {
+			return err
+		}
+
+		if time.Since(started) >= time.Duration(s.userData.GameStableTime)*time.Second {
+			// It ran long enough that this isn't the same problem as last time.
+			crashes = 0
+			backoff = time.Duration(s.userData.GameRestartBackoff) * time.Second
+		}
+		crashes++
+
+		if crashes > s.userData.GameRestartLimit {
+			s.mu.Lock()
+			s.gaveUp = true
+			s.mu.Unlock()
+
+			message := fmt.Sprintf("The game crashed %d times in a row (%s), giving up on restarting it.", crashes, err.Error())
+			if s.userData.GameCrashAction == "terminate" {
+				message += " The instance is being shut down."
+			} else {
+				message += " The instance is being kept up for debugging."
+			}
+			notify(s.userData, s.sess, "Game server crashed", s.withTail(message))
+			return err
+		}
+
+		notify(s.userData, s.sess, "Game server crashed",
+			s.withTail(fmt.Sprintf("The game crashed (%s), restarting it in %s.", err.Error(), backoff)))
+		time.Sleep(backoff)
+		if s.isStopping() {
+			return err
+		}
+
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+
+		backoff *= 2
+		if backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+	}
+}
+
+// runOnce starts the game and waits for it to exit.
+func (s *supervisor) runOnce() error {
+	credential, account, err := runCredential(s.userData)
+	if err != nil {
+		return err
+	}
+
+	env := baseEnvironment(s.userData, account)
+	env = append(env, runEnvironment(s.userData)...)
+
+	err = runGameHooks(s.userData, "Pre-start", s.userData.PreStartHooks, credential, env)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting %s.\n", s.userData.GameName)
+	var cmd *exec.Cmd
+	if s.userData.ComposeFile != "" {
+		cmd = composeCommand(s.userData)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Dir = filepath.Dir(s.userData.ComposeFile)
+	} else if s.userData.DockerImage != "" {
+		// The container runs as the image's user, and Docker limits it itself.
+		cmd = dockerCommand(s.userData)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	} else {
+		// Run through the shell, like su -c did, so the run path can still have arguments of
+		// its own. RunArgs are passed on after them, untouched by the shell.
+		args := append([]string{"-c", s.userData.RunPath + ` "$@"`, "sh"}, s.userData.RunArgs...)
+		cmd = exec.Command("/bin/sh", args...)
+		// A process group of its own, so stopping it reaches everything it started.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential, Setpgid: true}
+		cmd.Dir = s.userData.RunDirectory
+		cmd.Env = env
+	}
+
+	stdout := []io.Writer{os.Stdout, &s.tail}
+	stderr := []io.Writer{os.Stderr, &s.tail}
+	if s.userData.GameLogDirectory != "" {
+		name := "game.log"
+		if len(games) > 1 {
+			name = s.userData.GameName + ".log"
+		}
+		log, err := openRotatingLog(s.userData.GameLogDirectory, name,
+			int64(s.userData.GameLogMaxSize)*1024*1024, s.userData.GameLogMaxFiles)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+
+		stdout = append(stdout, log)
+		stderr = append(stderr, log)
+	}
+
+	var stdin io.WriteCloser
+	if s.console != nil {
+		stdout = append(stdout, s.console)
+		stderr = append(stderr, s.console)
+
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("error opening game console: %s", err.Error())
+		}
+	}
+	cmd.Stdout = io.MultiWriter(stdout...)
+	cmd.Stderr = io.MultiWriter(stderr...)
+
+	kills := 0
+	if cgroupEnabled(s.userData) && !containerized(s.userData) {
+		err = setUpCgroup(s.userData)
+		if err != nil {
+			return fmt.Errorf("error limiting game server: %s", err.Error())
+		}
+		kills = cgroupOOMKills(s.userData)
+	}
+	systemKills := systemOOMKills()
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("error starting game server: %s", err.Error())
+	}
+	if cgroupEnabled(s.userData) && !containerized(s.userData) {
+		err = joinCgroup(s.userData, cmd.Process.Pid)
+		if err != nil {
+			// Running it without its limits would defeat the point of them.
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("error limiting game server: %s", err.Error())
+		}
+	}
+	if s.console != nil {
+		s.console.attach(stdin)
+		defer s.console.attach(nil)
+	}
+	exited := make(chan struct{})
+	s.mu.Lock()
+	s.exited = exited
+	s.unhealthy = false
+	s.started = time.Now().UTC()
+	s.mu.Unlock()
+	if s.userData.HealthCheck != nil {
+		go s.watchHealth(exited)
+	}
+	atomic.StoreInt32(&s.pid, int32(cmd.Process.Pid))
+	writeStatus()
+	watchEvent(s.userData, "game-started", fmt.Sprintf("%s started.", s.userData.GameName), nil)
+
+	err = cmd.Wait()
+	s.killLeftovers(cmd.Process.Pid)
+	atomic.StoreInt32(&s.pid, 0)
+	writeStatus()
+
+	// Before the game counts as exited, so the volume isn't released from under the hooks.
+	status := strconv.Itoa(cmd.ProcessState.ExitCode())
+	hookErr := runGameHooks(s.userData, "Post-stop", s.userData.PostStopHooks, credential, append(env, "GAME_EXIT_STATUS="+status))
+	if hookErr != nil {
+		fmt.Println(hookErr.Error())
+	}
+	close(exited)
+
+	s.mu.Lock()
+	unhealthy := s.unhealthy
+	s.mu.Unlock()
+	if unhealthy {
+		return fmt.Errorf("game server stopped responding and was killed")
+	}
+	if containerized(s.userData) && containerOOMKilled(s.userData) {
+		return fmt.Errorf("game server ran out of memory and was killed")
+	} else if !containerized(s.userData) && cgroupEnabled(s.userData) && cgroupOOMKills(s.userData) > kills {
+		return fmt.Errorf("game server ran out of memory and was killed")
+	} else if err != nil && !cgroupEnabled(s.userData) && systemOOMKills() > systemKills {
+		// Without a cgroup there is no telling whose process it was, but it is the likeliest.
+		return fmt.Errorf("game server returned error, most likely killed for running out of memory: %s", err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("game server returned error: %s", err.Error())
+	}
+
+	fmt.Printf("%s done.\n", s.userData.GameName)
+	return nil
+}
+
+// withTail adds the end of the game's output to a message.
+func (s *supervisor) withTail(message string) string {
+	tail := s.tail.lines(20)
+	if tail == "" {
+		return message
+	}
+	return message + "\n\nLast output:\n" + tail
+}
+
+// hasGivenUp reports whether the game crashed too often to restart.
+func (s *supervisor) hasGivenUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gaveUp
+}
+
+func (s *supervisor) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// takeRestarting reports whether the game was stopped to restart it, and clears that.
+func (s *supervisor) takeRestarting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restarting := s.restarting && !s.stopping
+	s.restarting = false
+	return restarting
+}
+
+// restart stops the game the usual way and has the supervisor start it again straight
+// away, without counting it as a crash.
+func (s *supervisor) restart(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stopping || atomic.LoadInt32(&s.pid) == 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("game isn't running")
+	}
+	s.restarting = true
+	exited := s.exited
+	s.mu.Unlock()
+
+	err := haltGame(ctx, s.userData, s, exited)
+	select {
+	case <-exited:
+	default:
+		// The game is still running, so its next exit is a crash, not this restart.
+		s.mu.Lock()
+		s.restarting = false
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// stop tells the supervisor the game is being stopped, so it isn't restarted, and returns
+// a channel that is closed once the game has exited.
+func (s *supervisor) stop() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopping = true
+	if s.exited == nil {
+		exited := make(chan struct{})
+		close(exited)
+		return exited
+	}
+	return s.exited
+}
+
+// signal sends a signal to the game's process group, if the game is running.
+func (s *supervisor) signal(sig syscall.Signal) error {
+	pid := int(atomic.LoadInt32(&s.pid))
+	if pid == 0 {
+		return nil
+	}
+
+	err := syscall.Kill(-pid, sig)
+	if err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("error sending %s to the game: %s", sig.String(), err.Error())
+	}
+	return nil
+}
+
+// defaultSearchPath is the PATH the game gets in a clean environment.
+const defaultSearchPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// baseEnvironment returns the environment the game starts from: the daemon's own, or with
+// RunCleanEnvironment only the basics, like a login would give. Either way it is set up for
+// the run user.
+func baseEnvironment(userData *GameServerUserData, account *user.User) []string {
+	env := []string{}
+	if userData.RunCleanEnvironment {
+		env = append(env, "SHELL=/bin/sh")
+		for _, name := range []string{"LANG", "LC_ALL", "TZ"} {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	} else {
+		env = append(env, os.Environ()...)
+	}
+
+	if userData.RunSearchPath != "" {
+		env = append(env, "PATH="+userData.RunSearchPath)
+	} else if userData.RunCleanEnvironment {
+		env = append(env, "PATH="+defaultSearchPath)
+	}
+
+	return append(env,
+		"HOME="+account.HomeDir,
+		"USER="+account.Username,
+		"LOGNAME="+account.Username,
+	)
+}
+
+// runEnvironment returns the configured environment variables for the game, sorted so the
+// game sees them in the same order every time.
+func runEnvironment(userData *GameServerUserData) []string {
+	names := []string{}
+	for name := range userData.RunEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env := []string{}
+	for _, name := range names {
+		env = append(env, name+"="+userData.RunEnv[name])
+	}
+	return env
+}
+
+// runCredential looks up the user and group the game runs as, along with the user's other
+// groups.
+func runCredential(userData *GameServerUserData) (*syscall.Credential, *user.User, error) {
+	account, err := user.Lookup(userData.RunUser)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error looking up user %s: %s", userData.RunUser, err.Error())
+	}
+
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+
+	if userData.RunGroup != "" {
+		group, err := user.LookupGroup(userData.RunGroup)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error looking up group %s: %s", userData.RunGroup, err.Error())
+		}
+		gid, _ = strconv.Atoi(group.Gid)
+	}
+
+	groupIDs, err := account.GroupIds()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error looking up groups of %s: %s", userData.RunUser, err.Error())
+	}
+
+	groups := []uint32{}
+	for _, groupID := range groupIDs {
+		id, err := strconv.Atoi(groupID)
+		if err == nil {
+			groups = append(groups, uint32(id))
+		}
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	return credential, account, nil
+}
+
+// stopSignal returns the signal the game is stopped with, SIGTERM unless configured
+// otherwise.
+func (s *supervisor) stopSignal() syscall.Signal {
+	if s.userData.StopSignal != "" {
+		return stopSignals[s.userData.StopSignal]
+	}
+	return syscall.SIGTERM
+}
+
+// killLeftovers kills whatever the game left running when it exited, like a server its
+// wrapper script started in the background, so it doesn't keep the port bound. Anything in
+// the game's process group gets SIGTERM and a few seconds before SIGKILL, and with limits
+// the whole cgroup is killed, catching processes that left the group too.
+func (s *supervisor) killLeftovers(pid int) {
+	if containerized(s.userData) {
+		return
+	}
+
+	err := syscall.Kill(-pid, syscall.SIGTERM)
+	if err == nil {
+		fmt.Printf("Stopping processes %s left behind.\n", s.userData.GameName)
+		for i := 0; i < 50 && syscall.Kill(-pid, 0) == nil; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+
+	if cgroupEnabled(s.userData) {
+		// Only kernels from 5.14 have cgroup.kill.
+		writeCgroupFile(cgroupPath(s.userData), "cgroup.kill", "1")
+	}
+}
+
+// forceKill kills the game outright, or its container.
+func (s *supervisor) forceKill() error {
+	if containerized(s.userData) {
+		return killContainer(s.userData)
+	}
+	return s.signal(syscall.SIGKILL)
+}
+
+// stopSignals are the signals StopSignal can name.
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// stopGame stops every game at once, and returns the last error.
+func stopGame(ctx context.Context, userData *GameServerUserData) error {
+	errs := make(chan error, len(userData.games))
+	for _, data := range userData.games {
+		go func(data *GameServerUserData) {
+			err := stopOneGame(ctx, data, supervisorFor(data))
+			if err != nil && len(userData.games) > 1 {
+				err = fmt.Errorf("%s: %s", data.GameName, err.Error())
+			}
+			errs <- err
+		}(data)
+	}
+
+	var failed error
+	for range userData.games {
+		err := <-errs
+		if err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// stopOneGame stops the game with the stop script, if there is one, or the stop signal,
+// and waits for it to exit until the context ends. A game that outlasts the kill timeout,
+// or the context, is killed.
+func stopOneGame(ctx context.Context, userData *GameServerUserData, game *supervisor) error {
+	var exited <-chan struct{}
+	if game != nil {
+		exited = game.stop()
+	}
+	return haltGame(ctx, userData, game, exited)
+}
+
+// haltGame makes the game exit, and waits for exited to be closed.
+func haltGame(ctx context.Context, userData *GameServerUserData, game *supervisor, exited <-chan struct{}) error {
+	var stopErr error
+	_, err := os.Stat(userData.StopPath)
+	if err == nil {
+		stopErr = runCommandContext(ctx, userData.StopPath)
+		if stopErr != nil && game != nil {
+			// Whatever the script managed, the game still has to go so nothing is left
+			// holding the port or the volume.
+			fmt.Printf("Error calling stop: %s, signalling the game instead.\n", stopErr.Error())
+			err = game.signal(game.stopSignal())
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+		} else if stopErr != nil {
+			return stopErr
+		}
+	} else if containerized(userData) && game != nil {
+		// Docker does the waiting and killing itself.
+		err = stopContainer(ctx, userData)
+		if err != nil {
+			return err
+		}
+	} else if game != nil {
+		// Without a stop script the game has to exit on the signal itself.
+		err = game.signal(game.stopSignal())
+		if err != nil {
+			return err
+		}
+	} else {
+		return nil
+	}
+
+	if game == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(userData.StopKillTimeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return stopErr
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Game still running, killing it.")
+	err = game.forceKill()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-exited:
+		return fmt.Errorf("game had to be killed")
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("game still running after being killed")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultUnitPath is where install writes the daemon's systemd unit.
+const defaultUnitPath = "/etc/systemd/system/aws-spot-game-server.service"
+
+// unitTemplate is the daemon's systemd unit. The daemon stops the game itself, so only it
+// gets the stop signal, and it has time to release the volume before anything is killed.
+// Booting can take minutes while the volume is attached, so starting isn't timed out.
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=AWS spot game server
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.Path}}
+Restart=on-failure
+RestartSec=10
+TimeoutStartSec=infinity
+TimeoutStopSec={{.StopTimeout}}
+WatchdogSec={{.WatchdogSec}}
+KillMode=mixed
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// runInstall writes the daemon's systemd unit and enables it, so the daemon starts at boot.
+// It is run as "aws-spot-game-server install", and returns the exit status.
+func runInstall(args []string) int {
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	path := flags.String("path", "", "path of the daemon binary, defaulting to this one")
+	unit := flags.String("unit", defaultUnitPath, "systemd unit file to write")
+	stopTimeout := flags.Int("stop-timeout", 180, "seconds systemd gives the daemon to shut down")
+	watchdog := flags.Int("watchdog", 60, "seconds without a watchdog ping before systemd restarts the daemon, 0 to turn it off")
+	enable := flags.Bool("enable", true, "enable the unit so it starts at boot")
+	flags.Parse(args)
+
+	if *path == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Printf("Error finding this binary: %s\n", err.Error())
+			return 1
+		}
+		*path = executable
+	}
+
+	var content strings.Builder
+	err := unitTemplate.Execute(&content, map[string]interface{}{
+		"Path":        *path,
+		"StopTimeout": *stopTimeout,
+		"WatchdogSec": *watchdog,
+	})
+	if err != nil {
+		fmt.Printf("Error writing unit: %s\n", err.Error())
+		return 1
+	}
+
+	err = ioutil.WriteFile(*unit, []byte(content.String()), 0644)
+	if err != nil {
+		fmt.Printf("Error writing unit: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Wrote %s.\n", *unit)
+
+	commands := [][]string{{"systemctl", "daemon-reload"}}
+	if *enable {
+		commands = append(commands, []string{"systemctl", "enable", strings.TrimSuffix(filepath.Base(*unit), ".service")})
+	}
+	for _, command := range commands {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			fmt.Printf("Error running %s: %s\n", strings.Join(command, " "), err.Error())
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// sdNotify sends a state change like READY=1 to systemd. It does nothing when the daemon
+// isn't run by systemd as a notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error notifying systemd: %s", err.Error())
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("error notifying systemd: %s", err.Error())
+	}
+	return nil
+}
+
+// startWatchdog pings systemd's watchdog at half its interval, if it is watching the daemon.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		for {
+			err := sdNotify("WATCHDOG=1")
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
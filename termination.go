@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// instanceAction is the spot interruption notice from spot/instance-action.
+type instanceAction struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// rebalanceRecommendation is the notice from events/recommendations/rebalance.
+type rebalanceRecommendation struct {
+	NoticeTime time.Time `json:"noticeTime"`
+}
+
+// interruptionEvent is the part of an EventBridge EC2 event the daemon uses.
+type interruptionEvent struct {
+	DetailType string    `json:"detail-type"`
+	Time       time.Time `json:"time"`
+	Detail     struct {
+		InstanceID     string `json:"instance-id"`
+		InstanceAction string `json:"instance-action"`
+	} `json:"detail"`
+}
+
+// snsEnvelope is how a message looks when it reached the queue through SNS.
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// interruptionOnce and rebalanceOnce make sure each notice is only handled once, no matter
+// which source saw it first.
+var interruptionOnce sync.Once
+var rebalanceOnce sync.Once
+
+// spotInterrupted is set to 1 once an interruption is being handled, for the metrics.
+var spotInterrupted int32
+
+// getInstanceAction returns the pending spot interruption, or nil if there isn't one.
+// The metadata client uses IMDSv2 session tokens, falling back to IMDSv1 if they aren't
+// available.
+func getInstanceAction(metadata *ec2metadata.EC2Metadata) (*instanceAction, error) {
+	contents, err := metadata.GetMetadata("spot/instance-action")
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	action := &instanceAction{}
+	err = json.Unmarshal([]byte(contents), action)
+	if err != nil {
+		return nil, fmt.Errorf("instance action was malformed: %s", err.Error())
+	}
+
+	return action, nil
+}
+
+// getRebalanceRecommendation returns the rebalance recommendation, or nil if there isn't one.
+func getRebalanceRecommendation(metadata *ec2metadata.EC2Metadata) (*rebalanceRecommendation, error) {
+	contents, err := metadata.GetMetadata("events/recommendations/rebalance")
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	recommendation := &rebalanceRecommendation{}
+	err = json.Unmarshal([]byte(contents), recommendation)
+	if err != nil {
+		return nil, fmt.Errorf("rebalance recommendation was malformed: %s", err.Error())
+	}
+
+	return recommendation, nil
+}
+
+// checkTermination polls the instance metadata for a spot interruption notice and handles
+// the interruption when one arrives. Rebalance recommendations are watched for as well.
+func checkTermination(userData *GameServerUserData, instanceID string, metadata *ec2metadata.EC2Metadata, sess *session.Session) {
+	go func() {
+		if userData.InterruptionQueueURL != "" {
+			go watchInterruptionQueue(userData, instanceID, sess)
+		}
+
+		rebalanced := false
+		var hibernateTime time.Time
+		for {
+			if !rebalanced {
+				recommendation, err := getRebalanceRecommendation(metadata)
+				if err != nil {
+					fmt.Printf("Error getting rebalance recommendation: %s\n", err.Error())
+				} else if recommendation != nil {
+					rebalanced = true
+					handleRebalance(userData, instanceID, sess, recommendation)
+				}
+			}
+
+			action, err := getInstanceAction(metadata)
+			if err != nil {
+				fmt.Printf("Error getting instance action: %s\n", err.Error())
+			} else if action != nil && !action.Time.Equal(hibernateTime) {
+				remaining := time.Until(action.Time).Round(time.Second)
+				fmt.Printf("We got notification of spot %s at %s, %s from now.\n",
+					action.Action, action.Time.Format(time.RFC3339), remaining)
+
+				if action.Action == "hibernate" {
+					// The notice stays up until the instance hibernates, don't handle it twice.
+					hibernateTime = action.Time
+					handleHibernation(userData, instanceID, metadata, sess, action)
+				} else {
+					handleInterruption(userData, instanceID, sess, action)
+					if autoScalingGroup != "" {
+						err = completeLifecycleAction(userData, instanceID, sess)
+						if err != nil {
+							fmt.Printf("Error completing lifecycle action: %s\n", err.Error())
+						}
+					}
+					return
+				}
+			}
+
+			if autoScalingGroup != "" {
+				state, err := getTargetLifecycleState(metadata)
+				if err != nil {
+					fmt.Printf("Error getting target lifecycle state: %s\n", err.Error())
+				} else if state == "Terminated" && !terminatingSelf {
+					handleScaleIn(userData, instanceID, sess)
+					return
+				}
+			}
+
+			time.Sleep(time.Duration(userData.TerminationCheckInterval) * time.Second)
+		}
+	}()
+}
+
+// handleInterruption stops the game and cleans up before the instance is reclaimed. It
+// only runs once, however many times the interruption is seen.
+func handleInterruption(userData *GameServerUserData, instanceID string, sess *session.Session, action *instanceAction) {
+	interruptionOnce.Do(func() {
+		shuttingDown.Add(1)
+		defer shuttingDown.Done()
+		setStatusState("interrupted")
+		atomic.StoreInt32(&spotInterrupted, 1)
+
+		message := fmt.Sprintf("AWS is reclaiming the instance (spot %s).", action.Action)
+		detail := map[string]string{"action": action.Action}
+		if !action.Time.IsZero() {
+			message = fmt.Sprintf("AWS is reclaiming the instance (spot %s) in %s.", action.Action, time.Until(action.Time).Round(time.Second))
+			detail["deadline"] = action.Time.UTC().Format(time.RFC3339)
+		}
+		publishEvent(userData, instanceID, sess, "interruption", message, detail)
+
+		if action.Action == "stop" {
+			keepAttached = true
+		}
+
+		runShutdownSteps(userData, instanceID, sess, userData.TerminationSteps, "spot "+action.Action, action.Time)
+
+		// A stopped instance comes back by itself, and a fleet replaces its own, so there is
+		// nothing to replace.
+		stopping := action.Action == "stop"
+		if !stopping && ec2Fleet == "" && (userData.ReplaceOnInterruption || action.Action == "rebalance" && userData.RebalanceAction == "replace") {
+			err := launchReplacement(userData, instanceID, sess)
+			if err != nil {
+				notify(userData, sess, "Replacement launch failed", err.Error())
+			}
+		}
+
+		if action.Time.IsZero() {
+			fmt.Println("Interruption handled.")
+		} else {
+			fmt.Printf("Interruption handled with %s to spare.\n", time.Until(action.Time).Round(time.Second))
+			if stopping {
+				publishEvent(userData, instanceID, sess, "stopping", "Shutdown finished, waiting for AWS to stop the instance.", nil)
+			} else {
+				publishEvent(userData, instanceID, sess, "terminating", "Shutdown finished, waiting for AWS to reclaim the instance.", nil)
+			}
+		}
+	})
+}
+
+// hibernationSteps are the shutdown steps that make sense before hibernating. The game and
+// its volume are frozen along with the rest of memory and carry on when the instance
+// resumes, so it isn't stopped, snapshotted, or released.
+func hibernationSteps(steps []ShutdownStep) []ShutdownStep {
+	kept := []ShutdownStep{}
+	for _, step := range steps {
+		if step.Action == "stop" || step.Action == "snapshot" || step.Action == "release" {
+			continue
+		}
+		kept = append(kept, step)
+	}
+	return kept
+}
+
+// handleHibernation gets the game ready for the instance hibernating, then waits for it to
+// resume and points DNS at the new public IP.
+func handleHibernation(userData *GameServerUserData, instanceID string, metadata *ec2metadata.EC2Metadata, sess *session.Session, action *instanceAction) {
+	setStatusState("hibernating")
+	publishEvent(userData, instanceID, sess, "interruption", "AWS is hibernating the instance (spot hibernate).",
+		map[string]string{"action": action.Action, "deadline": action.Time.UTC().Format(time.RFC3339)})
+
+	runShutdownSteps(userData, instanceID, sess, hibernationSteps(userData.TerminationSteps), "spot hibernate", action.Time)
+
+	go resumeAfterHibernation(userData, metadata, sess)
+}
+
+// resumeAfterHibernation waits for the instance to resume from hibernation, then points DNS
+// at its new public IP.
+func resumeAfterHibernation(userData *GameServerUserData, metadata *ec2metadata.EC2Metadata, sess *session.Session) {
+	// The monotonic clock stops while the instance is hibernated, but the wall clock
+	// doesn't, so resuming shows up as the two drifting apart.
+	last := time.Now()
+	for {
+		time.Sleep(5 * time.Second)
+		now := time.Now()
+		if now.Round(0).Sub(last.Round(0))-now.Sub(last) > 30*time.Second {
+			break
+		}
+		last = now
+	}
+
+	fmt.Println("Resumed from hibernation.")
+	setStatusState("running")
+	err := setDNS(userData, metadata, sess)
+	if err != nil {
+		fmt.Printf("Error setting DNS: %s\n", err.Error())
+	}
+}
+
+// handleRebalance acts on a rebalance recommendation. The instance is at elevated risk of
+// interruption, but there is no deadline yet.
+func handleRebalance(userData *GameServerUserData, instanceID string, sess *session.Session, recommendation *rebalanceRecommendation) {
+	rebalanceOnce.Do(func() {
+		rebalance(userData, instanceID, sess, recommendation)
+	})
+}
+
+func rebalance(userData *GameServerUserData, instanceID string, sess *session.Session, recommendation *rebalanceRecommendation) {
+	notify(userData, sess, "Rebalance recommendation",
+		fmt.Sprintf("EC2 recommended rebalancing at %s, so an interruption is likely soon.", recommendation.NoticeTime.Format(time.RFC3339)))
+
+	if userData.RebalanceAction == "shutdown" || userData.RebalanceAction == "replace" {
+		fmt.Println("Shutting down ahead of the interruption.")
+		shuttingDown.Add(1)
+		go func() {
+			defer shuttingDown.Done()
+			handleInterruption(userData, instanceID, sess, &instanceAction{Action: "rebalance"})
+
+			// Nothing is running any more, so don't pay for the instance until it is reclaimed.
+			publishEvent(userData, instanceID, sess, "terminating", "Terminating the instance ahead of the interruption.", nil)
+			terminateInstance(userData, instanceID, true, sess)
+		}()
+	}
+}
+
+// Events for other instances are put back on the queue hidden for otherEventVisibility, so
+// daemons sharing the queue don't keep receiving each other's, and deleted once they are
+// older than staleEventAge, by when their instance has been interrupted anyway. A daemon
+// only seeing other instances' events backs off up to maxQueueBackoff between receives.
+const otherEventVisibility = 5
+const staleEventAge = 2 * time.Minute
+const maxQueueBackoff = 10 * time.Second
+
+// watchInterruptionQueue long polls the interruption queue for EventBridge events about this
+// instance. The spot interruption warning event is sent two minutes before the interruption.
+func watchInterruptionQueue(userData *GameServerUserData, instanceID string, sess *session.Session) {
+	service := sqs.New(sess)
+
+	var backoff time.Duration
+	for {
+		if backoff > 0 {
+			time.Sleep(backoff)
+		}
+
+		output, err := service.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(userData.InterruptionQueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			fmt.Printf("Error receiving from interruption queue: %s\n", err.Error())
+			time.Sleep(time.Duration(userData.TerminationCheckInterval) * time.Second)
+			continue
+		}
+
+		others := 0
+		for _, message := range output.Messages {
+			event, err := parseInterruptionEvent(aws.StringValue(message.Body))
+			if err != nil {
+				// Nobody can make sense of it, so don't let it come back forever.
+				fmt.Printf("Error parsing interruption event, deleting it: %s\n", err.Error())
+				others++
+				_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(userData.InterruptionQueueURL),
+					ReceiptHandle: message.ReceiptHandle,
+				})
+				if err != nil {
+					fmt.Printf("Error deleting interruption event: %s\n", err.Error())
+				}
+				continue
+			}
+
+			if event.Detail.InstanceID != instanceID {
+				others++
+				if time.Since(event.Time) > staleEventAge {
+					_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+						QueueUrl:      aws.String(userData.InterruptionQueueURL),
+						ReceiptHandle: message.ReceiptHandle,
+					})
+					if err != nil {
+						fmt.Printf("Error deleting stale interruption event: %s\n", err.Error())
+					}
+					continue
+				}
+
+				// Someone else's event, make it visible again shortly for whoever is watching
+				// for it.
+				_, err = service.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(userData.InterruptionQueueURL),
+					ReceiptHandle:     message.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(otherEventVisibility),
+				})
+				if err != nil {
+					fmt.Printf("Error releasing interruption event: %s\n", err.Error())
+				}
+				continue
+			}
+
+			_, err = service.DeleteMessage(&sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(userData.InterruptionQueueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				fmt.Printf("Error deleting interruption event: %s\n", err.Error())
+			}
+
+			switch event.DetailType {
+			case "EC2 Spot Instance Interruption Warning":
+				fmt.Printf("We got an interruption warning event for spot %s.\n", event.Detail.InstanceAction)
+				go handleInterruption(userData, instanceID, sess, &instanceAction{
+					Action: event.Detail.InstanceAction,
+					Time:   event.Time.Add(2 * time.Minute),
+				})
+			case "EC2 Instance Rebalance Recommendation":
+				handleRebalance(userData, instanceID, sess, &rebalanceRecommendation{NoticeTime: event.Time})
+			}
+		}
+
+		backoff = nextQueueBackoff(backoff, len(output.Messages) > 0 && others == len(output.Messages))
+	}
+}
+
+// nextQueueBackoff returns how long to wait before receiving from a shared queue again,
+// doubling up to maxQueueBackoff while every message received was for someone else, and
+// not waiting otherwise.
+func nextQueueBackoff(backoff time.Duration, onlyOthers bool) time.Duration {
+	if !onlyOthers {
+		return 0
+	}
+	if backoff == 0 {
+		return time.Second
+	}
+	backoff *= 2
+	if backoff > maxQueueBackoff {
+		backoff = maxQueueBackoff
+	}
+	return backoff
+}
+
+// parseInterruptionEvent parses an EventBridge event delivered straight to the queue, or
+// wrapped in an SNS notification.
+func parseInterruptionEvent(body string) (*interruptionEvent, error) {
+	envelope := &snsEnvelope{}
+	err := json.Unmarshal([]byte(body), envelope)
+	if err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	event := &interruptionEvent{}
+	err = json.Unmarshal([]byte(body), event)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Tag keys used on the resources the daemon creates.
+const (
+	tagGame           = "aws-spot-game-server:game"
+	tagSourceSnapshot = "aws-spot-game-server:source-snapshot"
+	tagCreatedAt      = "aws-spot-game-server:created-at"
+	tagReason         = "aws-spot-game-server:reason"
+	tagProvisioned    = "aws-spot-game-server:provisioned"
+	tagSourceVolume   = "aws-spot-game-server:source-volume"
+	tagOriginVolume   = "aws-spot-game-server:origin-volume"
+	tagMountLock      = "aws-spot-game-server:mounted-by"
+)
+
+// gameVolumeIDs returns the EBS volumes that make up the game storage.
+func gameVolumeIDs(userData *GameServerUserData) []string {
+	if len(userData.VolumeIDs) > 0 {
+		return userData.VolumeIDs
+	}
+
+	return []string{userData.VolumeID}
+}
+
+// findLatestSnapshot returns the ID of the most recent completed snapshot owned by this
+// account that carries all of the given tags.
+func findLatestSnapshot(service *ec2.EC2, tags map[string]string) (string, error) {
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String("completed")},
+		},
+	}
+	for key, value := range tags {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []*string{aws.String(value)},
+		})
+	}
+
+	snapshots := []*ec2.Snapshot{}
+	input := &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters:  filters,
+	}
+	err := service.DescribeSnapshotsPages(input, func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+		snapshots = append(snapshots, page.Snapshots...)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(snapshots) == 0 {
+		return "", fmt.Errorf("no completed snapshots found matching the snapshot tags")
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].StartTime.After(*snapshots[j].StartTime)
+	})
+
+	return *snapshots[0].SnapshotId, nil
+}
+
+// staleVolumeIDs are the game's volumes created from older snapshots, or in another zone,
+// left over from earlier launches. They are deleted once the new volume is mounted.
+var staleVolumeIDs []string
+
+// createVolumeFromSnapshot creates a new volume in the given availability zone from the
+// configured snapshot, tags it, and waits for it to become available. A volume left over
+// from an earlier launch from the same snapshot, in the same zone, is used again instead.
+func createVolumeFromSnapshot(userData *GameServerUserData, zone string, sess *session.Session) (string, error) {
+	service := ec2.New(sess)
+
+	snapshotID := userData.SnapshotID
+	if snapshotID == "" {
+		fmt.Println("Finding latest snapshot.")
+		var err error
+		snapshotID, err = findLatestSnapshot(service, userData.SnapshotTags)
+		if err != nil {
+			return "", fmt.Errorf("error finding latest snapshot: %s", err.Error())
+		}
+	}
+
+	leftover, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + tagGame), Values: []*string{aws.String(userData.GameName)}},
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(tagSourceSnapshot)}},
+			{Name: aws.String("status"), Values: []*string{aws.String(ec2.VolumeStateAvailable)}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error looking for volumes from earlier launches: %s", err.Error())
+	}
+	staleVolumeIDs = nil
+	reuse := ""
+	for _, volume := range leftover.Volumes {
+		source, moved := "", false
+		for _, tag := range volume.Tags {
+			if *tag.Key == tagSourceSnapshot {
+				source = *tag.Value
+			}
+			// Volumes moveVolumeToZone made hold the game's data, not a copy of a snapshot.
+			if *tag.Key == tagSourceVolume {
+				moved = true
+			}
+		}
+		if moved {
+			continue
+		}
+		if reuse == "" && source == snapshotID && aws.StringValue(volume.AvailabilityZone) == zone {
+			reuse = *volume.VolumeId
+		} else {
+			staleVolumeIDs = append(staleVolumeIDs, *volume.VolumeId)
+		}
+	}
+	if reuse != "" {
+		fmt.Printf("Using volume %s, created from snapshot %s before.\n", reuse, snapshotID)
+		return reuse, nil
+	}
+
+	fmt.Printf("Creating volume in %s from snapshot %s.\n", zone, snapshotID)
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		SnapshotId:       aws.String(snapshotID),
+		VolumeType:       aws.String(userData.VolumeType),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeVolume),
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(userData.GameName)},
+					{Key: aws.String(tagGame), Value: aws.String(userData.GameName)},
+					{Key: aws.String(tagSourceSnapshot), Value: aws.String(snapshotID)},
+				},
+			},
+		},
+	}
+
+	volume, err := service.CreateVolume(input)
+	if err != nil {
+		return "", fmt.Errorf("error creating volume: %s", err.Error())
+	}
+
+	fmt.Printf("Waiting for volume %s to become available.\n", *volume.VolumeId)
+	err = service.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{volume.VolumeId},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error waiting for volume: %s", err.Error())
+	}
+
+	fmt.Println("Volume created.")
+	return *volume.VolumeId, nil
+}
+
+// deleteStaleVolumes deletes the volumes createVolumeFromSnapshot found left over, now that
+// the new one is mounted.
+func deleteStaleVolumes(sess *session.Session) {
+	service := ec2.New(sess)
+	for _, volumeID := range staleVolumeIDs {
+		fmt.Printf("Deleting volume %s left over from an earlier launch.\n", volumeID)
+		_, err := service.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: aws.String(volumeID)})
+		if err != nil {
+			fmt.Printf("Error deleting volume %s: %s\n", volumeID, err.Error())
+		}
+	}
+	staleVolumeIDs = nil
+}
+
+// findDeviceFile returns the block device for an attached volume. On Nitro instances EBS
+// volumes show up as NVMe devices in whatever order they were attached, but the NVMe serial
+// number is the volume ID without the dash, so that is used to find the right one. On Xen
+// instances the device keeps the requested name, possibly with sd renamed to xvd.
+func findDeviceFile(volumeID string, requestedDevice string) (string, bool) {
+	serial := strings.Replace(volumeID, "-", "", 1)
+
+	namespaces, _ := filepath.Glob("/sys/block/nvme*n1")
+	for _, namespace := range namespaces {
+		contents, err := ioutil.ReadFile(filepath.Join(namespace, "device", "serial"))
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimSpace(string(contents)) == serial {
+			return filepath.Join("/dev", filepath.Base(namespace)), true
+		}
+	}
+
+	candidates := []string{
+		requestedDevice,
+		strings.Replace(requestedDevice, "/dev/sd", "/dev/xvd", 1),
+	}
+	for _, candidate := range candidates {
+		_, err := os.Stat(candidate)
+		if err == nil {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+// isVolumeAttached reports whether the volume is attached to the instance. Multi-Attach
+// volumes can be attached to several instances at once, so all attachments are checked.
+func isVolumeAttached(service *ec2.EC2, volumeID string, instanceID string) (bool, error) {
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return false, nil
+	}
+
+	for _, attachment := range volumes.Volumes[0].Attachments {
+		if aws.StringValue(attachment.InstanceId) == instanceID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// instanceState returns the state of an instance, treating one EC2 no longer knows about
+// as terminated.
+func instanceState(service *ec2.EC2, instanceID string) (string, error) {
+	instances, err := service.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceID.NotFound" {
+			return ec2.InstanceStateNameTerminated, nil
+		}
+		return "", err
+	}
+
+	if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		return ec2.InstanceStateNameTerminated, nil
+	}
+
+	return *instances.Reservations[0].Instances[0].State.Name, nil
+}
+
+// acquireMountLock keeps two instances from mounting a Multi-Attach volume at the same
+// time, which would corrupt a normal filesystem. The instance holding the volume is
+// recorded in a tag. A lock held by a live instance is waited on, one held by a dead
+// instance is taken over. Tags aren't atomic, so the lock is read back after a moment to
+// catch two instances racing for it. Volumes without Multi-Attach are skipped, since
+// EBS itself only lets one instance attach them.
+func acquireMountLock(service *ec2.EC2, userData *GameServerUserData, volumeID string, instanceID string) error {
+	deadline := time.Now().Add(time.Duration(userData.MultiAttachLockTimeout) * time.Second)
+	for {
+		volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		if err != nil {
+			return fmt.Errorf("error describing volume: %s", err.Error())
+		}
+
+		if len(volumes.Volumes) == 0 {
+			return fmt.Errorf("volume %s not found", volumeID)
+		}
+		volume := volumes.Volumes[0]
+
+		if !aws.BoolValue(volume.MultiAttachEnabled) {
+			return nil
+		}
+
+		holder := ""
+		for _, tag := range volume.Tags {
+			if *tag.Key == tagMountLock {
+				holder = *tag.Value
+			}
+		}
+
+		if holder == instanceID {
+			return nil
+		}
+
+		if holder != "" {
+			state, err := instanceState(service, holder)
+			if err != nil {
+				return fmt.Errorf("error checking lock holder %s: %s", holder, err.Error())
+			}
+
+			if state == ec2.InstanceStateNamePending || state == ec2.InstanceStateNameRunning {
+				if time.Now().After(deadline) {
+					return fmt.Errorf("volume %s is still mounted by %s", volumeID, holder)
+				}
+
+				fmt.Printf("Volume %s is mounted by %s instance %s. Waiting.\n", volumeID, state, holder)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+		}
+
+		_, err = service.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{aws.String(volumeID)},
+			Tags:      []*ec2.Tag{{Key: aws.String(tagMountLock), Value: aws.String(instanceID)}},
+		})
+		if err != nil {
+			return fmt.Errorf("error locking volume: %s", err.Error())
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// releaseMountLock removes this instance's mount lock from the volume, if it has one.
+func releaseMountLock(service *ec2.EC2, volumeID string, instanceID string) error {
+	_, err := service.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(volumeID)},
+		Tags:      []*ec2.Tag{{Key: aws.String(tagMountLock), Value: aws.String(instanceID)}},
+	})
+
+	return err
+}
+
+// detachFromDeadInstance detaches the volume from whatever instance currently has it,
+// as long as that instance is on its way out. A normal detach is tried first, and if
+// the volume isn't available after the grace period the detach is forced.
+func detachFromDeadInstance(service *ec2.EC2, volumeID string, instanceID string, gracePeriod int) error {
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing volume: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 || len(volumes.Volumes[0].Attachments) == 0 {
+		// Already detached, the next attach should work.
+		return nil
+	}
+
+	// Multi-Attach volumes can have several attachments, look for one that isn't this instance.
+	owner := ""
+	for _, attachment := range volumes.Volumes[0].Attachments {
+		if aws.StringValue(attachment.InstanceId) != instanceID {
+			owner = aws.StringValue(attachment.InstanceId)
+			break
+		}
+	}
+
+	if owner == "" {
+		return nil
+	}
+
+	state, err := instanceState(service, owner)
+	if err != nil {
+		return fmt.Errorf("error describing instance %s: %s", owner, err.Error())
+	}
+
+	switch state {
+	case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+	default:
+		return fmt.Errorf("volume is in use by %s instance %s", state, owner)
+	}
+
+	fmt.Printf("Detaching volume from %s instance %s.\n", state, owner)
+	input := &ec2.DetachVolumeInput{
+		InstanceId: aws.String(owner),
+		VolumeId:   aws.String(volumeID),
+	}
+	_, err = service.DetachVolume(input)
+	if err != nil {
+		return fmt.Errorf("error detaching volume: %s", err.Error())
+	}
+
+	if waitForVolumeAvailable(service, volumeID, time.Duration(gracePeriod)*time.Second) == nil {
+		fmt.Println("Volume detached.")
+		return nil
+	}
+
+	fmt.Println("Volume still attached after the grace period. Forcing detach.")
+	input.Force = aws.Bool(true)
+	_, err = service.DetachVolume(input)
+	if err != nil {
+		return fmt.Errorf("error force detaching volume: %s", err.Error())
+	}
+
+	err = waitForVolumeAvailable(service, volumeID, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("error waiting for volume to detach: %s", err.Error())
+	}
+
+	fmt.Println("Volume detached.")
+	return nil
+}
+
+// waitForVolumeAvailable waits up to timeout for the volume to become available.
+func waitForVolumeAvailable(service *ec2.EC2, volumeID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return service.WaitUntilVolumeAvailableWithContext(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}, request.WithWaiterDelay(request.ConstantWaiterDelay(5*time.Second)))
+}
+
+// verifyVolumeEncryption makes sure the volume is encrypted, and with the required KMS
+// key if one is configured.
+func verifyVolumeEncryption(service *ec2.EC2, userData *GameServerUserData, volumeID string, sess *session.Session) error {
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing volume: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return fmt.Errorf("volume %s not found", volumeID)
+	}
+	volume := volumes.Volumes[0]
+
+	if !aws.BoolValue(volume.Encrypted) {
+		return fmt.Errorf("volume %s is not encrypted", volumeID)
+	}
+
+	if userData.RequiredKMSKeyID == "" {
+		return nil
+	}
+
+	// Resolve the configured key to its ARN, which is what the volume reports.
+	key, err := kms.New(sess).DescribeKey(&kms.DescribeKeyInput{
+		KeyId: aws.String(userData.RequiredKMSKeyID),
+	})
+	if err != nil {
+		return fmt.Errorf("error describing KMS key %s: %s", userData.RequiredKMSKeyID, err.Error())
+	}
+
+	if aws.StringValue(volume.KmsKeyId) != aws.StringValue(key.KeyMetadata.Arn) {
+		return fmt.Errorf("volume %s is encrypted with %s, not %s", volumeID,
+			aws.StringValue(volume.KmsKeyId), aws.StringValue(key.KeyMetadata.Arn))
+	}
+
+	return nil
+}
+
+// findAttachedVolume returns the game volume already attached to this instance, or "" if
+// there isn't one. A persistent spot request that was stopped on interruption starts again
+// with its volumes still attached, and that volume is the one with the latest world on it.
+func findAttachedVolume(userData *GameServerUserData, instanceID string, sess *session.Session) (string, error) {
+	volumes, err := ec2.New(sess).DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + tagGame), Values: []*string{aws.String(userData.GameName)}},
+			{Name: aws.String("attachment.instance-id"), Values: []*string{aws.String(instanceID)}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing volumes: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return "", nil
+	}
+
+	return *volumes.Volumes[0].VolumeId, nil
+}
+
+// findOrProvisionVolume returns the volume provisioned for this game on an earlier launch,
+// or creates a new one in the given availability zone and records it for the next launch.
+func findOrProvisionVolume(userData *GameServerUserData, zone string, sess *session.Session) (string, error) {
+	service := ec2.New(sess)
+
+	fmt.Println("Looking for a provisioned volume.")
+	volumeID, err := findProvisionedVolume(service, userData, sess)
+	if err != nil {
+		return "", err
+	}
+
+	if volumeID != "" {
+		fmt.Printf("Using provisioned volume %s.\n", volumeID)
+		return volumeID, nil
+	}
+
+	fmt.Printf("Creating %d GiB %s volume in %s.\n", userData.VolumeSize, userData.VolumeType, zone)
+	volume, err := service.CreateVolume(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		Size:             aws.Int64(userData.VolumeSize),
+		VolumeType:       aws.String(userData.VolumeType),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeVolume),
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(userData.GameName)},
+					{Key: aws.String(tagGame), Value: aws.String(userData.GameName)},
+					{Key: aws.String(tagProvisioned), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating volume: %s", err.Error())
+	}
+
+	err = waitForVolumeAvailable(service, *volume.VolumeId, 5*time.Minute)
+	if err != nil {
+		return "", fmt.Errorf("error waiting for volume: %s", err.Error())
+	}
+	userData.provisioned = true
+
+	if userData.VolumeSSMParameter != "" {
+		_, err = ssm.New(sess).PutParameter(&ssm.PutParameterInput{
+			Name:      aws.String(userData.VolumeSSMParameter),
+			Value:     volume.VolumeId,
+			Type:      aws.String(ssm.ParameterTypeString),
+			Overwrite: aws.Bool(true),
+		})
+		if err != nil {
+			// The volume is still found by its tags next time.
+			fmt.Printf("Error recording volume in SSM: %s\n", err.Error())
+		}
+	}
+
+	fmt.Printf("Volume %s created.\n", *volume.VolumeId)
+	return *volume.VolumeId, nil
+}
+
+// findProvisionedVolume looks up the volume recorded in the SSM parameter, falling back to
+// the most recently provisioned volume tagged for this game. It returns "" if there is none.
+func findProvisionedVolume(service *ec2.EC2, userData *GameServerUserData, sess *session.Session) (string, error) {
+	if userData.VolumeSSMParameter != "" {
+		parameter, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{
+			Name: aws.String(userData.VolumeSSMParameter),
+		})
+		if err == nil {
+			return *parameter.Parameter.Value, nil
+		}
+
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ssm.ErrCodeParameterNotFound {
+			return "", fmt.Errorf("error getting volume SSM parameter: %s", err.Error())
+		}
+	}
+
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagGame),
+				Values: []*string{aws.String(userData.GameName)},
+			},
+			{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(tagProvisioned)},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing volumes: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return "", nil
+	}
+
+	sort.Slice(volumes.Volumes, func(i, j int) bool {
+		return volumes.Volumes[i].CreateTime.After(*volumes.Volumes[j].CreateTime)
+	})
+
+	return *volumes.Volumes[0].VolumeId, nil
+}
+
+// volumeModifyCooldown is how long EBS makes a volume wait between modifications.
+const volumeModifyCooldown = 6 * time.Hour
+
+// volumeModifiableAt returns when EBS next allows the volume to be modified, which may be in
+// the past.
+func volumeModifiableAt(service *ec2.EC2, volumeID string) (time.Time, error) {
+	modifications, err := service.DescribeVolumesModifications(&ec2.DescribeVolumesModificationsInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		// Volumes never modified are reported as not found.
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidVolumeModification.NotFound" {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("error describing volume modifications: %s", err.Error())
+	}
+
+	var last time.Time
+	for _, modification := range modifications.VolumesModifications {
+		if started := aws.TimeValue(modification.StartTime); started.After(last) {
+			last = started
+		}
+	}
+	if last.IsZero() {
+		return last, nil
+	}
+	return last.Add(volumeModifyCooldown), nil
+}
+
+// tuneVolumePerformance sets the gp3 IOPS and throughput of the game volumes before the game
+// starts, and drops them back to the steady state values once the boost duration is up.
+// EBS only allows a volume to be modified once every six hours, so the drop waits for that
+// too when the boost modified the volume.
+func tuneVolumePerformance(userData *GameServerUserData, sess *session.Session) {
+	service := ec2.New(sess)
+
+	fmt.Println("Tuning volume performance.")
+	for _, volumeID := range gameVolumeIDs(userData) {
+		err := modifyVolumePerformance(service, volumeID, userData.VolumeIOPS, userData.VolumeThroughput)
+		if err != nil {
+			fmt.Printf("Error tuning volume %s: %s\n", volumeID, err.Error())
+		}
+	}
+
+	if userData.VolumeSteadyIOPS <= 0 && userData.VolumeSteadyThroughput <= 0 {
+		return
+	}
+
+	boostEnds := time.Now().Add(time.Duration(userData.VolumeBoostDuration) * time.Second)
+	for _, volumeID := range gameVolumeIDs(userData) {
+		go func(volumeID string) {
+			dropAt := boostEnds
+			modifiable, err := volumeModifiableAt(service, volumeID)
+			if err != nil {
+				fmt.Printf("Error checking when volume %s can be modified: %s\n", volumeID, err.Error())
+			} else if modifiable.After(dropAt) {
+				fmt.Printf("Volume %s can't be modified again until %s, keeping the boost until then.\n",
+					volumeID, modifiable.Format(time.RFC3339))
+				dropAt = modifiable
+			}
+			time.Sleep(time.Until(dropAt))
+
+			fmt.Printf("Returning volume %s to steady state performance.\n", volumeID)
+			err = modifyVolumePerformance(service, volumeID, userData.VolumeSteadyIOPS, userData.VolumeSteadyThroughput)
+			if err != nil {
+				fmt.Printf("Error tuning volume %s: %s\n", volumeID, err.Error())
+			}
+		}(volumeID)
+	}
+}
+
+// modifyVolumePerformance changes a gp3 volume's IOPS and throughput, leaving out either
+// that is zero. Nothing is modified if the volume already has them, so as not to start a
+// six hour modification cooldown for nothing.
+func modifyVolumePerformance(service *ec2.EC2, volumeID string, iops int64, throughput int64) error {
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing volume: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return fmt.Errorf("volume not found")
+	}
+	volume := volumes.Volumes[0]
+
+	input := &ec2.ModifyVolumeInput{VolumeId: aws.String(volumeID)}
+	changed := false
+	if iops > 0 && aws.Int64Value(volume.Iops) != iops {
+		input.Iops = aws.Int64(iops)
+		volume.Iops = input.Iops
+		changed = true
+	}
+	if throughput > 0 && aws.Int64Value(volume.Throughput) != throughput {
+		input.Throughput = aws.Int64(throughput)
+		volume.Throughput = input.Throughput
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	_, err = service.ModifyVolume(input)
+	if err != nil {
+		return fmt.Errorf("error modifying volume: %s", err.Error())
+	}
+
+	fmt.Printf("Volume %s modified to %d IOPS and %d MiB/s.\n", volumeID,
+		aws.Int64Value(volume.Iops), aws.Int64Value(volume.Throughput))
+	return nil
+}
+
+// moveVolumeToZone makes sure the game volume is in the instance's availability zone. A
+// volume in another zone can't be attached, so it is recreated here from its latest
+// snapshot (taking one first if it has none) and the new volume is used from then on. The
+// new volume keeps the old one's tags and is tagged with the volume and snapshot it came from,
+// along with the original volume, so a configured volume ID keeps finding its latest copy.
+func moveVolumeToZone(userData *GameServerUserData, zone string, sess *session.Session) (string, error) {
+	service := ec2.New(sess)
+
+	descendants, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + tagOriginVolume), Values: []*string{aws.String(userData.VolumeID)}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing volumes: %s", err.Error())
+	}
+
+	if len(descendants.Volumes) > 0 {
+		sort.Slice(descendants.Volumes, func(i, j int) bool {
+			return descendants.Volumes[i].CreateTime.After(*descendants.Volumes[j].CreateTime)
+		})
+		fmt.Printf("Volume %s was moved to %s.\n", userData.VolumeID, *descendants.Volumes[0].VolumeId)
+		userData.VolumeID = *descendants.Volumes[0].VolumeId
+	}
+
+	volumes, err := service.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(userData.VolumeID)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing volume: %s", err.Error())
+	}
+
+	if len(volumes.Volumes) == 0 {
+		return "", fmt.Errorf("volume %s not found", userData.VolumeID)
+	}
+	volume := volumes.Volumes[0]
+
+	if *volume.AvailabilityZone == zone {
+		return userData.VolumeID, nil
+	}
+
+	fmt.Printf("Volume %s is in %s, not %s. Recreating it from a snapshot.\n", userData.VolumeID, *volume.AvailabilityZone, zone)
+
+	snapshots, err := service.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{Name: aws.String("volume-id"), Values: []*string{volume.VolumeId}},
+			{Name: aws.String("status"), Values: []*string{aws.String("completed")}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing snapshots: %s", err.Error())
+	}
+
+	var snapshotID string
+	if len(snapshots.Snapshots) > 0 {
+		sort.Slice(snapshots.Snapshots, func(i, j int) bool {
+			return snapshots.Snapshots[i].StartTime.After(*snapshots.Snapshots[j].StartTime)
+		})
+		snapshotID = *snapshots.Snapshots[0].SnapshotId
+	} else {
+		fmt.Println("Volume has no snapshots. Creating one.")
+		snapshotID, err = createSnapshot(userData, "zone move", sess)
+		if err != nil {
+			return "", err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Hour)
+		defer cancel()
+		err = service.WaitUntilSnapshotCompletedWithContext(ctx, &ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(snapshotID)},
+		}, request.WithWaiterMaxAttempts(240))
+		if err != nil {
+			return "", fmt.Errorf("error waiting for snapshot %s: %s", snapshotID, err.Error())
+		}
+	}
+
+	origin := *volume.VolumeId
+	tags := []*ec2.Tag{}
+	for _, tag := range volume.Tags {
+		if *tag.Key == tagOriginVolume {
+			origin = *tag.Value
+			continue
+		}
+		if *tag.Key == tagSourceVolume || *tag.Key == tagSourceSnapshot || *tag.Key == tagGame || strings.HasPrefix(*tag.Key, "aws:") {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	tags = append(tags,
+		&ec2.Tag{Key: aws.String(tagGame), Value: aws.String(userData.GameName)},
+		&ec2.Tag{Key: aws.String(tagOriginVolume), Value: aws.String(origin)},
+		&ec2.Tag{Key: aws.String(tagSourceVolume), Value: volume.VolumeId},
+		&ec2.Tag{Key: aws.String(tagSourceSnapshot), Value: aws.String(snapshotID)},
+	)
+
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		SnapshotId:       aws.String(snapshotID),
+		VolumeType:       volume.VolumeType,
+		TagSpecifications: []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeVolume), Tags: tags},
+		},
+	}
+	if *volume.VolumeType == ec2.VolumeTypeGp3 || *volume.VolumeType == ec2.VolumeTypeIo1 || *volume.VolumeType == ec2.VolumeTypeIo2 {
+		input.Iops = volume.Iops
+	}
+	if *volume.VolumeType == ec2.VolumeTypeGp3 {
+		input.Throughput = volume.Throughput
+	}
+
+	fmt.Printf("Creating volume in %s from snapshot %s.\n", zone, snapshotID)
+	created, err := service.CreateVolume(input)
+	if err != nil {
+		return "", fmt.Errorf("error creating volume: %s", err.Error())
+	}
+
+	err = waitForVolumeAvailable(service, *created.VolumeId, 10*time.Minute)
+	if err != nil {
+		return "", fmt.Errorf("error waiting for volume: %s", err.Error())
+	}
+
+	if userData.VolumeSSMParameter != "" {
+		_, err = ssm.New(sess).PutParameter(&ssm.PutParameterInput{
+			Name:      aws.String(userData.VolumeSSMParameter),
+			Value:     created.VolumeId,
+			Type:      aws.String(ssm.ParameterTypeString),
+			Overwrite: aws.Bool(true),
+		})
+		if err != nil {
+			fmt.Printf("Error recording volume in SSM: %s\n", err.Error())
+		}
+	}
+
+	fmt.Printf("Volume %s created from %s.\n", *created.VolumeId, userData.VolumeID)
+	return *created.VolumeId, nil
+}
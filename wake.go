@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// WakeListener is an address the wake proxy listens on for players trying to join while the
+// game is down. Protocol "minecraft" answers the server list with a sleeping message and
+// launches when someone logs in, telling them to come back shortly; "tcp" and "udp" launch
+// when the same address connects or sends packets again within a minute, which clients
+// retrying do and port scanners passing by mostly don't.
+type WakeListener struct {
+	Protocol string
+	Address  string
+}
+
+// waker launches the game when a player tries to join, no more than once a cooldown.
+type waker struct {
+	profile  *LaunchProfile
+	sess     *session.Session
+	service  *ec2.EC2
+	cooldown time.Duration
+
+	// mu guards launching, set while a launch is under way, lastWake, and knocks, when each
+	// address last tried a tcp or udp listener.
+	mu        sync.Mutex
+	launching bool
+	lastWake  time.Time
+	knocks    map[string]time.Time
+}
+
+// knockWindow is how soon an address has to try a tcp or udp listener again to wake the game.
+const knockWindow = time.Minute
+
+// runWake runs the wake proxy, a small always-on process listening on the game's ports that
+// launches the game when a player tries to join. It is run somewhere that stays up, like a
+// tiny instance, as "aws-spot-game-server wake -profile <name>". With the user data's
+// DNSShutdownAction "point" and the proxy's address as DNSShutdownTarget, the game's name
+// points here whenever the game is down, and the daemon points it back once it is up. It
+// returns the exit status.
+func runWake(args []string) int {
+	flags := flag.NewFlagSet("wake", flag.ExitOnError)
+	name, directory := profileFlags(flags)
+	flags.Parse(args)
+
+	profile, err := loadProfile(*name, *directory)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 2
+	}
+	if len(profile.WakeListeners) == 0 {
+		fmt.Printf("Profile %s has no wake listeners.\n", profile.name)
+		return 2
+	}
+
+	sess := profile.session()
+	w := &waker{
+		profile:  profile,
+		sess:     sess,
+		service:  ec2.New(sess),
+		cooldown: time.Duration(profile.WakeCooldown) * time.Second,
+	}
+
+	errs := make(chan error)
+	for _, listener := range profile.WakeListeners {
+		go func(listener WakeListener) {
+			errs <- w.listen(listener)
+		}(listener)
+		fmt.Printf("Waiting for %s players on %s.\n", listener.Protocol, listener.Address)
+	}
+
+	err = <-errs
+	fmt.Println(err.Error())
+	return 1
+}
+
+// listen serves one listener until it fails.
+func (w *waker) listen(listener WakeListener) error {
+	if listener.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp", listener.Address)
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %s", listener.Address, err.Error())
+		}
+		buffer := make([]byte, 2048)
+		for {
+			_, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return fmt.Errorf("error reading on %s: %s", listener.Address, err.Error())
+			}
+			if w.knock(from) {
+				w.wake(from.String())
+			}
+		}
+	}
+
+	socket, err := net.Listen("tcp", listener.Address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %s", listener.Address, err.Error())
+	}
+	for {
+		conn, err := socket.Accept()
+		if err != nil {
+			return fmt.Errorf("error accepting on %s: %s", listener.Address, err.Error())
+		}
+
+		if listener.Protocol == "minecraft" {
+			go w.serveMinecraft(conn)
+			continue
+		}
+		if w.knock(conn.RemoteAddr()) {
+			w.wake(conn.RemoteAddr().String())
+		}
+		conn.Close()
+	}
+}
+
+// knock records an address trying a tcp or udp listener, and reports whether it tried
+// within the knock window before.
+func (w *waker) knock(from net.Addr) bool {
+	host, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		host = from.String()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if w.knocks == nil {
+		w.knocks = map[string]time.Time{}
+	}
+	for address, knocked := range w.knocks {
+		if now.Sub(knocked) > knockWindow {
+			delete(w.knocks, address)
+		}
+	}
+
+	_, again := w.knocks[host]
+	w.knocks[host] = now
+	return again
+}
+
+// wake launches the game unless it is already being launched, was launched within the
+// cooldown, or already has an instance. A stopped instance, like one stopped or hibernated
+// when idle, or a paused persistent one, is started instead.
+func (w *waker) wake(from string) {
+	w.mu.Lock()
+	if w.launching || time.Since(w.lastWake) < w.cooldown {
+		w.mu.Unlock()
+		return
+	}
+	w.launching = true
+	w.lastWake = time.Now()
+	w.mu.Unlock()
+
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			w.launching = false
+			w.mu.Unlock()
+		}()
+
+		game := w.profile.gameData.GameName
+		existing, err := findGameInstances(w.service, game)
+		if err != nil {
+			fmt.Printf("Error looking for instances: %s\n", err.Error())
+			return
+		}
+		var stopped *ec2.Instance
+		for _, instance := range existing {
+			if aws.StringValue(instance.State.Name) != ec2.InstanceStateNameStopped {
+				fmt.Printf("%s tried to join, but %s already has instance %s (%s).\n",
+					from, game, aws.StringValue(instance.InstanceId), aws.StringValue(instance.State.Name))
+				return
+			}
+			stopped = instance
+		}
+		if stopped != nil {
+			w.start(from, stopped)
+			return
+		}
+
+		fmt.Printf("%s tried to join, launching %s.\n", from, game)
+		var instanceID string
+		err = checkBudget(w.profile.gameData, w.sess)
+		if err == nil {
+			err = w.profile.resolveAMI(w.sess)
+		}
+		if err == nil && w.profile.Fleet {
+			instanceID, err = launchFleet(w.service, w.profile)
+		} else if err == nil {
+			instanceID, err = launchCheapest(w.sess, w.service, w.profile)
+		}
+		if err != nil {
+			notify(w.profile.gameData, w.sess, "Wake failed", fmt.Sprintf("Launching for %s failed: %s", from, err.Error()))
+			return
+		}
+		notify(w.profile.gameData, w.sess, "Waking", fmt.Sprintf("Launched %s since %s tried to join.", instanceID, from))
+	}()
+}
+
+// start starts the game's stopped instance.
+func (w *waker) start(from string, instance *ec2.Instance) {
+	instanceID := aws.StringValue(instance.InstanceId)
+	fmt.Printf("%s tried to join, starting %s.\n", from, instanceID)
+
+	err := checkBudget(w.profile.gameData, w.sess)
+	if err == nil {
+		_, err = w.service.StartInstances(&ec2.StartInstancesInput{InstanceIds: []*string{aws.String(instanceID)}})
+	}
+	if err != nil {
+		notify(w.profile.gameData, w.sess, "Wake failed", fmt.Sprintf("Starting %s for %s failed: %s", instanceID, from, err.Error()))
+		return
+	}
+	notify(w.profile.gameData, w.sess, "Waking", fmt.Sprintf("Started %s since %s tried to join.", instanceID, from))
+}
+
+// waking reports whether the game was launched within the cooldown.
+func (w *waker) waking() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.launching || time.Since(w.lastWake) < w.cooldown
+}
+
+// serveMinecraft answers a Minecraft client. The server list gets a message saying whether
+// the game is asleep or starting, and a login wakes the game and is turned away with
+// WakeMessage. Refreshing the server list doesn't wake the game, only trying to join does.
+func (w *waker) serveMinecraft(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	handshake, err := readMinecraftPacket(reader)
+	if err != nil {
+		return
+	}
+	body := bytes.NewReader(handshake)
+	id, err := readVarInt(body)
+	if err != nil || id != 0x00 {
+		return
+	}
+	protocol, err := readVarInt(body)
+	if err != nil {
+		return
+	}
+	hostLength, err := readVarInt(body)
+	if err != nil || hostLength < 0 || int(hostLength) > body.Len() {
+		return
+	}
+	body.Seek(int64(hostLength)+2, io.SeekCurrent)
+	next, err := readVarInt(body)
+	if err != nil {
+		return
+	}
+
+	switch next {
+	case 1:
+		// Status request, then the ping to echo.
+		if _, err := readMinecraftPacket(reader); err != nil {
+			return
+		}
+
+		motd := "Asleep, join to start the server."
+		if w.waking() {
+			motd = w.profile.WakeMessage
+		}
+		status, _ := json.Marshal(map[string]interface{}{
+			"version":     map[string]interface{}{"name": "Asleep", "protocol": protocol},
+			"players":     map[string]interface{}{"max": 0, "online": 0},
+			"description": map[string]interface{}{"text": motd},
+		})
+		var response bytes.Buffer
+		writeVarInt(&response, int32(len(status)))
+		response.Write(status)
+		writeMinecraftPacket(conn, 0x00, response.Bytes())
+
+		ping, err := readMinecraftPacket(reader)
+		if err != nil || len(ping) < 9 {
+			return
+		}
+		writeMinecraftPacket(conn, 0x01, ping[1:9])
+	case 2, 3:
+		// Login, or a transfer. Either way someone wants to play.
+		w.wake(conn.RemoteAddr().String())
+
+		reason, _ := json.Marshal(map[string]string{"text": w.profile.WakeMessage})
+		var disconnect bytes.Buffer
+		writeVarInt(&disconnect, int32(len(reason)))
+		disconnect.Write(reason)
+		writeMinecraftPacket(conn, 0x00, disconnect.Bytes())
+	}
+}
+
+// readMinecraftPacket reads a length-prefixed packet, returning it without the length.
+func readMinecraftPacket(reader *bufio.Reader) ([]byte, error) {
+	length, err := readVarInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 || length > 1<<16 {
+		return nil, fmt.Errorf("packet has bad length %d", length)
+	}
+
+	packet := make([]byte, length)
+	_, err = io.ReadFull(reader, packet)
+	return packet, err
+}
+
+// writeMinecraftPacket writes a packet with its length and ID.
+func writeMinecraftPacket(conn net.Conn, id int32, data []byte) error {
+	var packet bytes.Buffer
+	writeVarInt(&packet, id)
+	packet.Write(data)
+
+	var framed bytes.Buffer
+	writeVarInt(&framed, int32(packet.Len()))
+	framed.Write(packet.Bytes())
+	_, err := conn.Write(framed.Bytes())
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookDeliveries tracks webhook deliveries in progress, so the last events aren't lost
+// when the daemon exits.
+var webhookDeliveries sync.WaitGroup
+
+// sendWebhooks POSTs the event to every webhook that wants it. Each delivery is retried in
+// the background, so a slow endpoint doesn't hold the daemon up.
+func sendWebhooks(userData *GameServerUserData, event gameEvent) {
+	for _, webhook := range userData.Webhooks {
+		if !webhookWants(webhook, event.Event) {
+			continue
+		}
+
+		webhookDeliveries.Add(1)
+		go func(webhook Webhook) {
+			defer webhookDeliveries.Done()
+
+			err := deliverWebhook(webhook, event)
+			if err != nil {
+				fmt.Printf("Error sending %s event to webhook: %s\n", event.Event, err.Error())
+			}
+		}(webhook)
+	}
+}
+
+// webhookWants reports whether the webhook takes the event. Without a list of events it
+// takes everything but idle ticks.
+func webhookWants(webhook Webhook, event string) bool {
+	if len(webhook.Events) == 0 {
+		return event != "idle-tick"
+	}
+
+	for _, wanted := range webhook.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverWebhook POSTs the event as JSON, signed with the webhook's secret, trying again up
+// to Retries times, a few seconds further apart each time.
+func deliverWebhook(webhook Webhook, event gameEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := 2 * time.Second
+	for attempt := 0; ; attempt++ {
+		err = postSigned(webhook, event.Event, body)
+		if err == nil || attempt >= webhook.Retries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postSigned POSTs the body once. With a secret the X-Signature-256 header is "sha256="
+// and the hex HMAC-SHA256 of the body, so the receiver can tell it came from the daemon.
+func postSigned(webhook Webhook, event string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(webhook.Timeout)*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Game-Event", event)
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		request.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// waitForWebhooks waits for webhook deliveries in progress, for up to the timeout.
+func waitForWebhooks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		webhookDeliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Println("Gave up waiting for webhooks.")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// webSocketGUID is appended to the client's key to accept a WebSocket handshake.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessage is the biggest message taken from a client, far more than a line of
+// console input needs.
+const maxWebSocketMessage = 64 * 1024
+
+// webSocketConn is a WebSocket connection that reads and writes like the connection
+// underneath, so it can be attached to the console like a socket client. Each message read
+// is a line, and each write is sent as a binary message, since the game's output can split
+// a character across writes.
+type webSocketConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	writeMu sync.Mutex
+}
+
+// upgradeWebSocket takes over the request's connection as a WebSocket. Requests from pages
+// on other sites are refused, since a browser would send them with the credentials it has
+// for this one.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocketConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, fmt.Errorf("not a WebSocket request")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("unsupported WebSocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("missing WebSocket key")
+	}
+
+	if crossOrigin(r) {
+		return nil, fmt.Errorf("cross-origin WebSocket request")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection can't be taken over")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{Conn: conn, reader: buffered.Reader}, nil
+}
+
+// Read reads the next message, answering pings along the way, and returns io.EOF once the
+// client closes the connection.
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasSuffix(string(message), "\n") {
+			message = append(message, '\n')
+		}
+		c.pending = message
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a whole text or binary message has arrived.
+func (c *webSocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		final, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case 0x8:
+			c.writeFrame(0x8, nil)
+			return nil, io.EOF
+		case 0x9:
+			err = c.writeFrame(0xA, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case 0xA:
+			continue
+		}
+
+		message = append(message, payload...)
+		if len(message) > maxWebSocketMessage {
+			return nil, fmt.Errorf("WebSocket message too big")
+		}
+		if final {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a frame from the client, unmasking its payload.
+func (c *webSocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	final := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if !masked {
+		return false, 0, nil, fmt.Errorf("unmasked WebSocket frame from client")
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, fmt.Errorf("WebSocket frame too big")
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.reader, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return final, opcode, payload, nil
+}
+
+// Write sends p as a binary message.
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(0x2, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single unmasked frame.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		header = append(header, 127)
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(len(payload)))
+		header = append(header, extended[:]...)
+	}
+
+	_, err := c.Conn.Write(append(header, payload...))
+	return err
+}
+
+// serveWebConsole attaches a WebSocket to a game's console, the one named by the game
+// parameter or the first. Output is streamed as it comes, and each message sent is a line
+// of console input. A browser asking for the page without upgrading gets the console page.
+func serveWebConsole(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, consoleHTML)
+		return
+	}
+
+	var console *gameConsole
+	name := r.FormValue("game")
+	for _, game := range games {
+		if game.console != nil && (name == "" || name == game.userData.GameName) {
+			console = game.console
+			break
+		}
+	}
+	if console == nil {
+		writeControl(w, http.StatusNotFound, controlResult{Error: "no console"})
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeControl(w, http.StatusBadRequest, controlResult{Error: err.Error()})
+		return
+	}
+
+	console.serve(conn)
+}
+
+// consoleHTML is the console page. It streams the game's output over a WebSocket to the
+// same URL, and sends what is typed as console input.
+const consoleHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Game console</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+#output { background: #111; color: #ddd; height: 70vh; overflow-y: scroll; padding: 0.5em; white-space: pre-wrap; }
+#input { box-sizing: border-box; font-family: monospace; font-size: 1em; margin-top: 0.5em; padding: 0.5em; width: 100%; }
+</style>
+</head>
+<body>
+<a href="./">Dashboard</a>
+<pre id="output"></pre>
+<input id="input" placeholder="Console command" autocomplete="off" disabled>
+<script>
+var output = document.getElementById("output"), input = document.getElementById("input");
+var decoder = new TextDecoder();
+
+function print(text) {
+  var follow = output.scrollTop + output.clientHeight >= output.scrollHeight - 5;
+  output.textContent += text;
+  if (follow) {
+    output.scrollTop = output.scrollHeight;
+  }
+}
+
+var socket = new WebSocket(location.href.replace(/^http/, "ws"));
+socket.binaryType = "arraybuffer";
+socket.onopen = function() {
+  input.disabled = false;
+  input.focus();
+};
+socket.onmessage = function(event) {
+  print(decoder.decode(event.data, {stream: true}));
+};
+socket.onclose = function() {
+  input.disabled = true;
+  print("\n[Disconnected]\n");
+};
+
+input.onkeydown = function(event) {
+  if (event.key === "Enter" && input.value !== "") {
+    socket.send(input.value);
+    print("> " + input.value + "\n");
+    input.value = "";
+  }
+};
+</script>
+</body>
+</html>
+`
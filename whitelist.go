@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// validPlayer matches the player names the whitelist takes. Anything else could smuggle a
+// second command into RCON or break the file.
+var validPlayer = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+
+// whitelistMu makes sure only one whitelist change is made at a time.
+var whitelistMu sync.Mutex
+
+// controlWhitelist is the body of a whitelist response.
+type controlWhitelist struct {
+	Players []string `json:"players"`
+}
+
+// listWhitelist returns the players on the whitelist, from WhitelistFile or by running
+// WhitelistListCommand over RCON on the first game that has it.
+func listWhitelist(userData *GameServerUserData) ([]string, error) {
+	whitelistMu.Lock()
+	defer whitelistMu.Unlock()
+
+	if userData.WhitelistFile != "" {
+		return readWhitelistFile(userData.WhitelistFile)
+	}
+
+	for _, data := range userData.games {
+		if !rconEnabled(data) {
+			continue
+		}
+
+		output, err := rconCommand(data, userData.WhitelistListCommand)
+		if err != nil {
+			return nil, err
+		}
+		return parseWhitelistOutput(output), nil
+	}
+	return nil, fmt.Errorf("no game has RCON")
+}
+
+// changeWhitelist adds or removes the player. With WhitelistFile the file is edited and
+// WhitelistReloadCommand, if any, run over RCON so the game reads it again. Otherwise
+// WhitelistAddCommand or WhitelistRemoveCommand is run over RCON on every game.
+func changeWhitelist(userData *GameServerUserData, player string, add bool) error {
+	if !validPlayer.MatchString(player) {
+		return fmt.Errorf("invalid player name")
+	}
+
+	whitelistMu.Lock()
+	defer whitelistMu.Unlock()
+
+	if userData.WhitelistFile == "" {
+		command := userData.WhitelistRemoveCommand
+		if add {
+			command = userData.WhitelistAddCommand
+		}
+		return rconEveryGame(userData, strings.Replace(command, "{player}", player, -1))
+	}
+
+	err := editWhitelistFile(userData.WhitelistFile, player, add)
+	if err != nil {
+		return err
+	}
+
+	if userData.WhitelistReloadCommand != "" {
+		err = rconEveryGame(userData, userData.WhitelistReloadCommand)
+		if err != nil {
+			return fmt.Errorf("whitelist changed, but reloading it failed: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// parseWhitelistOutput reads the players from a list command's output, like Minecraft's
+// "There are 2 whitelisted players: alice, bob", or one a line otherwise.
+func parseWhitelistOutput(output string) []string {
+	players := []string{}
+	if index := strings.Index(output, ":"); index >= 0 {
+		for _, name := range strings.Split(output[index+1:], ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				players = append(players, name)
+			}
+		}
+		return players
+	}
+
+	if strings.Contains(output, "no whitelisted players") {
+		return players
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			players = append(players, line)
+		}
+	}
+	return players
+}
+
+// readWhitelistFile reads the players from the whitelist file, a JSON array of objects with
+// a name like Minecraft's whitelist.json if it ends in .json, or one name a line otherwise.
+func readWhitelistFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading whitelist: %s", err.Error())
+	}
+
+	players := []string{}
+	if strings.HasSuffix(path, ".json") {
+		entries := []map[string]interface{}{}
+		err = json.Unmarshal(content, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing whitelist: %s", err.Error())
+		}
+		for _, entry := range entries {
+			if name, ok := entry["name"].(string); ok {
+				players = append(players, name)
+			}
+		}
+	} else {
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				players = append(players, line)
+			}
+		}
+	}
+
+	sort.Strings(players)
+	return players, nil
+}
+
+// editWhitelistFile adds the player to the whitelist file or removes them, leaving the
+// other entries as they were. The file keeps its owner and mode, so the game can still
+// write it.
+func editWhitelistFile(path string, player string, add bool) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading whitelist: %s", err.Error())
+	}
+
+	var edited []byte
+	if strings.HasSuffix(path, ".json") {
+		entries := []map[string]interface{}{}
+		if len(strings.TrimSpace(string(content))) > 0 {
+			err = json.Unmarshal(content, &entries)
+			if err != nil {
+				return fmt.Errorf("error parsing whitelist: %s", err.Error())
+			}
+		}
+
+		kept := []map[string]interface{}{}
+		for _, entry := range entries {
+			if name, _ := entry["name"].(string); !strings.EqualFold(name, player) {
+				kept = append(kept, entry)
+			}
+		}
+		if add {
+			kept = append(kept, map[string]interface{}{"name": player})
+		}
+
+		edited, err = json.MarshalIndent(kept, "", "  ")
+		if err != nil {
+			return err
+		}
+		edited = append(edited, '\n')
+	} else {
+		lines := []string{}
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if line != "" && !strings.EqualFold(strings.TrimSpace(line), player) {
+				lines = append(lines, line)
+			}
+		}
+		if add {
+			lines = append(lines, player)
+		}
+		edited = []byte(strings.Join(lines, "\n") + "\n")
+	}
+
+	return replaceFile(path, edited)
+}
+
+// replaceFile writes the file through a temporary file, so the game never reads half of it,
+// keeping the owner and mode of the file it replaces.
+func replaceFile(path string, content []byte) error {
+	mode := os.FileMode(0644)
+	uid, gid := -1, -1
+	info, err := os.Stat(path)
+	if err == nil {
+		mode = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+
+	temporary, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("error writing whitelist: %s", err.Error())
+	}
+	defer os.Remove(temporary.Name())
+
+	_, err = temporary.Write(content)
+	if err == nil {
+		err = temporary.Chmod(mode)
+	}
+	if err == nil && uid >= 0 {
+		err = temporary.Chown(uid, gid)
+	}
+	closeErr := temporary.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporary.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing whitelist: %s", err.Error())
+	}
+	return nil
+}